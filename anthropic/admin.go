@@ -0,0 +1,272 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Admin reads the usage and cost reports of the organization with the Admin
+// API, e.g. to reconcile the usage reported by the plugin with the billing.
+// It requires an admin key, see [Anthropic.AdminKey].
+type Admin struct {
+	client *anthropic.Client
+}
+
+// Admin returns the Admin API client of an initialized plugin
+func (a *Anthropic) Admin() *Admin {
+	return &Admin{client: a.admin}
+}
+
+// UsageReportParams select the usage of a report
+type UsageReportParams struct {
+	// StartingAt and EndingAt are the time range of the report, EndingAt is
+	// now when zero
+	StartingAt time.Time
+	EndingAt   time.Time
+	// BucketWidth is the time range of each bucket: "1m", "1h" or "1d", the
+	// default of Anthropic when empty
+	BucketWidth string
+	// GroupBy splits the usage of the buckets, e.g. by "model", "workspace_id",
+	// "api_key_id", "service_tier" or "context_window"
+	GroupBy []string
+	// Models, WorkspaceIDs and APIKeyIDs restrict the report to their usage
+	Models       []string
+	WorkspaceIDs []string
+	APIKeyIDs    []string
+}
+
+// UsageBucket is the usage of a time range
+type UsageBucket struct {
+	StartingAt time.Time
+	EndingAt   time.Time
+	// Results are the usage of each group of [UsageReportParams.GroupBy]
+	Results []*UsageResult
+}
+
+// UsageResult is the token usage of a group, its fields not grouped by are empty
+type UsageResult struct {
+	Model         string
+	WorkspaceID   string
+	APIKeyID      string
+	ServiceTier   string
+	ContextWindow string
+
+	UncachedInputTokens  int64
+	CacheReadInputTokens int64
+	// CacheWrite5mInputTokens and CacheWrite1hInputTokens are the input tokens
+	// written to the prompt cache with a 5 minutes and a 1 hour TTL
+	CacheWrite5mInputTokens int64
+	CacheWrite1hInputTokens int64
+	OutputTokens            int64
+	WebSearchRequests       int64
+}
+
+// CostReportParams select the costs of a report
+type CostReportParams struct {
+	// StartingAt and EndingAt are the time range of the report, EndingAt is
+	// now when zero. The buckets are a day.
+	StartingAt time.Time
+	EndingAt   time.Time
+	// GroupBy splits the costs of the buckets, by "workspace_id" or "description"
+	GroupBy []string
+}
+
+// CostBucket is the cost of a day
+type CostBucket struct {
+	StartingAt time.Time
+	EndingAt   time.Time
+	// Results are the costs of each group of [CostReportParams.GroupBy]
+	Results []*CostResult
+}
+
+// CostResult is the cost of a group, its fields not grouped by are empty
+type CostResult struct {
+	// Amount is the cost in the currency, e.g. in USD
+	Amount   float64
+	Currency string
+
+	WorkspaceID string
+	// Description describes the cost, the type, model and token type fields are
+	// set when grouped by description
+	Description   string
+	CostType      string
+	Model         string
+	TokenType     string
+	ServiceTier   string
+	ContextWindow string
+}
+
+// UsageReport returns the token usage of the organization, by bucket
+func (a *Admin) UsageReport(ctx context.Context, p UsageReportParams) ([]*UsageBucket, error) {
+	if a.client == nil {
+		return nil, errors.New("Admin.UsageReport: no admin key")
+	}
+	q := reportQuery(p.StartingAt, p.EndingAt, p.GroupBy)
+	if p.BucketWidth != "" {
+		q.Set("bucket_width", p.BucketWidth)
+	}
+	for _, m := range p.Models {
+		q.Add("models[]", m)
+	}
+	for _, id := range p.WorkspaceIDs {
+		q.Add("workspace_ids[]", id)
+	}
+	for _, id := range p.APIKeyIDs {
+		q.Add("api_key_ids[]", id)
+	}
+
+	var usageBuckets []*UsageBucket
+	err := readReport(ctx, a.client, "v1/organizations/usage_report/messages", q, func(b reportBucket[usageResult]) {
+		bucket := &UsageBucket{StartingAt: b.StartingAt, EndingAt: b.EndingAt}
+		for _, r := range b.Results {
+			bucket.Results = append(bucket.Results, &UsageResult{
+				Model:                   r.Model,
+				WorkspaceID:             r.WorkspaceID,
+				APIKeyID:                r.APIKeyID,
+				ServiceTier:             r.ServiceTier,
+				ContextWindow:           r.ContextWindow,
+				UncachedInputTokens:     r.UncachedInputTokens,
+				CacheReadInputTokens:    r.CacheReadInputTokens,
+				CacheWrite5mInputTokens: r.CacheCreation.Ephemeral5mInputTokens,
+				CacheWrite1hInputTokens: r.CacheCreation.Ephemeral1hInputTokens,
+				OutputTokens:            r.OutputTokens,
+				WebSearchRequests:       r.ServerToolUse.WebSearchRequests,
+			})
+		}
+		usageBuckets = append(usageBuckets, bucket)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Admin.UsageReport: %w", err)
+	}
+	return usageBuckets, nil
+}
+
+// CostReport returns the costs of the organization, by day
+func (a *Admin) CostReport(ctx context.Context, p CostReportParams) ([]*CostBucket, error) {
+	if a.client == nil {
+		return nil, errors.New("Admin.CostReport: no admin key")
+	}
+	var costBuckets []*CostBucket
+	var convErr error
+	err := readReport(ctx, a.client, "v1/organizations/cost_report", reportQuery(p.StartingAt, p.EndingAt, p.GroupBy), func(b reportBucket[costResult]) {
+		bucket := &CostBucket{StartingAt: b.StartingAt, EndingAt: b.EndingAt}
+		for _, r := range b.Results {
+			// the amounts are decimal strings in cents
+			cents, err := strconv.ParseFloat(r.Amount, 64)
+			if err != nil && convErr == nil {
+				convErr = fmt.Errorf("invalid amount %q: %w", r.Amount, err)
+			}
+			bucket.Results = append(bucket.Results, &CostResult{
+				Amount:        cents / 100,
+				Currency:      r.Currency,
+				WorkspaceID:   r.WorkspaceID,
+				Description:   r.Description,
+				CostType:      r.CostType,
+				Model:         r.Model,
+				TokenType:     r.TokenType,
+				ServiceTier:   r.ServiceTier,
+				ContextWindow: r.ContextWindow,
+			})
+		}
+		costBuckets = append(costBuckets, bucket)
+	})
+	if err == nil {
+		err = convErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Admin.CostReport: %w", err)
+	}
+	return costBuckets, nil
+}
+
+// reportQuery returns the query of a report over a time range
+func reportQuery(startingAt, endingAt time.Time, groupBy []string) url.Values {
+	q := url.Values{}
+	q.Set("starting_at", startingAt.UTC().Format(time.RFC3339))
+	if !endingAt.IsZero() {
+		q.Set("ending_at", endingAt.UTC().Format(time.RFC3339))
+	}
+	for _, g := range groupBy {
+		q.Add("group_by[]", g)
+	}
+	return q
+}
+
+// readReport reads all the pages of a report, calling fn with each bucket
+func readReport[T any](ctx context.Context, client *anthropic.Client, path string, q url.Values, fn func(reportBucket[T])) error {
+	for {
+		var page struct {
+			Data     []reportBucket[T] `json:"data"`
+			HasMore  bool              `json:"has_more"`
+			NextPage string            `json:"next_page"`
+		}
+		if err := client.Get(ctx, path+"?"+q.Encode(), nil, &page); err != nil {
+			return err
+		}
+		for _, b := range page.Data {
+			fn(b)
+		}
+		if !page.HasMore || page.NextPage == "" {
+			return nil
+		}
+		q.Set("page", page.NextPage)
+	}
+}
+
+type reportBucket[T any] struct {
+	StartingAt time.Time `json:"starting_at"`
+	EndingAt   time.Time `json:"ending_at"`
+	Results    []T       `json:"results"`
+}
+
+type usageResult struct {
+	Model                string `json:"model"`
+	WorkspaceID          string `json:"workspace_id"`
+	APIKeyID             string `json:"api_key_id"`
+	ServiceTier          string `json:"service_tier"`
+	ContextWindow        string `json:"context_window"`
+	UncachedInputTokens  int64  `json:"uncached_input_tokens"`
+	CacheReadInputTokens int64  `json:"cache_read_input_tokens"`
+	CacheCreation        struct {
+		Ephemeral5mInputTokens int64 `json:"ephemeral_5m_input_tokens"`
+		Ephemeral1hInputTokens int64 `json:"ephemeral_1h_input_tokens"`
+	} `json:"cache_creation"`
+	OutputTokens  int64 `json:"output_tokens"`
+	ServerToolUse struct {
+		WebSearchRequests int64 `json:"web_search_requests"`
+	} `json:"server_tool_use"`
+}
+
+type costResult struct {
+	Amount        string `json:"amount"`
+	Currency      string `json:"currency"`
+	WorkspaceID   string `json:"workspace_id"`
+	Description   string `json:"description"`
+	CostType      string `json:"cost_type"`
+	Model         string `json:"model"`
+	TokenType     string `json:"token_type"`
+	ServiceTier   string `json:"service_tier"`
+	ContextWindow string `json:"context_window"`
+}
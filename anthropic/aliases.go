@@ -0,0 +1,90 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// resolveModel returns the name of a model given by name or ID, and the
+// version to send when given by ID. The IDs unknown to the plugin are sent as is.
+func resolveModel(model string) (name, version string) {
+	if _, ok := anthropicModels[model]; ok {
+		return model, ""
+	}
+	for _, name := range slices.Sorted(maps.Keys(anthropicModels)) {
+		if slices.Contains(anthropicModels[name].Versions, model) {
+			return name, model
+		}
+	}
+	return model, ""
+}
+
+// defineAliases defines the models of [Anthropic.Aliases]
+func (a *Anthropic) defineAliases(g *genkit.Genkit) error {
+	for _, alias := range slices.Sorted(maps.Keys(a.Aliases)) {
+		target := a.Aliases[alias]
+		if target == "" {
+			return fmt.Errorf("alias %q has no model", alias)
+		}
+		if _, ok := anthropicModels[alias]; ok {
+			return fmt.Errorf("alias %q is the name of a model", alias)
+		}
+		a.defineAlias(g, alias, target)
+	}
+	return nil
+}
+
+// defineAlias defines a model generating with the target model, given by name
+// or ID. An alias of an ID generates with this version only.
+func (a *Anthropic) defineAlias(g *genkit.Genkit, alias, target string) ai.Model {
+	name, version := resolveModel(target)
+	info, ok := anthropicModels[name]
+	if !ok {
+		info = ai.ModelInfo{Supports: &Multimodal, Versions: []string{name}}
+	}
+	info = withLifecycle(name, info, time.Now())
+	meta := &ai.ModelInfo{
+		Label:    provider + "-" + alias,
+		Stage:    info.Stage,
+		Supports: info.Supports,
+		Versions: info.Versions,
+	}
+	if version != "" {
+		meta.Versions = []string{version}
+	}
+
+	client := a.messages
+	fn := func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		if version != "" {
+			var err error
+			if input, err = defaultVersion(input, version); err != nil {
+				return nil, err
+			}
+		}
+		return anthropicGenerate(ctx, client, name, input, cb)
+	}
+	// the alias shares the limits, prices and metrics of its model
+	return defineModelFunc(g, alias, meta, fn, a.modelMiddleware(name)...)
+}
@@ -18,20 +18,32 @@ package anthropic
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
 	"os"
 	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"time"
+	"unicode"
 
 	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
 	"github.com/firebase/genkit/go/genkit"
 	"github.com/invopop/jsonschema"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+	"github.com/anthropics/anthropic-sdk-go/packages/respjson"
 )
 
 const (
@@ -41,10 +53,105 @@ const (
 
 type Anthropic struct {
 	APIKey string
+	// DiscoverModels defines on Init the models listed by the Models API that
+	// are not known to the plugin, see [Anthropic.RefreshModels]
+	DiscoverModels bool
+	// ValidateVersions makes [Anthropic.DefineModel] check the versions of its
+	// model with the Models API, so a typo in a snapshot fails at startup
+	// instead of at the first call
+	ValidateVersions bool
+	// Middleware wraps every model defined by the plugin, e.g. for logging or
+	// scrubbing requests, in the given order
+	Middleware []ai.ModelMiddleware
+	// Retry configures the retries of the failed calls, the retries of the
+	// Anthropic SDK are used when nil
+	Retry *RetryConfig
+	// OnRateLimits is called with the rate limits reported by every API
+	// response, so services can shed load before being rate limited
+	OnRateLimits func(*RateLimits)
+	// RateLimiter limits the Generate calls of the plugin before they reach the API
+	RateLimiter *RateLimiterConfig
+	// CircuitBreaker makes the Generate calls of the plugin fail fast during Anthropic outages
+	CircuitBreaker *CircuitBreakerConfig
+	// Deduplicate shares a single upstream call between the identical Generate
+	// calls in flight, identified by the hash of their request or the key set
+	// with [WithIdempotencyKey]
+	Deduplicate bool
+	// Guardrails check, rewrite or veto the requests and responses of every
+	// model of the plugin, whichever flow calls them
+	Guardrails *GuardrailsConfig
+	// ResponseCache returns the previous response of a model to the identical
+	// requests, e.g. for evaluation runs and demos
+	ResponseCache *ResponseCacheConfig
+	// Aliases are the names of models defined at Init, each generating with
+	// a model given by name or ID, e.g. "prod-chat" generating with
+	// "claude-sonnet-4-20250514", so the call sites don't change when the
+	// model is upgraded. An alias of an ID generates with this version only.
+	Aliases map[string]string
+	// Workspaces are the workspaces, by name, the requests can be sent to
+	// instead of the workspace of the API key, see [Workspace]
+	Workspaces map[string]Workspace
+	// Backends are the deployments the models fail over to, in order, when the
+	// Anthropic API is unavailable, e.g. Amazon Bedrock
+	Backends []Backend
+	// TracerProvider receives a span for each call to Anthropic, nested under
+	// the Genkit span of the call, the global provider is used when nil
+	TracerProvider trace.TracerProvider
+	// MeterProvider receives the request, duration and token usage metrics
+	// of the models, the global provider is used when nil
+	MeterProvider metric.MeterProvider
+	// Pricing overrides the prices of [DefaultPricing] used to estimate the
+	// cost of the responses, e.g. with negotiated rates, by model name or ID
+	Pricing map[string]Pricing
+	// Budget rejects the Generate calls of the plugin once a spending limit
+	// is reached, e.g. for autonomous agents
+	Budget *BudgetConfig
+	// ImageResize downscales the images of the requests larger than its limits
+	ImageResize *ImageResizeConfig
+	// MediaDownloadLimit caps the size in bytes of the media downloaded from
+	// the URIs of the media parts, 32MB by default
+	MediaDownloadLimit int64
+	// MediaHTTPClient downloads the media referenced by URI, e.g. with another
+	// timeout or transport, a client with a 30s timeout by default. The default
+	// fetchers of the cloud storage URIs use it too.
+	MediaHTTPClient *http.Client
+	// MediaFetchers maps the URI schemes of the media parts to their fetchers,
+	// on top of [DefaultMediaFetchers]: register a fetcher to resolve another
+	// scheme, or replace a default one, e.g. with one built on the storage SDK
+	// of a cloud provider
+	MediaFetchers map[string]MediaFetcher
+	// AdminKey is the admin key of the Admin API, read from the
+	// ANTHROPIC_ADMIN_KEY environment variable when empty. It is only
+	// required by [Anthropic.Admin].
+	AdminKey string
+	// Voyage configures the Voyage AI embedders defined at Init, e.g.
+	// "anthropic/voyage-3.5", see [VoyageEmbedder]. They are also defined when
+	// VOYAGE_API_KEY is set.
+	Voyage *VoyageConfig
+	// Messages replaces the Messages API of the SDK client the models generate
+	// with, e.g. with a fake in the tests of an application, no API key is
+	// required then
+	Messages MessagesAPI
 
-	client  *anthropic.Client
-	mu      sync.Mutex
-	initted bool
+	client *anthropic.Client
+	// admin is the client of the Admin API, nil without an admin key
+	admin *anthropic.Client
+	// messages is the Messages API the models generate with
+	messages MessagesAPI
+	budget   *budget
+	prices   map[string]Pricing
+	metrics  *metrics
+	limiter  *rateLimiter
+	breaker  *circuitBreaker
+	dedup    *deduplicator
+	cache    *responseCache
+	media    *mediaConfig
+	// workspaces route the requests to the Workspaces, nil without Workspaces
+	workspaces *workspaces
+	// backends are the clients of the Backends
+	backends []*backendClient
+	mu       sync.Mutex
+	initted  bool
 }
 
 func (a *Anthropic) Name() string {
@@ -71,32 +178,204 @@ func (a *Anthropic) Init(ctx context.Context, g *genkit.Genkit) (err error) {
 	if apiKey == "" {
 		apiKey = os.Getenv("ANTHROPIC_API_KEY")
 	}
-	if apiKey == "" {
+	if apiKey == "" && a.Messages == nil {
 		return fmt.Errorf("API key is required. Set APIKey field or ANTHROPIC_API_KEY environment variable")
 	}
 
-	c := anthropic.NewClient(
-		option.WithAPIKey(apiKey),
-	)
+	// without an API key, only the models generating with Messages are available
+	var opts []option.RequestOption
+	if a.Retry != nil {
+		opts = append(opts, a.Retry.options()...)
+	}
+	if a.OnRateLimits != nil {
+		opts = append(opts, option.WithMiddleware(rateLimitsMiddleware(a.OnRateLimits)))
+	}
+	if apiKey != "" {
+		a.client = newClient(append([]option.RequestOption{option.WithAPIKey(apiKey)}, opts...)...)
+		a.messages = &a.client.Messages
+	}
+	if a.Messages != nil {
+		a.messages = a.Messages
+	}
+	if len(a.Workspaces) > 0 {
+		if a.workspaces, err = newWorkspaces(a.messages, a.Workspaces, opts); err != nil {
+			return err
+		}
+		a.messages = a.workspaces
+	}
+	adminKey := a.AdminKey
+	if adminKey == "" {
+		adminKey = os.Getenv("ANTHROPIC_ADMIN_KEY")
+	}
+	if adminKey != "" {
+		opts := []option.RequestOption{option.WithAPIKey(adminKey)}
+		if a.Retry != nil {
+			opts = append(opts, a.Retry.options()...)
+		}
+		a.admin = newClient(opts...)
+	}
 
 	a.initted = true
-	a.client = &c
+	a.media = newMediaConfig(a.MediaDownloadLimit, a.MediaHTTPClient, a.MediaFetchers)
+	a.prices = newPricing(a.Pricing)
+	if a.metrics, err = newMetrics(a.MeterProvider); err != nil {
+		return err
+	}
+	if a.Budget != nil {
+		a.budget = newBudget(*a.Budget, time.Now)
+	}
+	if a.RateLimiter != nil {
+		a.limiter = newRateLimiter(*a.RateLimiter, time.Now)
+	}
+	if a.CircuitBreaker != nil {
+		a.breaker = newCircuitBreaker(*a.CircuitBreaker, time.Now)
+	}
+	if a.Deduplicate {
+		a.dedup = newDeduplicator()
+	}
+	if a.ResponseCache != nil {
+		a.cache = newResponseCache(*a.ResponseCache, time.Now)
+	}
+	for _, b := range a.Backends {
+		a.backends = append(a.backends, newBackendClient(b))
+	}
+
+	for name, mi := range anthropicModels {
+		defineAnthropicModel(g, a.messages, name, mi, a.modelMiddleware(name)...)
+	}
+	if err := a.defineAliases(g); err != nil {
+		return err
+	}
+	voyage, err := newVoyageClient(a.Voyage)
+	if err != nil {
+		return err
+	}
+	if voyage != nil {
+		voyage.defineEmbedders(g)
+	}
+
+	if a.DiscoverModels && a.client != nil {
+		if _, err := a.refreshModels(ctx, g); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
+// RefreshModels lists the models available with the Models API and defines the
+// ones not known to the plugin, named after their ID. It returns the names of
+// these models.
+func (a *Anthropic) RefreshModels(ctx context.Context, g *genkit.Genkit) ([]string, error) {
+	if a.client == nil {
+		return nil, errors.New("Anthropic.RefreshModels: plugin not initialized")
+	}
+	names, err := a.refreshModels(ctx, g)
+	if err != nil {
+		return nil, fmt.Errorf("Anthropic.RefreshModels: %w", err)
+	}
+	return names, nil
+}
+
+func (a *Anthropic) refreshModels(ctx context.Context, g *genkit.Genkit) ([]string, error) {
+	known := map[string]bool{}
 	for name, mi := range anthropicModels {
-		defineAnthropicModel(g, a.client, name, mi)
+		known[name] = true
+		for _, v := range mi.Versions {
+			known[v] = true
+		}
 	}
 
+	names := []string{}
+	iter := a.client.Models.ListAutoPaging(ctx, anthropic.ModelListParams{})
+	for iter.Next() {
+		m := iter.Current()
+		if known[m.ID] {
+			continue
+		}
+		defineAnthropicModel(g, a.messages, m.ID, ai.ModelInfo{
+			Label:    m.DisplayName,
+			Supports: &Multimodal,
+			Versions: []string{m.ID},
+		}, a.modelMiddleware(m.ID)...)
+		names = append(names, m.ID)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("unable to list models: %w", err)
+	}
+	return names, nil
+}
+
+// ListActions lists the models the plugin can resolve: the known models and,
+// once initialized, the models listed by the Models API
+func (a *Anthropic) ListActions(ctx context.Context) []core.ActionDesc {
+	infos := maps.Clone(anthropicModels)
+	if a.client != nil {
+		iter := a.client.Models.ListAutoPaging(ctx, anthropic.ModelListParams{})
+		for iter.Next() {
+			m := iter.Current()
+			if _, ok := infos[m.ID]; !ok {
+				infos[m.ID] = ai.ModelInfo{Label: m.DisplayName, Supports: &Multimodal, Versions: []string{m.ID}}
+			}
+		}
+		// the known models are still listed when the API can't be reached
+		_ = iter.Err()
+	}
+
+	actions := []core.ActionDesc{}
+	for _, name := range slices.Sorted(maps.Keys(infos)) {
+		info := withLifecycle(name, infos[name], time.Now())
+		model := map[string]any{
+			"supports": info.Supports,
+			"versions": info.Versions,
+		}
+		if info.Stage != "" {
+			model["stage"] = info.Stage
+		}
+		actions = append(actions, core.ActionDesc{
+			Type: core.ActionTypeModel,
+			Name: provider + "/" + name,
+			Key:  fmt.Sprintf("/%s/%s/%s", core.ActionTypeModel, provider, name),
+			Metadata: map[string]any{
+				"label": info.Label,
+				"model": model,
+			},
+		})
+	}
+	return actions
+}
+
+// ResolveAction defines the model with the given name on first use, so any
+// Claude model ID can be referenced as "anthropic/<model ID>"
+func (a *Anthropic) ResolveAction(g *genkit.Genkit, atype core.ActionType, name string) error {
+	if atype != core.ActionTypeModel || !strings.HasPrefix(name, "claude-") {
+		return nil
+	}
+	info, ok := anthropicModels[name]
+	if !ok {
+		info = ai.ModelInfo{Label: name, Supports: &Multimodal, Versions: []string{name}}
+	}
+	warnDeprecated(context.Background(), name, time.Now())
+	newAnthropicModel(g, a.messages, name, info, a.modelMiddleware(name)...)
 	return nil
 }
 
+// IsDefinedModel reports whether the model with the given name was defined by
+// the plugin. Unlike [AnthropicModel], it doesn't define the Claude models not
+// defined yet, see [Anthropic.ResolveAction].
+func IsDefinedModel(g *genkit.Genkit, name string) bool {
+	return definedModel(g, name) != nil
+}
+
 // AnthropicModel returns the [ai.Model] with the given name.
 // It returns nil if the model was not defined
 func AnthropicModel(g *genkit.Genkit, name string) ai.Model {
 	return genkit.LookupModel(g, provider, name)
 }
 
-// DefineModel adds the model to the registry
-func (a *Anthropic) DefineModel(g *genkit.Genkit, name string, info *ai.ModelInfo) (ai.Model, error) {
+// DefineModel adds the model to the registry, wrapped with the plugin
+// middleware then the given middleware
+func (a *Anthropic) DefineModel(g *genkit.Genkit, name string, info *ai.ModelInfo, mw ...ai.ModelMiddleware) (ai.Model, error) {
 	var mi ai.ModelInfo
 	if info == nil {
 		var ok bool
@@ -107,58 +386,517 @@ func (a *Anthropic) DefineModel(g *genkit.Genkit, name string, info *ai.ModelInf
 	} else {
 		mi = *info
 	}
-	return defineAnthropicModel(g, a.client, name, mi), nil
+	if a.ValidateVersions {
+		if err := a.validateVersions(context.Background(), name, mi.Versions); err != nil {
+			return nil, fmt.Errorf("%s.DefineModel: %w", provider, err)
+		}
+	}
+	warnDeprecated(context.Background(), name, time.Now())
+	return defineAnthropicModel(g, a.messages, name, mi, a.modelMiddleware(name, mw...)...), nil
 }
 
-func defineAnthropicModel(g *genkit.Genkit, client *anthropic.Client, name string, info ai.ModelInfo) ai.Model {
+// validateVersions checks that the versions of a model, or its name without
+// versions, are model IDs or aliases served by the Models API
+func (a *Anthropic) validateVersions(ctx context.Context, name string, versions []string) error {
+	if a.client == nil {
+		return errors.New("the versions can't be validated without an API key")
+	}
+	if len(versions) == 0 {
+		versions = []string{name}
+	}
+	var unknown []string
+	for _, v := range versions {
+		_, err := a.client.Models.Get(ctx, v, anthropic.ModelGetParams{})
+		var apiErr *anthropic.Error
+		switch {
+		case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+			unknown = append(unknown, v)
+		case err != nil:
+			return fmt.Errorf("unable to validate version %q of model %q: %w", v, name, err)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown versions of model %q: %s", name, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// middleware returns the middleware of the model with the given name defined
+// by the plugin: the Genkit status of the errors, the media settings of the
+// plugin, the plugin middleware, the
+// given middleware, the workspace
+// selection so the cached responses aren't shared by the workspaces, the guardrails,
+// the response cache, the image resizing, the deduplication so duplicates
+// don't count toward the limits, the budget, the circuit breaker so rejected
+// calls don't wait for the rate limiter, the rate limiter so it sees the
+// requests as sent, then the cost estimation, the metrics and the tracing of
+// the calls
+func (a *Anthropic) middleware(model string, mw ...ai.ModelMiddleware) []ai.ModelMiddleware {
+	mws := append([]ai.ModelMiddleware{genkitErrors(), mediaMiddleware(a.media)}, a.Middleware...)
+	mws = append(mws, mw...)
+	if a.workspaces != nil {
+		mws = append(mws, a.workspaces.middleware(model))
+	}
+	if a.Guardrails != nil {
+		mws = append(mws, a.Guardrails.middleware(model))
+	}
+	if a.cache != nil {
+		mws = append(mws, a.cache.middleware(model))
+	}
+	if a.ImageResize != nil {
+		mws = append(mws, a.ImageResize.middleware())
+	}
+	if a.dedup != nil {
+		mws = append(mws, a.dedup.middleware(model))
+	}
+	if a.budget != nil {
+		mws = append(mws, a.budget.middleware())
+	}
+	if a.breaker != nil {
+		mws = append(mws, a.breaker.middleware())
+	}
+	if a.limiter != nil {
+		mws = append(mws, a.limiter.middleware())
+	}
+	if a.prices != nil {
+		mws = append(mws, costs(a.prices, model))
+	}
+	if a.metrics != nil {
+		mws = append(mws, a.metrics.middleware(model))
+	}
+	return append(mws, tracing(newTracer(a.TracerProvider), model))
+}
+
+// modelMiddleware returns the middleware of a model generating with a single
+// Claude model: the middleware of the plugin, then the failover to the backends
+func (a *Anthropic) modelMiddleware(model string, mw ...ai.ModelMiddleware) []ai.ModelMiddleware {
+	mws := a.middleware(model, mw...)
+	if len(a.backends) > 0 {
+		mws = append(mws, failover(a.backends, model))
+	}
+	return mws
+}
+
+// definedModels are the models defined by the plugin in each registry. They are
+// looked up without [genkit.LookupModel], which resolves the missing models.
+var (
+	definedModelsMu sync.Mutex
+	definedModels   = map[*genkit.Genkit]map[string]ai.Model{}
+)
+
+// definedModel returns the model with the given name defined by the plugin, nil if none
+func definedModel(g *genkit.Genkit, name string) ai.Model {
+	definedModelsMu.Lock()
+	defer definedModelsMu.Unlock()
+	return definedModels[g][name]
+}
+
+func defineAnthropicModel(g *genkit.Genkit, client MessagesAPI, name string, info ai.ModelInfo, mw ...ai.ModelMiddleware) ai.Model {
 	// First, try to find an existing model
-	if existing := genkit.LookupModel(g, provider, name); existing != nil {
+	if existing := definedModel(g, name); existing != nil {
 		return existing
 	}
+	return newAnthropicModel(g, client, name, info, mw...)
+}
 
+// newAnthropicModel defines a model without looking it up first, as done
+// while the model is being resolved
+func newAnthropicModel(g *genkit.Genkit, client MessagesAPI, name string, info ai.ModelInfo, mw ...ai.ModelMiddleware) ai.Model {
+	info = withLifecycle(name, info, time.Now())
 	meta := &ai.ModelInfo{
 		Label:    provider + "-" + name,
+		Stage:    info.Stage,
 		Supports: info.Supports,
 		Versions: info.Versions,
 	}
-	return genkit.DefineModel(g, provider, name, meta, func(
+	var fn ai.ModelFunc = func(
 		ctx context.Context,
 		input *ai.ModelRequest,
 		cb func(context.Context, *ai.ModelResponseChunk) error,
 	) (*ai.ModelResponse, error) {
+		// the models unknown to the plugin default to their first version too
+		if _, known := anthropicModels[name]; !known && len(info.Versions) > 0 && info.Versions[0] != name {
+			var err error
+			if input, err = defaultVersion(input, info.Versions[0]); err != nil {
+				return nil, err
+			}
+		}
 		return anthropicGenerate(ctx, client, name, input, cb)
-	})
+	}
+	return defineModelFunc(g, name, meta, fn, mw...)
+}
+
+// defineModelFunc defines a model of the plugin generating with fn wrapped with the middleware
+func defineModelFunc(g *genkit.Genkit, name string, meta *ai.ModelInfo, fn ai.ModelFunc, mw ...ai.ModelMiddleware) ai.Model {
+	if len(mw) > 0 {
+		fn = core.ChainMiddleware(mw...)(fn)
+	}
+	m := genkit.DefineModel(g, provider, name, meta, fn)
+
+	definedModelsMu.Lock()
+	defer definedModelsMu.Unlock()
+	if definedModels[g] == nil {
+		definedModels[g] = map[string]ai.Model{}
+	}
+	definedModels[g][name] = m
+	return m
 }
 
 // generate function defines how a generate request is done in Anthropic models
 func anthropicGenerate(
 	ctx context.Context,
-	client *anthropic.Client,
+	client MessagesAPI,
 	model string,
 	input *ai.ModelRequest,
 	cb func(context.Context, *ai.ModelResponseChunk) error,
 ) (*ai.ModelResponse, error) {
-	req, err := toAnthropicRequest(model, input)
+	start := time.Now()
+	c, err := configFromRequest(input)
 	if err != nil {
-		return nil, fmt.Errorf("unable to generate anthropic request: %w", err)
+		return nil, err
+	}
+	if c.DryRun {
+		return dryRun(ctx, client, model, input)
+	}
+	// the schedule of the version sent, or of the model when it has none
+	if id := modelID(model, c); isScheduled(id) {
+		warnDeprecated(ctx, id, start)
+	} else {
+		warnDeprecated(ctx, model, start)
+	}
+
+	// the calls without streaming send the whole response as a single chunk
+	var chunkCB func(context.Context, *ai.ModelResponseChunk) error
+	if c.DisableStreaming {
+		chunkCB, cb = cb, nil
+	}
+
+	// the prefill is part of the answer, it is streamed first
+	if text, ok := prefill(input); ok && text != "" && cb != nil {
+		if err := cb(ctx, &ai.ModelResponseChunk{
+			Role:    ai.RoleModel,
+			Content: []*ai.Part{ai.NewTextPart(text)},
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := generate(ctx, client, model, input, cb)
+	// send the streams dropped by the network again, with the answer received
+	// so far as prefill, the chunks already streamed are not sent again
+	for n := 0; n < c.StreamReconnects && err != nil && canReconnect(ctx, err); n++ {
+		var serr *StreamError
+		errors.As(err, &serr)
+		r, err = generate(ctx, client, model, continueWith(input, serr.Partial.Text()), cb)
+		var next *StreamError
+		if err == nil {
+			addUsage(r.Usage, serr.Partial.Usage)
+		} else if errors.As(err, &next) {
+			addUsage(next.Partial.Usage, serr.Partial.Usage)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// continue the turns paused by Anthropic, e.g. during a long web search,
+	// by sending the paused turn back as is
+	pauses := c.PauseTurnContinuations
+	if pauses == 0 {
+		pauses = defaultPauseTurnContinuations
+	}
+	for n := 0; n < pauses && isPaused(r); n++ {
+		next := *input
+		next.Messages = append(slices.Clone(input.Messages), r.Message)
+		cont, err := generate(ctx, client, model, &next, cb)
+		if err != nil {
+			return nil, fmt.Errorf("pause_turn continuation %d: %w", n+1, err)
+		}
+		addUsage(cont.Usage, r.Usage)
+		r = resumedTurn(r, cont)
 	}
 
-	// no streaming
-	if cb == nil {
-		msg, err := client.Messages.New(ctx, *req)
+	// continue the answers cut at max_tokens, with the answer so far as prefill
+	for n := 0; n < c.MaxContinuations && canContinue(r); n++ {
+		cont, err := generate(ctx, client, model, continueWith(input, r.Text()), cb)
 		if err != nil {
+			return nil, fmt.Errorf("continuation %d: %w", n+1, err)
+		}
+		addUsage(cont.Usage, r.Usage)
+		r = cont
+	}
+
+	// send back the tool calls whose input doesn't match the schema of their
+	// tool with the validation errors, the repaired responses are not streamed
+	if c.ToolInputRepairs != 0 {
+		repairs := max(c.ToolInputRepairs, 0)
+		for n := 0; ; n++ {
+			verr := validateToolInputs(r, input.Tools, c, modelID(model, c))
+			if verr == nil {
+				break
+			}
+			if n >= repairs {
+				return nil, verr
+			}
+			next := *input
+			next.Messages = append(slices.Clone(input.Messages), r.Message, toolInputRepairMessage(r.Message, verr))
+			repaired, err := generate(ctx, client, model, &next, nil)
+			if err != nil {
+				return nil, fmt.Errorf("tool input repair %d: %w", n+1, err)
+			}
+			addUsage(repaired.Usage, r.Usage)
+			r = repaired
+		}
+	}
+
+	// send back the output that doesn't match the schema with the validation
+	// errors, the repaired responses are not streamed
+	if out := structuredOutputFor(input); out != nil && c.OutputRepairs >= 0 {
+		repairs := c.OutputRepairs
+		if repairs == 0 {
+			repairs = defaultOutputRepairs
+		}
+		for n := 0; ; n++ {
+			verr := out.validate(r)
+			if verr == nil {
+				break
+			}
+			if n >= repairs {
+				return nil, verr
+			}
+			next := *input
+			next.Messages = append(slices.Clone(input.Messages), ai.NewModelTextMessage(verr.Output), repairMessage(verr))
+			repaired, err := generate(ctx, client, model, &next, nil)
+			if err != nil {
+				return nil, fmt.Errorf("output repair %d: %w", n+1, err)
+			}
+			addUsage(repaired.Usage, r.Usage)
+			r = repaired
+		}
+	}
+
+	// the usage of the whole answer is streamed last, as reported by the
+	// blocking calls
+	if cb != nil && r.Usage != nil {
+		if err := cb(ctx, usageChunk(r.Usage)); err != nil {
 			return nil, err
 		}
+	}
+	if chunkCB != nil && r.Message != nil {
+		chunk := &ai.ModelResponseChunk{Role: ai.RoleModel, Content: r.Message.Content}
+		if r.Usage != nil {
+			chunk.Custom = usageChunk(r.Usage).Custom
+		}
+		if err := chunkCB(ctx, chunk); err != nil {
+			return nil, err
+		}
+	}
+
+	r.Request = input
+	r.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	return r, nil
+}
+
+// usageChunk returns the final chunk of a streamed response, holding a copy
+// of its usage
+func usageChunk(u *ai.GenerationUsage) *ai.ModelResponseChunk {
+	usage := *u
+	usage.Custom = maps.Clone(u.Custom)
+	return &ai.ModelResponseChunk{Role: ai.RoleModel, Custom: &usage}
+}
+
+// ChunkUsage returns the token usage of a streamed response, attached to its
+// final chunk, nil for the other chunks. It adds up the usage of all the
+// calls of the response, e.g. its continuations.
+func ChunkUsage(chunk *ai.ModelResponseChunk) *ai.GenerationUsage {
+	if chunk == nil {
+		return nil
+	}
+	usage, _ := chunk.Custom.(*ai.GenerationUsage)
+	return usage
+}
+
+// dryRun returns an empty response holding the request that would be sent
+func dryRun(ctx context.Context, client MessagesAPI, model string, input *ai.ModelRequest) (*ai.ModelResponse, error) {
+	truncated, err := truncateHistory(ctx, client, model, input)
+	if err != nil {
+		return nil, err
+	}
+	req, err := toAnthropicRequest(ctx, model, truncated)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate anthropic request: %w", err)
+	}
+	if id := userIDFromContext(ctx); id != "" && !req.Metadata.UserID.Valid() {
+		req.Metadata = anthropic.MetadataParam{UserID: anthropic.String(id)}
+	}
+	return &ai.ModelResponse{
+		Message:       &ai.Message{Role: ai.RoleModel, Content: []*ai.Part{}},
+		FinishReason:  ai.FinishReasonOther,
+		FinishMessage: "dry run, the request was not sent",
+		Request:       input,
+		Custom:        req,
+	}, nil
+}
+
+// RequestIDMetadataKey is the response message metadata key holding the
+// request-id header of the Anthropic response, to be given to Anthropic support
+const RequestIDMetadataKey = "requestId"
+
+// RequestID returns the ID Anthropic gave to the request of a response
+func RequestID(r *ai.ModelResponse) string {
+	if r == nil || r.Message == nil {
+		return ""
+	}
+	id, _ := r.Message.Metadata[RequestIDMetadataKey].(string)
+	return id
+}
+
+// withResponseHeaders records the request ID and the rate limits of an HTTP
+// response in the response message metadata
+func withResponseHeaders(r *ai.ModelResponse, httpResp *http.Response) {
+	if r.Message == nil || httpResp == nil {
+		return
+	}
+	set := func(key string, value any) {
+		if r.Message.Metadata == nil {
+			r.Message.Metadata = map[string]any{}
+		}
+		r.Message.Metadata[key] = value
+	}
+	if id := httpResp.Header.Get("request-id"); id != "" {
+		set(RequestIDMetadataKey, id)
+	}
+	if rl := parseRateLimits(httpResp.Header); rl != nil {
+		set(RateLimitsMetadataKey, rl)
+	}
+}
+
+// canContinue reports whether a response was cut at max_tokens in the middle of its text
+func canContinue(r *ai.ModelResponse) bool {
+	if r.FinishReason != ai.FinishReasonLength || r.Message == nil || len(r.Message.Content) == 0 {
+		return false
+	}
+	for _, p := range r.Message.Content {
+		if !p.IsText() {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultPauseTurnContinuations is the number of follow-up requests sent to
+// continue a paused turn, see [GenerationConfig.PauseTurnContinuations]
+const defaultPauseTurnContinuations = 5
+
+// isPaused reports whether Anthropic paused the turn of a response
+func isPaused(r *ai.ModelResponse) bool {
+	m, ok := r.Custom.(*anthropic.Message)
+	return ok && m.StopReason == anthropic.StopReasonPauseTurn && r.Message != nil
+}
+
+// resumedTurn returns the continuation of a paused turn, holding the content
+// of the paused turn first
+func resumedTurn(paused, cont *ai.ModelResponse) *ai.ModelResponse {
+	if cont.Message == nil {
+		return cont
+	}
+	cont.Message.Content = append(slices.Clone(paused.Message.Content), cont.Message.Content...)
+	metadata := maps.Clone(paused.Message.Metadata)
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+	maps.Copy(metadata, cont.Message.Metadata)
+	if len(metadata) > 0 {
+		cont.Message.Metadata = metadata
+	}
+	return cont
+}
+
+// addUsage adds the usage of a previous response to u
+func addUsage(u, prev *ai.GenerationUsage) {
+	if u == nil || prev == nil {
+		return
+	}
+	u.InputTokens += prev.InputTokens
+	u.OutputTokens += prev.OutputTokens
+	u.CachedContentTokens += prev.CachedContentTokens
+	u.TotalTokens += prev.TotalTokens
+	for k, v := range prev.Custom {
+		if u.Custom == nil {
+			u.Custom = map[string]float64{}
+		}
+		u.Custom[k] += v
+	}
+}
+
+// generate sends a single request to Anthropic
+func generate(
+	ctx context.Context,
+	client MessagesAPI,
+	model string,
+	input *ai.ModelRequest,
+	cb func(context.Context, *ai.ModelResponseChunk) error,
+) (*ai.ModelResponse, error) {
+	input, err := truncateHistory(ctx, client, model, input)
+	if err != nil {
+		return nil, err
+	}
+	req, err := toAnthropicRequest(ctx, model, input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate anthropic request: %w", err)
+	}
+	opts, err := toAnthropicRequestOptions(model, input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate anthropic request: %w", err)
+	}
+	if err := checkContextWindow(ctx, client, input, req, opts); err != nil {
+		return nil, err
+	}
+	if id := userIDFromContext(ctx); id != "" && !req.Metadata.UserID.Valid() {
+		req.Metadata = anthropic.MetadataParam{UserID: anthropic.String(id)}
+	}
+
+	out := structuredOutputFor(input)
+	var httpResp *http.Response
+	opts = append(opts, option.WithResponseInto(&httpResp))
+
+	// no streaming, unless the response may take too long to wait for it without
+	// streaming, see [anthropic.CalculateNonStreamingTimeout]
+	_, tooLong := anthropic.CalculateNonStreamingTimeout(int(req.MaxTokens), req.Model, opts)
+	events := streamEventsFromContext(ctx)
+	streaming := cb != nil || tooLong != nil || events != nil
+	if c, err := configFromRequest(input); err != nil {
+		return nil, err
+	} else if c.DisableStreaming {
+		if tooLong != nil {
+			return nil, fmt.Errorf("streaming can't be disabled with a max_tokens of %d, lower MaxOutputTokens: %w", req.MaxTokens, tooLong)
+		}
+		streaming = false
+	}
+	if !streaming {
+		msg, err := client.New(ctx, *req, opts...)
+		if err != nil {
+			return nil, apiError(err)
+		}
 
 		r, err := anthropicToGenkitResponse(msg)
 		if err != nil {
 			return nil, err
 		}
-
-		r.Request = input
+		if err := completeResponse(r, input); err != nil {
+			return nil, err
+		}
+		withResponseHeaders(r, httpResp)
 		return r, nil
 	} else {
-		stream := client.Messages.NewStreaming(ctx, *req)
+		if cb == nil {
+			cb = func(context.Context, *ai.ModelResponseChunk) error { return nil }
+		}
+		var partial *partialOutput
+		if out != nil {
+			partial = out.newPartialOutput()
+		}
+		stream := client.NewStreaming(ctx, *req, opts...)
 		message := anthropic.Message{}
 		for stream.Next() {
 			event := stream.Current()
@@ -166,31 +904,221 @@ func anthropicGenerate(
 			if err != nil {
 				return nil, err
 			}
+			if events != nil {
+				if err := events(ctx, event); err != nil {
+					return nil, err
+				}
+			}
 
 			switch event := event.AsAny().(type) {
 			case anthropic.ContentBlockDeltaEvent:
-				cb(ctx, &ai.ModelResponseChunk{
-					Content: []*ai.Part{
-						{
-							Text: event.Delta.Text,
-						},
-					},
-				})
+				var part *ai.Part
+				switch delta := event.Delta.AsAny().(type) {
+				case anthropic.TextDelta:
+					part = ai.NewTextPart(delta.Text)
+				case anthropic.CitationsDelta:
+					part = ai.NewTextPart("")
+					part.Metadata = map[string]any{
+						CitationsMetadataKey: []*Citation{fromAnthropicCitationDelta(delta.Citation)},
+					}
+				case anthropic.InputJSONDelta:
+					if int(event.Index) >= len(message.Content) {
+						continue
+					}
+					block := message.Content[event.Index]
+					// the structured output is streamed as text
+					if partial != nil && block.Name == structuredOutputToolName {
+						text, snapshot := partial.add(delta.PartialJSON)
+						if text == "" && snapshot == "" {
+							continue
+						}
+						part = ai.NewJSONPart(text)
+						if snapshot != "" {
+							part.Metadata = map[string]any{PartialOutputMetadataKey: snapshot}
+						}
+						break
+					}
+					// server tools, e.g. web_fetch, are run by Anthropic and
+					// are not tool requests of the caller
+					if block.Type != "tool_use" {
+						continue
+					}
+					// surface the tool arguments as they arrive instead of
+					// waiting for the whole tool_use block to be streamed
+					part = ai.NewToolRequestPart(&ai.ToolRequest{
+						Ref:  block.ID,
+						Name: block.Name,
+					})
+					part.Metadata = map[string]any{
+						PartialMetadataKey:     true,
+						PartialJSONMetadataKey: delta.PartialJSON,
+					}
+				case anthropic.ThinkingDelta:
+					part = ai.NewReasoningPart(delta.Thinking, nil)
+				case anthropic.SignatureDelta:
+					continue
+				default:
+					// deltas added to the API after this version of the SDK
+					slog.DebugContext(ctx, "anthropic: ignoring unknown stream delta", "type", event.Delta.Type)
+					continue
+				}
+				if err := cb(ctx, &ai.ModelResponseChunk{
+					Index:   int(event.Index),
+					Role:    ai.RoleModel,
+					Content: []*ai.Part{part},
+				}); err != nil {
+					return nil, err
+				}
+			case anthropic.ContentBlockStartEvent:
+				// the tool calls are streamed as soon as they start, so UIs can
+				// show the tool being called before its arguments are complete
+				if part := toolRequestChunkPart(&message, event.Index, partial != nil); part != nil {
+					part.Metadata = map[string]any{PartialMetadataKey: true, PartialJSONMetadataKey: ""}
+					if err := cb(ctx, &ai.ModelResponseChunk{
+						Index:   int(event.Index),
+						Role:    ai.RoleModel,
+						Content: []*ai.Part{part},
+					}); err != nil {
+						return nil, err
+					}
+				}
+			case anthropic.ContentBlockStopEvent:
+				// then again once their arguments are complete
+				if part := toolRequestChunkPart(&message, event.Index, partial != nil); part != nil {
+					part.ToolRequest.Input = slices.Clone(message.Content[event.Index].Input)
+					if err := cb(ctx, &ai.ModelResponseChunk{
+						Index:   int(event.Index),
+						Role:    ai.RoleModel,
+						Content: []*ai.Part{part},
+					}); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				// the end of a wrapped structured output is only known once complete
+				if partial == nil || int(event.Index) >= len(message.Content) || message.Content[event.Index].Name != structuredOutputToolName {
+					continue
+				}
+				if rest := partial.finish(); rest != "" {
+					if err := cb(ctx, &ai.ModelResponseChunk{
+						Index:   int(event.Index),
+						Role:    ai.RoleModel,
+						Content: []*ai.Part{ai.NewJSONPart(rest)},
+					}); err != nil {
+						return nil, err
+					}
+				}
+			case anthropic.MessageDeltaEvent:
+				// the final input counts, only the output tokens are accumulated by the SDK
+				if event.Usage.InputTokens > 0 {
+					message.Usage.InputTokens = event.Usage.InputTokens
+				}
+				if event.Usage.CacheCreationInputTokens > 0 {
+					message.Usage.CacheCreationInputTokens = event.Usage.CacheCreationInputTokens
+				}
+				if event.Usage.CacheReadInputTokens > 0 {
+					message.Usage.CacheReadInputTokens = event.Usage.CacheReadInputTokens
+				}
+				// the container of the code execution tool is only sent in the delta
+				if container, ok := event.Delta.JSON.ExtraFields["container"]; ok {
+					if message.JSON.ExtraFields == nil {
+						message.JSON.ExtraFields = map[string]respjson.Field{}
+					}
+					message.JSON.ExtraFields["container"] = container
+				}
+				// as are the context edits applied
+				if edits, ok := event.JSON.ExtraFields["context_management"]; ok {
+					if message.JSON.ExtraFields == nil {
+						message.JSON.ExtraFields = map[string]respjson.Field{}
+					}
+					message.JSON.ExtraFields["context_management"] = edits
+				}
 			case anthropic.MessageStopEvent:
 				r, err := anthropicToGenkitResponse(&message)
 				if err != nil {
 					return nil, err
 				}
-				r.Request = input
+				if err := completeResponse(r, input); err != nil {
+					return nil, err
+				}
+				withResponseHeaders(r, httpResp)
 				return r, nil
+			case anthropic.MessageStartEvent:
+			default:
+				// ping events are dropped by the SDK, as are the event types
+				// it doesn't know about
+				slog.DebugContext(ctx, "anthropic: ignoring unknown stream event", "type", stream.Current().Type)
 			}
 		}
-		if stream.Err() != nil {
-			return nil, stream.Err()
+		err = stream.Err()
+		if err != nil {
+			err = apiError(err)
+		} else {
+			// the connection was closed before the end of the message
+			err = fmt.Errorf("stream ended before message_stop: %w", io.ErrUnexpectedEOF)
+		}
+		if message.ID == "" {
+			return nil, err
+		}
+		return nil, streamError(&message, input, err)
+	}
+}
+
+// toolRequestChunkPart returns the tool request part of the tool_use block at
+// the given index of a streamed message, nil for the other blocks. The server
+// tools are run by Anthropic, and the structured output is streamed as text.
+func toolRequestChunkPart(m *anthropic.Message, index int64, structured bool) *ai.Part {
+	if int(index) >= len(m.Content) {
+		return nil
+	}
+	block := m.Content[index]
+	if block.Type != "tool_use" || structured && block.Name == structuredOutputToolName {
+		return nil
+	}
+	return ai.NewToolRequestPart(&ai.ToolRequest{Ref: block.ID, Name: block.Name})
+}
+
+// streamError returns the error of a stream failing after message_start with
+// the message received so far
+func streamError(m *anthropic.Message, input *ai.ModelRequest, err error) error {
+	r, terr := anthropicToGenkitResponse(m)
+	if terr != nil {
+		return err
+	}
+	if text, ok := prefill(input); ok {
+		withPrefill(r, text)
+	}
+	r.Request = input
+	return &StreamError{Partial: r, Err: err}
+}
+
+// canReconnect reports whether a failed stream can be sent again with the
+// answer received so far as prefill
+func canReconnect(ctx context.Context, err error) bool {
+	var serr *StreamError
+	if ctx.Err() != nil || !errors.As(err, &serr) || !isTransient(serr.Err) {
+		return false
+	}
+	for _, p := range serr.Partial.Message.Content {
+		if !p.IsText() {
+			return false
 		}
 	}
-
-	return nil, nil
+	return true
+}
+
+// continueWith returns the request continuing the answer of its response with
+// the given text as prefill, in place of the prefill of the request
+func continueWith(input *ai.ModelRequest, text string) *ai.ModelRequest {
+	next := *input
+	next.Messages = slices.Clone(input.Messages)
+	if _, ok := prefill(input); ok {
+		next.Messages = next.Messages[:len(next.Messages)-1]
+	}
+	if text != "" {
+		next.Messages = append(next.Messages, ai.NewModelTextMessage(text))
+	}
+	return &next
 }
 
 func toAnthropicRole(role ai.Role) (anthropic.MessageParamRole, error) {
@@ -200,15 +1128,85 @@ func toAnthropicRole(role ai.Role) (anthropic.MessageParamRole, error) {
 	case ai.RoleModel:
 		return anthropic.MessageParamRoleAssistant, nil
 	case ai.RoleTool:
-		return anthropic.MessageParamRoleAssistant, nil
+		return anthropic.MessageParamRoleUser, nil
 	default:
 		return "", fmt.Errorf("unknown role given: %q", role)
 	}
 }
 
+// appendMessage appends the blocks of a message, the consecutive messages of
+// a role are merged as Claude expects the turns to alternate, e.g. the tool
+// responses of a turn sent in several messages
+func appendMessage(messages []anthropic.MessageParam, role anthropic.MessageParamRole, blocks []anthropic.ContentBlockParamUnion) []anthropic.MessageParam {
+	if n := len(messages); n > 0 && messages[n-1].Role == role {
+		messages[n-1].Content = append(messages[n-1].Content, blocks...)
+		return messages
+	}
+	return append(messages, anthropic.MessageParam{Role: role, Content: blocks})
+}
+
+// appendSystemBlocks appends a text block per text part of a system message,
+// in order, so that the system messages of e.g. a prompt and of its caller
+// are all sent and the cache breakpoints of the parts are kept. The empty
+// parts are skipped, their breakpoint is set on the previous block.
+func appendSystemBlocks(blocks []anthropic.TextBlockParam, message *ai.Message) []anthropic.TextBlockParam {
+	for _, p := range message.Content {
+		// only text is supported for system messages
+		if !p.IsText() {
+			continue
+		}
+		cc, cached := cacheControl(p)
+		if p.Text == "" {
+			if cached && len(blocks) > 0 {
+				blocks[len(blocks)-1].CacheControl = cc
+			}
+			continue
+		}
+		block := anthropic.TextBlockParam{Text: p.Text}
+		if cached {
+			block.CacheControl = cc
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// toolUseIDs assigns the IDs of the tool requests of a conversation without a
+// reference, e.g. a history written by hand or by another provider
+type toolUseIDs struct {
+	n int
+	// pending are the IDs of the unanswered tool requests, by tool name
+	pending map[string][]string
+}
+
+// link sets the IDs of the tool_use and tool_result blocks of the parts without
+// a reference: the requests are given a new ID and the responses the ID of
+// the first unanswered request of their tool
+func (ids *toolUseIDs) link(parts []*ai.Part, blocks []anthropic.ContentBlockParamUnion) error {
+	for i, p := range parts {
+		switch b := blocks[i]; {
+		case p.IsToolRequest() && p.ToolRequest.Ref == "" && b.OfToolUse != nil:
+			if ids.pending == nil {
+				ids.pending = map[string][]string{}
+			}
+			ids.n++
+			b.OfToolUse.ID = fmt.Sprintf("toolu_genkit_%d", ids.n)
+			ids.pending[p.ToolRequest.Name] = append(ids.pending[p.ToolRequest.Name], b.OfToolUse.ID)
+		case p.IsToolResponse() && p.ToolResponse.Ref == "" && b.OfToolResult != nil:
+			pending := ids.pending[p.ToolResponse.Name]
+			if len(pending) == 0 {
+				return atPart(fmt.Errorf("tool response %q has no reference and no tool request", p.ToolResponse.Name), i)
+			}
+			b.OfToolResult.ToolUseID = pending[0]
+			ids.pending[p.ToolResponse.Name] = pending[1:]
+		}
+	}
+	return nil
+}
+
 // toAnthropicRequest translates [ai.ModelRequest] to an Anthropic request
-func toAnthropicRequest(model string, i *ai.ModelRequest) (*anthropic.MessageNewParams, error) {
-	messages := make([]anthropic.MessageParam, 0)
+func toAnthropicRequest(ctx context.Context, model string, i *ai.ModelRequest) (*anthropic.MessageNewParams, error) {
+	messages := make([]anthropic.MessageParam, 0, len(i.Messages))
 
 	c, err := configFromRequest(i)
 	if err != nil {
@@ -218,19 +1216,9 @@ func toAnthropicRequest(model string, i *ai.ModelRequest) (*anthropic.MessageNew
 	// minimum required data to perform a request
 	req := anthropic.MessageNewParams{}
 
-	// Use default version (if version info exists in model definition)
-	if modelInfo, exists := anthropicModels[model]; exists && len(modelInfo.Versions) > 0 {
-		req.Model = anthropic.Model(modelInfo.Versions[0]) // Use first version as default
-	} else {
-		req.Model = anthropic.Model(model) // Fallback to using model name
-	}
-	req.MaxTokens = int64(MaxNumberOfTokens)
-
-	if c.MaxOutputTokens != 0 {
-		req.MaxTokens = int64(c.MaxOutputTokens)
-	}
-	if c.Version != "" {
-		req.Model = anthropic.Model(c.Version) // User-specified version has highest priority
+	req.Model = anthropic.Model(modelID(model, c))
+	if req.MaxTokens, err = toAnthropicMaxTokens(string(req.Model), c); err != nil {
+		return nil, err
 	}
 	if c.Temperature != 0 {
 		req.Temperature = anthropic.Float(c.Temperature)
@@ -244,50 +1232,229 @@ func toAnthropicRequest(model string, i *ai.ModelRequest) (*anthropic.MessageNew
 	if len(c.StopSequences) > 0 {
 		req.StopSequences = c.StopSequences
 	}
+	if c.UserID != "" {
+		req.Metadata = anthropic.MetadataParam{UserID: anthropic.String(c.UserID)}
+	}
 
 	// configure system prompt (if given)
 	sysBlocks := []anthropic.TextBlockParam{}
-	for _, message := range i.Messages {
+	images := 0
+	var toolUses toolUseIDs
+	for mi, message := range i.Messages {
 		if message.Role == ai.RoleSystem {
-			// only text is supported for system messages
-			sysBlocks = append(sysBlocks, anthropic.TextBlockParam{Text: message.Text()})
-		} else if message.Content[len(message.Content)-1].IsToolResponse() {
-			// if the last message is a ToolResponse, the conversation must continue
-			// and the ToolResponse message must be sent as a user
+			sysBlocks = appendSystemBlocks(sysBlocks, message)
+			continue
+		}
+		parts, err := toAnthropicParts(ctx, message.Content)
+		if err == nil {
+			err = countImages(parts, &images)
+		}
+		if err == nil {
+			err = toolUses.link(message.Content, parts)
+		}
+		if err != nil {
+			return nil, atMessage(err, mi)
+		}
+		role, err := toAnthropicRole(message.Role)
+		if err != nil {
+			return nil, err
+		}
+		if hasToolResponse(message) {
+			// the tool responses are sent by the user in reply to the tool
+			// requests of the previous turn
 			// see: https://docs.anthropic.com/en/docs/build-with-claude/tool-use#handling-tool-use-and-tool-result-content-blocks
-			parts, err := toAnthropicParts(message.Content)
-			if err != nil {
-				return nil, err
-			}
-			messages = append(messages, anthropic.NewUserMessage(parts...))
-		} else {
-			parts, err := toAnthropicParts(message.Content)
-			if err != nil {
-				return nil, err
-			}
-			role, err := toAnthropicRole(message.Role)
-			if err != nil {
-				return nil, err
-			}
-			messages = append(messages, anthropic.MessageParam{
-				Role:    role,
-				Content: parts,
-			})
+			role = anthropic.MessageParamRoleUser
+		}
+		messages = appendMessage(messages, role, parts)
+	}
+
+	// the prefill can't end with whitespace, Claude starts its answer with it instead
+	if _, ok := prefill(i); ok {
+		last := messages[len(messages)-1].Content
+		if text := last[len(last)-1].OfText; text != nil {
+			text.Text = strings.TrimRightFunc(text.Text, unicode.IsSpace)
 		}
 	}
 
+	if len(i.Docs) > 0 {
+		results, err := toAnthropicDocs(ctx, i.Docs, c.Citations)
+		if err == nil {
+			err = countImages(results, &images)
+		}
+		if err != nil {
+			return nil, err
+		}
+		messages = withSearchResults(messages, results)
+	}
+
+	if c.Citations {
+		enableCitations(messages)
+	}
+
+	if c.CacheSystemPrompt && len(sysBlocks) > 0 {
+		sysBlocks[len(sysBlocks)-1].CacheControl = newCacheControl(c.CacheTTL)
+	}
+
 	req.System = sysBlocks
 	req.Messages = messages
 
-	tools, err := toAnthropicTools(i.Tools)
+	tools, err := toAnthropicTools(i.Tools, c, string(req.Model))
+	if err != nil {
+		return nil, err
+	}
+	serverTools, err := toAnthropicServerTools(c)
 	if err != nil {
 		return nil, err
 	}
-	req.Tools = tools
+	req.Tools = append(tools, serverTools...)
+	if c.CacheTools && len(req.Tools) > 0 {
+		setToolCacheControl(&req.Tools[len(req.Tools)-1], newCacheControl(c.CacheTTL))
+	}
+
+	// fields not modeled by the SDK yet
+	extras := map[string]any{}
+	if c.Container != "" {
+		extras["container"] = c.Container
+	}
+	if len(c.MCPServers) > 0 {
+		servers, err := toAnthropicMCPServers(c.MCPServers)
+		if err != nil {
+			return nil, err
+		}
+		extras["mcp_servers"] = servers
+	}
+	if c.ContextManagement != nil {
+		extras["context_management"] = toAnthropicContextManagement(c.ContextManagement)
+	}
+	if len(extras) > 0 {
+		req.SetExtraFields(extras)
+	}
+
+	if c.AutoCache != nil {
+		applyAutoCache(&req, c.AutoCache, c.CacheTTL)
+	}
+
+	if len(req.Tools) > 0 {
+		toolChoice, err := toAnthropicToolChoice(c.ToolChoice, i.ToolChoice, i.Tools)
+		if err != nil {
+			return nil, err
+		}
+		req.ToolChoice = toolChoice
+	}
+
+	if out := structuredOutputFor(i); out != nil {
+		req.Tools = append(req.Tools, out.tool())
+		req.ToolChoice = out.toolChoice()
+	}
 
 	return &req, nil
 }
 
+// prefill returns the text of the last message of the request when it is a
+// model message: Claude continues it instead of starting a new answer
+func prefill(i *ai.ModelRequest) (string, bool) {
+	if len(i.Messages) == 0 {
+		return "", false
+	}
+	last := i.Messages[len(i.Messages)-1]
+	if last.Role != ai.RoleModel || len(last.Content) == 0 {
+		return "", false
+	}
+	for _, p := range last.Content {
+		if !p.IsText() {
+			return "", false
+		}
+	}
+	return strings.TrimRightFunc(last.Text(), unicode.IsSpace), true
+}
+
+// completeResponse completes a response translated from Anthropic with what its
+// request asked for: the structured output in place of the output tool call,
+// and the prefill at the start of the answer
+func completeResponse(r *ai.ModelResponse, input *ai.ModelRequest) error {
+	if out := structuredOutputFor(input); out != nil {
+		if err := out.apply(r); err != nil {
+			return err
+		}
+	}
+	if text, ok := prefill(input); ok {
+		withPrefill(r, text)
+	}
+	r.Request = input
+	return nil
+}
+
+// withPrefill puts the prefill of the request at the start of the response,
+// so the response holds the whole answer
+func withPrefill(r *ai.ModelResponse, text string) {
+	if r.Message == nil || text == "" {
+		return
+	}
+	if len(r.Message.Content) > 0 && r.Message.Content[0].IsText() {
+		r.Message.Content[0].Text = text + r.Message.Content[0].Text
+		return
+	}
+	r.Message.Content = append([]*ai.Part{ai.NewTextPart(text)}, r.Message.Content...)
+}
+
+// modelID returns the Anthropic model ID to send for the given Genkit model name
+func modelID(model string, c *GenerationConfig) string {
+	if c.Version != "" {
+		return c.Version // User-specified version has highest priority
+	}
+	// Use default version (if version info exists in model definition)
+	if modelInfo, exists := anthropicModels[model]; exists && len(modelInfo.Versions) > 0 {
+		return modelInfo.Versions[0] // Use first version as default
+	}
+	return model // Fallback to using model name
+}
+
+// defaultVersion returns the request generating with the given version when
+// its config has none
+func defaultVersion(input *ai.ModelRequest, version string) (*ai.ModelRequest, error) {
+	c, err := configFromRequest(input)
+	if err != nil {
+		return nil, err
+	}
+	if c.Version != "" {
+		return input, nil
+	}
+	c.Version = version
+	in := *input
+	in.Config = c
+	return &in, nil
+}
+
+// checkVersion returns an error when the Version of the config is not one of
+// the versions of a model known to the plugin, as Genkit checks it for the
+// calls of the defined models
+func checkVersion(model string, c *GenerationConfig) error {
+	info, ok := anthropicModels[model]
+	if !ok || c.Version == "" || slices.Contains(info.Versions, c.Version) {
+		return nil
+	}
+	return fmt.Errorf("model %q does not support version %q, supported versions: %v", model, c.Version, info.Versions)
+}
+
+// toAnthropicRequestOptions returns the per request options, such as beta headers, required by the request
+func toAnthropicRequestOptions(model string, i *ai.ModelRequest) ([]option.RequestOption, error) {
+	c, err := configFromRequest(i)
+	if err != nil {
+		return nil, err
+	}
+
+	betas, err := betaFeatures(c, i, modelID(model, c))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []option.RequestOption{}
+	if len(betas) > 0 {
+		opts = append(opts, option.WithHeader("anthropic-beta", strings.Join(betas, ",")))
+	}
+	return opts, nil
+}
+
 // mapToStruct unmarshals a map[String]any to the expected type
 func mapToStruct(m map[string]any, v any) error {
 	jsonData, err := json.Marshal(m)
@@ -297,15 +1464,19 @@ func mapToStruct(m map[string]any, v any) error {
 	return json.Unmarshal(jsonData, v)
 }
 
-// configFromRequest converts any supported config type to [ai.GenerationCommonConfig]
-func configFromRequest(input *ai.ModelRequest) (*ai.GenerationCommonConfig, error) {
-	var result ai.GenerationCommonConfig
+// configFromRequest converts any supported config type to [GenerationConfig]
+func configFromRequest(input *ai.ModelRequest) (*GenerationConfig, error) {
+	var result GenerationConfig
 
 	switch config := input.Config.(type) {
-	case ai.GenerationCommonConfig:
+	case GenerationConfig:
 		result = config
-	case *ai.GenerationCommonConfig:
+	case *GenerationConfig:
 		result = *config
+	case ai.GenerationCommonConfig:
+		result.GenerationCommonConfig = config
+	case *ai.GenerationCommonConfig:
+		result.GenerationCommonConfig = *config
 	case map[string]any:
 		if err := mapToStruct(config, &result); err != nil {
 			return nil, err
@@ -319,8 +1490,9 @@ func configFromRequest(input *ai.ModelRequest) (*ai.GenerationCommonConfig, erro
 }
 
 // toAnthropicTools translates [ai.ToolDefinition] to an anthropic.ToolParam type
-func toAnthropicTools(tools []*ai.ToolDefinition) ([]anthropic.ToolUnionParam, error) {
-	resp := make([]anthropic.ToolUnionParam, 0)
+// Tools named after an Anthropic defined tool (e.g. computer) are sent as that tool type.
+func toAnthropicTools(tools []*ai.ToolDefinition, c *GenerationConfig, model string) ([]anthropic.ToolUnionParam, error) {
+	resp := make([]anthropic.ToolUnionParam, 0, len(tools))
 	regex := regexp.MustCompile(ToolNameRegex)
 
 	for _, t := range tools {
@@ -331,11 +1503,20 @@ func toAnthropicTools(tools []*ai.ToolDefinition) ([]anthropic.ToolUnionParam, e
 			return nil, fmt.Errorf("tool name must match regex: %s", ToolNameRegex)
 		}
 
+		builtin, err := builtinToolFor(t, c, model)
+		if err != nil {
+			return nil, err
+		}
+		if builtin != nil {
+			resp = append(resp, param.Override[anthropic.ToolUnionParam](builtin.params))
+			continue
+		}
+
 		resp = append(resp, anthropic.ToolUnionParam{
 			OfTool: &anthropic.ToolParam{
 				Name:        t.Name,
 				Description: anthropic.String(t.Description),
-				InputSchema: toAnthropicSchema[map[string]any](),
+				InputSchema: toAnthropicInputSchema(t.InputSchema),
 			},
 		})
 	}
@@ -343,6 +1524,76 @@ func toAnthropicTools(tools []*ai.ToolDefinition) ([]anthropic.ToolUnionParam, e
 	return resp, nil
 }
 
+// toAnthropicToolChoice translates the requested tool choice to an anthropic.ToolChoiceUnionParam.
+// The config value takes precedence over the Genkit [ai.ToolChoice].
+func toAnthropicToolChoice(choice *ToolChoice, genkitChoice ai.ToolChoice, tools []*ai.ToolDefinition) (anthropic.ToolChoiceUnionParam, error) {
+	if choice == nil {
+		switch genkitChoice {
+		case "":
+			return anthropic.ToolChoiceUnionParam{}, nil
+		case ai.ToolChoiceAuto:
+			choice = &ToolChoice{Type: ToolChoiceAuto}
+		case ai.ToolChoiceRequired:
+			choice = &ToolChoice{Type: ToolChoiceAny}
+		case ai.ToolChoiceNone:
+			choice = &ToolChoice{Type: ToolChoiceNone}
+		default:
+			return anthropic.ToolChoiceUnionParam{}, fmt.Errorf("unknown tool choice: %q", genkitChoice)
+		}
+	}
+
+	var disableParallel param.Opt[bool]
+	if choice.DisableParallelToolUse {
+		disableParallel = anthropic.Bool(true)
+	}
+
+	switch choice.Type {
+	case "", ToolChoiceAuto:
+		return anthropic.ToolChoiceUnionParam{OfAuto: &anthropic.ToolChoiceAutoParam{
+			DisableParallelToolUse: disableParallel,
+		}}, nil
+	case ToolChoiceAny:
+		return anthropic.ToolChoiceUnionParam{OfAny: &anthropic.ToolChoiceAnyParam{
+			DisableParallelToolUse: disableParallel,
+		}}, nil
+	case ToolChoiceNone:
+		return anthropic.ToolChoiceUnionParam{OfNone: &anthropic.ToolChoiceNoneParam{}}, nil
+	case ToolChoiceTool:
+		if choice.Name == "" {
+			return anthropic.ToolChoiceUnionParam{}, errors.New("tool choice of type \"tool\" requires a tool name")
+		}
+		for _, t := range tools {
+			if t.Name == choice.Name {
+				return anthropic.ToolChoiceUnionParam{OfTool: &anthropic.ToolChoiceToolParam{
+					Name:                   choice.Name,
+					DisableParallelToolUse: disableParallel,
+				}}, nil
+			}
+		}
+		return anthropic.ToolChoiceUnionParam{}, fmt.Errorf("tool choice references unknown tool %q", choice.Name)
+	default:
+		return anthropic.ToolChoiceUnionParam{}, fmt.Errorf("unknown tool choice type: %q", choice.Type)
+	}
+}
+
+// toAnthropicInputSchema returns the input_schema of a tool. The object schemas
+// are sent as is, so that their keywords (e.g. oneOf, pattern or const) reach
+// Claude untouched. Anthropic requires an object schema, the tools without one
+// (e.g. a tool whose input is a string) are sent with an empty object schema.
+func toAnthropicInputSchema(schema map[string]any) anthropic.ToolInputSchemaParam {
+	switch schema["type"] {
+	case "object":
+		return param.Override[anthropic.ToolInputSchemaParam](schema)
+	case nil:
+		if _, ok := schema["properties"]; ok {
+			s := maps.Clone(schema)
+			s["type"] = "object"
+			return param.Override[anthropic.ToolInputSchemaParam](s)
+		}
+	}
+	return toAnthropicSchema[map[string]any]()
+}
+
 // toAnthropicSchema generates a JSON schema for the requested input type
 func toAnthropicSchema[T any]() anthropic.ToolInputSchemaParam {
 	reflector := jsonschema.Reflector{
@@ -357,69 +1608,310 @@ func toAnthropicSchema[T any]() anthropic.ToolInputSchemaParam {
 }
 
 // toAnthropicParts translates [ai.Part] to an anthropic.ContentBlockParamUnion type
-func toAnthropicParts(parts []*ai.Part) ([]anthropic.ContentBlockParamUnion, error) {
-	blocks := []anthropic.ContentBlockParamUnion{}
+func toAnthropicParts(ctx context.Context, parts []*ai.Part) ([]anthropic.ContentBlockParamUnion, error) {
+	blocks := make([]anthropic.ContentBlockParamUnion, 0, len(parts))
 
-	for _, p := range parts {
+	for i, p := range parts {
 		switch {
 		case p.IsText():
 			blocks = append(blocks, anthropic.NewTextBlock(p.Text))
 		case p.IsMedia():
-			contentType, data, _ := Data(p)
-			blocks = append(blocks, anthropic.NewImageBlockBase64(contentType, base64.StdEncoding.EncodeToString(data)))
+			block, err := toAnthropicMediaBlock(ctx, p)
+			if err != nil {
+				return nil, atPart(err, i)
+			}
+			title, docContext := documentInfo(p)
+			setDocumentInfo(&block, title, docContext)
+			if enabled, ok := documentCitations(p.Metadata); ok {
+				setCitations(&block, enabled, true)
+			}
+			blocks = append(blocks, block)
 		case p.IsData():
-			contentType, data, _ := Data(p)
-			blocks = append(blocks, anthropic.NewImageBlockBase64(contentType, base64.RawStdEncoding.EncodeToString(data)))
+			m, err := readMedia(ctx, p)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read data part, err: %w", err)
+			}
+			if err := validateImage(m); err != nil {
+				return nil, atPart(err, i)
+			}
+			blocks = append(blocks, anthropic.NewImageBlockBase64(m.contentType, m.base64()))
+		case p.IsReasoning():
+			blocks = append(blocks, toAnthropicThinkingBlock(p))
 		case p.IsToolRequest():
 			toolReq := p.ToolRequest
 			blocks = append(blocks, anthropic.NewToolUseBlock(toolReq.Ref, toolReq.Input, toolReq.Name))
 		case p.IsToolResponse():
-			toolResp := p.ToolResponse
-			output, err := json.Marshal(toolResp.Output)
+			block, err := toAnthropicToolResult(ctx, p)
+			if err != nil {
+				return nil, atPart(err, i)
+			}
+			blocks = append(blocks, block)
+		case p.IsCustom():
+			block, err := fromServerBlockPart(p)
 			if err != nil {
-				return nil, fmt.Errorf("unable to parse tool response, err: %w", err)
+				return nil, err
 			}
-			blocks = append(blocks, anthropic.NewToolResultBlock(toolResp.Ref, string(output), false))
+			blocks = append(blocks, block)
 		default:
 			return nil, errors.New("unknown part type in the request")
 		}
+
+		if cc, ok := cacheControl(p); ok {
+			setCacheControl(&blocks[len(blocks)-1], cc)
+		}
 	}
 
 	return blocks, nil
 }
 
-// anthropicToGenkitResponse translates an Anthropic Message to [ai.ModelResponse]
-func anthropicToGenkitResponse(m *anthropic.Message) (*ai.ModelResponse, error) {
-	r := ai.ModelResponse{}
+// toAnthropicThinkingBlock translates a reasoning [ai.Part] of a previous turn
+// back to the thinking block, or redacted thinking block, it was received as
+func toAnthropicThinkingBlock(p *ai.Part) anthropic.ContentBlockParamUnion {
+	if data, ok := p.Metadata[RedactedThinkingMetadataKey].(string); ok {
+		return anthropic.NewRedactedThinkingBlock(data)
+	}
+	var signature string
+	switch s := p.Metadata[SignatureMetadataKey].(type) {
+	case string:
+		signature = s
+	case []byte:
+		signature = string(s)
+	}
+	return anthropic.NewThinkingBlock(signature, p.Text)
+}
+
+// toAnthropicMediaBlock translates a media [ai.Part] to an anthropic image or document block
+// depending on its content type: PDFs and plain text become documents, anything else an image.
+func toAnthropicMediaBlock(ctx context.Context, p *ai.Part) (anthropic.ContentBlockParamUnion, error) {
+	if id, ok := fileID(p); ok {
+		blockType := "image"
+		if p.ContentType == "application/pdf" || p.ContentType == "text/plain" {
+			blockType = "document"
+		}
+		return param.Override[anthropic.ContentBlockParamUnion](map[string]any{
+			"type":   blockType,
+			"source": map[string]any{"type": "file", "file_id": id},
+		}), nil
+	}
+
+	// Anthropic fetches https images and PDFs itself, no need to download and re-encode them
+	if strings.HasPrefix(p.Text, "https://") {
+		switch {
+		case p.ContentType == "application/pdf":
+			return anthropic.NewDocumentBlock(anthropic.URLPDFSourceParam{URL: p.Text}), nil
+		case strings.HasPrefix(p.ContentType, "image/"):
+			return anthropic.NewImageBlock(anthropic.URLImageSourceParam{URL: p.Text}), nil
+		}
+	}
+
+	// the other URLs are downloaded, e.g. http URLs and text documents
+	m, err := readMedia(ctx, p)
+	if err != nil {
+		return anthropic.ContentBlockParamUnion{}, fmt.Errorf("unable to read media part, err: %w", err)
+	}
+
+	switch m.contentType {
+	case "application/pdf":
+		return anthropic.NewDocumentBlock(anthropic.Base64PDFSourceParam{
+			Data: m.base64(),
+		}), nil
+	case "text/plain":
+		data, err := m.bytes()
+		if err != nil {
+			return anthropic.ContentBlockParamUnion{}, fmt.Errorf("unable to read media part, err: %w", err)
+		}
+		return anthropic.NewDocumentBlock(anthropic.PlainTextSourceParam{
+			Data: string(data),
+		}), nil
+	default:
+		if err := validateImage(m); err != nil {
+			return anthropic.ContentBlockParamUnion{}, err
+		}
+		return anthropic.NewImageBlockBase64(m.contentType, m.base64()), nil
+	}
+}
+
+// toAnthropicToolResult translates an [ai.ToolResponse] part to an anthropic tool_result block.
+// Outputs made of media parts are sent as nested image blocks so the model can see them,
+// anything else is sent as JSON text.
+func toAnthropicToolResult(ctx context.Context, p *ai.Part) (anthropic.ContentBlockParamUnion, error) {
+	toolResp := p.ToolResponse
+	if toolErr, ok := toolResp.Output.(error); ok {
+		return anthropic.NewToolResultBlock(toolResp.Ref, toolErr.Error(), true), nil
+	}
+	isError, _ := p.Metadata[ToolErrorMetadataKey].(bool)
+
+	if parts := toolOutputParts(toolResp.Output); parts != nil {
+		content := make([]anthropic.ToolResultBlockParamContentUnion, 0, len(parts))
+		for _, part := range parts {
+			switch {
+			case part.IsMedia():
+				m, err := readMedia(ctx, part)
+				if err != nil {
+					return anthropic.ContentBlockParamUnion{}, fmt.Errorf("unable to read tool response media, err: %w", err)
+				}
+				if err := validateImage(m); err != nil {
+					return anthropic.ContentBlockParamUnion{}, err
+				}
+				content = append(content, anthropic.ToolResultBlockParamContentUnion{
+					OfImage: &anthropic.ImageBlockParam{
+						Source: anthropic.ImageBlockParamSourceUnion{
+							OfBase64: &anthropic.Base64ImageSourceParam{
+								MediaType: anthropic.Base64ImageSourceMediaType(m.contentType),
+								Data:      m.base64(),
+							},
+						},
+					},
+				})
+			case part.IsText():
+				content = append(content, anthropic.ToolResultBlockParamContentUnion{
+					OfText: &anthropic.TextBlockParam{Text: part.Text},
+				})
+			default:
+				return anthropic.ContentBlockParamUnion{}, fmt.Errorf("unsupported part in tool response: %v", part.Kind)
+			}
+		}
+		block := &anthropic.ToolResultBlockParam{
+			ToolUseID: toolResp.Ref,
+			Content:   content,
+		}
+		if isError {
+			block.IsError = anthropic.Bool(true)
+		}
+		return anthropic.ContentBlockParamUnion{OfToolResult: block}, nil
+	}
+
+	output, err := json.Marshal(toolResp.Output)
+	if err != nil {
+		return anthropic.ContentBlockParamUnion{}, fmt.Errorf("unable to parse tool response, err: %w", err)
+	}
+	return anthropic.NewToolResultBlock(toolResp.Ref, string(output), isError), nil
+}
+
+// toolOutputParts returns the parts of a tool output made of [ai.Part] values,
+// or nil when the output holds no media and should be sent as plain JSON
+func toolOutputParts(output any) []*ai.Part {
+	var parts []*ai.Part
+	switch o := output.(type) {
+	case *ai.Part:
+		parts = []*ai.Part{o}
+	case []*ai.Part:
+		parts = o
+	case map[string]any, []any:
+		// outputs that went through a JSON round trip (e.g. resumed requests)
+		// keep the part shape, decode them back when they carry media
+		b, err := json.Marshal(o)
+		if err != nil {
+			return nil
+		}
+		if _, ok := o.(map[string]any); ok {
+			b = append(append([]byte("["), b...), ']')
+		}
+		if err := json.Unmarshal(b, &parts); err != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	hasMedia := false
+	for _, p := range parts {
+		if p == nil {
+			return nil
+		}
+		if p.IsMedia() {
+			hasMedia = true
+		}
+	}
+	if !hasMedia {
+		return nil
+	}
+	return parts
+}
 
+// RawMessage returns the Anthropic message a response was translated from,
+// holding the data Genkit doesn't model such as the message ID.
+// After continuations or repairs it is the last message received.
+func RawMessage(r *ai.ModelResponse) *anthropic.Message {
+	if r == nil {
+		return nil
+	}
+	m, _ := r.Custom.(*anthropic.Message)
+	return m
+}
+
+// toGenkitFinishReason translates the stop_reason of a message to a finish
+// reason, with a message explaining the ones callers may need to act on
+func toGenkitFinishReason(m *anthropic.Message) (ai.FinishReason, string) {
 	switch m.StopReason {
+	case anthropic.StopReasonEndTurn:
+		return ai.FinishReasonStop, ""
 	case anthropic.StopReasonMaxTokens:
-		r.FinishReason = ai.FinishReasonLength
+		return ai.FinishReasonLength, "reached the max_tokens limit"
 	case anthropic.StopReasonStopSequence:
-		r.FinishReason = ai.FinishReasonStop
-	case anthropic.StopReasonEndTurn:
-		r.FinishReason = ai.FinishReasonStop
+		return ai.FinishReasonStop, fmt.Sprintf("stop sequence %q", m.StopSequence)
 	case anthropic.StopReasonToolUse:
-		r.FinishReason = ai.FinishReasonInterrupted
+		// Claude ended its turn to get the results of the tool requests
+		return ai.FinishReasonStop, ""
+	case anthropic.StopReasonPauseTurn:
+		return ai.FinishReasonOther, "pause_turn: send the response back as is to let Claude continue"
+	case anthropic.StopReasonRefusal:
+		return ai.FinishReasonBlocked, "refusal: Claude declined to answer"
+	case "":
+		return ai.FinishReasonUnknown, ""
 	default:
-		r.FinishReason = ai.FinishReasonUnknown
+		return ai.FinishReasonUnknown, fmt.Sprintf("unknown stop reason %q", m.StopReason)
 	}
+}
+
+// anthropicToGenkitResponse translates an Anthropic Message to [ai.ModelResponse]
+func anthropicToGenkitResponse(m *anthropic.Message) (*ai.ModelResponse, error) {
+	r := ai.ModelResponse{}
 
-	msg := &ai.Message{}
+	r.FinishReason, r.FinishMessage = toGenkitFinishReason(m)
+
+	msg := &ai.Message{Content: make([]*ai.Part, 0, len(m.Content))}
 	msg.Role = ai.RoleModel
 	for _, part := range m.Content {
 		var p *ai.Part
 		switch part.AsAny().(type) {
 		case anthropic.TextBlock:
 			p = ai.NewTextPart(string(part.Text))
+			if len(part.Citations) > 0 {
+				citations := make([]*Citation, 0, len(part.Citations))
+				for _, c := range part.Citations {
+					citations = append(citations, fromAnthropicCitation(c))
+				}
+				p.Metadata = map[string]any{CitationsMetadataKey: citations}
+			}
 		case anthropic.ToolUseBlock:
 			p = ai.NewToolRequestPart(&ai.ToolRequest{
 				Ref:   part.ID,
 				Input: part.Input,
 				Name:  part.Name,
 			})
+		case anthropic.ThinkingBlock:
+			p = ai.NewReasoningPart(part.Thinking, nil)
+			p.Metadata = map[string]any{SignatureMetadataKey: part.Signature}
+		case anthropic.RedactedThinkingBlock:
+			p = ai.NewReasoningPart("", nil)
+			p.Metadata = map[string]any{RedactedThinkingMetadataKey: part.Data}
+		case anthropic.ServerToolUseBlock, anthropic.WebSearchToolResultBlock:
+			sp, err := serverBlockPart(part.RawJSON())
+			if err != nil {
+				return nil, err
+			}
+			p = sp
 		default:
-			return nil, fmt.Errorf("unknown part: %#v", part)
+			if !isServerBlock(part.Type) {
+				return nil, fmt.Errorf("unknown part: %#v", part)
+			}
+			// server tool blocks not yet modeled by the SDK, e.g. web_fetch_tool_result
+			sp, err := serverBlockPart(part.RawJSON())
+			if err != nil {
+				return nil, err
+			}
+			p = sp
 		}
 
 		//If the part is a tool use, we need to handle it differently; DON'T add it to the message content
@@ -432,10 +1924,34 @@ func anthropicToGenkitResponse(m *anthropic.Message) (*ai.ModelResponse, error)
 		msg.Content = append(msg.Content, p)
 	}
 
+	if container, err := containerMetadata(m); err != nil {
+		return nil, err
+	} else if container != nil {
+		msg.Metadata = map[string]any{containerMetadataKey: container}
+	}
+	if edits, err := contextEdits(m); err != nil {
+		return nil, err
+	} else if edits != nil {
+		if msg.Metadata == nil {
+			msg.Metadata = map[string]any{}
+		}
+		msg.Metadata[ContextEditsMetadataKey] = edits
+	}
+
 	r.Message = msg
+	r.Custom = m
 	r.Usage = &ai.GenerationUsage{
-		InputTokens:  int(m.Usage.InputTokens),
-		OutputTokens: int(m.Usage.OutputTokens),
+		InputTokens:         int(m.Usage.InputTokens),
+		OutputTokens:        int(m.Usage.OutputTokens),
+		CachedContentTokens: int(m.Usage.CacheReadInputTokens),
+		TotalTokens: int(m.Usage.InputTokens + m.Usage.CacheCreationInputTokens +
+			m.Usage.CacheReadInputTokens + m.Usage.OutputTokens),
+	}
+	if m.Usage.CacheCreationInputTokens > 0 || m.Usage.CacheReadInputTokens > 0 {
+		r.Usage.Custom = map[string]float64{
+			UsageCacheCreationInputTokens: float64(m.Usage.CacheCreationInputTokens),
+			UsageCacheReadInputTokens:     float64(m.Usage.CacheReadInputTokens),
+		}
 	}
 	return &r, nil
 }
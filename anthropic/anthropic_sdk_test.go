@@ -242,7 +242,7 @@ func TestAnthropicSDK_Generate(t *testing.T) {
 			}
 
 			// Here we only test request conversion logic, not actual API calls
-			resp, err := anthropicGenerate(ctx, plugin.client, "claude-3-5-sonnet", tt.request, nil)
+			resp, err := anthropicGenerate(ctx, plugin.messages, "claude-3-5-sonnet", tt.request, nil)
 
 			if tt.expectError && err == nil {
 				t.Errorf("expected error but got none")
@@ -250,7 +250,7 @@ func TestAnthropicSDK_Generate(t *testing.T) {
 			if !tt.expectError && err != nil {
 				// Since we're using a test API Key, actual calls will fail, which is expected
 				// We mainly test that request conversion logic doesn't error
-				if _, convErr := toAnthropicRequest("claude-3-5-sonnet", tt.request); convErr != nil {
+				if _, convErr := toAnthropicRequest(context.Background(), "claude-3-5-sonnet", tt.request); convErr != nil {
 					t.Errorf("request conversion failed: %v", convErr)
 				}
 			}
@@ -289,10 +289,10 @@ func TestAnthropicSDK_StreamingGenerate(t *testing.T) {
 		}
 
 		// Test streaming generation (will fail with test API Key, but we verify logic)
-		_, err = anthropicGenerate(ctx, plugin.client, "claude-3-5-sonnet", request, callback)
+		_, err = anthropicGenerate(ctx, plugin.messages, "claude-3-5-sonnet", request, callback)
 
 		// Since we're using test API Key, actual calls will fail, but we verify request conversion logic
-		if _, convErr := toAnthropicRequest("claude-3-5-sonnet", request); convErr != nil {
+		if _, convErr := toAnthropicRequest(context.Background(), "claude-3-5-sonnet", request); convErr != nil {
 			t.Errorf("streaming request conversion failed: %v", convErr)
 		}
 	})
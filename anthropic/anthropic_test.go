@@ -17,10 +17,45 @@
 package anthropic
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
 	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
+	"github.com/firebase/genkit/go/genkit"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestAnthropic(t *testing.T) {
@@ -47,7 +82,7 @@ func TestAnthropic(t *testing.T) {
 		},
 	}
 	t.Run("to anthropic request", func(t *testing.T) {
-		ar, err := toAnthropicRequest("claude-3.7-opus", req)
+		ar, err := toAnthropicRequest(context.Background(), "claude-3.7-opus", req)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -112,8 +147,8 @@ func TestAnthropic(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		if r != anthropic.MessageParamRoleAssistant {
-			t.Errorf("want: %q, got: %q", anthropic.MessageParamRoleAssistant, r)
+		if r != anthropic.MessageParamRoleUser {
+			t.Errorf("want: %q, got: %q", anthropic.MessageParamRoleUser, r)
 		}
 		r, err = toAnthropicRole("unknown")
 		if err == nil {
@@ -121,3 +156,5523 @@ func TestAnthropic(t *testing.T) {
 		}
 	})
 }
+
+func TestToAnthropicToolChoice(t *testing.T) {
+	tools := []*ai.ToolDefinition{{Name: "foo-tool"}}
+
+	tests := []struct {
+		name         string
+		choice       *ToolChoice
+		genkitChoice ai.ToolChoice
+		check        func(anthropic.ToolChoiceUnionParam) bool
+		expectError  bool
+	}{
+		{
+			name:  "unset choice sends nothing",
+			check: func(tc anthropic.ToolChoiceUnionParam) bool { return tc.GetType() == nil },
+		},
+		{
+			name:         "genkit required maps to any",
+			genkitChoice: ai.ToolChoiceRequired,
+			check:        func(tc anthropic.ToolChoiceUnionParam) bool { return tc.OfAny != nil },
+		},
+		{
+			name:         "genkit none maps to none",
+			genkitChoice: ai.ToolChoiceNone,
+			check:        func(tc anthropic.ToolChoiceUnionParam) bool { return tc.OfNone != nil },
+		},
+		{
+			name:         "config takes precedence over genkit choice",
+			choice:       &ToolChoice{Type: ToolChoiceAuto},
+			genkitChoice: ai.ToolChoiceNone,
+			check:        func(tc anthropic.ToolChoiceUnionParam) bool { return tc.OfAuto != nil },
+		},
+		{
+			name:   "specific tool",
+			choice: &ToolChoice{Type: ToolChoiceTool, Name: "foo-tool"},
+			check: func(tc anthropic.ToolChoiceUnionParam) bool {
+				return tc.OfTool != nil && tc.OfTool.Name == "foo-tool"
+			},
+		},
+		{
+			name:   "disable parallel tool use",
+			choice: &ToolChoice{Type: ToolChoiceAny, DisableParallelToolUse: true},
+			check: func(tc anthropic.ToolChoiceUnionParam) bool {
+				return tc.OfAny != nil && tc.OfAny.DisableParallelToolUse.Value
+			},
+		},
+		{
+			name:        "specific tool without name",
+			choice:      &ToolChoice{Type: ToolChoiceTool},
+			expectError: true,
+		},
+		{
+			name:        "specific tool not in request",
+			choice:      &ToolChoice{Type: ToolChoiceTool, Name: "bar-tool"},
+			expectError: true,
+		},
+		{
+			name:        "unknown type",
+			choice:      &ToolChoice{Type: "sometimes"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := toAnthropicToolChoice(tt.choice, tt.genkitChoice, tools)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("should have failed, got: %#v", tc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(tc) {
+				t.Errorf("unexpected tool choice: %#v", tc)
+			}
+		})
+	}
+}
+
+func TestToAnthropicInputSchema(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"properties": {
+			"id": {"type": "string", "pattern": "^[A-Z]{3}-[0-9]+$"},
+			"kind": {"const": "order"},
+			"target": {"oneOf": [{"type": "string"}, {"type": "integer"}]}
+		},
+		"required": ["id"],
+		"additionalProperties": false
+	}`
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool, err := DefineToolWithJSONSchema(g, "lookup", "Look up an order", []byte(schema), func(ctx *ai.ToolContext, input any) (string, error) {
+		return "", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		schema map[string]any
+		want   string
+	}{
+		{
+			name:   "raw schema",
+			schema: tool.Definition().InputSchema,
+			want:   schema,
+		},
+		{
+			name:   "schema without type",
+			schema: map[string]any{"properties": map[string]any{"q": map[string]any{"type": "string"}}},
+			want:   `{"type": "object", "properties": {"q": {"type": "string"}}}`,
+		},
+		{
+			name:   "non object schema",
+			schema: map[string]any{"type": "string"},
+			want:   `{"type": "object", "properties": null}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tools, err := toAnthropicTools([]*ai.ToolDefinition{{Name: "lookup", InputSchema: tt.schema}}, &GenerationConfig{}, "claude-sonnet-4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(tools[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				InputSchema map[string]any `json:"input_schema"`
+			}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			var want map[string]any
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.InputSchema, want) {
+				t.Errorf("want: %v, got: %v", want, got.InputSchema)
+			}
+		})
+	}
+}
+
+// newTestClient returns a client sending every request to the given handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) *anthropic.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return newClient(option.WithBaseURL(srv.URL), option.WithAPIKey("sk-ant-test-key"), option.WithMaxRetries(0))
+}
+
+// newStreamingTestClient returns a client whose Messages API answers every
+// request with the given server-sent events.
+func newStreamingTestClient(t *testing.T, events ...string) *anthropic.Client {
+	t.Helper()
+	return newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range events {
+			var typ struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal([]byte(e), &typ); err != nil {
+				t.Errorf("invalid test event %q: %v", e, err)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ.Type, e)
+		}
+	})
+}
+
+func TestAnthropicStreamToolInput(t *testing.T) {
+	client := newStreamingTestClient(t,
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-5-sonnet-20240620","usage":{"input_tokens":10,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"server_tool_use","id":"srvtoolu_1","name":"web_fetch","input":{}}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"url\":\"https://example.com\"}"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":12}}`,
+		`{"type":"message_stop"}`,
+	)
+
+	var partials []string
+	var complete []*ai.ToolRequest
+	cb := func(ctx context.Context, chunk *ai.ModelResponseChunk) error {
+		for _, p := range chunk.Content {
+			if !p.IsToolRequest() {
+				t.Errorf("expecting tool request chunk, got: %#v", p)
+				continue
+			}
+			if p.ToolRequest.Ref != "toolu_1" || p.ToolRequest.Name != "get_weather" {
+				t.Errorf("unexpected tool request: %#v", p.ToolRequest)
+			}
+			if p.Metadata[PartialMetadataKey] != true {
+				complete = append(complete, p.ToolRequest)
+				continue
+			}
+			partials = append(partials, p.Metadata[PartialJSONMetadataKey].(string))
+		}
+		return nil
+	}
+
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("weather in Paris?")}}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-3-5-sonnet", req, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the call is streamed as it starts, then with its arguments as they
+	// arrive, then with all of them
+	if want := []string{"", `{"city":`, `"Paris"}`}; !slices.Equal(partials, want) {
+		t.Errorf("want: %q, got: %q", want, partials)
+	}
+	if len(complete) != 1 {
+		t.Fatalf("expecting the complete tool request, got: %#v", complete)
+	}
+	if input, ok := complete[0].Input.(json.RawMessage); !ok || string(input) != `{"city":"Paris"}` {
+		t.Errorf("want: %q, got: %#v", `{"city":"Paris"}`, complete[0].Input)
+	}
+	if resp.FinishReason != ai.FinishReasonStop {
+		t.Errorf("want: %q, got: %q", ai.FinishReasonStop, resp.FinishReason)
+	}
+	if n := len(resp.Message.Content); n == 0 || !resp.Message.Content[n-1].IsToolRequest() {
+		t.Errorf("expecting a tool request, got: %#v", resp.Message.Content)
+	}
+}
+
+func TestAnthropicStreamChunks(t *testing.T) {
+	client := newStreamingTestClient(t,
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":10,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":"","signature":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"Paris is in France."}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig_1"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Let me check."}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"city\":\"Paris\"}"}}`,
+		`{"type":"content_block_stop","index":2}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":12}}`,
+		`{"type":"message_stop"}`,
+	)
+
+	var got []string
+	cb := func(ctx context.Context, chunk *ai.ModelResponseChunk) error {
+		if chunk.Role != ai.RoleModel {
+			t.Errorf("want: %q, got: %q", ai.RoleModel, chunk.Role)
+		}
+		for _, p := range chunk.Content {
+			got = append(got, fmt.Sprintf("%d:%s", chunk.Index, partKind(p)))
+		}
+		return nil
+	}
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("weather in Paris?")}}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"0:reasoning", "1:text", "2:toolRequest", "2:toolRequest", "2:toolRequest"}
+	if !slices.Equal(got, want) {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	reasoning := resp.Message.Content[0]
+	if !reasoning.IsReasoning() || reasoning.Text != "Paris is in France." || reasoning.Metadata[SignatureMetadataKey] != "sig_1" {
+		t.Fatalf("expecting the signed reasoning first, got: %#v", resp.Message.Content)
+	}
+	// the thinking is sent back as is with the tool results
+	blocks, err := toAnthropicParts(context.Background(), []*ai.Part{reasoning})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := blocks[0].OfThinking; b == nil || b.Thinking != "Paris is in France." || b.Signature != "sig_1" {
+		t.Errorf("expecting the thinking block, got: %#v", blocks[0])
+	}
+	redacted := ai.NewReasoningPart("", nil)
+	redacted.Metadata[RedactedThinkingMetadataKey] = "encrypted"
+	if blocks, err := toAnthropicParts(context.Background(), []*ai.Part{redacted}); err != nil || blocks[0].OfRedactedThinking == nil || blocks[0].OfRedactedThinking.Data != "encrypted" {
+		t.Errorf("expecting the redacted thinking block, got: %#v, %v", blocks, err)
+	}
+}
+
+// partKind names the kind of a streamed part
+func partKind(p *ai.Part) string {
+	switch {
+	case p.IsReasoning():
+		return "reasoning"
+	case p.IsToolRequest():
+		return "toolRequest"
+	default:
+		return "text"
+	}
+}
+
+// pngBase64 is a valid 1x1 PNG image
+const pngBase64 = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII="
+
+var png1x1, _ = base64.StdEncoding.DecodeString(pngBase64)
+
+func TestToAnthropicToolResult(t *testing.T) {
+	screenshot := ai.NewMediaPart("image/png", "data:image/png;base64,"+pngBase64)
+
+	t.Run("media output becomes image content", func(t *testing.T) {
+		block, err := toAnthropicToolResult(context.Background(), ai.NewToolResponsePart(&ai.ToolResponse{
+			Ref:    "toolu_1",
+			Name:   "screenshot",
+			Output: []*ai.Part{ai.NewTextPart("the screen"), screenshot},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := block.OfToolResult
+		if res == nil || res.ToolUseID != "toolu_1" {
+			t.Fatalf("expecting tool result for toolu_1, got: %#v", block)
+		}
+		if len(res.Content) != 2 {
+			t.Fatalf("expecting 2 content blocks, got: %d", len(res.Content))
+		}
+		if res.Content[0].OfText == nil || res.Content[0].OfText.Text != "the screen" {
+			t.Errorf("expecting text block, got: %#v", res.Content[0])
+		}
+		img := res.Content[1].OfImage
+		if img == nil || img.Source.OfBase64 == nil {
+			t.Fatalf("expecting base64 image block, got: %#v", res.Content[1])
+		}
+		if img.Source.OfBase64.MediaType != "image/png" {
+			t.Errorf("want: %q, got: %q", "image/png", img.Source.OfBase64.MediaType)
+		}
+	})
+
+	t.Run("decoded media output becomes image content", func(t *testing.T) {
+		block, err := toAnthropicToolResult(context.Background(), ai.NewToolResponsePart(&ai.ToolResponse{
+			Ref: "toolu_1",
+			Output: map[string]any{
+				"media": map[string]any{"contentType": "image/png", "url": "data:image/png;base64," + pngBase64},
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(block.OfToolResult.Content) != 1 || block.OfToolResult.Content[0].OfImage == nil {
+			t.Errorf("expecting a single image block, got: %#v", block.OfToolResult.Content)
+		}
+	})
+
+	t.Run("plain output is sent as JSON text", func(t *testing.T) {
+		block, err := toAnthropicToolResult(context.Background(), ai.NewToolResponsePart(&ai.ToolResponse{
+			Ref:    "toolu_1",
+			Output: map[string]any{"temperature": 20},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := block.OfToolResult.Content
+		if len(content) != 1 || content[0].OfText == nil || content[0].OfText.Text != `{"temperature":20}` {
+			t.Errorf("expecting JSON text block, got: %#v", content)
+		}
+	})
+}
+
+func TestToAnthropicToolResultError(t *testing.T) {
+	t.Run("typed tool error", func(t *testing.T) {
+		block, err := toAnthropicToolResult(context.Background(), ai.NewToolResponsePart(&ai.ToolResponse{
+			Ref:    "toolu_1",
+			Output: &ToolError{Message: "city not found"},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := block.OfToolResult
+		if !res.IsError.Value {
+			t.Errorf("expecting is_error to be set")
+		}
+		if len(res.Content) != 1 || res.Content[0].OfText.Text != "city not found" {
+			t.Errorf("expecting error message as content, got: %#v", res.Content)
+		}
+	})
+
+	t.Run("error metadata", func(t *testing.T) {
+		p := ai.NewToolResponsePart(&ai.ToolResponse{
+			Ref:    "toolu_1",
+			Output: map[string]any{"error": "timeout"},
+		})
+		p.Metadata = map[string]any{ToolErrorMetadataKey: true}
+		block, err := toAnthropicToolResult(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !block.OfToolResult.IsError.Value {
+			t.Errorf("expecting is_error to be set")
+		}
+	})
+
+	t.Run("successful result", func(t *testing.T) {
+		block, err := toAnthropicToolResult(context.Background(), ai.NewToolResponsePart(&ai.ToolResponse{
+			Ref:    "toolu_1",
+			Output: "ok",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.OfToolResult.IsError.Value {
+			t.Errorf("expecting is_error to be unset")
+		}
+	})
+}
+
+func TestAnthropicWebFetch(t *testing.T) {
+	var beta string
+	var sent map[string]any
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		beta = r.Header.Get("anthropic-beta")
+		if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","stop_reason":"end_turn",
+			"content":[
+				{"type":"server_tool_use","id":"srvtoolu_1","name":"web_fetch","input":{"url":"https://example.com"}},
+				{"type":"web_fetch_tool_result","tool_use_id":"srvtoolu_1","content":{"type":"web_fetch_result","url":"https://example.com",
+					"content":{"type":"document","source":{"type":"text","media_type":"text/plain","data":"Example Domain"}}}},
+				{"type":"text","text":"The page says Example Domain."}
+			],
+			"usage":{"input_tokens":10,"output_tokens":5}}`)
+	})
+
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{
+			WebFetch: &WebFetchConfig{AllowedDomains: []string{"example.com"}, MaxUses: 2},
+		},
+		Messages: []*ai.Message{ai.NewUserTextMessage("what does https://example.com say?")},
+	}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if beta != webFetchBeta {
+		t.Errorf("want: %q, got: %q", webFetchBeta, beta)
+	}
+	tools, _ := sent["tools"].([]any)
+	if len(tools) != 1 {
+		t.Fatalf("expecting 1 tool, got: %v", sent["tools"])
+	}
+	tool := tools[0].(map[string]any)
+	if tool["type"] != webFetchToolType || tool["max_uses"] != float64(2) {
+		t.Errorf("unexpected web fetch tool: %v", tool)
+	}
+
+	content := resp.Message.Content
+	if len(content) != 3 {
+		t.Fatalf("expecting 3 parts, got: %d", len(content))
+	}
+	if !content[0].IsCustom() || content[0].Custom["type"] != "server_tool_use" {
+		t.Errorf("expecting server_tool_use custom part, got: %#v", content[0])
+	}
+	if !content[1].IsCustom() || content[1].Custom["type"] != "web_fetch_tool_result" {
+		t.Errorf("expecting web_fetch_tool_result custom part, got: %#v", content[1])
+	}
+	if resp.Text() != "The page says Example Domain." {
+		t.Errorf("unexpected text: %q", resp.Text())
+	}
+
+	// server blocks are sent back untouched on the next turn
+	blocks, err := toAnthropicParts(context.Background(), content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(blocks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"tool_use_id":"srvtoolu_1"`) {
+		t.Errorf("unexpected block: %s", b)
+	}
+}
+
+func TestAnthropicComputerUse(t *testing.T) {
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{
+			Computer: &ComputerUseConfig{DisplayWidthPx: 1024, DisplayHeightPx: 768},
+		},
+		Messages: []*ai.Message{ai.NewUserTextMessage("open the browser")},
+		Tools:    []*ai.ToolDefinition{builtinToolDefinition(ComputerToolName)},
+	}
+
+	t.Run("computer tool is sent as the built-in type", func(t *testing.T) {
+		ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(ar.Tools)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `[{"display_height_px":768,"display_width_px":1024,"name":"computer","type":"computer_20250124"}]`
+		if string(b) != want {
+			t.Errorf("want: %s, got: %s", want, b)
+		}
+	})
+
+	t.Run("beta depends on the model generation", func(t *testing.T) {
+		c, _ := configFromRequest(req)
+		betas, err := betaFeatures(c, req, "claude-3-5-sonnet-latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(betas) != 1 || betas[0] != "computer-use-2024-10-22" {
+			t.Errorf("unexpected betas: %v", betas)
+		}
+	})
+
+	t.Run("computer tool requires the display config", func(t *testing.T) {
+		_, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", &ai.ModelRequest{
+			Messages: req.Messages,
+			Tools:    req.Tools,
+		})
+		if err == nil {
+			t.Errorf("should have failed without display config")
+		}
+	})
+}
+
+// builtinToolDefinition returns the definition of a tool defined to execute
+// the Anthropic defined tool with the given name, e.g. with [DefineBashTool]
+func builtinToolDefinition(name string) *ai.ToolDefinition {
+	return &ai.ToolDefinition{Name: name, InputSchema: map[string]any{builtinToolKey: name}}
+}
+
+func TestBuiltinToolFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		tool        string
+		model       string
+		wantType    string
+		wantBeta    string
+		expectError bool
+	}{
+		{name: "regular tool", tool: "foo-tool", model: "claude-sonnet-4-20250514"},
+		{name: "text editor on claude 4", tool: TextEditorToolName, model: "claude-sonnet-4-20250514", wantType: "text_editor_20250429"},
+		{name: "text editor on claude 3.7", tool: LegacyTextEditorToolName, model: "claude-3-7-sonnet-latest", wantType: "text_editor_20250124"},
+		{name: "text editor on claude 3.5", tool: LegacyTextEditorToolName, model: "claude-3-5-sonnet-latest", wantType: "text_editor_20241022", wantBeta: "computer-use-2024-10-22"},
+		{name: "legacy text editor on claude 4", tool: LegacyTextEditorToolName, model: "claude-opus-4-20250514", expectError: true},
+		{name: "bash on claude 4", tool: BashToolName, model: "claude-opus-4-20250514", wantType: "bash_20250124"},
+		{name: "bash on claude 3.5", tool: BashToolName, model: "claude-3-5-haiku-latest", wantType: "bash_20241022", wantBeta: "computer-use-2024-10-22"},
+		{name: "claude 4 text editor on claude 3.7", tool: TextEditorToolName, model: "claude-3-7-sonnet-latest", expectError: true},
+		{name: "memory", tool: MemoryToolName, model: "claude-sonnet-4-20250514", wantType: "memory_20250818", wantBeta: contextManagementBeta},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builtin, err := builtinToolFor(builtinToolDefinition(tt.tool), &GenerationConfig{}, tt.model)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("should have failed, got: %#v", builtin)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantType == "" {
+				if builtin != nil {
+					t.Errorf("expecting a regular tool, got: %#v", builtin)
+				}
+				return
+			}
+			if builtin.params["type"] != tt.wantType {
+				t.Errorf("want: %q, got: %q", tt.wantType, builtin.params["type"])
+			}
+			if builtin.params["name"] != tt.tool {
+				t.Errorf("want: %q, got: %q", tt.tool, builtin.params["name"])
+			}
+			if builtin.beta != tt.wantBeta {
+				t.Errorf("want: %q, got: %q", tt.wantBeta, builtin.beta)
+			}
+		})
+	}
+
+	t.Run("tools named after a builtin tool", func(t *testing.T) {
+		ctx := context.Background()
+		g, err := genkit.Init(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bash := DefineBashTool(g, func(ctx *ai.ToolContext, input BashCommand) (string, error) {
+			return "ran " + input.Command, nil
+		})
+		if builtin, err := builtinToolFor(bash.Definition(), &GenerationConfig{}, "claude-sonnet-4-20250514"); err != nil || builtin == nil {
+			t.Errorf("expecting the builtin bash tool, got: %#v, %v", builtin, err)
+		}
+		out, err := bash.RunRaw(ctx, map[string]any{"command": "ls"})
+		if err != nil || out != "ran ls" {
+			t.Errorf("want: %q, got: %v, %v", "ran ls", out, err)
+		}
+
+		for _, name := range []string{BashToolName, ComputerToolName, MemoryToolName, TextEditorToolName} {
+			def := &ai.ToolDefinition{Name: name, Description: "an application tool", InputSchema: map[string]any{"type": "object"}}
+			if builtin, err := builtinToolFor(def, &GenerationConfig{}, "claude-sonnet-4-20250514"); err != nil || builtin != nil {
+				t.Errorf("%s: expecting a regular tool, got: %#v, %v", name, builtin, err)
+			}
+		}
+	})
+}
+
+func TestAnthropicCodeExecution(t *testing.T) {
+	var beta string
+	var sent map[string]any
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		beta = r.Header.Get("anthropic-beta")
+		if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","stop_reason":"end_turn",
+			"container":{"id":"container_1","expires_at":"2025-06-01T00:00:00Z"},
+			"content":[
+				{"type":"server_tool_use","id":"srvtoolu_1","name":"code_execution","input":{"code":"print(1+1)"}},
+				{"type":"code_execution_tool_result","tool_use_id":"srvtoolu_1","content":{"type":"code_execution_result","stdout":"2\\n","stderr":"","return_code":0,"content":[]}},
+				{"type":"text","text":"The result is 2."}
+			],
+			"usage":{"input_tokens":10,"output_tokens":5}}`)
+	})
+
+	req := &ai.ModelRequest{
+		Config:   &GenerationConfig{CodeExecution: true, Container: "container_0"},
+		Messages: []*ai.Message{ai.NewUserTextMessage("compute 1+1 with python")},
+	}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if beta != codeExecutionBeta {
+		t.Errorf("want: %q, got: %q", codeExecutionBeta, beta)
+	}
+	if sent["container"] != "container_0" {
+		t.Errorf("want: %q, got: %v", "container_0", sent["container"])
+	}
+	if id := ContainerID(resp); id != "container_1" {
+		t.Errorf("want: %q, got: %q", "container_1", id)
+	}
+	if p := resp.Message.Content[1]; !p.IsCustom() || p.Custom["type"] != "code_execution_tool_result" {
+		t.Errorf("expecting code_execution_tool_result custom part, got: %#v", p)
+	}
+}
+
+func TestAnthropicMCPConnector(t *testing.T) {
+	var beta string
+	var sent map[string]any
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		beta = r.Header.Get("anthropic-beta")
+		if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","stop_reason":"end_turn",
+			"content":[
+				{"type":"mcp_tool_use","id":"mcptoolu_1","name":"echo","server_name":"example","input":{"text":"hi"}},
+				{"type":"mcp_tool_result","tool_use_id":"mcptoolu_1","is_error":false,"content":[{"type":"text","text":"hi"}]},
+				{"type":"text","text":"The server said hi."}
+			],
+			"usage":{"input_tokens":10,"output_tokens":5}}`)
+	})
+
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{
+			MCPServers: []MCPServer{{
+				Name:               "example",
+				URL:                "https://example.com/sse",
+				AuthorizationToken: "token",
+				AllowedTools:       []string{"echo"},
+			}},
+		},
+		Messages: []*ai.Message{ai.NewUserTextMessage("echo hi")},
+	}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if beta != mcpClientBeta {
+		t.Errorf("want: %q, got: %q", mcpClientBeta, beta)
+	}
+	servers, _ := sent["mcp_servers"].([]any)
+	if len(servers) != 1 {
+		t.Fatalf("expecting 1 mcp server, got: %v", sent["mcp_servers"])
+	}
+	server := servers[0].(map[string]any)
+	if server["type"] != "url" || server["authorization_token"] != "token" || server["tool_configuration"] == nil {
+		t.Errorf("unexpected mcp server: %v", server)
+	}
+	content := resp.Message.Content
+	if !content[0].IsCustom() || content[0].Custom["type"] != "mcp_tool_use" {
+		t.Errorf("expecting mcp_tool_use custom part, got: %#v", content[0])
+	}
+	if !content[1].IsCustom() || content[1].Custom["type"] != "mcp_tool_result" {
+		t.Errorf("expecting mcp_tool_result custom part, got: %#v", content[1])
+	}
+}
+
+func TestAnthropicCitations(t *testing.T) {
+	t.Run("citations are enabled on documents", func(t *testing.T) {
+		doc := ai.NewCustomPart(map[string]any{
+			"type":   "document",
+			"source": map[string]any{"type": "text", "media_type": "text/plain", "data": "The grass is green."},
+		})
+		req := &ai.ModelRequest{
+			Config:   &GenerationConfig{Citations: true},
+			Messages: []*ai.Message{ai.NewUserMessage(doc, ai.NewTextPart("what color is the grass?"))},
+		}
+		ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(ar.Messages[0].Content[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"citations":{"enabled":true}`) {
+			t.Errorf("expecting citations to be enabled, got: %s", b)
+		}
+		if _, ok := doc.Custom["citations"]; ok {
+			t.Errorf("request part should not be modified")
+		}
+	})
+
+	t.Run("citations are mapped to part metadata", func(t *testing.T) {
+		var m anthropic.Message
+		err := json.Unmarshal([]byte(`{"id":"msg_1","type":"message","role":"assistant","stop_reason":"end_turn",
+			"content":[{"type":"text","text":"the grass is green","citations":[
+				{"type":"char_location","cited_text":"The grass is green.","document_index":0,"document_title":"Facts","start_char_index":0,"end_char_index":20}
+			]}],
+			"usage":{"input_tokens":10,"output_tokens":5}}`), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := anthropicToGenkitResponse(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		citations := Citations(r.Message.Content[0])
+		if len(citations) != 1 {
+			t.Fatalf("expecting 1 citation, got: %d", len(citations))
+		}
+		want := &Citation{Type: "char_location", CitedText: "The grass is green.", DocumentTitle: "Facts", EndCharIndex: 20}
+		if *citations[0] != *want {
+			t.Errorf("want: %#v, got: %#v", want, citations[0])
+		}
+	})
+
+	t.Run("citations decoded from JSON", func(t *testing.T) {
+		want := &Citation{Type: "search_result_location", CitedText: "The grass is green.", Source: "https://example.com/grass", SearchResultIndex: 1, EndBlockIndex: 1}
+		p := ai.NewTextPart("the grass is green")
+		p.Metadata = map[string]any{CitationsMetadataKey: []*Citation{want}}
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded ai.Part
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		citations := Citations(&decoded)
+		if len(citations) != 1 || *citations[0] != *want {
+			t.Errorf("want: %#v, got: %#v", want, citations)
+		}
+
+		decoded.Metadata[CitationsMetadataKey] = []map[string]any{{"type": "char_location", "citedText": "The sky is blue."}}
+		if citations := Citations(&decoded); len(citations) != 1 || citations[0].CitedText != "The sky is blue." {
+			t.Errorf("want: the citation of the map, got: %#v", citations)
+		}
+	})
+
+	t.Run("streamed citations are sent as chunks", func(t *testing.T) {
+		client := newStreamingTestClient(t,
+			`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":"","citations":[]}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"citations_delta","citation":{"type":"char_location","cited_text":"The grass is green.","document_index":0,"start_char_index":0,"end_char_index":20}}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"the grass is green"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+			`{"type":"message_stop"}`,
+		)
+		var streamed []*Citation
+		cb := func(ctx context.Context, chunk *ai.ModelResponseChunk) error {
+			for _, p := range chunk.Content {
+				streamed = append(streamed, Citations(p)...)
+			}
+			return nil
+		}
+		req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("what color is the grass?")}}
+		resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, cb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(streamed) != 1 || streamed[0].CitedText != "The grass is green." {
+			t.Errorf("unexpected streamed citations: %#v", streamed)
+		}
+		if len(Citations(resp.Message.Content[0])) != 1 {
+			t.Errorf("expecting citations on the final response")
+		}
+	})
+}
+
+func TestToAnthropicSearchResults(t *testing.T) {
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{Citations: true},
+		Docs: []*ai.Document{
+			ai.DocumentFromText("The grass is green.", map[string]any{
+				DocumentSourceMetadataKey: "https://example.com/grass",
+				DocumentTitleMetadataKey:  "Grass facts",
+			}),
+			ai.DocumentFromText("The sky is blue.", nil),
+		},
+		Messages: []*ai.Message{ai.NewUserTextMessage("what color is the grass?")},
+	}
+
+	ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := ar.Messages[0].Content
+	if len(content) != 3 {
+		t.Fatalf("expecting 2 search results and the prompt, got: %d blocks", len(content))
+	}
+	b, err := json.Marshal(content[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"citations":{"enabled":true},"content":[{"text":"The grass is green.","type":"text"}],"source":"https://example.com/grass","title":"Grass facts","type":"search_result"}`
+	if string(b) != want {
+		t.Errorf("want: %s, got: %s", want, b)
+	}
+	b, _ = json.Marshal(content[1])
+	if !strings.Contains(string(b), `"source":"document-1"`) {
+		t.Errorf("expecting a default source, got: %s", b)
+	}
+	if content[2].OfText == nil {
+		t.Errorf("expecting the prompt last, got: %#v", content[2])
+	}
+
+	c, _ := configFromRequest(req)
+	betas, err := betaFeatures(c, req, "claude-sonnet-4-20250514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(betas) != 1 || betas[0] != searchResultsBeta {
+		t.Errorf("unexpected betas: %v", betas)
+	}
+}
+
+func TestToAnthropicSearchResultsToolLoop(t *testing.T) {
+	req := &ai.ModelRequest{
+		Docs: []*ai.Document{ai.DocumentFromText("The grass is green.", nil)},
+		Messages: []*ai.Message{
+			ai.NewUserTextMessage("what color is the grass?"),
+			ai.NewModelMessage(ai.NewToolRequestPart(&ai.ToolRequest{Name: "lookup", Ref: "toolu_1", Input: "grass"})),
+			ai.NewMessage(ai.RoleTool, nil, ai.NewToolResponsePart(&ai.ToolResponse{Name: "lookup", Ref: "toolu_1", Output: "green"})),
+		},
+	}
+
+	ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ar.Messages) != 3 {
+		t.Fatalf("want: 3 messages, got: %d", len(ar.Messages))
+	}
+	content := ar.Messages[2].Content
+	if len(content) != 2 || content[0].OfToolResult == nil {
+		t.Fatalf("expecting the tool result first, got: %#v", content)
+	}
+	b, _ := json.Marshal(content[1])
+	if !strings.Contains(string(b), `"type":"search_result"`) {
+		t.Errorf("expecting the search result after the tool result, got: %s", b)
+	}
+}
+
+func TestToAnthropicMediaDocs(t *testing.T) {
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{Citations: true},
+		Docs: []*ai.Document{
+			{
+				Content:  []*ai.Part{ai.NewMediaPart("application/pdf", "data:application/pdf;base64,JVBERi0xLjQ=")},
+				Metadata: map[string]any{DocumentTitleMetadataKey: "Annual report"},
+			},
+			{Content: []*ai.Part{ai.NewMediaPart("image/png", "data:image/png;base64,"+pngBase64), ai.NewTextPart("a chart")}},
+		},
+		Messages: []*ai.Message{ai.NewUserTextMessage("summarize the report")},
+	}
+
+	ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := ar.Messages[0].Content
+	if len(content) != 4 {
+		t.Fatalf("expecting 3 document blocks and the prompt, got: %d blocks", len(content))
+	}
+	if doc := content[0].OfDocument; doc == nil || doc.Title.Value != "Annual report" || doc.Source.OfBase64 == nil || !doc.Citations.Enabled.Value {
+		t.Errorf("expecting the cited PDF document, got: %#v", content[0])
+	}
+	if content[1].OfImage == nil {
+		t.Errorf("expecting an image, got: %#v", content[1])
+	}
+	if doc := content[2].OfDocument; doc == nil || doc.Title.Value != "document-1" || doc.Source.OfText == nil || doc.Source.OfText.Data != "a chart" {
+		t.Errorf("expecting the text document, got: %#v", content[2])
+	}
+
+	c, _ := configFromRequest(req)
+	betas, err := betaFeatures(c, req, "claude-sonnet-4-20250514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(betas, searchResultsBeta) {
+		t.Errorf("unexpected betas: %v", betas)
+	}
+
+	req.Docs = []*ai.Document{{Content: []*ai.Part{ai.NewDataPart(`{"a":1}`)}}}
+	if _, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req); err == nil {
+		t.Error("expecting an error for a data document")
+	}
+}
+
+func TestDocumentCitations(t *testing.T) {
+	pdf := func(citations any) *ai.Part {
+		p := ai.NewMediaPart("application/pdf", "data:application/pdf;base64,JVBERi0xLjQ=")
+		if citations != nil {
+			p.Metadata = map[string]any{DocumentCitationsMetadataKey: citations}
+		}
+		return p
+	}
+	cited := func(b anthropic.ContentBlockParamUnion) string {
+		if b.OfDocument == nil || !b.OfDocument.Citations.Enabled.Valid() {
+			return "unset"
+		}
+		return fmt.Sprint(b.OfDocument.Citations.Enabled.Value)
+	}
+
+	tests := []struct {
+		name      string
+		citations bool
+		want      []string
+	}{
+		{name: "enabled per document", want: []string{"true", "false", "unset"}},
+		{name: "disabled per document", citations: true, want: []string{"true", "false", "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", &ai.ModelRequest{
+				Config:   &GenerationConfig{Citations: tt.citations},
+				Messages: []*ai.Message{ai.NewUserMessage(pdf(true), pdf(false), pdf(nil), ai.NewTextPart("compare"))},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range ar.Messages[0].Content[:3] {
+				got = append(got, cited(b))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("documents", func(t *testing.T) {
+		report := &ai.Document{Content: []*ai.Part{pdf(nil)}, Metadata: map[string]any{DocumentCitationsMetadataKey: false}}
+		ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", &ai.ModelRequest{
+			Config:   &GenerationConfig{Citations: true},
+			Docs:     []*ai.Document{report, ai.DocumentFromText("The grass is green.", nil)},
+			Messages: []*ai.Message{ai.NewUserTextMessage("summarize")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cited(ar.Messages[0].Content[0]); got != "false" {
+			t.Errorf("want: the citations of the report disabled, got: %s", got)
+		}
+		b, _ := json.Marshal(ar.Messages[0].Content[1])
+		if !strings.Contains(string(b), `"citations":{"enabled":true}`) {
+			t.Errorf("want: the citations of the search result enabled, got: %s", b)
+		}
+
+		_, err = toAnthropicRequest(context.Background(), "claude-sonnet-4", &ai.ModelRequest{
+			Docs: []*ai.Document{
+				ai.DocumentFromText("The grass is green.", map[string]any{DocumentCitationsMetadataKey: true}),
+				ai.DocumentFromText("The sky is blue.", nil),
+			},
+			Messages: []*ai.Message{ai.NewUserTextMessage("what color is the grass?")},
+		})
+		if err == nil {
+			t.Error("want: an error for search results with and without citations")
+		}
+	})
+}
+
+func TestDocumentInfo(t *testing.T) {
+	pdf := ai.NewMediaPart("application/pdf", "data:application/pdf;base64,JVBERi0xLjQ=")
+	pdf.Metadata = map[string]any{DocumentTitleMetadataKey: "Annual report", DocumentContextMetadataKey: "Published in 2024 by ACME"}
+	uploaded := NewFilePart(&File{ID: "file_1", MimeType: "application/pdf"})
+	uploaded.Metadata = map[string]any{DocumentTitleMetadataKey: "Uploaded report"}
+	report := &ai.Document{
+		Content:  []*ai.Part{ai.NewMediaPart("application/pdf", "data:application/pdf;base64,JVBERi0xLjQ=")},
+		Metadata: map[string]any{DocumentTitleMetadataKey: "Retrieved report", DocumentContextMetadataKey: "From the archive"},
+	}
+
+	ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", &ai.ModelRequest{
+		Docs:     []*ai.Document{report},
+		Messages: []*ai.Message{ai.NewUserMessage(pdf, uploaded, ai.NewTextPart("compare"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := ar.Messages[0].Content
+	want := []string{
+		`"context":"From the archive"`, `"title":"Retrieved report"`,
+		`"context":"Published in 2024 by ACME"`, `"title":"Annual report"`,
+		`"title":"Uploaded report"`,
+	}
+	blocks := []int{0, 0, 1, 1, 2}
+	for i, w := range want {
+		b, _ := json.Marshal(content[blocks[i]])
+		if !strings.Contains(string(b), w) {
+			t.Errorf("block %d: want: %s, got: %s", blocks[i], w, b)
+		}
+	}
+}
+
+func TestToAnthropicMediaBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		part  *ai.Part
+		check func(anthropic.ContentBlockParamUnion) bool
+	}{
+		{
+			name: "pdf becomes a base64 document",
+			part: ai.NewMediaPart("application/pdf", "data:application/pdf;base64,JVBERi0xLjQ="),
+			check: func(b anthropic.ContentBlockParamUnion) bool {
+				return b.OfDocument != nil && b.OfDocument.Source.OfBase64 != nil && b.OfDocument.Source.OfBase64.Data == "JVBERi0xLjQ="
+			},
+		},
+		{
+			name: "plain text becomes a text document",
+			part: ai.NewMediaPart("text/plain", "data:text/plain,hello"),
+			check: func(b anthropic.ContentBlockParamUnion) bool {
+				return b.OfDocument != nil && b.OfDocument.Source.OfText != nil && b.OfDocument.Source.OfText.Data == "hello"
+			},
+		},
+		{
+			name: "https image is sent by url",
+			part: ai.NewMediaPart("image/jpeg", "https://example.com/cat.jpg"),
+			check: func(b anthropic.ContentBlockParamUnion) bool {
+				return b.OfImage != nil && b.OfImage.Source.OfURL != nil && b.OfImage.Source.OfURL.URL == "https://example.com/cat.jpg"
+			},
+		},
+		{
+			name: "https pdf is sent by url",
+			part: ai.NewMediaPart("application/pdf", "https://example.com/report.pdf"),
+			check: func(b anthropic.ContentBlockParamUnion) bool {
+				return b.OfDocument != nil && b.OfDocument.Source.OfURL != nil
+			},
+		},
+		{
+			name: "image stays an image",
+			part: ai.NewMediaPart("image/png", "data:image/png;base64,"+pngBase64),
+			check: func(b anthropic.ContentBlockParamUnion) bool {
+				return b.OfImage != nil && b.OfImage.Source.OfBase64 != nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, err := toAnthropicMediaBlock(context.Background(), tt.part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(block) {
+				t.Errorf("unexpected block: %#v", block)
+			}
+		})
+	}
+
+	t.Run("invalid media fails", func(t *testing.T) {
+		if _, err := toAnthropicMediaBlock(context.Background(), ai.NewMediaPart("image/png", "not base64!")); err == nil {
+			t.Errorf("should have failed")
+		}
+	})
+
+	t.Run("downloaded", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/notes.txt":
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				fmt.Fprint(w, "hello")
+			case "/cat.png":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(png1x1)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer srv.Close()
+		plain := httptest.NewServer(srv.Config.Handler)
+		defer plain.Close()
+		ctx := withMediaConfig(context.Background(), newMediaConfig(0, srv.Client(), nil))
+
+		for _, tt := range []struct {
+			name string
+			part *ai.Part
+			want string
+		}{
+			{name: "https plain text", part: ai.NewMediaPart("text/plain", srv.URL+"/notes.txt"), want: "hello"},
+			{name: "https untyped text", part: ai.NewMediaPart("", srv.URL+"/notes.txt"), want: "hello"},
+			{name: "http plain text", part: ai.NewMediaPart("text/plain", plain.URL+"/notes.txt"), want: "hello"},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				block, err := toAnthropicMediaBlock(ctx, tt.part)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if block.OfDocument == nil || block.OfDocument.Source.OfText == nil || block.OfDocument.Source.OfText.Data != tt.want {
+					t.Errorf("expecting a %q text document, got: %#v", tt.want, block)
+				}
+			})
+		}
+
+		t.Run("http image", func(t *testing.T) {
+			block, err := toAnthropicMediaBlock(ctx, ai.NewMediaPart("image/png", plain.URL+"/cat.png"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.OfImage == nil || block.OfImage.Source.OfBase64 == nil || block.OfImage.Source.OfBase64.MediaType != "image/png" {
+				t.Errorf("expecting a base64 image, got: %#v", block)
+			}
+		})
+
+		t.Run("not found", func(t *testing.T) {
+			if _, err := toAnthropicMediaBlock(ctx, ai.NewMediaPart("text/plain", plain.URL+"/missing.txt")); err == nil {
+				t.Errorf("should have failed")
+			}
+		})
+
+		t.Run("data", func(t *testing.T) {
+			contentType, data, err := Data(ctx, ai.NewMediaPart("", plain.URL+"/cat.png"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != "image/png" || !bytes.Equal(data, png1x1) {
+				t.Errorf("want: the downloaded image, got: %q %q", contentType, data)
+			}
+		})
+
+		t.Run("too large", func(t *testing.T) {
+			ctx := withMediaConfig(ctx, newMediaConfig(4, srv.Client(), nil))
+			if _, _, err := Data(ctx, ai.NewMediaPart("", plain.URL+"/cat.png")); err == nil || !strings.Contains(err.Error(), "larger than 4 bytes") {
+				t.Errorf("want: a size error, got: %v", err)
+			}
+		})
+	})
+}
+
+func TestMediaFetchers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/storage/v1/b/docs/o/reports%2Fq1.pdf":
+			if got := r.Header.Get("Authorization"); got != "Bearer gcs-token" {
+				t.Errorf("want: %q, got: %q", "Bearer gcs-token", got)
+			}
+			w.Header().Set("Content-Type", "application/pdf")
+			fmt.Fprint(w, "%PDF-1.7")
+		case "/docs/reports/q1%20notes.txt":
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+				t.Errorf("want: a SigV4 signature, got: %q", auth)
+			}
+			if got := r.Header.Get("X-Amz-Security-Token"); got != "session" {
+				t.Errorf("want: %q, got: %q", "session", got)
+			}
+			fmt.Fprint(w, "hello")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "gcs-token")
+	t.Setenv("AWS_ENDPOINT_URL_S3", srv.URL)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+
+	t.Run("gs", func(t *testing.T) {
+		block, err := toAnthropicMediaBlock(context.Background(), ai.NewMediaPart("", "gs://docs/reports/q1.pdf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.OfDocument == nil || block.OfDocument.Source.OfBase64 == nil {
+			t.Errorf("expecting a pdf document, got: %#v", block)
+		}
+	})
+
+	t.Run("s3", func(t *testing.T) {
+		block, err := toAnthropicMediaBlock(context.Background(), ai.NewMediaPart("text/plain", "s3://docs/reports/q1 notes.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.OfDocument == nil || block.OfDocument.Source.OfText == nil || block.OfDocument.Source.OfText.Data != "hello" {
+			t.Errorf("expecting a text document, got: %#v", block)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, _, err := Data(context.Background(), ai.NewMediaPart("", "s3://docs/missing.txt")); err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("want: a not found error, got: %v", err)
+		}
+	})
+
+	t.Run("custom scheme", func(t *testing.T) {
+		ctx := withMediaConfig(context.Background(), newMediaConfig(0, nil, map[string]MediaFetcher{"mem": memFetcher{"notes/a.txt": "from memory"}}))
+		contentType, data, err := Data(ctx, ai.NewMediaPart("", "mem://notes/a.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "text/plain" || string(data) != "from memory" {
+			t.Errorf("want: the fetched text, got: %q %q", contentType, data)
+		}
+	})
+}
+
+func TestAnthropicMediaSettings(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	ctx := context.Background()
+	fake := &fakeMessages{text: "Hello"}
+	g, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{
+		Messages:           fake,
+		MediaDownloadLimit: 64,
+		MediaFetchers:      map[string]MediaFetcher{"mem": memFetcher{"notes/a.txt": "from memory", "notes/b.txt": strings.Repeat("a", 65)}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generate := func(ctx context.Context, uri string) error {
+		_, err := genkit.Generate(ctx, g, ai.WithModel(ModelClaudeSonnet4),
+			ai.WithMessages(ai.NewUserMessage(ai.NewTextPart("summarize"), ai.NewMediaPart("text/plain", uri))))
+		return err
+	}
+
+	t.Run("fetchers", func(t *testing.T) {
+		if err := generate(ctx, "mem://notes/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(fake.requests[len(fake.requests)-1].Messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), "from memory") {
+			t.Errorf("want: the fetched text, got: %s", b)
+		}
+	})
+
+	t.Run("download limit", func(t *testing.T) {
+		if err := generate(ctx, "mem://notes/b.txt"); err == nil || !strings.Contains(err.Error(), "larger than 64 bytes") {
+			t.Errorf("want: a size error, got: %v", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("the media should not be downloaded: %s", r.URL.Path)
+		}))
+		defer srv.Close()
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, _, err := Data(canceled, ai.NewMediaPart("text/plain", srv.URL+"/notes.txt")); !errors.Is(err, context.Canceled) {
+			t.Errorf("want: %v, got: %v", context.Canceled, err)
+		}
+	})
+}
+
+// memFetcher is a [MediaFetcher] of in-memory text files
+type memFetcher map[string]string
+
+func (f memFetcher) Fetch(_ context.Context, uri *url.URL) (io.ReadCloser, string, error) {
+	text, ok := f[uri.Host+uri.Path]
+	if !ok {
+		return nil, "", fmt.Errorf("%s not found", uri)
+	}
+	return io.NopCloser(strings.NewReader(text)), "text/plain; charset=utf-8", nil
+}
+
+func TestAnthropicFiles(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("anthropic-beta") != filesBeta {
+			t.Errorf("want: %q, got: %q", filesBeta, r.Header.Get("anthropic-beta"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/files":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("invalid upload: %v", err)
+			}
+			fmt.Fprint(w, `{"id":"file_1","type":"file","filename":"report.pdf","mime_type":"application/pdf","size_bytes":4,"created_at":"2025-06-01T00:00:00Z"}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/files":
+			fmt.Fprint(w, `{"data":[{"id":"file_1","type":"file","filename":"report.pdf","mime_type":"application/pdf","size_bytes":4,"created_at":"2025-06-01T00:00:00Z"}],"has_more":false}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/files/file_1":
+			fmt.Fprint(w, `{"id":"file_1","type":"file","filename":"report.pdf","mime_type":"application/pdf","size_bytes":4,"created_at":"2025-06-01T00:00:00Z"}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1/files/file_1":
+			fmt.Fprint(w, `{"id":"file_1","type":"file_deleted"}`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	files := (&Anthropic{client: client}).Files()
+	ctx := context.Background()
+
+	f, err := files.Upload(ctx, "report.pdf", "application/pdf", strings.NewReader("%PDF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != "file_1" || f.MimeType != "application/pdf" {
+		t.Errorf("unexpected file: %#v", f)
+	}
+	list, err := files.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "file_1" {
+		t.Errorf("unexpected files: %#v", list)
+	}
+	if _, err := files.Get(ctx, "file_1"); err != nil {
+		t.Error(err)
+	}
+	if err := files.Delete(ctx, "file_1"); err != nil {
+		t.Error(err)
+	}
+
+	t.Run("file parts reference the uploaded file", func(t *testing.T) {
+		req := &ai.ModelRequest{
+			Messages: []*ai.Message{ai.NewUserMessage(NewFilePart(f), ai.NewTextPart("summarize the report"))},
+		}
+		ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(ar.Messages[0].Content[0])
+		want := `{"source":{"file_id":"file_1","type":"file"},"type":"document"}`
+		if string(b) != want {
+			t.Errorf("want: %s, got: %s", want, b)
+		}
+		c, _ := configFromRequest(req)
+		betas, _ := betaFeatures(c, req, "claude-sonnet-4-20250514")
+		if len(betas) != 1 || betas[0] != filesBeta {
+			t.Errorf("unexpected betas: %v", betas)
+		}
+	})
+}
+
+func TestAnthropicPromptCaching(t *testing.T) {
+	cached := ai.NewTextPart("a very long document")
+	cached.Metadata = map[string]any{CacheControlMetadataKey: true}
+	doc := ai.NewCustomPart(map[string]any{
+		"type":   "document",
+		"source": map[string]any{"type": "text", "media_type": "text/plain", "data": "The grass is green."},
+	})
+	doc.Metadata = map[string]any{CacheControlMetadataKey: "ephemeral"}
+
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{CacheSystemPrompt: true, CacheTools: true},
+		Messages: []*ai.Message{
+			ai.NewSystemTextMessage("you are a helpful assistant"),
+			ai.NewUserMessage(cached, doc, ai.NewTextPart("summarize")),
+		},
+		Tools: []*ai.ToolDefinition{{Name: "foo-tool"}, builtinToolDefinition(BashToolName)},
+	}
+	ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ar.System[0].CacheControl.Type != "ephemeral" {
+		t.Errorf("expecting the system prompt to be cached")
+	}
+	content := ar.Messages[0].Content
+	if content[0].OfText.CacheControl.Type != "ephemeral" {
+		t.Errorf("expecting the first part to be cached")
+	}
+	b, _ := json.Marshal(content[1])
+	if !strings.Contains(string(b), `"cache_control":{"type":"ephemeral"}`) {
+		t.Errorf("expecting the raw document to be cached, got: %s", b)
+	}
+	if _, ok := doc.Custom["cache_control"]; ok {
+		t.Errorf("request part should not be modified")
+	}
+	if content[2].OfText.CacheControl.Type != "" {
+		t.Errorf("expecting the last part not to be cached")
+	}
+	if ar.Tools[0].OfTool.CacheControl.Type != "" {
+		t.Errorf("expecting only the last tool to be cached")
+	}
+	b, _ = json.Marshal(ar.Tools[1])
+	if !strings.Contains(string(b), `"cache_control":{"type":"ephemeral"}`) {
+		t.Errorf("expecting the last tool to be cached, got: %s", b)
+	}
+}
+
+func TestAnthropicPromptCachingTTL(t *testing.T) {
+	hour := ai.NewTextPart("a very long document")
+	hour.Metadata = map[string]any{CacheControlMetadataKey: CacheTTLOneHour}
+	fiveMinutes := ai.NewTextPart("another long document")
+	fiveMinutes.Metadata = map[string]any{CacheControlMetadataKey: map[string]any{"ttl": CacheTTLFiveMinutes}}
+
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{CacheSystemPrompt: true, CacheTTL: CacheTTLOneHour},
+		Messages: []*ai.Message{
+			ai.NewSystemTextMessage("you are a helpful assistant"),
+			ai.NewUserMessage(hour, fiveMinutes),
+		},
+	}
+	ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		block any
+		want  string
+	}{
+		{"system prompt", ar.System[0], `"cache_control":{"type":"ephemeral","ttl":"1h"}`},
+		{"one hour part", ar.Messages[0].Content[0], `"cache_control":{"type":"ephemeral","ttl":"1h"}`},
+		{"five minutes part", ar.Messages[0].Content[1], `"cache_control":{"type":"ephemeral","ttl":"5m"}`},
+	} {
+		b, _ := json.Marshal(tt.block)
+		if !strings.Contains(string(b), tt.want) {
+			t.Errorf("%s: want: %s, got: %s", tt.name, tt.want, b)
+		}
+	}
+
+	c, _ := configFromRequest(req)
+	betas, _ := betaFeatures(c, req, "claude-sonnet-4-20250514")
+	if len(betas) != 1 || betas[0] != extendedCacheTTLBeta {
+		t.Errorf("unexpected betas: %v", betas)
+	}
+}
+
+func TestAnthropicSystemMessages(t *testing.T) {
+	cached := ai.NewTextPart("the rules")
+	cached.Metadata = map[string]any{CacheControlMetadataKey: true}
+	marker := ai.NewTextPart("")
+	marker.Metadata = map[string]any{CacheControlMetadataKey: CacheTTLOneHour}
+	req := &ai.ModelRequest{
+		Messages: []*ai.Message{
+			ai.NewSystemMessage(ai.NewTextPart("you are a judge"), cached),
+			ai.NewUserTextMessage("hi"),
+			ai.NewSystemMessage(ai.NewTextPart("answer in French"), marker),
+		},
+	}
+	ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{"you are a judge", "the rules", "answer in French"}
+	if len(ar.System) != len(texts) {
+		t.Fatalf("want: %d system blocks, got: %d", len(texts), len(ar.System))
+	}
+	for i, text := range texts {
+		if ar.System[i].Text != text {
+			t.Errorf("want: %q, got: %q", text, ar.System[i].Text)
+		}
+	}
+	last, _ := json.Marshal(ar.System[2])
+	if ar.System[0].CacheControl.Type != "" || ar.System[1].CacheControl.Type != "ephemeral" || !strings.Contains(string(last), `"ttl":"1h"`) {
+		t.Errorf("want: the breakpoints of the parts, got: %+v", ar.System)
+	}
+	if len(ar.Messages) != 1 {
+		t.Errorf("want: 1 message, got: %d", len(ar.Messages))
+	}
+
+	req.Config = &GenerationConfig{CacheSystemPrompt: true}
+	req.Messages[2] = ai.NewSystemTextMessage("answer in French")
+	if ar, err = toAnthropicRequest(context.Background(), "claude-sonnet-4", req); err != nil {
+		t.Fatal(err)
+	}
+	if ar.System[2].CacheControl.Type != "ephemeral" {
+		t.Errorf("expecting the last system block to be cached")
+	}
+}
+
+func TestAnthropicCacheUsage(t *testing.T) {
+	var m anthropic.Message
+	err := json.Unmarshal([]byte(`{"id":"msg_1","type":"message","role":"assistant","stop_reason":"end_turn",
+		"content":[{"type":"text","text":"hello"}],
+		"usage":{"input_tokens":10,"output_tokens":5,"cache_creation_input_tokens":100,"cache_read_input_tokens":2000}}`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := anthropicToGenkitResponse(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Usage.CachedContentTokens != 2000 {
+		t.Errorf("want: %d, got: %d", 2000, r.Usage.CachedContentTokens)
+	}
+	if r.Usage.Custom[UsageCacheCreationInputTokens] != 100 {
+		t.Errorf("want: %d, got: %f", 100, r.Usage.Custom[UsageCacheCreationInputTokens])
+	}
+	if r.Usage.Custom[UsageCacheReadInputTokens] != 2000 {
+		t.Errorf("want: %d, got: %f", 2000, r.Usage.Custom[UsageCacheReadInputTokens])
+	}
+	if r.Usage.TotalTokens != 2115 {
+		t.Errorf("want: %d, got: %d", 2115, r.Usage.TotalTokens)
+	}
+}
+
+func TestAnthropicStreamUsage(t *testing.T) {
+	client := newStreamingTestClient(t,
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":10,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hello"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":25,"output_tokens":7}}`,
+		`{"type":"message_stop"}`,
+	)
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req,
+		func(context.Context, *ai.ModelResponseChunk) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Usage.InputTokens != 25 || resp.Usage.OutputTokens != 7 || resp.Usage.TotalTokens != 32 {
+		t.Errorf("unexpected usage: %+v", resp.Usage)
+	}
+}
+
+func TestAnthropicStreamUsageChunk(t *testing.T) {
+	events := func(text string, stop string) []string {
+		return []string{
+			`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":10,"cache_read_input_tokens":5,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			fmt.Sprintf(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":%q}}`, text),
+			`{"type":"content_block_stop","index":0}`,
+			fmt.Sprintf(`{"type":"message_delta","delta":{"stop_reason":%q},"usage":{"input_tokens":12,"output_tokens":20}}`, stop),
+			`{"type":"message_stop"}`,
+		}
+	}
+	n := 0
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		text, stop := "Hello", "max_tokens"
+		if n++; n > 1 {
+			text, stop = " world", "end_turn"
+		}
+		for _, e := range events(text, stop) {
+			var typ struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal([]byte(e), &typ)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ.Type, e)
+		}
+	})
+	req := &ai.ModelRequest{
+		Config:   &GenerationConfig{MaxContinuations: 1},
+		Messages: []*ai.Message{ai.NewUserTextMessage("hi")},
+	}
+	var usages []*ai.GenerationUsage
+	chunks := 0
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req,
+		func(_ context.Context, c *ai.ModelResponseChunk) error {
+			chunks++
+			if u := ChunkUsage(c); u != nil {
+				usages = append(usages, u)
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || ChunkUsage(&ai.ModelResponseChunk{}) != nil {
+		t.Fatalf("want: the usage in the final chunk only, got: %d usages in %d chunks", len(usages), chunks)
+	}
+	u := usages[0]
+	if u.InputTokens != 24 || u.OutputTokens != 40 || u.CachedContentTokens != 10 || u.Custom[UsageCacheReadInputTokens] != 10 {
+		t.Errorf("want: the usage of both calls, got: %+v", u)
+	}
+	if u.InputTokens != resp.Usage.InputTokens || u.OutputTokens != resp.Usage.OutputTokens || u.TotalTokens != resp.Usage.TotalTokens {
+		t.Errorf("want: the usage of the response %+v, got: %+v", resp.Usage, u)
+	}
+	resp.Usage.Custom["cost"] = 1
+	if _, ok := u.Custom["cost"]; ok {
+		t.Error("want: a copy of the usage")
+	}
+}
+
+func TestAnthropicAutoCache(t *testing.T) {
+	messages := []*ai.Message{
+		ai.NewSystemTextMessage("you are a helpful assistant"),
+		ai.NewUserTextMessage("hello"),
+		ai.NewModelTextMessage("hello, how can I help?"),
+		ai.NewUserTextMessage("tell me a joke"),
+	}
+
+	t.Run("system prompt and last-but-n message are cached", func(t *testing.T) {
+		ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", &ai.ModelRequest{
+			Config:   &GenerationConfig{AutoCache: &AutoCacheConfig{SkipMessages: 1}},
+			Messages: messages,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ar.System[0].CacheControl.Type != "ephemeral" {
+			t.Errorf("expecting the system prompt to be cached")
+		}
+		for i, m := range ar.Messages {
+			cached := m.Content[0].OfText.CacheControl.Type != ""
+			if cached != (i == 1) {
+				t.Errorf("message %d: unexpected cache breakpoint: %v", i, cached)
+			}
+		}
+	})
+
+	t.Run("short conversations only cache the system prompt", func(t *testing.T) {
+		ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", &ai.ModelRequest{
+			Config:   &GenerationConfig{AutoCache: &AutoCacheConfig{MinMessages: 4}},
+			Messages: messages,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ar.System[0].CacheControl.Type != "ephemeral" {
+			t.Errorf("expecting the system prompt to be cached")
+		}
+		for i, m := range ar.Messages {
+			if m.Content[0].OfText.CacheControl.Type != "" {
+				t.Errorf("message %d: unexpected cache breakpoint", i)
+			}
+		}
+	})
+
+	t.Run("the breakpoint limit is respected", func(t *testing.T) {
+		var parts []*ai.Part
+		for range maxCacheBreakpoints {
+			p := ai.NewTextPart("cached")
+			p.Metadata = map[string]any{CacheControlMetadataKey: true}
+			parts = append(parts, p)
+		}
+		ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", &ai.ModelRequest{
+			Config:   &GenerationConfig{AutoCache: &AutoCacheConfig{}},
+			Messages: []*ai.Message{messages[0], ai.NewUserMessage(parts...), ai.NewModelTextMessage("ok")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ar.System[0].CacheControl.Type != "" {
+			t.Errorf("expecting no automatic breakpoint on the system prompt")
+		}
+		if ar.Messages[1].Content[0].OfText.CacheControl.Type != "" {
+			t.Errorf("expecting no automatic breakpoint on the last message")
+		}
+	})
+}
+
+func TestAnthropicCountTokens(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages/count_tokens" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body["model"] != "claude-sonnet-4-20250514" {
+			t.Errorf("want: %q, got: %q", "claude-sonnet-4-20250514", body["model"])
+		}
+		if _, ok := body["max_tokens"]; ok {
+			t.Errorf("max_tokens is not a count_tokens parameter")
+		}
+		if system, _ := body["system"].([]any); len(system) != 1 {
+			t.Errorf("unexpected system prompt: %v", body["system"])
+		}
+		if tools, _ := body["tools"].([]any); len(tools) != 1 {
+			t.Errorf("unexpected tools: %v", body["tools"])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"input_tokens":42}`)
+	})
+
+	req := &ai.ModelRequest{
+		Messages: []*ai.Message{
+			ai.NewSystemTextMessage("you are a helpful assistant"),
+			ai.NewUserTextMessage("what's the weather in Paris?"),
+		},
+		Tools: []*ai.ToolDefinition{{
+			Name:        "weather",
+			Description: "returns the weather of a city",
+			InputSchema: map[string]any{"type": "object"},
+		}},
+	}
+	n, err := (&Anthropic{client: client, messages: &client.Messages}).CountTokens(context.Background(), "claude-sonnet-4", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 42 {
+		t.Errorf("want: %d, got: %d", 42, n)
+	}
+
+	if _, err := (&Anthropic{}).CountTokens(context.Background(), "claude-sonnet-4", req); err == nil {
+		t.Errorf("expecting an error when the plugin is not initialized")
+	}
+}
+
+func TestAnthropicContextWindowCheck(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages/count_tokens" {
+			t.Errorf("the request should not be sent: %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"input_tokens":199000}`)
+	})
+
+	newRequest := func(check ContextWindowCheck, text string) *ai.ModelRequest {
+		return &ai.ModelRequest{
+			Config: &GenerationConfig{
+				GenerationCommonConfig: ai.GenerationCommonConfig{MaxOutputTokens: 4096},
+				ContextWindowCheck:     check,
+			},
+			Messages: []*ai.Message{ai.NewUserTextMessage(text)},
+		}
+	}
+
+	t.Run("counted", func(t *testing.T) {
+		_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", newRequest(ContextWindowCheckCount, "hello"), nil)
+		var cwe *ContextWindowExceededError
+		if !errors.As(err, &cwe) {
+			t.Fatalf("expecting a context window error, got: %v", err)
+		}
+		if cwe.InputTokens != 199000 || cwe.MaxOutputTokens != 4096 || cwe.ContextWindow != 200000 || cwe.Estimated {
+			t.Errorf("unexpected error: %#v", cwe)
+		}
+	})
+
+	t.Run("counted from the converted request", func(t *testing.T) {
+		var downloads atomic.Int32
+		media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			downloads.Add(1)
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "notes")
+		}))
+		defer media.Close()
+
+		req := newRequest(ContextWindowCheckCount, "hello")
+		req.Messages[0].Content = append(req.Messages[0].Content, ai.NewMediaPart("text/plain", media.URL+"/notes.txt"))
+		_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+		var cwe *ContextWindowExceededError
+		if !errors.As(err, &cwe) {
+			t.Fatalf("expecting a context window error, got: %v", err)
+		}
+		if n := downloads.Load(); n != 1 {
+			t.Errorf("want: 1 download, got: %d", n)
+		}
+	})
+
+	t.Run("estimated", func(t *testing.T) {
+		_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", newRequest(ContextWindowCheckEstimate, strings.Repeat("a", 800000)), nil)
+		var cwe *ContextWindowExceededError
+		if !errors.As(err, &cwe) {
+			t.Fatalf("expecting a context window error, got: %v", err)
+		}
+		if cwe.InputTokens != 200000 || !cwe.Estimated {
+			t.Errorf("unexpected error: %#v", cwe)
+		}
+	})
+
+	t.Run("fits", func(t *testing.T) {
+		req := newRequest(ContextWindowCheckEstimate, "hello")
+		sent, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkContextWindow(context.Background(), &client.Messages, req, sent, nil); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestAnthropicMaxTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		model   string
+		config  *GenerationConfig
+		want    int64
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			model:  "claude-sonnet-4",
+			config: &GenerationConfig{},
+			want:   MaxNumberOfTokens,
+		},
+		{
+			name:   "default above the limit",
+			model:  "claude-3-haiku",
+			config: &GenerationConfig{},
+			want:   4096,
+		},
+		{
+			name:   "within the limit of the snapshot",
+			model:  "claude-opus-4",
+			config: &GenerationConfig{GenerationCommonConfig: ai.GenerationCommonConfig{MaxOutputTokens: 32000, Version: "claude-opus-4-1-20250805"}},
+			want:   32000,
+		},
+		{
+			name:    "above the limit",
+			model:   "claude-opus-4-1",
+			config:  &GenerationConfig{GenerationCommonConfig: ai.GenerationCommonConfig{MaxOutputTokens: 64000}},
+			wantErr: true,
+		},
+		{
+			name:   "clamped",
+			model:  "claude-opus-4-1",
+			config: &GenerationConfig{GenerationCommonConfig: ai.GenerationCommonConfig{MaxOutputTokens: 64000}, ClampMaxOutputTokens: true},
+			want:   32000,
+		},
+		{
+			name:   "extended output",
+			model:  "claude-3-7-sonnet",
+			config: &GenerationConfig{GenerationCommonConfig: ai.GenerationCommonConfig{MaxOutputTokens: 128000}, ExtendedOutput: true},
+			want:   128000,
+		},
+		{
+			name:   "unknown model",
+			model:  "claude-custom",
+			config: &GenerationConfig{GenerationCommonConfig: ai.GenerationCommonConfig{MaxOutputTokens: 500000}},
+			want:   500000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := toAnthropicRequest(context.Background(), tt.model, &ai.ModelRequest{
+				Config:   tt.config,
+				Messages: []*ai.Message{ai.NewUserTextMessage("hello")},
+			})
+			if tt.wantErr {
+				var mte *MaxOutputTokensExceededError
+				if !errors.As(err, &mte) {
+					t.Fatalf("expecting a max output tokens error, got: %v", err)
+				}
+				if mte.Model != "claude-opus-4-1-20250805" || mte.MaxOutputTokens != 64000 || mte.Limit != 32000 {
+					t.Errorf("unexpected error: %#v", mte)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.MaxTokens != tt.want {
+				t.Errorf("want: %d, got: %d", tt.want, req.MaxTokens)
+			}
+		})
+	}
+}
+
+func TestAnthropicBatches(t *testing.T) {
+	const batch = `{"id":"msgbatch_1","type":"message_batch","processing_status":%q,"request_counts":{"processing":%d,"succeeded":%d,"errored":%d,"canceled":0,"expired":0},"created_at":"2025-06-01T00:00:00Z","expires_at":"2025-06-02T00:00:00Z","ended_at":null,"archived_at":null,"cancel_initiated_at":null,"results_url":null}`
+	polls := 0
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/messages/batches":
+			var body struct {
+				Requests []struct {
+					CustomID string         `json:"custom_id"`
+					Params   map[string]any `json:"params"`
+				} `json:"requests"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Requests) != 2 || body.Requests[0].CustomID != "a" || body.Requests[0].Params["model"] != "claude-sonnet-4-20250514" {
+				t.Errorf("unexpected batch requests: %+v", body.Requests)
+			}
+			fmt.Fprintf(w, batch, "in_progress", 2, 0, 0)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/messages/batches/msgbatch_1":
+			polls++
+			if polls < 3 {
+				fmt.Fprintf(w, batch, "in_progress", 2, 0, 0)
+				return
+			}
+			fmt.Fprintf(w, batch, "ended", 0, 1, 1)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/messages/batches/msgbatch_1/results":
+			w.Header().Set("Content-Type", "application/x-jsonl")
+			fmt.Fprintln(w, `{"custom_id":"a","result":{"type":"succeeded","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hello"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}}}`)
+			fmt.Fprintln(w, `{"custom_id":"b","result":{"type":"errored","error":{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: too large"}}}}`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	batches := (&Anthropic{client: client}).Batches()
+	ctx := context.Background()
+
+	b, err := batches.Submit(ctx, []BatchRequest{
+		{CustomID: "a", Model: "claude-sonnet-4", Request: &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}},
+		{CustomID: "b", Model: "claude-sonnet-4", Request: &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != "msgbatch_1" || b.Ended() {
+		t.Errorf("unexpected batch: %#v", b)
+	}
+
+	results := map[string]*BatchResult{}
+	b, err = batches.WaitForBatch(ctx, b.ID, PollOptions{
+		Interval: time.Millisecond,
+		OnResult: func(r *BatchResult) error {
+			results[r.CustomID] = r
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polls != 3 || !b.Ended() || b.RequestCounts.Succeeded != 1 || b.RequestCounts.Errored != 1 {
+		t.Errorf("unexpected batch after %d polls: %#v", polls, b)
+	}
+	if r := results["a"]; r == nil || r.Err != nil || r.Response.Text() != "hello" {
+		t.Errorf("unexpected result: %#v", r)
+	}
+	var batchErr *BatchError
+	if r := results["b"]; r == nil || r.State != BatchResultErrored || !errors.As(r.Err, &batchErr) || batchErr.Type != "invalid_request_error" {
+		t.Errorf("unexpected result: %#v", r)
+	}
+}
+
+func TestAnthropicBatchCancel(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/messages/batches/msgbatch_1/cancel":
+			fmt.Fprint(w, `{"id":"msgbatch_1","type":"message_batch","processing_status":"canceling","request_counts":{"processing":3,"succeeded":0,"errored":0,"canceled":0,"expired":0},"created_at":"2025-06-01T00:00:00Z","expires_at":"2025-06-02T00:00:00Z"}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/messages/batches/msgbatch_1":
+			fmt.Fprint(w, `{"id":"msgbatch_1","type":"message_batch","processing_status":"ended","request_counts":{"processing":0,"succeeded":1,"errored":0,"canceled":1,"expired":1},"created_at":"2025-06-01T00:00:00Z","expires_at":"2025-06-02T00:00:00Z"}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/messages/batches/msgbatch_1/results":
+			w.Header().Set("Content-Type", "application/x-jsonl")
+			fmt.Fprintln(w, `{"custom_id":"a","result":{"type":"succeeded","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hello"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}}}`)
+			fmt.Fprintln(w, `{"custom_id":"b","result":{"type":"canceled"}}`)
+			fmt.Fprintln(w, `{"custom_id":"c","result":{"type":"expired"}}`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	batches := (&Anthropic{client: client}).Batches()
+	ctx := context.Background()
+
+	b, err := batches.Cancel(ctx, "msgbatch_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Status != "canceling" {
+		t.Errorf("want: %q, got: %q", "canceling", b.Status)
+	}
+
+	results := []*BatchResult{}
+	if _, err := batches.WaitForBatch(ctx, "msgbatch_1", PollOptions{
+		OnResult: func(r *BatchResult) error {
+			results = append(results, r)
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("unexpected results: %#v", results)
+	}
+	if results[1].State != BatchResultCanceled || !errors.Is(results[1].Err, ErrBatchRequestCanceled) {
+		t.Errorf("unexpected result: %#v", results[1])
+	}
+	if results[2].State != BatchResultExpired || !errors.Is(results[2].Err, ErrBatchRequestExpired) {
+		t.Errorf("unexpected result: %#v", results[2])
+	}
+
+	requests := []BatchRequest{{CustomID: "a"}, {CustomID: "b"}, {CustomID: "c"}, {CustomID: "d"}}
+	failed := FailedRequests(requests, results)
+	ids := []string{}
+	for _, r := range failed {
+		ids = append(ids, r.CustomID)
+	}
+	if strings.Join(ids, ",") != "b,c,d" {
+		t.Errorf("want: %q, got: %q", "b,c,d", strings.Join(ids, ","))
+	}
+}
+
+func TestAnthropicBatchJSONL(t *testing.T) {
+	const results = `{"custom_id":"a","result":{"type":"succeeded","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hello"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}}}
+{"custom_id":"b","result":{"type":"expired"}}
+`
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/messages/batches":
+			if r.Header.Get("anthropic-beta") != webFetchBeta {
+				t.Errorf("want: %q, got: %q", webFetchBeta, r.Header.Get("anthropic-beta"))
+			}
+			var body struct {
+				Requests []struct {
+					CustomID string         `json:"custom_id"`
+					Params   map[string]any `json:"params"`
+				} `json:"requests"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Requests) != 2 || body.Requests[1].Params["max_tokens"] != float64(MaxNumberOfTokens) {
+				t.Errorf("unexpected batch requests: %+v", body.Requests)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"id":"msgbatch_1","type":"message_batch","processing_status":"in_progress","request_counts":{"processing":2,"succeeded":0,"errored":0,"canceled":0,"expired":0},"created_at":"2025-06-01T00:00:00Z","expires_at":"2025-06-02T00:00:00Z"}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/messages/batches/msgbatch_1/results":
+			w.Header().Set("Content-Type", "application/x-jsonl")
+			fmt.Fprint(w, results)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	batches := (&Anthropic{client: client}).Batches()
+	ctx := context.Background()
+
+	var file strings.Builder
+	if err := WriteBatchRequests(context.Background(), &file, []BatchRequest{
+		{CustomID: "a", Model: "claude-sonnet-4", Request: &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}},
+		{CustomID: "b", Model: "claude-sonnet-4", Request: &ai.ModelRequest{
+			Config:   &GenerationConfig{WebFetch: &WebFetchConfig{}},
+			Messages: []*ai.Message{ai.NewUserTextMessage("summarize https://example.com")},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(file.String(), "\n"); lines != 2 {
+		t.Errorf("want: %d lines, got: %d", 2, lines)
+	}
+
+	requests, err := ReadBatchRequests(strings.NewReader(file.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || requests[0].CustomID != "a" || len(requests[0].Betas) != 0 || requests[1].Betas[0] != webFetchBeta {
+		t.Errorf("unexpected requests: %+v", requests)
+	}
+	if _, err := batches.SubmitEncoded(ctx, requests); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadBatchRequests(strings.NewReader(`{"custom_id":"a","params":{}}` + "\n" + `{"custom_id":"a","params":{}}`)); err == nil {
+		t.Errorf("expecting an error for duplicate custom ids")
+	}
+
+	var exported strings.Builder
+	if err := batches.ExportResults(ctx, "msgbatch_1", &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.String() != results {
+		t.Errorf("want: %q, got: %q", results, exported.String())
+	}
+	states := []BatchResultState{}
+	if err := ReadBatchResults(strings.NewReader(exported.String()), nil, func(r *BatchResult) error {
+		states = append(states, r.State)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || states[0] != BatchResultSucceeded || states[1] != BatchResultExpired {
+		t.Errorf("unexpected states: %v", states)
+	}
+}
+
+func TestAnthropicRefreshModels(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v1/models" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data":[
+			{"type":"model","id":"claude-sonnet-4-20250514","display_name":"Claude Sonnet 4","created_at":"2025-05-22T00:00:00Z"},
+			{"type":"model","id":"claude-opus-4-5-20251101","display_name":"Claude Opus 4.5","created_at":"2025-11-24T00:00:00Z"}
+		],"has_more":false,"first_id":"claude-sonnet-4-20250514","last_id":"claude-opus-4-5-20251101"}`)
+	})
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &Anthropic{client: client, messages: &client.Messages}
+
+	names, err := plugin.RefreshModels(ctx, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "claude-opus-4-5-20251101" {
+		t.Errorf("unexpected models: %v", names)
+	}
+	if AnthropicModel(g, "claude-opus-4-5-20251101") == nil {
+		t.Errorf("expecting the discovered model to be defined")
+	}
+
+	// models already defined are kept
+	if names, err = plugin.RefreshModels(ctx, g); err != nil || len(names) != 1 {
+		t.Errorf("unexpected models: %v, %v", names, err)
+	}
+}
+
+func TestAnthropicResolveAction(t *testing.T) {
+	var _ genkit.DynamicPlugin = &Anthropic{}
+
+	ctx := context.Background()
+	g, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{APIKey: "sk-ant-test-key"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if AnthropicModel(g, "claude-opus-4-1-20250805") == nil {
+		t.Errorf("expecting the model to be resolved on first use")
+	}
+	if AnthropicModel(g, "gpt-4o") != nil {
+		t.Errorf("expecting only Claude models to be resolved")
+	}
+	if !IsDefinedModel(g, "claude-sonnet-4") || IsDefinedModel(g, "gpt-4o") {
+		t.Errorf("unexpected defined models")
+	}
+	// probing a model doesn't define it
+	for range 2 {
+		if IsDefinedModel(g, "claude-typo-xyz") {
+			t.Errorf("expecting %q not to be defined", "claude-typo-xyz")
+		}
+	}
+	if !IsDefinedModel(g, "claude-opus-4-1-20250805") {
+		t.Errorf("expecting the resolved model to be defined")
+	}
+
+	actions := (&Anthropic{}).ListActions(ctx)
+	if len(actions) != len(anthropicModels) {
+		t.Errorf("want: %d actions, got: %d", len(anthropicModels), len(actions))
+	}
+	for _, a := range actions {
+		if !strings.HasPrefix(a.Key, "/model/anthropic/claude-") {
+			t.Errorf("unexpected action key: %q", a.Key)
+		}
+	}
+}
+
+func TestAnthropicLongContext(t *testing.T) {
+	req := &ai.ModelRequest{
+		Config:   &GenerationConfig{LongContext: true},
+		Messages: []*ai.Message{ai.NewUserTextMessage("hello")},
+	}
+	c, err := configFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	betas, err := betaFeatures(c, req, "claude-sonnet-4-20250514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(betas) != 1 || betas[0] != longContextBeta {
+		t.Errorf("want: %q, got: %q", longContextBeta, betas)
+	}
+	if _, err := betaFeatures(c, req, "claude-sonnet-4-5-20250929"); err != nil {
+		t.Errorf("expecting long context on Claude Sonnet 4.5, got: %v", err)
+	}
+	for _, model := range []string{"claude-3-5-haiku-latest", "claude-haiku-4-5-20251001"} {
+		if _, err := betaFeatures(c, req, model); err == nil {
+			t.Errorf("expecting an error for %s without long context", model)
+		}
+	}
+	if w := contextWindow("claude-sonnet-4-20250514", c); w != longContextWindow {
+		t.Errorf("want: %d, got: %d", longContextWindow, w)
+	}
+	if w := contextWindow("claude-sonnet-4-20250514", &GenerationConfig{}); w != defaultContextWindow {
+		t.Errorf("want: %d, got: %d", defaultContextWindow, w)
+	}
+}
+
+func TestAnthropicExtendedOutput(t *testing.T) {
+	var streamed bool
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("anthropic-beta") != extendedOutputBeta {
+			t.Errorf("want: %q, got: %q", extendedOutputBeta, r.Header.Get("anthropic-beta"))
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		streamed = body["stream"] == true
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range []string{
+			`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-7-sonnet-latest","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"a long essay"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+			`{"type":"message_stop"}`,
+		} {
+			var typ struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal([]byte(e), &typ)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ.Type, e)
+		}
+	})
+
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{
+			GenerationCommonConfig: ai.GenerationCommonConfig{MaxOutputTokens: 128000},
+			ExtendedOutput:         true,
+		},
+		Messages: []*ai.Message{ai.NewUserTextMessage("write a long essay")},
+	}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-3-7-sonnet", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !streamed {
+		t.Errorf("expecting the request to be streamed")
+	}
+	if resp.Text() != "a long essay" {
+		t.Errorf("want: %q, got: %q", "a long essay", resp.Text())
+	}
+
+	c, err := configFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := betaFeatures(c, req, "claude-sonnet-4-20250514"); err == nil {
+		t.Errorf("expecting an error for models without extended output")
+	}
+}
+
+func TestAnthropicFinishReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		message    string
+		wantReason ai.FinishReason
+		wantMsg    string
+	}{
+		{"end turn", `{"stop_reason":"end_turn"}`, ai.FinishReasonStop, ""},
+		{"max tokens", `{"stop_reason":"max_tokens"}`, ai.FinishReasonLength, "reached the max_tokens limit"},
+		{"stop sequence", `{"stop_reason":"stop_sequence","stop_sequence":"###"}`, ai.FinishReasonStop, `stop sequence "###"`},
+		{"tool use", `{"stop_reason":"tool_use"}`, ai.FinishReasonStop, ""},
+		{"pause turn", `{"stop_reason":"pause_turn"}`, ai.FinishReasonOther, "pause_turn: send the response back as is to let Claude continue"},
+		{"refusal", `{"stop_reason":"refusal"}`, ai.FinishReasonBlocked, "refusal: Claude declined to answer"},
+		{"unknown", `{"stop_reason":"model_context_window_exceeded"}`, ai.FinishReasonUnknown, `unknown stop reason "model_context_window_exceeded"`},
+		{"missing", `{}`, ai.FinishReasonUnknown, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m anthropic.Message
+			if err := json.Unmarshal([]byte(tt.message), &m); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := anthropicToGenkitResponse(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.FinishReason != tt.wantReason {
+				t.Errorf("want: %q, got: %q", tt.wantReason, resp.FinishReason)
+			}
+			if resp.FinishMessage != tt.wantMsg {
+				t.Errorf("want: %q, got: %q", tt.wantMsg, resp.FinishMessage)
+			}
+		})
+	}
+}
+
+func TestAnthropicPrefill(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Role    string `json:"role"`
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		last := body.Messages[len(body.Messages)-1]
+		if last.Role != "assistant" || last.Content[0].Text != `{"name":` {
+			t.Errorf("unexpected prefill: %+v", last)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":" \"Ada\"}"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+
+	req := &ai.ModelRequest{Messages: []*ai.Message{
+		ai.NewUserTextMessage("give me a JSON user"),
+		ai.NewModelTextMessage(`{"name": `),
+	}}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name": "Ada"}`; resp.Text() != want {
+		t.Errorf("want: %q, got: %q", want, resp.Text())
+	}
+}
+
+func TestAnthropicContinuation(t *testing.T) {
+	responses := []string{
+		`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"Once upon"}],"stop_reason":"max_tokens","usage":{"input_tokens":10,"output_tokens":2}}`,
+		`{"id":"msg_2","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":" a time"}],"stop_reason":"max_tokens","usage":{"input_tokens":12,"output_tokens":2}}`,
+		`{"id":"msg_3","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":" there was"}],"stop_reason":"max_tokens","usage":{"input_tokens":14,"output_tokens":2}}`,
+	}
+	prefills := []string{}
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Role    string `json:"role"`
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if last := body.Messages[len(body.Messages)-1]; last.Role == "assistant" {
+			prefills = append(prefills, last.Content[0].Text)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, responses[len(prefills)])
+	})
+
+	req := &ai.ModelRequest{
+		Config:   &GenerationConfig{MaxContinuations: 2},
+		Messages: []*ai.Message{ai.NewUserTextMessage("tell me a story")},
+	}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Once upon a time there was"; resp.Text() != want {
+		t.Errorf("want: %q, got: %q", want, resp.Text())
+	}
+	if want := "Once upon,Once upon a time"; strings.Join(prefills, ",") != want {
+		t.Errorf("want: %q, got: %q", want, strings.Join(prefills, ","))
+	}
+	if resp.Usage.InputTokens != 36 || resp.Usage.OutputTokens != 6 {
+		t.Errorf("unexpected usage: %+v", resp.Usage)
+	}
+	if resp.FinishReason != ai.FinishReasonLength {
+		t.Errorf("want: %q, got: %q", ai.FinishReasonLength, resp.FinishReason)
+	}
+	if resp.Request != req {
+		t.Errorf("expecting the response to reference the original request")
+	}
+	if m := RawMessage(resp); m == nil || m.ID != "msg_3" {
+		t.Errorf("expecting the last message as raw message, got: %#v", m)
+	}
+}
+
+func TestAnthropicUserID(t *testing.T) {
+	var got string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Metadata struct {
+				UserID string `json:"user_id"`
+			} `json:"metadata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		got = body.Metadata.UserID
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		config *GenerationConfig
+		want   string
+	}{
+		{"none", context.Background(), &GenerationConfig{}, ""},
+		{"config", context.Background(), &GenerationConfig{UserID: "user-1"}, "user-1"},
+		{"context", WithUserID(context.Background(), "user-2"), &GenerationConfig{}, "user-2"},
+		{"config over context", WithUserID(context.Background(), "user-2"), &GenerationConfig{UserID: "user-1"}, "user-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &ai.ModelRequest{Config: tt.config, Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+			if _, err := anthropicGenerate(tt.ctx, &client.Messages, "claude-sonnet-4", req, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("want: %q, got: %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAnthropicStructuredOutput(t *testing.T) {
+	toolInput := `{"name":"Ada","age":36}`
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Tools []struct {
+				Name        string         `json:"name"`
+				InputSchema map[string]any `json:"input_schema"`
+			} `json:"tools"`
+			ToolChoice map[string]any `json:"tool_choice"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Tools) != 1 || body.Tools[0].Name != structuredOutputToolName || body.Tools[0].InputSchema["type"] != "object" {
+			t.Errorf("unexpected tools: %+v", body.Tools)
+		}
+		if body.ToolChoice["type"] != "tool" || body.ToolChoice["name"] != structuredOutputToolName {
+			t.Errorf("unexpected tool choice: %v", body.ToolChoice)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"tool_use","id":"toolu_1","name":%q,"input":%s}],"stop_reason":"tool_use","usage":{"input_tokens":1,"output_tokens":1}}`,
+			structuredOutputToolName, toolInput)
+	})
+
+	type User struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := defineAnthropicModel(g, &client.Messages, "claude-sonnet-4", anthropicModels["claude-sonnet-4"])
+
+	t.Run("object", func(t *testing.T) {
+		resp, err := genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("who wrote the first program?"), ai.WithOutputType(User{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var u User
+		if err := resp.Output(&u); err != nil {
+			t.Fatal(err)
+		}
+		if u.Name != "Ada" || u.Age != 36 {
+			t.Errorf("unexpected output: %+v", u)
+		}
+	})
+
+	t.Run("wrapped", func(t *testing.T) {
+		toolInput = `{"output":["Ada","Grace"]}`
+		resp, err := genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("name two programmers"), ai.WithOutputType([]string{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `["Ada","Grace"]`; resp.Text() != want {
+			t.Errorf("want: %q, got: %q", want, resp.Text())
+		}
+	})
+}
+
+func TestAnthropicOutputRepair(t *testing.T) {
+	var inputs []string
+	var lastMessage string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		last := body.Messages[len(body.Messages)-1]
+		lastMessage = last.Content[0].Text
+		input := inputs[0]
+		inputs = inputs[1:]
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"tool_use","id":"toolu_1","name":%q,"input":%s}],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`,
+			structuredOutputToolName, input)
+	})
+
+	newRequest := func(repairs int) *ai.ModelRequest {
+		return &ai.ModelRequest{
+			Config:   &GenerationConfig{OutputRepairs: repairs},
+			Messages: []*ai.Message{ai.NewUserTextMessage("who wrote the first program?")},
+			Output: &ai.ModelOutputConfig{
+				Format:      "json",
+				Constrained: true,
+				Schema: map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"name": map[string]any{"type": "string"}, "age": map[string]any{"type": "integer"}},
+					"required":   []any{"name", "age"},
+				},
+			},
+		}
+	}
+
+	t.Run("repaired", func(t *testing.T) {
+		inputs = []string{`{"name":"Ada","age":"36"}`, `{"name":"Ada","age":36}`}
+		resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", newRequest(0), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"name":"Ada","age":36}`; resp.Text() != want {
+			t.Errorf("want: %q, got: %q", want, resp.Text())
+		}
+		if !strings.Contains(lastMessage, "age") {
+			t.Errorf("expecting the validation errors to be sent back, got: %q", lastMessage)
+		}
+		if resp.Usage.InputTokens != 20 {
+			t.Errorf("want: %d, got: %d", 20, resp.Usage.InputTokens)
+		}
+	})
+
+	t.Run("still invalid", func(t *testing.T) {
+		inputs = []string{`{"name":"Ada"}`, `{"name":"Ada"}`}
+		_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", newRequest(0), nil)
+		var verr *OutputValidationError
+		if !errors.As(err, &verr) || len(verr.Errors) != 1 {
+			t.Errorf("expecting a validation error, got: %v", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		inputs = []string{`{"name":"Ada"}`}
+		if _, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", newRequest(-1), nil); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestCompleteJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`{`, `{}`},
+		{`{"na`, `{}`},
+		{`{"name"`, `{}`},
+		{`{"name":`, `{"name":null}`},
+		{`{"name": "Ad`, `{"name": "Ad"}`},
+		{`{"name": "Ada", `, `{"name": "Ada"}`},
+		{`{"tags": ["a", "b`, `{"tags": ["a", "b"]}`},
+		{`{"age": 3`, `{"age": 3}`},
+		{`{"ok": tr`, `{"ok":null}`},
+		{`["a\`, `["a"]`},
+		{`["\u00`, `[""]`},
+		{`"hello`, `"hello"`},
+	}
+	for _, tt := range tests {
+		got, ok := completeJSON(tt.in)
+		if !ok || got != tt.want {
+			t.Errorf("completeJSON(%q): want: %q, got: %q", tt.in, tt.want, got)
+		}
+	}
+	if _, ok := completeJSON(`tr`); ok {
+		t.Errorf("expecting no JSON for an incomplete literal")
+	}
+}
+
+func TestAnthropicStreamStructuredOutput(t *testing.T) {
+	newEvents := func(deltas ...string) []string {
+		events := []string{
+			`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			fmt.Sprintf(`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":%q,"input":{}}}`, structuredOutputToolName),
+		}
+		for _, d := range deltas {
+			b, _ := json.Marshal(d)
+			events = append(events, fmt.Sprintf(`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":%s}}`, b))
+		}
+		return append(events,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":12}}`,
+			`{"type":"message_stop"}`,
+		)
+	}
+
+	tests := []struct {
+		name          string
+		schema        map[string]any
+		deltas        []string
+		wantText      string
+		wantSnapshots []string
+	}{
+		{
+			name:          "object",
+			schema:        map[string]any{"type": "object"},
+			deltas:        []string{`{"name": "Ad`, `a", "age"`, `: 36}`},
+			wantText:      `{"name": "Ada", "age": 36}`,
+			wantSnapshots: []string{`{"name": "Ad"}`, `{"name": "Ada"}`, `{"name": "Ada", "age": 36}`},
+		},
+		{
+			name:          "wrapped",
+			schema:        map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			deltas:        []string{`{"output": ["Ada"`, `, "Grace"]`, `}`},
+			wantText:      `["Ada", "Grace"]`,
+			wantSnapshots: []string{`["Ada"]`, `["Ada", "Grace"]`, `["Ada", "Grace"]`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newStreamingTestClient(t, newEvents(tt.deltas...)...)
+			var text strings.Builder
+			snapshots := []string{}
+			cb := func(ctx context.Context, chunk *ai.ModelResponseChunk) error {
+				for _, p := range chunk.Content {
+					text.WriteString(p.Text)
+					if s, ok := p.Metadata[PartialOutputMetadataKey].(string); ok {
+						snapshots = append(snapshots, s)
+					}
+				}
+				return nil
+			}
+			req := &ai.ModelRequest{
+				Config:   &GenerationConfig{OutputRepairs: -1},
+				Messages: []*ai.Message{ai.NewUserTextMessage("hi")},
+				Output:   &ai.ModelOutputConfig{Format: "json", Constrained: true, Schema: tt.schema},
+			}
+			if _, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, cb); err != nil {
+				t.Fatal(err)
+			}
+			if text.String() != tt.wantText {
+				t.Errorf("want: %q, got: %q", tt.wantText, text.String())
+			}
+			if strings.Join(snapshots, "|") != strings.Join(tt.wantSnapshots, "|") {
+				t.Errorf("want: %q, got: %q", tt.wantSnapshots, snapshots)
+			}
+		})
+	}
+}
+
+func TestModelRefs(t *testing.T) {
+	refs := []ai.ModelRef{
+		ModelClaudeSonnet45, ModelClaudeHaiku45, ModelClaudeOpus41,
+		ModelClaudeSonnet4, ModelClaudeOpus4, ModelClaude37Sonnet, ModelClaude35SonnetV2,
+		ModelClaude35Sonnet, ModelClaude35Haiku, ModelClaude3Haiku,
+	}
+	for _, ref := range refs {
+		name, ok := strings.CutPrefix(ref.Name(), provider+"/")
+		if !ok {
+			t.Errorf("unexpected model reference: %q", ref.Name())
+		}
+		if _, ok := anthropicModels[name]; !ok {
+			t.Errorf("reference to unknown model: %q", ref.Name())
+		}
+		if ref.Config() != nil {
+			t.Errorf("expecting no config, got: %#v", ref.Config())
+		}
+	}
+
+	ref := NewModelRef("claude-sonnet-4", &GenerationConfig{Citations: true})
+	if c, ok := ref.Config().(*GenerationConfig); !ok || !c.Citations {
+		t.Errorf("unexpected config: %#v", ref.Config())
+	}
+}
+
+func TestAnthropicMiddleware(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+
+	calls := []string{}
+	logging := func(name string) ai.ModelMiddleware {
+		return func(next ai.ModelFunc) ai.ModelFunc {
+			return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+				calls = append(calls, name)
+				return next(ctx, req, cb)
+			}
+		}
+	}
+
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &Anthropic{client: client, messages: &client.Messages, Middleware: []ai.ModelMiddleware{logging("plugin")}}
+	m, err := plugin.DefineModel(g, "claude-sonnet-4", nil, logging("model"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ",") != "plugin,model" {
+		t.Errorf("want: %q, got: %q", "plugin,model", strings.Join(calls, ","))
+	}
+
+	t.Run("plugin registered", func(t *testing.T) {
+		calls = nil
+		plugin := &Anthropic{APIKey: "sk-ant-test-key", Middleware: []ai.ModelMiddleware{logging("plugin")}}
+		g, err := genkit.Init(ctx, genkit.WithPlugins(plugin))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin.client = client
+		plugin.messages = &client.Messages
+		info := &ai.ModelInfo{Label: "Custom", Supports: &Multimodal, Versions: []string{"claude-custom-20250101"}}
+		m, err := plugin.DefineModel(g, "claude-custom", info, logging("model"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("hi")); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(calls, ",") != "plugin,model" {
+			t.Errorf("want: %q, got: %q", "plugin,model", strings.Join(calls, ","))
+		}
+	})
+}
+
+func TestAnthropicRawMessage(t *testing.T) {
+	var m anthropic.Message
+	if err := json.Unmarshal([]byte(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514",
+		"content":[{"type":"text","text":"done ###"}],"stop_reason":"stop_sequence","stop_sequence":"###","usage":{"input_tokens":1,"output_tokens":1}}`), &m); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := anthropicToGenkitResponse(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := RawMessage(resp)
+	if raw == nil || raw.ID != "msg_1" || raw.Model != "claude-sonnet-4-20250514" || raw.StopSequence != "###" {
+		t.Errorf("unexpected raw message: %#v", raw)
+	}
+	if RawMessage(&ai.ModelResponse{}) != nil {
+		t.Errorf("expecting no raw message")
+	}
+}
+
+func TestAnthropicRequestID(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("request-id", "req_123")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if RequestID(resp) != "req_123" {
+		t.Errorf("want: %q, got: %q", "req_123", RequestID(resp))
+	}
+	if resp.LatencyMs <= 0 {
+		t.Errorf("expecting the latency to be recorded, got: %f", resp.LatencyMs)
+	}
+
+	t.Run("streaming", func(t *testing.T) {
+		client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("request-id", "req_456")
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, e := range []string{
+				`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":1,"output_tokens":1}}}`,
+				`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":1}}`,
+				`{"type":"message_stop"}`,
+			} {
+				var typ struct {
+					Type string `json:"type"`
+				}
+				json.Unmarshal([]byte(e), &typ)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ.Type, e)
+			}
+		})
+		resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req,
+			func(context.Context, *ai.ModelResponseChunk) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if RequestID(resp) != "req_456" {
+			t.Errorf("want: %q, got: %q", "req_456", RequestID(resp))
+		}
+	})
+}
+
+func TestAnthropicRetry(t *testing.T) {
+	retry := RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	newRetryClient := func(t *testing.T, failures int, status int, handler http.HandlerFunc) (*anthropic.Client, *int) {
+		attempts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts <= failures {
+				w.Header().Set("retry-after-ms", "1")
+				w.WriteHeader(status)
+				fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+				return
+			}
+			handler(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		return newClient(append([]option.RequestOption{option.WithBaseURL(srv.URL), option.WithAPIKey("sk-ant-test-key")}, retry.options()...)...), &attempts
+	}
+	message := func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []any `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Messages) != 1 {
+			t.Errorf("expecting the request body to be replayed, got: %v (%v)", body, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	}
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+
+	t.Run("generate", func(t *testing.T) {
+		client, attempts := newRetryClient(t, 2, http.StatusTooManyRequests, message)
+		resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Text() != "hi" || *attempts != 3 {
+			t.Errorf("want: 3 attempts, got: %d (%q)", *attempts, resp.Text())
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		client, attempts := newRetryClient(t, 1, http.StatusServiceUnavailable, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"type\":\"message\",\"role\":\"assistant\",\"content\":[],\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":1,\"output_tokens\":1}}}\n\n")
+			fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+		})
+		_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req,
+			func(context.Context, *ai.ModelResponseChunk) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *attempts != 2 {
+			t.Errorf("want: 2 attempts, got: %d", *attempts)
+		}
+	})
+
+	t.Run("count tokens", func(t *testing.T) {
+		client, attempts := newRetryClient(t, 1, http.StatusInternalServerError, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"input_tokens":7}`)
+		})
+		n, err := (&Anthropic{client: client, messages: &client.Messages}).CountTokens(context.Background(), "claude-sonnet-4", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 7 || *attempts != 2 {
+			t.Errorf("want: 7 tokens in 2 attempts, got: %d in %d", n, *attempts)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		client, attempts := newRetryClient(t, 5, http.StatusTooManyRequests, message)
+		_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+		var apiErr *anthropic.Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expecting a rate limit error, got: %v", err)
+		}
+		if *attempts != 3 {
+			t.Errorf("want: 3 attempts, got: %d", *attempts)
+		}
+	})
+
+	t.Run("not retried", func(t *testing.T) {
+		client, attempts := newRetryClient(t, 1, http.StatusBadRequest, message)
+		if _, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil); err == nil {
+			t.Error("expecting the bad request error")
+		}
+		if *attempts != 1 {
+			t.Errorf("want: 1 attempt, got: %d", *attempts)
+		}
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	rc := RetryConfig{BaseDelay: time.Second, MaxDelay: 3 * time.Second, Jitter: -1}.withDefaults()
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 3 * time.Second, 10: 3 * time.Second} {
+		if got, ok := rc.delay(attempt, nil); !ok || got != want {
+			t.Errorf("attempt %d, want: %v, got: %v", attempt, want, got)
+		}
+	}
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"2"}}}
+	if got, ok := rc.delay(1, resp); !ok || got != 2*time.Second {
+		t.Errorf("want: %v, got: %v", 2*time.Second, got)
+	}
+	// no retry when asked to wait longer than the max delay
+	resp = &http.Response{Header: http.Header{"Retry-After": []string{"3600"}}}
+	if got, ok := rc.delay(1, resp); ok {
+		t.Errorf("expecting no retry, got a delay of %v", got)
+	}
+	// overloaded errors back off longer
+	resp = &http.Response{StatusCode: statusOverloaded, Header: http.Header{}}
+	for attempt, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 10: 30 * time.Second} {
+		if got, ok := rc.delay(attempt, resp); !ok || got != want {
+			t.Errorf("overloaded attempt %d, want: %v, got: %v", attempt, want, got)
+		}
+	}
+}
+
+func TestAnthropicErrOverloaded(t *testing.T) {
+	for _, tt := range []struct {
+		status     int
+		body       string
+		overloaded bool
+	}{
+		{status: statusOverloaded, body: `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, overloaded: true},
+		{status: http.StatusInternalServerError, body: `{"type":"error","error":{"type":"api_error","message":"Internal server error"}}`},
+	} {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+			req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+			_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+			if errors.Is(err, ErrOverloaded) != tt.overloaded {
+				t.Errorf("want overloaded: %v, got: %v", tt.overloaded, err)
+			}
+			var apiErr *anthropic.Error
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status {
+				t.Errorf("expecting the API error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestAnthropicRateLimits(t *testing.T) {
+	reset := time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC)
+	setHeaders := func(w http.ResponseWriter) {
+		w.Header().Set("anthropic-ratelimit-requests-limit", "50")
+		w.Header().Set("anthropic-ratelimit-requests-remaining", "49")
+		w.Header().Set("anthropic-ratelimit-requests-reset", reset.Format(time.RFC3339))
+		w.Header().Set("anthropic-ratelimit-input-tokens-limit", "30000")
+		w.Header().Set("anthropic-ratelimit-input-tokens-remaining", "29990")
+	}
+	var reported []*RateLimits
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setHeaders(w)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	t.Cleanup(srv.Close)
+	c := newClient(option.WithBaseURL(srv.URL), option.WithAPIKey("sk-ant-test-key"), option.WithMaxRetries(0),
+		option.WithMiddleware(rateLimitsMiddleware(func(rl *RateLimits) { reported = append(reported, rl) })))
+
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+	resp, err := anthropicGenerate(context.Background(), &c.Messages, "claude-sonnet-4", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := ResponseRateLimits(resp)
+	if rl == nil {
+		t.Fatal("expecting the rate limits in the response metadata")
+	}
+	want := RateLimit{Limit: 50, Remaining: 49, Reset: reset}
+	if rl.Requests == nil || *rl.Requests != want {
+		t.Errorf("want: %+v, got: %+v", want, rl.Requests)
+	}
+	if rl.InputTokens == nil || rl.InputTokens.Remaining != 29990 {
+		t.Errorf("want: 29990 input tokens remaining, got: %+v", rl.InputTokens)
+	}
+	if rl.Tokens != nil || rl.OutputTokens != nil {
+		t.Errorf("expecting no token and output token limits, got: %+v", rl)
+	}
+	if len(reported) != 1 || reported[0].Requests.Remaining != 49 {
+		t.Errorf("expecting the rate limits to be reported once, got: %+v", reported)
+	}
+
+	if rl := parseRateLimits(http.Header{}); rl != nil {
+		t.Errorf("expecting no rate limits without headers, got: %+v", rl)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	newLimiter := func(c RateLimiterConfig) *rateLimiter {
+		return newRateLimiter(c, func() time.Time { return now })
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		l := newLimiter(RateLimiterConfig{RequestsPerMinute: 2, Reject: true})
+		for i := range 2 {
+			if err := l.wait(context.Background(), 0); err != nil {
+				t.Fatalf("call %d: %v", i, err)
+			}
+		}
+		if err := l.wait(context.Background(), 0); !errors.Is(err, ErrRateLimited) {
+			t.Errorf("want: %v, got: %v", ErrRateLimited, err)
+		}
+		now = now.Add(30 * time.Second)
+		if err := l.wait(context.Background(), 0); err != nil {
+			t.Errorf("expecting the bucket to be refilled, got: %v", err)
+		}
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		l := newLimiter(RateLimiterConfig{TokensPerMinute: 1000})
+		if d := l.tokens.delay(600, now); d != 0 {
+			t.Errorf("want: no delay, got: %v", d)
+		}
+		l.tokens.take(600)
+		if d := l.tokens.delay(600, now); d != 12*time.Second {
+			t.Errorf("want: %v, got: %v", 12*time.Second, d)
+		}
+		// a call larger than the bucket waits for a full bucket
+		if d := l.tokens.delay(5000, now); d != 36*time.Second {
+			t.Errorf("want: %v, got: %v", 36*time.Second, d)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		l := newLimiter(RateLimiterConfig{RequestsPerMinute: 1})
+		if err := l.wait(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := l.wait(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("want: %v, got: %v", context.DeadlineExceeded, err)
+		}
+		// the canceled call gave its turn back
+		if d := l.requests.delay(1, now.Add(time.Minute)); d != 0 {
+			t.Errorf("want: no delay, got: %v", d)
+		}
+	})
+
+	t.Run("middleware", func(t *testing.T) {
+		l := newLimiter(RateLimiterConfig{TokensPerMinute: 10, Reject: true})
+		calls := 0
+		fn := l.middleware()(func(context.Context, *ai.ModelRequest, func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			calls++
+			return &ai.ModelResponse{}, nil
+		})
+		req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage(strings.Repeat("a", 32))}}
+		if _, err := fn(context.Background(), req, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fn(context.Background(), req, nil); !errors.Is(err, ErrRateLimited) {
+			t.Errorf("want: %v, got: %v", ErrRateLimited, err)
+		}
+		if calls != 1 {
+			t.Errorf("want: 1 call, got: %d", calls)
+		}
+	})
+
+	t.Run("request failing the conversion", func(t *testing.T) {
+		l := newLimiter(RateLimiterConfig{TokensPerMinute: 10, Reject: true})
+		fn := l.middleware()(func(context.Context, *ai.ModelRequest, func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			return &ai.ModelResponse{}, nil
+		})
+		// the config doesn't convert, the tokens are estimated all the same
+		req := &ai.ModelRequest{
+			Config:   "invalid",
+			Messages: []*ai.Message{ai.NewUserTextMessage(strings.Repeat("a", 32))},
+		}
+		if _, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req); err == nil {
+			t.Fatal("expecting a conversion error")
+		}
+		if _, err := fn(context.Background(), req, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fn(context.Background(), req, nil); !errors.Is(err, ErrRateLimited) {
+			t.Errorf("want: %v, got: %v", ErrRateLimited, err)
+		}
+	})
+
+	t.Run("media not downloaded", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("the media should not be downloaded: %s", r.URL.Path)
+		}))
+		defer srv.Close()
+		req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserMessage(
+			ai.NewTextPart(strings.Repeat("a", 40)),
+			ai.NewMediaPart("image/png", srv.URL+"/cat.png"),
+			ai.NewMediaPart("application/pdf", srv.URL+"/paper.pdf"),
+		)}}
+		if n := estimateRequestTokens(req); n != 10+imageTokens {
+			t.Errorf("want: %d, got: %d", 10+imageTokens, n)
+		}
+	})
+}
+
+func TestAnthropicStructuredOutputWithTools(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Tools []struct {
+				Name string `json:"name"`
+			} `json:"tools"`
+			ToolChoice map[string]any `json:"tool_choice"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Tools) != 1 || body.Tools[0].Name != "lookup" {
+			t.Errorf("expecting only the user tool, got: %+v", body.Tools)
+		}
+		if body.ToolChoice != nil {
+			t.Errorf("expecting no forced tool choice, got: %v", body.ToolChoice)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"{\"name\":\"Ada\",\"age\":36}"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	})
+
+	type User struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := defineAnthropicModel(g, &client.Messages, "claude-sonnet-4", anthropicModels["claude-sonnet-4"])
+	lookup := genkit.DefineTool(g, "lookup", "looks up a person", func(ctx *ai.ToolContext, name string) (string, error) {
+		return name, nil
+	})
+
+	resp, err := genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("who wrote the first program?"),
+		ai.WithTools(lookup), ai.WithOutputType(User{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u User
+	if err := resp.Output(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "Ada" || u.Age != 36 {
+		t.Errorf("unexpected output: %+v", u)
+	}
+}
+
+func TestAnthropicBatchResultsCompleted(t *testing.T) {
+	schema := map[string]any{"type": "array", "items": map[string]any{"type": "string"}}
+	requests := []BatchRequest{
+		{CustomID: "json", Model: "claude-sonnet-4", Request: &ai.ModelRequest{
+			Messages: []*ai.Message{ai.NewUserTextMessage("name two programmers")},
+			Output:   &ai.ModelOutputConfig{Format: "json", Constrained: true, Schema: schema},
+		}},
+		{CustomID: "prefill", Model: "claude-sonnet-4", Request: &ai.ModelRequest{
+			Messages: []*ai.Message{ai.NewUserTextMessage("count to 3"), ai.NewModelTextMessage("1,")},
+		}},
+	}
+	results := `{"custom_id":"json","result":{"type":"succeeded","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"tool_use","id":"toolu_1","name":"structured_output","input":{"output":["Ada","Grace"]}}],"stop_reason":"tool_use","usage":{"input_tokens":1,"output_tokens":1}}}}
+{"custom_id":"prefill","result":{"type":"succeeded","message":{"id":"msg_2","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":" 2, 3"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}}}
+`
+	texts := map[string]string{}
+	if err := ReadBatchResults(strings.NewReader(results), requests, func(r *BatchResult) error {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		texts[r.CustomID] = r.Response.Text()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `["Ada","Grace"]`; texts["json"] != want {
+		t.Errorf("want: %q, got: %q", want, texts["json"])
+	}
+	if want := "1, 2, 3"; texts["prefill"] != want {
+		t.Errorf("want: %q, got: %q", want, texts["prefill"])
+	}
+}
+
+func TestAnthropicStreamUnexpectedEOF(t *testing.T) {
+	client := newStreamingTestClient(t,
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":1,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+	)
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+	_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req,
+		func(context.Context, *ai.ModelResponseChunk) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("want: %v, got: %v", io.ErrUnexpectedEOF, err)
+	}
+	var serr *StreamError
+	if !errors.As(err, &serr) {
+		t.Fatalf("want: *StreamError, got: %T", err)
+	}
+	if got := serr.Partial.Text(); got != "Hel" {
+		t.Errorf("want: %q, got: %q", "Hel", got)
+	}
+}
+
+func TestAnthropicStreamUnknownEvents(t *testing.T) {
+	client := newStreamingTestClient(t,
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":1,"output_tokens":1}}}`,
+		`{"type":"ping"}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"future_delta","value":1}}`,
+		`{"type":"future_event","value":1}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+		`{"type":"message_stop"}`,
+	)
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+	var chunks []string
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req,
+		func(_ context.Context, c *ai.ModelResponseChunk) error {
+			if ChunkUsage(c) == nil {
+				chunks = append(chunks, c.Text())
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text() != "Hello" {
+		t.Errorf("want: %q, got: %q", "Hello", resp.Text())
+	}
+	if want := []string{"Hello"}; !slices.Equal(chunks, want) {
+		t.Errorf("want: %q, got: %q", want, chunks)
+	}
+}
+
+func TestAnthropicStreamEvents(t *testing.T) {
+	client := newStreamingTestClient(t,
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":1,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+		`{"type":"message_stop"}`,
+	)
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+
+	t.Run("without genkit callback", func(t *testing.T) {
+		var events []string
+		ctx := WithStreamEvents(context.Background(), func(_ context.Context, e anthropic.MessageStreamEventUnion) error {
+			events = append(events, e.Type)
+			return nil
+		})
+		resp, err := anthropicGenerate(ctx, &client.Messages, "claude-sonnet-4", req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Text() != "Hello" {
+			t.Errorf("want: %q, got: %q", "Hello", resp.Text())
+		}
+		want := []string{"message_start", "content_block_start", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+		if !slices.Equal(events, want) {
+			t.Errorf("want: %q, got: %q", want, events)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		stop := errors.New("stop")
+		ctx := WithStreamEvents(context.Background(), func(_ context.Context, e anthropic.MessageStreamEventUnion) error {
+			if e.Type == "content_block_delta" {
+				return stop
+			}
+			return nil
+		})
+		var chunks int
+		_, err := anthropicGenerate(ctx, &client.Messages, "claude-sonnet-4", req, func(context.Context, *ai.ModelResponseChunk) error {
+			chunks++
+			return nil
+		})
+		if !errors.Is(err, stop) {
+			t.Errorf("want: %v, got: %v", stop, err)
+		}
+		if chunks != 0 {
+			t.Errorf("want: no chunks, got: %d", chunks)
+		}
+	})
+}
+
+func TestAnthropicDisableStreaming(t *testing.T) {
+	fake := &fakeMessages{text: "Hello"}
+	newRequest := func(maxOutputTokens int) *ai.ModelRequest {
+		return &ai.ModelRequest{
+			Config: &GenerationConfig{
+				GenerationCommonConfig: ai.GenerationCommonConfig{MaxOutputTokens: maxOutputTokens},
+				DisableStreaming:       true,
+			},
+			Messages: []*ai.Message{ai.NewUserTextMessage("hi")},
+		}
+	}
+	ctx := WithStreamEvents(context.Background(), func(context.Context, anthropic.MessageStreamEventUnion) error {
+		t.Error("no event should be streamed")
+		return nil
+	})
+
+	var chunks []*ai.ModelResponseChunk
+	resp, err := anthropicGenerate(ctx, fake, "claude-sonnet-4", newRequest(0), func(_ context.Context, c *ai.ModelResponseChunk) error {
+		chunks = append(chunks, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text() != "Hello" || len(fake.requests) != 1 {
+		t.Errorf("want: %q in a single request, got: %q in %d requests", "Hello", resp.Text(), len(fake.requests))
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("want: a single chunk, got: %d", len(chunks))
+	}
+	if chunks[0].Text() != "Hello" {
+		t.Errorf("want: %q, got: %q", "Hello", chunks[0].Text())
+	}
+	if u := ChunkUsage(chunks[0]); u == nil || u.OutputTokens != 1 {
+		t.Errorf("expecting the usage in the chunk, got: %+v", u)
+	}
+
+	if _, err := anthropicGenerate(ctx, fake, "claude-sonnet-4", newRequest(64000), nil); err == nil || !strings.Contains(err.Error(), "streaming can't be disabled") {
+		t.Errorf("expecting an error for a response too long without streaming, got: %v", err)
+	}
+}
+
+func TestAnthropicStreamErrorEvent(t *testing.T) {
+	client := newStreamingTestClient(t,
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":1,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+		`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+	)
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+	_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req,
+		func(context.Context, *ai.ModelResponseChunk) error { return nil })
+	if !errors.Is(err, ErrOverloaded) {
+		t.Errorf("want: %v, got: %v", ErrOverloaded, err)
+	}
+	var eventErr *StreamEventError
+	if !errors.As(err, &eventErr) {
+		t.Fatalf("want: *StreamEventError, got: %T", err)
+	}
+	if want := (StreamEventError{Type: "overloaded_error", Message: "Overloaded"}); *eventErr != want {
+		t.Errorf("want: %+v, got: %+v", want, *eventErr)
+	}
+	var serr *StreamError
+	if !errors.As(err, &serr) {
+		t.Fatalf("want: *StreamError, got: %T", err)
+	}
+	if got := serr.Partial.Text(); got != "Hel" {
+		t.Errorf("want: %q, got: %q", "Hel", got)
+	}
+}
+
+func TestAnthropicStreamReconnect(t *testing.T) {
+	var calls atomic.Int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Role    string `json:"role"`
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		events := []string{
+			`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":5,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		}
+		if calls.Add(1) == 1 {
+			// the connection is closed in the middle of the answer
+			events = append(events, `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"1, 2,"}}`)
+		} else {
+			last := body.Messages[len(body.Messages)-1]
+			if last.Role != "assistant" || len(last.Content) != 1 || last.Content[0].Text != "1, 2," {
+				t.Errorf("want: the answer so far as prefill, got: %+v", last)
+			}
+			events = append(events,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" 3"}}`,
+				`{"type":"content_block_stop","index":0}`,
+				`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+				`{"type":"message_stop"}`,
+			)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range events {
+			var typ struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal([]byte(e), &typ)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ.Type, e)
+		}
+	})
+
+	req := &ai.ModelRequest{
+		Messages: []*ai.Message{ai.NewUserTextMessage("count to 3")},
+		Config:   &GenerationConfig{StreamReconnects: 1},
+	}
+	var streamed strings.Builder
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req,
+		func(_ context.Context, c *ai.ModelResponseChunk) error {
+			streamed.WriteString(c.Text())
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1, 2, 3"; resp.Text() != want {
+		t.Errorf("want: %q, got: %q", want, resp.Text())
+	}
+	if want := "1, 2, 3"; streamed.String() != want {
+		t.Errorf("want: %q, got: %q", want, streamed.String())
+	}
+	if resp.Usage.InputTokens != 10 {
+		t.Errorf("want: %d, got: %d", 10, resp.Usage.InputTokens)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("want: %d, got: %d", 2, n)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(CircuitBreakerConfig{Failures: 2, CoolDown: time.Minute}, func() time.Time { return now })
+	overloaded := &anthropic.Error{StatusCode: 529}
+
+	calls := 0
+	failing := true
+	fn := b.middleware()(func(context.Context, *ai.ModelRequest, func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		calls++
+		if failing {
+			return nil, overloaded
+		}
+		return &ai.ModelResponse{}, nil
+	})
+	call := func() error {
+		_, err := fn(context.Background(), &ai.ModelRequest{}, nil)
+		return err
+	}
+
+	// a client error doesn't count
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.record(&anthropic.Error{StatusCode: http.StatusBadRequest})
+
+	for range 2 {
+		if err := call(); err != overloaded {
+			t.Fatalf("want: %v, got: %v", overloaded, err)
+		}
+	}
+	var open *CircuitOpenError
+	if err := call(); !errors.As(err, &open) || !open.RetryAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expecting the breaker to be open, got: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("want: 2 calls, got: %d", calls)
+	}
+
+	// the probe fails, the breaker opens again
+	now = now.Add(time.Minute)
+	if err := call(); err != overloaded {
+		t.Errorf("want: %v, got: %v", overloaded, err)
+	}
+	if err := call(); !errors.As(err, &open) {
+		t.Errorf("expecting the breaker to be open, got: %v", err)
+	}
+
+	// the probe succeeds, the breaker closes
+	now = now.Add(time.Minute)
+	failing = false
+	for range 2 {
+		if err := call(); err != nil {
+			t.Errorf("expecting the breaker to be closed, got: %v", err)
+		}
+	}
+	if calls != 5 {
+		t.Errorf("want: 5 calls, got: %d", calls)
+	}
+}
+
+func TestAnthropicFallbackModel(t *testing.T) {
+	models := []string{}
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		models = append(models, body.Model)
+		w.Header().Set("Content-Type", "application/json")
+		switch body.Model {
+		case "claude-sonnet-4-20250514":
+			w.WriteHeader(529)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+		case "claude-3-7-sonnet-latest":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"not_found_error","message":"model not found"}}`)
+		case "claude-3-haiku-20240307":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"invalid_request_error","message":"bad request"}}`)
+		default:
+			fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":%q,"content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`, body.Model)
+		}
+	})
+
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &Anthropic{client: client, messages: &client.Messages}
+	m, err := plugin.DefineFallbackModel(g, "chat", []string{"claude-sonnet-4", "claude-3-7-sonnet", "claude-3-5-haiku"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Message.Metadata[ModelMetadataKey]; got != "claude-3-5-haiku" {
+		t.Errorf("want: %q, got: %v", "claude-3-5-haiku", got)
+	}
+	if len(models) != 3 {
+		t.Errorf("want: 3 requests, got: %v", models)
+	}
+
+	t.Run("other errors", func(t *testing.T) {
+		models = nil
+		m, err := plugin.DefineFallbackModel(g, "cheap", []string{"claude-3-haiku", "claude-3-5-haiku"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("hi")); err == nil {
+			t.Error("expecting the bad request error")
+		}
+		if len(models) != 1 {
+			t.Errorf("expecting no fallback, got: %v", models)
+		}
+	})
+
+	t.Run("version", func(t *testing.T) {
+		models = nil
+		// a middleware sets the version after Genkit checked the request
+		withVersion := func(next ai.ModelFunc) ai.ModelFunc {
+			return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+				in := *input
+				in.Config = &GenerationConfig{GenerationCommonConfig: ai.GenerationCommonConfig{Version: "claude-sonnet-4-20250514"}}
+				return next(ctx, &in, cb)
+			}
+		}
+		m, err := plugin.DefineFallbackModel(g, "pinned", []string{"claude-sonnet-4", "claude-3-5-haiku"}, withVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("hi"))
+		if err == nil || !strings.Contains(err.Error(), "does not support versions") {
+			t.Errorf("want: a version error, got: %v", err)
+		}
+		if len(models) != 0 {
+			t.Errorf("want: no request, got: %v", models)
+		}
+	})
+}
+
+func TestAnthropicBackendFailover(t *testing.T) {
+	primary := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(529)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+	})
+	var model string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		model = body.Model
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":%q,"content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`, body.Model)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &Anthropic{client: primary, messages: &primary.Messages, backends: []*backendClient{newBackendClient(Backend{
+		Name:    "bedrock",
+		Options: []option.RequestOption{option.WithBaseURL(srv.URL), option.WithAPIKey("sk-ant-test-key"), option.WithMaxRetries(0)},
+		ModelID: func(id string) string { return "anthropic." + id + "-v1:0" },
+	})}}
+	m, err := plugin.DefineModel(g, "claude-sonnet-4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "anthropic.claude-sonnet-4-20250514-v1:0"; model != want {
+		t.Errorf("want: %q, got: %q", want, model)
+	}
+	if got := resp.Message.Metadata[BackendMetadataKey]; got != "bedrock" {
+		t.Errorf("want: %q, got: %v", "bedrock", got)
+	}
+	if resp.Text() != "hi" {
+		t.Errorf("want: %q, got: %q", "hi", resp.Text())
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := newDeduplicator()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := d.middleware("claude-sonnet-4")(func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		calls.Add(1)
+		<-release
+		return &ai.ModelResponse{Message: ai.NewModelTextMessage(input.Messages[0].Text())}, nil
+	})
+
+	generate := func(ctx context.Context, prompt string) <-chan string {
+		out := make(chan string, 1)
+		go func() {
+			resp, err := fn(ctx, &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage(prompt)}}, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			out <- resp.Text()
+		}()
+		return out
+	}
+	waitForCalls := func(n int32) {
+		for calls.Load() < n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx := context.Background()
+	first := generate(ctx, "hi")
+	waitForCalls(1)
+	duplicate := generate(ctx, "hi")
+	keyed := generate(WithIdempotencyKey(ctx, "k"), "hello")
+	waitForCalls(2)
+	sameKey := generate(WithIdempotencyKey(ctx, "k"), "something else")
+	// let the duplicates join the calls in flight
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for _, tt := range []struct {
+		out  <-chan string
+		want string
+	}{{first, "hi"}, {duplicate, "hi"}, {keyed, "hello"}, {sameKey, "hello"}} {
+		if got := <-tt.out; got != tt.want {
+			t.Errorf("want: %q, got: %q", tt.want, got)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("want: 2 upstream calls, got: %d", n)
+	}
+}
+
+func TestCopyResponse(t *testing.T) {
+	text := ai.NewTextPart("hello")
+	text.Metadata = map[string]any{"citations": []any{map[string]any{"cited_text": "a"}}}
+	call := ai.NewToolRequestPart(&ai.ToolRequest{Name: "lookup", Input: map[string]any{"q": "a"}})
+	resp := &ai.ModelResponse{
+		Message: &ai.Message{Role: ai.RoleModel, Content: []*ai.Part{text, call}, Metadata: map[string]any{"k": "v"}},
+		Usage:   &ai.GenerationUsage{InputTokens: 1, Custom: map[string]float64{UsageCacheReadInputTokens: 1}},
+	}
+	want, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := copyResponse(resp)
+	c.Message.Metadata["k"] = "changed"
+	c.Message.Content[0].Text = "changed"
+	c.Message.Content[0].Metadata["citations"].([]any)[0].(map[string]any)["cited_text"] = "changed"
+	c.Message.Content[1].ToolRequest.Input.(map[string]any)["q"] = "changed"
+	c.Usage.Custom[UsageCacheReadInputTokens] = 2
+
+	got, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := newTracer(tp)
+
+	fn := tracing(tracer, "claude-sonnet-4")(func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		if input.Messages == nil {
+			return nil, errors.New("no messages")
+		}
+		return &ai.ModelResponse{
+			FinishReason: ai.FinishReasonStop,
+			Usage: &ai.GenerationUsage{
+				InputTokens:  10,
+				OutputTokens: 5,
+				Custom:       map[string]float64{UsageCacheReadInputTokens: 3},
+			},
+			Custom: &anthropic.Message{ID: "msg_1", Model: "claude-sonnet-4-20250514", StopReason: anthropic.StopReasonEndTurn},
+		}, nil
+	})
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "generate")
+	if _, err := fn(ctx, &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fn(ctx, &ai.ModelRequest{}, func(context.Context, *ai.ModelResponseChunk) error { return nil }); err == nil {
+		t.Fatal("want: an error, got: nil")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("want: %d spans, got: %d", 3, len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "anthropic/generate" {
+		t.Errorf("want: %q, got: %q", "anthropic/generate", span.Name())
+	}
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("want: the span nested under the span of the context")
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	for k, want := range map[attribute.Key]string{
+		attrRequestModel:        "claude-sonnet-4",
+		attrResponseModel:       "claude-sonnet-4-20250514",
+		attrStopReason:          "end_turn",
+		attrInputTokens:         "10",
+		attrOutputTokens:        "5",
+		attrCacheReadTokens:     "3",
+		attrCacheCreationTokens: "0",
+	} {
+		if got := attrs[k].Emit(); got != want {
+			t.Errorf("%s: want: %q, got: %q", k, want, got)
+		}
+	}
+
+	failed := spans[1]
+	if failed.Name() != "anthropic/stream" {
+		t.Errorf("want: %q, got: %q", "anthropic/stream", failed.Name())
+	}
+	if failed.Status().Code != codes.Error {
+		t.Errorf("want: %v, got: %v", codes.Error, failed.Status().Code)
+	}
+}
+
+// recordingCounter records the values added to a counter by attribute set
+type recordingCounter struct {
+	noop.Int64Counter
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func (c *recordingCounter) Add(_ context.Context, n int64, opts ...metric.AddOption) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	set := metric.NewAddConfig(opts).Attributes()
+	c.values[set.Encoded(attribute.DefaultEncoder())] += n
+}
+
+func TestMetrics(t *testing.T) {
+	requests := &recordingCounter{values: map[string]int64{}}
+	tokens := &recordingCounter{values: map[string]int64{}}
+	m := &metrics{requests: requests, tokens: tokens, duration: noop.Float64Histogram{}}
+
+	fn := m.middleware("claude-sonnet-4")(func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		if input.Messages == nil {
+			return nil, &anthropic.Error{StatusCode: 529}
+		}
+		return &ai.ModelResponse{Usage: &ai.GenerationUsage{
+			InputTokens:  10,
+			OutputTokens: 5,
+			Custom:       map[string]float64{UsageCacheReadInputTokens: 3},
+		}}, nil
+	})
+	req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+	for range 2 {
+		if _, err := fn(context.Background(), req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fn(context.Background(), &ai.ModelRequest{}, nil); err == nil {
+		t.Fatal("want: an error, got: nil")
+	}
+
+	wantRequests := map[string]int64{
+		"gen_ai.request.model=claude-sonnet-4":                2,
+		"error.type=529,gen_ai.request.model=claude-sonnet-4": 1,
+	}
+	if !maps.Equal(requests.values, wantRequests) {
+		t.Errorf("want: %v, got: %v", wantRequests, requests.values)
+	}
+	wantTokens := map[string]int64{
+		"gen_ai.request.model=claude-sonnet-4,gen_ai.token.type=input":      20,
+		"gen_ai.request.model=claude-sonnet-4,gen_ai.token.type=output":     10,
+		"gen_ai.request.model=claude-sonnet-4,gen_ai.token.type=cache_read": 6,
+	}
+	if !maps.Equal(tokens.values, wantTokens) {
+		t.Errorf("want: %v, got: %v", wantTokens, tokens.values)
+	}
+}
+
+func TestCost(t *testing.T) {
+	usage := &ai.GenerationUsage{
+		InputTokens:  1_000_000,
+		OutputTokens: 100_000,
+		Custom: map[string]float64{
+			UsageCacheCreationInputTokens: 200_000,
+			UsageCacheReadInputTokens:     1_000_000,
+		},
+	}
+	tests := []struct {
+		name      string
+		overrides map[string]Pricing
+		model     string
+		metadata  map[string]any
+		want      float64
+		ok        bool
+	}{
+		{name: "default", model: "claude-sonnet-4", want: 3 + 1.5 + 0.75 + 0.3, ok: true},
+		{
+			name:      "override",
+			overrides: map[string]Pricing{"claude-sonnet-4": {Input: 2, Output: 10}},
+			model:     "claude-sonnet-4",
+			want:      2 + 1,
+			ok:        true,
+		},
+		{
+			name:     "fallback",
+			model:    "chain",
+			metadata: map[string]any{ModelMetadataKey: "claude-3-haiku"},
+			want:     0.25 + 0.125 + 0.06 + 0.03,
+			ok:       true,
+		},
+		{name: "unknown", model: "claude-future"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := costs(newPricing(tc.overrides), tc.model)(func(context.Context, *ai.ModelRequest, func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+				return &ai.ModelResponse{
+					Message: &ai.Message{Role: ai.RoleModel, Metadata: maps.Clone(tc.metadata)},
+					Usage:   usage,
+				}, nil
+			})
+			r, err := fn(context.Background(), &ai.ModelRequest{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := Cost(r)
+			if ok != tc.ok || math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("want: %v %v, got: %v %v", tc.want, tc.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestBudget(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 30, 0, 0, time.UTC)
+	b := newBudget(BudgetConfig{MaxCost: 1, Window: time.Hour}, func() time.Time { return now })
+	fn := b.middleware()(func(context.Context, *ai.ModelRequest, func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		return &ai.ModelResponse{
+			Message: &ai.Message{Role: ai.RoleModel, Metadata: map[string]any{CostMetadataKey: 0.6}},
+			Usage:   &ai.GenerationUsage{InputTokens: 100, OutputTokens: 20},
+		}, nil
+	})
+	call := func() error {
+		_, err := fn(context.Background(), &ai.ModelRequest{}, nil)
+		return err
+	}
+
+	for range 2 {
+		if err := call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var berr *BudgetExceededError
+	if err := call(); !errors.As(err, &berr) {
+		t.Fatalf("want: *BudgetExceededError, got: %v", err)
+	}
+	if want := time.Date(2025, 6, 1, 13, 0, 0, 0, time.UTC); !berr.ResetAt.Equal(want) {
+		t.Errorf("want: %v, got: %v", want, berr.ResetAt)
+	}
+	if berr.Tokens != 240 {
+		t.Errorf("want: %d, got: %d", 240, berr.Tokens)
+	}
+
+	// the budget is reset with the next window
+	now = now.Add(30 * time.Minute)
+	if err := call(); err != nil {
+		t.Errorf("want: nil, got: %v", err)
+	}
+}
+
+// fakeMessages answers every message with the same text
+type fakeMessages struct {
+	MessagesAPI
+	text     string
+	requests []anthropic.MessageNewParams
+}
+
+func (f *fakeMessages) New(_ context.Context, body anthropic.MessageNewParams, _ ...option.RequestOption) (*anthropic.Message, error) {
+	f.requests = append(f.requests, body)
+	var m anthropic.Message
+	err := m.UnmarshalJSON([]byte(fmt.Sprintf(`{"id":"msg_1","type":"message","role":"assistant","model":%q,"content":[{"type":"text","text":%q}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`, body.Model, f.text)))
+	return &m, err
+}
+
+func TestMessagesAPI(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	ctx := context.Background()
+	fake := &fakeMessages{text: "Hello from the fake"}
+	g, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: fake}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := genkit.Generate(ctx, g, ai.WithModel(ModelClaudeSonnet4), ai.WithPrompt("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text() != fake.text {
+		t.Errorf("want: %q, got: %q", fake.text, resp.Text())
+	}
+	if len(fake.requests) != 1 || fake.requests[0].Model != "claude-sonnet-4-20250514" {
+		t.Errorf("want: a request to claude-sonnet-4-20250514, got: %+v", fake.requests)
+	}
+}
+
+// toolLoopMessages replies with the tool_use blocks of a round per request,
+// then with a text
+type toolLoopMessages struct {
+	MessagesAPI
+	rounds []string
+	// stop is the stop reason of the rounds, tool_use when empty
+	stop     string
+	requests []anthropic.MessageNewParams
+}
+
+func (f *toolLoopMessages) New(_ context.Context, body anthropic.MessageNewParams, _ ...option.RequestOption) (*anthropic.Message, error) {
+	content, stop := `[{"type":"text","text":"done"}]`, "end_turn"
+	if n := len(f.requests); n < len(f.rounds) {
+		content, stop = f.rounds[n], cmp.Or(f.stop, "tool_use")
+	}
+	f.requests = append(f.requests, body)
+	var m anthropic.Message
+	err := m.UnmarshalJSON([]byte(fmt.Sprintf(`{"id":"msg_1","type":"message","role":"assistant","model":%q,"content":%s,"stop_reason":%q,"usage":{"input_tokens":1,"output_tokens":1}}`, body.Model, content, stop)))
+	return &m, err
+}
+
+func TestAnthropicToolLoop(t *testing.T) {
+	t.Run("rounds", func(t *testing.T) {
+		t.Setenv("ANTHROPIC_API_KEY", "")
+		ctx := context.Background()
+		fake := &toolLoopMessages{rounds: []string{
+			`[{"type":"tool_use","id":"toolu_1","name":"lookup","input":"Ada"},{"type":"tool_use","id":"toolu_2","name":"lookup","input":"Grace"}]`,
+			`[{"type":"text","text":"one more"},{"type":"tool_use","id":"toolu_3","name":"lookup","input":"Alan"}]`,
+		}}
+		g, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: fake}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lookup := genkit.DefineTool(g, "lookup", "looks up a person", func(ctx *ai.ToolContext, name string) (string, error) {
+			return "found " + name, nil
+		})
+
+		resp, err := genkit.Generate(ctx, g, ai.WithModel(ModelClaudeSonnet4), ai.WithPrompt("who wrote the first programs?"), ai.WithTools(lookup))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Text() != "done" {
+			t.Errorf("want: %q, got: %q", "done", resp.Text())
+		}
+		if len(fake.requests) != 3 {
+			t.Fatalf("want: 3 requests, got: %d", len(fake.requests))
+		}
+		// user, assistant tool_use, user tool_result, assistant tool_use, user tool_result
+		messages := fake.requests[2].Messages
+		roles := []anthropic.MessageParamRole{"user", "assistant", "user", "assistant", "user"}
+		if len(messages) != len(roles) {
+			t.Fatalf("want: %d messages, got: %d", len(roles), len(messages))
+		}
+		for i, role := range roles {
+			if messages[i].Role != role {
+				t.Errorf("message %d: want: %q, got: %q", i, role, messages[i].Role)
+			}
+		}
+		uses := map[string]bool{}
+		for _, m := range messages {
+			for _, b := range m.Content {
+				if b.OfToolUse != nil {
+					uses[b.OfToolUse.ID] = true
+				}
+				if b.OfToolResult != nil && !uses[b.OfToolResult.ToolUseID] {
+					t.Errorf("tool result of an unknown tool use: %q", b.OfToolResult.ToolUseID)
+				}
+			}
+		}
+		if len(uses) != 3 || len(messages[2].Content) != 2 || len(messages[4].Content) != 1 {
+			t.Errorf("want: 3 tool uses answered in their turn, got: %+v", messages)
+		}
+	})
+	t.Run("history without references", func(t *testing.T) {
+		req := &ai.ModelRequest{Messages: []*ai.Message{
+			ai.NewUserTextMessage("who wrote the first program?"),
+			ai.NewModelMessage(ai.NewToolRequestPart(&ai.ToolRequest{Name: "lookup", Input: "Ada"})),
+			ai.NewMessage(ai.RoleTool, nil, ai.NewToolResponsePart(&ai.ToolResponse{Name: "lookup", Output: "found"})),
+			ai.NewUserTextMessage("and who was she?"),
+		}}
+		ar, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ar.Messages) != 3 {
+			t.Fatalf("want: 3 messages, got: %d", len(ar.Messages))
+		}
+		use, result := ar.Messages[1].Content[0].OfToolUse, ar.Messages[2].Content[0].OfToolResult
+		if use == nil || result == nil || use.ID == "" || result.ToolUseID != use.ID {
+			t.Errorf("want: a tool result of the tool use, got: %+v, %+v", use, result)
+		}
+		if len(ar.Messages[2].Content) != 2 || ar.Messages[2].Role != anthropic.MessageParamRoleUser {
+			t.Errorf("want: the tool result and the text in a user message, got: %+v", ar.Messages[2])
+		}
+
+		req.Messages = []*ai.Message{
+			ai.NewUserTextMessage("hi"),
+			ai.NewMessage(ai.RoleTool, nil, ai.NewToolResponsePart(&ai.ToolResponse{Name: "lookup", Output: "found"})),
+		}
+		if _, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", req); err == nil {
+			t.Error("want: an error for a tool response without a tool request")
+		}
+	})
+}
+
+func TestToolInputValidation(t *testing.T) {
+	invalid := `[{"type":"tool_use","id":"toolu_1","name":"lookup","input":{"name":42}},{"type":"tool_use","id":"toolu_2","name":"clock","input":{}}]`
+	valid := `[{"type":"tool_use","id":"toolu_3","name":"lookup","input":{"name":"Ada"}}]`
+	request := func(repairs int) *ai.ModelRequest {
+		return &ai.ModelRequest{
+			Config:   &GenerationConfig{ToolInputRepairs: repairs},
+			Messages: []*ai.Message{ai.NewUserTextMessage("who is Ada?")},
+			Tools: []*ai.ToolDefinition{
+				{Name: "lookup", InputSchema: map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"name": map[string]any{"type": "string"}},
+					"required":   []string{"name"},
+				}},
+				{Name: "clock"},
+			},
+		}
+	}
+
+	t.Run("error", func(t *testing.T) {
+		fake := &toolLoopMessages{rounds: []string{invalid, valid}}
+		_, err := anthropicGenerate(context.Background(), fake, "claude-sonnet-4", request(-1), nil)
+		var verr *ToolInputValidationError
+		if !errors.As(err, &verr) || len(verr.Calls) != 1 || verr.Calls[0].Request.Ref != "toolu_1" || len(fake.requests) != 1 {
+			t.Errorf("want: the invalid lookup call, got: %v", err)
+		}
+	})
+	t.Run("repair", func(t *testing.T) {
+		fake := &toolLoopMessages{rounds: []string{invalid, valid}}
+		resp, err := anthropicGenerate(context.Background(), fake, "claude-sonnet-4", request(1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.requests) != 2 {
+			t.Fatalf("want: 2 requests, got: %d", len(fake.requests))
+		}
+		tr := resp.ToolRequests()
+		if len(tr) != 1 || tr[0].Ref != "toolu_3" || resp.Usage.InputTokens != 2 {
+			t.Errorf("want: the repaired tool call, got: %+v", resp.Message)
+		}
+		last := fake.requests[1].Messages[2]
+		if last.Role != anthropic.MessageParamRoleUser || len(last.Content) != 2 {
+			t.Fatalf("want: the results of both tool calls, got: %+v", last)
+		}
+		for _, b := range last.Content {
+			if b.OfToolResult == nil || !b.OfToolResult.IsError.Value {
+				t.Errorf("want: an error result, got: %+v", b)
+			}
+		}
+		if text := last.Content[0].OfToolResult.Content[0].OfText.Text; !strings.Contains(text, "name: Invalid type") {
+			t.Errorf("want: the validation error, got: %q", text)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		fake := &toolLoopMessages{rounds: []string{invalid}}
+		resp, err := anthropicGenerate(context.Background(), fake, "claude-sonnet-4", request(0), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.ToolRequests()) != 2 || len(fake.requests) != 1 {
+			t.Errorf("want: the tool calls as is, got: %+v", resp.Message)
+		}
+	})
+}
+
+func TestInterrupted(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	ctx := context.Background()
+	fake := &toolLoopMessages{rounds: []string{
+		`[{"type":"tool_use","id":"toolu_1","name":"transfer","input":{"amount":100}},{"type":"tool_use","id":"toolu_2","name":"balance","input":{}}]`,
+	}}
+	g, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: fake}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type Transfer struct {
+		Amount int `json:"amount"`
+	}
+	transfer := genkit.DefineTool(g, "transfer", "transfers money", func(ctx *ai.ToolContext, in Transfer) (string, error) {
+		return "", ctx.Interrupt(&ai.InterruptOptions{Metadata: map[string]any{"approval": "required"}})
+	})
+	balance := genkit.DefineTool(g, "balance", "returns the balance", func(ctx *ai.ToolContext, in struct{}) (int, error) {
+		return 1000, nil
+	})
+
+	resp, err := genkit.Generate(ctx, g, ai.WithModel(ModelClaudeSonnet4), ai.WithPrompt("send 100"), ai.WithTools(transfer, balance))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewInterrupted(&ai.ModelResponse{FinishReason: ai.FinishReasonStop}); err == nil {
+		t.Error("want: an error for a response not interrupted")
+	}
+	state, err := NewInterrupted(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the state is stored while waiting for the approval
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resumed Interrupted
+	if err := json.Unmarshal(data, &resumed); err != nil {
+		t.Fatal(err)
+	}
+	interrupts := resumed.Interrupts()
+	if len(interrupts) != 1 || interrupts[0].ToolRequest.Ref != "toolu_1" {
+		t.Fatalf("want: the interrupted transfer, got: %+v", interrupts)
+	}
+	if _, err := resumed.Resume(ai.NewToolResponsePart(&ai.ToolResponse{Name: "transfer", Ref: "toolu_9"})); err == nil {
+		t.Error("want: an error for the result of an unknown tool request")
+	}
+	opts, err := resumed.Resume(transfer.Respond(interrupts[0], "approved", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = genkit.Generate(ctx, g, append(opts, ai.WithModel(ModelClaudeSonnet4), ai.WithTools(transfer, balance))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text() != "done" {
+		t.Errorf("want: %q, got: %q", "done", resp.Text())
+	}
+
+	if len(fake.requests) != 2 {
+		t.Fatalf("want: 2 requests, got: %d", len(fake.requests))
+	}
+	messages := fake.requests[1].Messages
+	last := messages[len(messages)-1]
+	results := map[string]string{}
+	for _, b := range last.Content {
+		if r := b.OfToolResult; r != nil && len(r.Content) > 0 && r.Content[0].OfText != nil {
+			results[r.ToolUseID] = r.Content[0].OfText.Text
+		}
+	}
+	if last.Role != anthropic.MessageParamRoleUser || results["toolu_1"] != `"approved"` || results["toolu_2"] != "1000" {
+		t.Errorf("want: the results of both tool uses, got: %+v", results)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	ctx := context.Background()
+	fake := &fakeMessages{text: "not sent"}
+	g, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: fake}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ai.NewTextPart("a long document")
+	p.Metadata = map[string]any{CacheControlMetadataKey: true}
+	resp, err := genkit.Generate(ctx, g,
+		ai.WithModel(ModelClaudeSonnet4),
+		ai.WithConfig(&GenerationConfig{DryRun: true}),
+		ai.WithSystem("be brief"),
+		ai.WithMessages(ai.NewUserMessage(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("want: no request sent, got: %d", len(fake.requests))
+	}
+	req, ok := resp.Custom.(*anthropic.MessageNewParams)
+	if !ok {
+		t.Fatalf("want: *anthropic.MessageNewParams, got: %T", resp.Custom)
+	}
+	if req.Model != "claude-sonnet-4-20250514" || len(req.System) != 1 || req.System[0].Text != "be brief" {
+		t.Errorf("want: the converted request, got: %+v", req)
+	}
+	if got := req.Messages[0].Content[0].OfText.CacheControl.Type; got != "ephemeral" {
+		t.Errorf("want: %q, got: %q", "ephemeral", got)
+	}
+}
+
+func TestData(t *testing.T) {
+	tests := []struct {
+		name            string
+		part            *ai.Part
+		wantContentType string
+		wantData        string
+	}{
+		{name: "base64", part: ai.NewMediaPart("image/png", "iVBORw=="), wantContentType: "image/png", wantData: "\x89PNG"},
+		{name: "unpadded base64", part: ai.NewMediaPart("image/png", "iVBORw"), wantContentType: "image/png", wantData: "\x89PNG"},
+		{name: "content type parameters", part: ai.NewMediaPart("text/plain; charset=utf-8", "hello"), wantContentType: "text/plain", wantData: "hello"},
+		{name: "raw json", part: ai.NewMediaPart("application/json", `{"a":1}`), wantContentType: "application/json", wantData: `{"a":1}`},
+		{name: "base64 data URI", part: ai.NewMediaPart("", "data:image/png;base64,iVBORw=="), wantContentType: "image/png", wantData: "\x89PNG"},
+		{name: "data URI parameters", part: ai.NewMediaPart("", "data:text/plain;charset=utf-8;base64,aGVsbG8="), wantContentType: "text/plain", wantData: "hello"},
+		{name: "URL-encoded data URI", part: ai.NewMediaPart("", "data:text/plain,hello%20world%2C%20bye"), wantContentType: "text/plain", wantData: "hello world, bye"},
+		{name: "default data URI type", part: ai.NewMediaPart("", "data:,hi"), wantContentType: "text/plain", wantData: "hi"},
+		{name: "sniffed image", part: ai.NewMediaPart("", "iVBORw0KGgo="), wantContentType: "image/png", wantData: "\x89PNG\r\n\x1a\n"},
+		{name: "sniffed pdf", part: ai.NewMediaPart("application/octet-stream", "JVBERi0xLjc="), wantContentType: "application/pdf", wantData: "%PDF-1.7"},
+		{name: "sniffed data URI", part: ai.NewMediaPart("", "data:application/octet-stream;base64,R0lGODlh"), wantContentType: "image/gif", wantData: "GIF89a"},
+		{name: "unknown data", part: ai.NewMediaPart("", "AAEC"), wantContentType: "application/octet-stream", wantData: "\x00\x01\x02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, data, err := Data(context.Background(), tt.part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != tt.wantContentType {
+				t.Errorf("want: %q, got: %q", tt.wantContentType, contentType)
+			}
+			if string(data) != tt.wantData {
+				t.Errorf("want: %q, got: %q", tt.wantData, data)
+			}
+		})
+	}
+
+	if _, _, err := Data(context.Background(), ai.NewMediaPart("image/png", "not base64!")); err == nil {
+		t.Error("want: an error for invalid base64, got: nil")
+	}
+}
+
+func TestMediaValidation(t *testing.T) {
+	// webp returns a lossless WebP header of the given dimensions
+	webp := func(width, height uint32) string {
+		data := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2f")
+		data = binary.LittleEndian.AppendUint32(data, (width-1)|(height-1)<<14)
+		data = append(data, make([]byte, 10)...)
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	newRequest := func(parts ...*ai.Part) *ai.ModelRequest {
+		return &ai.ModelRequest{Messages: []*ai.Message{
+			ai.NewUserTextMessage("first"),
+			ai.NewUserMessage(append([]*ai.Part{ai.NewTextPart("look")}, parts...)...),
+		}}
+	}
+
+	tests := []struct {
+		name   string
+		req    *ai.ModelRequest
+		reason string
+	}{
+		{name: "png", req: newRequest(ai.NewMediaPart("image/png", pngBase64))},
+		{name: "webp", req: newRequest(ai.NewMediaPart("image/webp", webp(800, 600)))},
+		{name: "unsupported type", req: newRequest(ai.NewMediaPart("image/bmp", pngBase64)), reason: "unsupported image type"},
+		{name: "too large", req: newRequest(ai.NewMediaPart("image/png", base64.StdEncoding.EncodeToString(make([]byte, 6<<20)))), reason: "larger than 5242880 bytes"},
+		{name: "too many pixels", req: newRequest(ai.NewMediaPart("image/webp", webp(9000, 100))), reason: "9000x100 pixels"},
+		{name: "not an image", req: newRequest(ai.NewMediaPart("image/png", "aGVsbG8=")), reason: "invalid image/png image"},
+		{name: "too many images", req: newRequest(slices.Repeat([]*ai.Part{ai.NewMediaPart("image/png", pngBase64)}, 101)...), reason: "more than 100 images"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := toAnthropicRequest(context.Background(), "claude-sonnet-4", tt.req)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var merr *MediaError
+			if !errors.As(err, &merr) {
+				t.Fatalf("want: *MediaError, got: %v", err)
+			}
+			if merr.Message != 1 || merr.Part < 1 {
+				t.Errorf("want: message 1 and the part of the image, got: message %d, part %d", merr.Message, merr.Part)
+			}
+			if !strings.Contains(merr.Reason, tt.reason) {
+				t.Errorf("want: %q, got: %q", tt.reason, merr.Reason)
+			}
+		})
+	}
+}
+
+func TestImageResize(t *testing.T) {
+	encode := func(img image.Image) *ai.Part {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return ai.NewMediaPart("image/png", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	}
+	decode := func(p *ai.Part) (string, image.Config) {
+		contentType, data, err := Data(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contentType, cfg
+	}
+	large := encode(image.NewRGBA(image.Rect(0, 0, 3000, 2000)))
+	small := ai.NewMediaPart("image/png", pngBase64)
+	noise := image.NewRGBA(image.Rect(0, 0, 600, 600))
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for i := range noise.Pix {
+		noise.Pix[i] = byte(rnd.IntN(256))
+	}
+
+	input := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserMessage(ai.NewTextPart("look"), small, large)}}
+	c := ImageResizeConfig{}.withDefaults()
+	resized, err := c.resizeRequest(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if input.Messages[0].Content[2] != large {
+		t.Error("want: the request of the caller unchanged")
+	}
+	content := resized.Messages[0].Content
+	if content[1] != small {
+		t.Error("want: the small image sent as is")
+	}
+	if contentType, cfg := decode(content[2]); contentType != "image/png" || cfg.Width != 1313 || cfg.Height != 875 {
+		t.Errorf("want: a 1313x875 PNG, got: a %dx%d %s", cfg.Width, cfg.Height, contentType)
+	}
+
+	t.Run("max bytes", func(t *testing.T) {
+		c := ImageResizeConfig{MaxBytes: 100 << 10}.withDefaults()
+		p, err := c.resize(context.Background(), encode(noise))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, data, _ := Data(context.Background(), p)
+		if contentType != "image/jpeg" || len(data) > 100<<10 {
+			t.Errorf("want: a JPEG of at most 100KB, got: %s of %d bytes", contentType, len(data))
+		}
+	})
+}
+
+func TestGenerateMany(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		var body struct {
+			Messages []struct {
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		prompt := body.Messages[0].Content[0].Text
+		mu.Lock()
+		attempts[prompt]++
+		n = int32(attempts[prompt])
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case prompt == "flaky" && n == 1:
+			w.WriteHeader(529)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+		case prompt == "bad":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"invalid_request_error","message":"bad"}}`)
+		default:
+			fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":%q}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`, strings.ToUpper(prompt))
+		}
+	})
+
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &Anthropic{client: client, messages: &client.Messages}
+	if _, err := plugin.DefineModel(g, "claude-sonnet-4", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	prompts := []string{"a", "flaky", "b", "bad", "c", "d"}
+	requests := make([]*ai.ModelRequest, len(prompts))
+	for i, p := range prompts {
+		requests[i] = &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage(p)}}
+	}
+	results, err := GenerateMany(ctx, g, ModelClaudeSonnet4, requests, GenerateManyOptions{Concurrency: 2, RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range prompts {
+		r := results[i]
+		switch p {
+		case "bad":
+			if r.Err == nil || r.Attempts != 1 {
+				t.Errorf("want: a single failed attempt, got: %d, %v", r.Attempts, r.Err)
+			}
+		case "flaky":
+			if r.Err != nil || r.Attempts != 2 {
+				t.Errorf("want: a retried request, got: %d, %v", r.Attempts, r.Err)
+			}
+			fallthrough
+		default:
+			if r.Err != nil || r.Response.Text() != strings.ToUpper(p) {
+				t.Errorf("want: %q, got: %#v", strings.ToUpper(p), r)
+			}
+		}
+	}
+	if n := maxInFlight.Load(); n > 2 {
+		t.Errorf("want: at most 2 requests at the same time, got: %d", n)
+	}
+
+	if _, err := GenerateMany(ctx, g, NewModelRef("claude-unknown", nil), requests, GenerateManyOptions{}); err == nil {
+		t.Error("expecting an error for an undefined model")
+	}
+}
+
+func TestInlineMediaNotCopied(t *testing.T) {
+	pdf := base64.StdEncoding.EncodeToString([]byte("%PDF-1.7 a report"))
+	for _, tt := range []struct {
+		name    string
+		part    *ai.Part
+		encoded string
+	}{
+		{name: "base64 image", part: ai.NewMediaPart("image/png", pngBase64), encoded: pngBase64},
+		{name: "data URI image", part: ai.NewMediaPart("", "data:image/png;base64,"+pngBase64), encoded: pngBase64},
+		{name: "untyped image", part: ai.NewMediaPart("", pngBase64), encoded: pngBase64},
+		{name: "pdf", part: ai.NewMediaPart("application/pdf", pdf), encoded: pdf},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			block, err := toAnthropicMediaBlock(context.Background(), tt.part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data string
+			switch {
+			case block.OfImage != nil && block.OfImage.Source.OfBase64 != nil:
+				data = block.OfImage.Source.OfBase64.Data
+			case block.OfDocument != nil && block.OfDocument.Source.OfBase64 != nil:
+				data = block.OfDocument.Source.OfBase64.Data
+			default:
+				t.Fatalf("expecting a base64 block, got: %#v", block)
+			}
+			if data != tt.encoded {
+				t.Fatalf("want: %q, got: %q", tt.encoded, data)
+			}
+			if !strings.HasSuffix(tt.part.Text, data) || unsafe.StringData(data) != unsafe.StringData(tt.part.Text[len(tt.part.Text)-len(data):]) {
+				t.Error("the base64 data of the part was copied")
+			}
+		})
+	}
+
+	// the other encodings are decoded, the size of the inline data is computed
+	unpadded := strings.TrimRight(pngBase64, "=")
+	block, err := toAnthropicMediaBlock(context.Background(), ai.NewMediaPart("image/png", unpadded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := block.OfImage.Source.OfBase64.Data; got != pngBase64 {
+		t.Errorf("want: %q, got: %q", pngBase64, got)
+	}
+	m, err := readMedia(context.Background(), ai.NewMediaPart("image/png", pngBase64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.size() != len(png1x1) {
+		t.Errorf("want: %d, got: %d", len(png1x1), m.size())
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	rc := newResponseCache(ResponseCacheConfig{TTL: time.Minute, MaxEntries: 2}, func() time.Time { return now })
+	var calls int
+	fn := rc.middleware("claude-sonnet-4")(func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		calls++
+		if input.Messages[0].Text() == "fail" {
+			return nil, errors.New("failed")
+		}
+		return &ai.ModelResponse{Message: ai.NewModelTextMessage(fmt.Sprintf("%s %d", input.Messages[0].Text(), calls))}, nil
+	})
+	generate := func(prompt string, cb func(context.Context, *ai.ModelResponseChunk) error) *ai.ModelResponse {
+		t.Helper()
+		resp, err := fn(context.Background(), &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage(prompt)}}, cb)
+		if err != nil && prompt != "fail" {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	first := generate("hi", nil)
+	var streamed string
+	cached := generate("hi", func(ctx context.Context, chunk *ai.ModelResponseChunk) error {
+		streamed += chunk.Text()
+		return nil
+	})
+	if cached.Text() != "hi 1" || streamed != "hi 1" || calls != 1 {
+		t.Errorf("want: the cached response streamed, got: %q, %q after %d calls", cached.Text(), streamed, calls)
+	}
+	if cached.Message.Metadata[ResponseCachedMetadataKey] != true || first.Message.Metadata[ResponseCachedMetadataKey] != nil {
+		t.Errorf("want: only the cached response marked, got: %v and %v", first.Message.Metadata, cached.Message.Metadata)
+	}
+
+	generate("fail", nil)
+	generate("fail", nil)
+	if calls != 3 {
+		t.Errorf("want: the failed calls not cached, got: %d calls", calls)
+	}
+
+	now = now.Add(time.Minute)
+	if got := generate("hi", nil).Text(); got != "hi 4" {
+		t.Errorf("want: the expired response generated again, got: %q", got)
+	}
+
+	t.Run("least recently used evicted", func(t *testing.T) {
+		generate("a", nil)
+		generate("b", nil)
+		generate("a", nil)
+		generate("c", nil)
+		n := calls
+		generate("a", nil)
+		if calls != n {
+			t.Error("want: a still cached")
+		}
+		generate("b", nil)
+		if calls != n+1 {
+			t.Error("want: b evicted")
+		}
+	})
+}
+
+func TestGuardrails(t *testing.T) {
+	c := GuardrailsConfig{
+		CheckRequest: func(ctx context.Context, model string, req *ai.ModelRequest) (*ai.ModelRequest, error) {
+			text := req.Messages[0].Text()
+			if strings.Contains(text, "forbidden") {
+				return nil, &PolicyError{Reason: "forbidden topic"}
+			}
+			redacted := *req
+			redacted.Messages = []*ai.Message{ai.NewUserTextMessage(strings.ReplaceAll(text, "555-0100", "[phone]"))}
+			return &redacted, nil
+		},
+		CheckResponse: func(ctx context.Context, model string, resp *ai.ModelResponse) (*ai.ModelResponse, error) {
+			if strings.Contains(resp.Text(), "secret") {
+				return nil, &PolicyError{Reason: "leaked secret"}
+			}
+			return resp, nil
+		},
+	}
+	var sent []string
+	fn := c.middleware("claude-sonnet-4")(func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		text := input.Messages[0].Text()
+		sent = append(sent, text)
+		if cb != nil {
+			if err := cb(ctx, &ai.ModelResponseChunk{Content: []*ai.Part{ai.NewTextPart("unchecked")}}); err != nil {
+				return nil, err
+			}
+		}
+		return &ai.ModelResponse{Message: ai.NewModelTextMessage("echo: " + text)}, nil
+	})
+	generate := func(prompt string, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		return fn(context.Background(), &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage(prompt)}}, cb)
+	}
+
+	var streamed []string
+	resp, err := generate("call me at 555-0100", func(ctx context.Context, chunk *ai.ModelResponseChunk) error {
+		streamed = append(streamed, chunk.Text())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo: call me at [phone]"; resp.Text() != want || !slices.Equal(streamed, []string{want}) {
+		t.Errorf("want: the rewritten request and the checked response streamed, got: %q, %q", resp.Text(), streamed)
+	}
+
+	for _, tt := range []struct {
+		prompt string
+		stage  GuardrailStage
+		reason string
+	}{
+		{prompt: "a forbidden question", stage: GuardrailRequest, reason: "forbidden topic"},
+		{prompt: "tell me the secret", stage: GuardrailResponse, reason: "leaked secret"},
+	} {
+		n := len(sent)
+		_, err := generate(tt.prompt, nil)
+		var perr *PolicyError
+		if !errors.As(err, &perr) || perr.Stage != tt.stage || perr.Reason != tt.reason || perr.Model != "claude-sonnet-4" {
+			t.Errorf("want: a %s policy error, got: %v", tt.stage, err)
+		}
+		if tt.stage == GuardrailRequest && len(sent) != n {
+			t.Error("want: the vetoed request not sent")
+		}
+	}
+}
+
+// countingMessages is a fake Messages API counting 100 input tokens per message
+type countingMessages struct {
+	fakeMessages
+	counts int
+}
+
+func (f *countingMessages) CountTokens(_ context.Context, body anthropic.MessageCountTokensParams, _ ...option.RequestOption) (*anthropic.MessageTokensCount, error) {
+	f.counts++
+	return &anthropic.MessageTokensCount{InputTokens: int64(100 * len(body.Messages))}, nil
+}
+
+func TestTruncation(t *testing.T) {
+	long := strings.Repeat("x", 400)
+	weather := &ai.ToolRequest{Ref: "toolu_1", Name: "weather", Input: map[string]any{}}
+	messages := []*ai.Message{
+		ai.NewSystemTextMessage("be brief"),
+		ai.NewUserTextMessage("first " + long),
+		ai.NewModelTextMessage("one"),
+		ai.NewUserTextMessage("second " + long),
+		ai.NewModelMessage(ai.NewToolRequestPart(weather)),
+		ai.NewMessage(ai.RoleUser, nil, ai.NewToolResponsePart(&ai.ToolResponse{Ref: "toolu_1", Name: "weather", Output: "sunny"})),
+		ai.NewModelTextMessage("two"),
+		ai.NewUserTextMessage("third " + long),
+	}
+	sent := func(t *testing.T, client MessagesAPI, c *TruncationConfig) []string {
+		t.Helper()
+		resp, err := anthropicGenerate(context.Background(), client, "claude-sonnet-4", &ai.ModelRequest{
+			Messages: messages,
+			Config:   &GenerationConfig{DryRun: true, Truncation: c},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := resp.Custom.(*anthropic.MessageNewParams)
+		if len(req.System) != 1 {
+			t.Errorf("want: the system prompt kept, got: %+v", req.System)
+		}
+		var firsts []string
+		for _, m := range req.Messages {
+			switch b := m.Content[0]; {
+			case b.OfText != nil:
+				firsts = append(firsts, strings.Fields(b.OfText.Text)[0])
+			case b.OfToolUse != nil:
+				firsts = append(firsts, "tool_use")
+			case b.OfToolResult != nil:
+				firsts = append(firsts, "tool_result")
+			}
+		}
+		return firsts
+	}
+
+	for _, tt := range []struct {
+		name string
+		c    *TruncationConfig
+		want []string
+	}{
+		{name: "disabled", want: []string{"first", "one", "second", "tool_use", "tool_result", "two", "third"}},
+		{name: "max turns", c: &TruncationConfig{MaxTurns: 2}, want: []string{"second", "tool_use", "tool_result", "two", "third"}},
+		{name: "estimated tokens", c: &TruncationConfig{MaxInputTokens: 250}, want: []string{"second", "tool_use", "tool_result", "two", "third"}},
+		{name: "last turn kept", c: &TruncationConfig{MaxInputTokens: 10}, want: []string{"third"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sent(t, &fakeMessages{}, tt.c); !slices.Equal(got, tt.want) {
+				t.Errorf("want: %q, got: %q", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("counted tokens", func(t *testing.T) {
+		fake := &countingMessages{}
+		got := sent(t, fake, &TruncationConfig{MaxInputTokens: 300, Count: ContextWindowCheckCount})
+		if want := []string{"third"}; !slices.Equal(got, want) {
+			t.Errorf("want: %q, got: %q", want, got)
+		}
+		if fake.counts > 2 {
+			t.Errorf("want: at most 2 token counts, got: %d", fake.counts)
+		}
+	})
+}
+
+func TestContextManagement(t *testing.T) {
+	var beta string
+	var sent map[string]any
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		beta = r.Header.Get("anthropic-beta")
+		if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","stop_reason":"end_turn",
+			"content":[{"type":"text","text":"done"}],
+			"context_management":{"applied_edits":[{"type":"clear_tool_uses_20250919","cleared_tool_uses":8,"cleared_input_tokens":50000}]},
+			"usage":{"input_tokens":10,"output_tokens":5}}`)
+	})
+
+	req := &ai.ModelRequest{
+		Config: &GenerationConfig{ContextManagement: &ContextManagementConfig{ClearToolUses: &ClearToolUsesConfig{
+			TriggerInputTokens: 30000,
+			KeepToolUses:       2,
+			ExcludeTools:       []string{"memory"},
+		}}},
+		Messages: []*ai.Message{ai.NewUserTextMessage("go on")},
+	}
+	resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beta != contextManagementBeta {
+		t.Errorf("want: %q, got: %q", contextManagementBeta, beta)
+	}
+	got, _ := json.Marshal(sent["context_management"])
+	if want := `{"edits":[{"exclude_tools":["memory"],"keep":{"type":"tool_uses","value":2},"trigger":{"type":"input_tokens","value":30000},"type":"clear_tool_uses_20250919"}]}`; string(got) != want {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+	want := []*ContextEdit{{Type: "clear_tool_uses_20250919", ClearedToolUses: 8, ClearedInputTokens: 50000}}
+	if edits := ContextEdits(resp); !reflect.DeepEqual(edits, want) {
+		t.Errorf("want: %v, got: %v", want, edits)
+	}
+
+	t.Run("decoded metadata", func(t *testing.T) {
+		b, err := json.Marshal(resp.Message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m ai.Message
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		if edits := ContextEdits(&ai.ModelResponse{Message: &m}); !reflect.DeepEqual(edits, want) {
+			t.Errorf("want: %v, got: %v", want, edits)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		client := newStreamingTestClient(t,
+			`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-20250514","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"done"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2},"context_management":{"applied_edits":[{"type":"clear_tool_uses_20250919","cleared_tool_uses":8,"cleared_input_tokens":50000}]}}`,
+			`{"type":"message_stop"}`,
+		)
+		resp, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, func(context.Context, *ai.ModelResponseChunk) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edits := ContextEdits(resp); !reflect.DeepEqual(edits, want) {
+			t.Errorf("want: %v, got: %v", want, edits)
+		}
+	})
+}
+
+func TestMemoryTool(t *testing.T) {
+	store, err := NewFileMemoryStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	run := func(c MemoryCommand) string {
+		t.Helper()
+		out, err := runMemoryCommand(ctx, store, c)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Command, err)
+		}
+		return out
+	}
+
+	run(MemoryCommand{Command: "create", Path: "/memories/notes/todo.md", FileText: "buy milk\ncall mom\n"})
+	run(MemoryCommand{Command: "str_replace", Path: "/memories/notes/todo.md", OldStr: "milk", NewStr: "bread"})
+	run(MemoryCommand{Command: "insert", Path: "/memories/notes/todo.md", InsertLine: 0, InsertText: "# TODO\n"})
+	if got, want := run(MemoryCommand{Command: "view", Path: "/memories/notes/todo.md", ViewRange: []int{1, 2}}),
+		"Here's the content of /memories/notes/todo.md with line numbers:\n     1\t# TODO\n     2\tbuy bread\n"; got != want {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	run(MemoryCommand{Command: "rename", OldPath: "/memories/notes/todo.md", NewPath: "/memories/todo.md"})
+	run(MemoryCommand{Command: "create", Path: "/memories/notes/ideas.md", FileText: "a plugin"})
+	if got, want := run(MemoryCommand{Command: "view", Path: "/memories"}), "Directory: /memories\n- /memories/notes/ideas.md\n- /memories/todo.md\n"; got != want {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+	run(MemoryCommand{Command: "delete", Path: "/memories/notes"})
+	files, err := store.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"todo.md"}; !slices.Equal(files, want) {
+		t.Errorf("want: %q, got: %q", want, files)
+	}
+
+	for _, c := range []MemoryCommand{
+		{Command: "view", Path: "/memories/../etc/passwd"},
+		{Command: "create", Path: "/tmp/notes.md"},
+		{Command: "view", Path: "/memories/missing.md"},
+		{Command: "str_replace", Path: "/memories/todo.md", OldStr: "nothing like it"},
+		{Command: "delete", Path: "/memories"},
+		{Command: "undo_edit", Path: "/memories/todo.md"},
+	} {
+		var terr *ToolError
+		if _, err := runMemoryCommand(ctx, store, c); !errors.As(err, &terr) {
+			t.Errorf("%s %s: want: a tool error, got: %v", c.Command, c.Path, err)
+		}
+	}
+}
+
+func TestModelLifecycle(t *testing.T) {
+	l, ok := Lifecycle("claude-3-7-sonnet-20250219")
+	if !ok {
+		t.Fatal("expecting a deprecation schedule")
+	}
+	if at := date(2025, time.October, 1); l.IsDeprecated(at) || l.IsRetired(at) {
+		t.Errorf("expecting the model to be supported on %v", at)
+	}
+	if at := date(2025, time.December, 1); !l.IsDeprecated(at) || l.IsRetired(at) {
+		t.Errorf("expecting the model to be deprecated on %v", at)
+	}
+	if at := date(2026, time.March, 1); !l.IsRetired(at) {
+		t.Errorf("expecting the model to be retired on %v", at)
+	}
+	if _, ok := Lifecycle("claude-sonnet-4-5"); ok {
+		t.Errorf("expecting no deprecation schedule")
+	}
+
+	info := withLifecycle("claude-3-5-haiku", anthropicModels["claude-3-5-haiku"], date(2026, time.January, 1))
+	if info.Stage != ai.ModelStageDeprecated {
+		t.Errorf("want: %q, got: %q", ai.ModelStageDeprecated, info.Stage)
+	}
+	if info := withLifecycle("claude-3-5-haiku", anthropicModels["claude-3-5-haiku"], date(2025, time.January, 1)); info.Stage != "" {
+		t.Errorf("want: no stage, got: %q", info.Stage)
+	}
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	ctx := context.Background()
+	for range 2 {
+		warnDeprecated(ctx, "claude-3-5-haiku-20241022", date(2025, time.December, 1))
+		warnDeprecated(ctx, "claude-sonnet-4-5", date(2025, time.December, 1))
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expecting a single warning, got: %q", lines)
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"level":       "WARN",
+		"msg":         "anthropic: model is deprecated",
+		"model":       "claude-3-5-haiku-20241022",
+		"deprecated":  "2025-10-28",
+		"retired":     "2026-02-19",
+		"replacement": "claude-haiku-4-5",
+	}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("%s: want: %q, got: %q", k, v, record[k])
+		}
+	}
+}
+
+func TestValidateVersions(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch id := strings.TrimPrefix(r.URL.Path, "/v1/models/"); id {
+		case "claude-custom-20250101", "claude-custom-latest":
+			fmt.Fprintf(w, `{"type":"model","id":%q,"display_name":"Claude Custom","created_at":"2025-01-01T00:00:00Z"}`, id)
+		case "claude-broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"api_error","message":"Internal server error"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"type":"error","error":{"type":"not_found_error","message":"model: %s"}}`, id)
+		}
+	})
+	g, err := genkit.Init(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &Anthropic{client: c, messages: &c.Messages, ValidateVersions: true}
+
+	if _, err := plugin.DefineModel(g, "claude-custom", &ai.ModelInfo{Supports: &Multimodal, Versions: []string{"claude-custom-20250101", "claude-custom-latest"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = plugin.DefineModel(g, "claude-typo", &ai.ModelInfo{Supports: &Multimodal, Versions: []string{"claude-custom-20250101", "claude-custom-2025011"}})
+	if err == nil || !strings.Contains(err.Error(), "unknown versions of model \"claude-typo\": claude-custom-2025011") {
+		t.Errorf("want: an unknown version error, got: %v", err)
+	}
+	if _, err := plugin.DefineModel(g, "claude-nameless", &ai.ModelInfo{Supports: &Multimodal}); err == nil {
+		t.Error("want: an error for an unknown model name")
+	}
+	if _, err := plugin.DefineModel(g, "claude-broken", &ai.ModelInfo{Supports: &Multimodal}); err == nil || strings.Contains(err.Error(), "unknown versions") {
+		t.Errorf("want: an error validating the versions, got: %v", err)
+	}
+	if IsDefinedModel(g, "claude-typo") {
+		t.Error("want: the model with a typo not defined")
+	}
+
+	plugin = &Anthropic{messages: &fakeMessages{}, ValidateVersions: true}
+	if _, err := plugin.DefineModel(g, "claude-offline", &ai.ModelInfo{Supports: &Multimodal}); err == nil {
+		t.Error("want: an error without an API key")
+	}
+}
+
+func TestModelVersions(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	ctx := context.Background()
+	fake := &fakeMessages{text: "hi"}
+	plugin := &Anthropic{Messages: fake}
+	g, err := genkit.Init(ctx, genkit.WithPlugins(plugin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := plugin.DefineModel(g, "claude-custom", &ai.ModelInfo{Supports: &Multimodal, Versions: []string{"claude-custom-20250101", "claude-custom-20250601"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := func(version string) *GenerationConfig {
+		return &GenerationConfig{GenerationCommonConfig: ai.GenerationCommonConfig{Version: version}}
+	}
+
+	tests := []struct {
+		name  string
+		model ai.ModelArg
+		want  string
+	}{
+		{name: "default version", model: ModelClaudeSonnet4, want: "claude-sonnet-4-20250514"},
+		{name: "pinned snapshot", model: NewModelRef("claude-3-7-sonnet", pinned("claude-3-7-sonnet-20250219")), want: "claude-3-7-sonnet-20250219"},
+		{name: "pinned alias", model: NewModelRef("claude-sonnet-4", pinned("claude-sonnet-4-0")), want: "claude-sonnet-4-0"},
+		{name: "custom model default version", model: custom, want: "claude-custom-20250101"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.requests = nil
+			if _, err := genkit.Generate(ctx, g, ai.WithModel(tt.model), ai.WithPrompt("hi")); err != nil {
+				t.Fatal(err)
+			}
+			if len(fake.requests) != 1 || string(fake.requests[0].Model) != tt.want {
+				t.Errorf("want: %q, got: %v", tt.want, fake.requests)
+			}
+		})
+	}
+
+	if _, err := genkit.Generate(ctx, g, ai.WithModel(custom), ai.WithConfig(pinned("claude-custom-20250601")), ai.WithPrompt("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fake.requests[len(fake.requests)-1].Model); got != "claude-custom-20250601" {
+		t.Errorf("want: %q, got: %q", "claude-custom-20250601", got)
+	}
+	if _, err := genkit.Generate(ctx, g, ai.WithModel(NewModelRef("claude-sonnet-4", pinned("claude-sonnet-4-20990101"))), ai.WithPrompt("hi")); err == nil {
+		t.Errorf("expecting an error for an unknown version")
+	}
+	if _, err := EncodeBatchRequest(context.Background(), BatchRequest{CustomID: "a", Model: "claude-sonnet-4", Request: &ai.ModelRequest{
+		Config:   pinned("claude-sonnet-4-20990101"),
+		Messages: []*ai.Message{ai.NewUserTextMessage("hi")},
+	}}); err == nil {
+		t.Errorf("expecting an error for an unknown version in a batch")
+	}
+}
+
+func TestModelAliases(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	ctx := context.Background()
+	fake := &fakeMessages{text: "hi"}
+	g, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: fake, Aliases: map[string]string{
+		"prod-chat": "claude-sonnet-4-20250514",
+		"fast":      "claude-haiku-4-5",
+		"next":      "claude-opus-5-20270101",
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for alias, want := range map[string]string{
+		"prod-chat": "claude-sonnet-4-20250514",
+		"fast":      "claude-haiku-4-5-20251001",
+		"next":      "claude-opus-5-20270101",
+	} {
+		fake.requests = nil
+		if _, err := genkit.Generate(ctx, g, ai.WithModelName(provider+"/"+alias), ai.WithPrompt("hi")); err != nil {
+			t.Fatalf("%s: %v", alias, err)
+		}
+		if len(fake.requests) != 1 || string(fake.requests[0].Model) != want {
+			t.Errorf("%s: want: %q, got: %v", alias, want, fake.requests)
+		}
+	}
+
+	// an alias of an ID generates with this version only
+	config := &GenerationConfig{GenerationCommonConfig: ai.GenerationCommonConfig{Version: "claude-sonnet-4-0"}}
+	if _, err := genkit.Generate(ctx, g, ai.WithModelName(provider+"/prod-chat"), ai.WithConfig(config), ai.WithPrompt("hi")); err == nil {
+		t.Errorf("expecting an error for another version of the alias")
+	}
+	if _, err := genkit.Generate(ctx, g, ai.WithModelName(provider+"/fast"), ai.WithConfig(&GenerationConfig{
+		GenerationCommonConfig: ai.GenerationCommonConfig{Version: "claude-haiku-4-5"},
+	}), ai.WithPrompt("hi")); err != nil {
+		t.Errorf("expecting the versions of the model on its alias, got: %v", err)
+	}
+
+	for _, aliases := range []map[string]string{{"claude-sonnet-4": "claude-opus-4"}, {"empty": ""}} {
+		if _, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: fake, Aliases: aliases})); err == nil {
+			t.Errorf("%v: expecting an error", aliases)
+		}
+	}
+}
+
+func TestAdminReports(t *testing.T) {
+	start := time.Date(2025, time.October, 1, 0, 0, 0, 0, time.UTC)
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		q := r.URL.Query()
+		if got := q.Get("starting_at"); got != "2025-10-01T00:00:00Z" {
+			t.Errorf("want: %q, got: %q", "2025-10-01T00:00:00Z", got)
+		}
+		switch r.URL.Path {
+		case "/v1/organizations/usage_report/messages":
+			if got := q["group_by[]"]; !slices.Equal(got, []string{"model"}) || q.Get("bucket_width") != "1d" || q.Get("models[]") != "claude-sonnet-4-20250514" {
+				t.Errorf("unexpected query: %v", q)
+			}
+			if q.Get("page") == "" {
+				fmt.Fprint(w, `{"data":[{"starting_at":"2025-10-01T00:00:00Z","ending_at":"2025-10-02T00:00:00Z","results":[
+					{"model":"claude-sonnet-4-20250514","uncached_input_tokens":100,"cache_read_input_tokens":20,
+					"cache_creation":{"ephemeral_5m_input_tokens":30,"ephemeral_1h_input_tokens":40},"output_tokens":50,
+					"server_tool_use":{"web_search_requests":2}}]}],"has_more":true,"next_page":"page_2"}`)
+				return
+			}
+			if q.Get("page") != "page_2" {
+				t.Errorf("want: %q, got: %q", "page_2", q.Get("page"))
+			}
+			fmt.Fprint(w, `{"data":[{"starting_at":"2025-10-02T00:00:00Z","ending_at":"2025-10-03T00:00:00Z","results":[]}],"has_more":false,"next_page":null}`)
+		case "/v1/organizations/cost_report":
+			if got := q["group_by[]"]; !slices.Equal(got, []string{"workspace_id", "description"}) {
+				t.Errorf("unexpected query: %v", q)
+			}
+			fmt.Fprint(w, `{"data":[{"starting_at":"2025-10-01T00:00:00Z","ending_at":"2025-10-02T00:00:00Z","results":[
+				{"currency":"USD","amount":"1234.5","workspace_id":"wrkspc_1","description":"Claude Sonnet 4 Usage - Input Tokens",
+				"cost_type":"tokens","model":"claude-sonnet-4-20250514","token_type":"uncached_input_tokens"}]}],"has_more":false,"next_page":null}`)
+		default:
+			t.Errorf("unexpected request: %s", r.URL.Path)
+		}
+	})
+	ctx := context.Background()
+	admin := (&Anthropic{admin: client}).Admin()
+
+	usage, err := admin.UsageReport(ctx, UsageReportParams{StartingAt: start, BucketWidth: "1d", GroupBy: []string{"model"}, Models: []string{"claude-sonnet-4-20250514"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || len(usage[0].Results) != 1 || len(usage[1].Results) != 0 {
+		t.Fatalf("unexpected usage: %v", usage)
+	}
+	want := UsageResult{
+		Model:                   "claude-sonnet-4-20250514",
+		UncachedInputTokens:     100,
+		CacheReadInputTokens:    20,
+		CacheWrite5mInputTokens: 30,
+		CacheWrite1hInputTokens: 40,
+		OutputTokens:            50,
+		WebSearchRequests:       2,
+	}
+	if got := *usage[0].Results[0]; got != want {
+		t.Errorf("want: %+v, got: %+v", want, got)
+	}
+	if !usage[0].StartingAt.Equal(start) {
+		t.Errorf("want: %v, got: %v", start, usage[0].StartingAt)
+	}
+
+	costs, err := admin.CostReport(ctx, CostReportParams{StartingAt: start, GroupBy: []string{"workspace_id", "description"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(costs) != 1 || len(costs[0].Results) != 1 {
+		t.Fatalf("unexpected costs: %v", costs)
+	}
+	if c := costs[0].Results[0]; c.Amount != 12.345 || c.Currency != "USD" || c.WorkspaceID != "wrkspc_1" || c.TokenType != "uncached_input_tokens" {
+		t.Errorf("unexpected cost: %+v", c)
+	}
+
+	if _, err := (&Anthropic{}).Admin().UsageReport(ctx, UsageReportParams{StartingAt: start}); err == nil {
+		t.Errorf("expecting an error without an admin key")
+	}
+}
+
+func TestWorkspaces(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	var models []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Api-Key"); got != "sk-ant-acme" {
+			t.Errorf("want: %q, got: %q", "sk-ant-acme", got)
+		}
+		var body struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		models = append(models, body.Model)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"msg_1","type":"message","role":"assistant","model":%q,"content":[{"type":"text","text":"from acme"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`, body.Model)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	fake := &fakeMessages{text: "from default"}
+	g, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{
+		Messages:      fake,
+		ResponseCache: &ResponseCacheConfig{},
+		Workspaces: map[string]Workspace{
+			"acme": {
+				APIKey:  "sk-ant-acme",
+				BaseURL: srv.URL,
+				Models:  map[string]string{"claude-sonnet-4": "claude-sonnet-4-0"},
+				Options: []option.RequestOption{option.WithMaxRetries(0)},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generate := func(ctx context.Context, opts ...ai.GenerateOption) string {
+		t.Helper()
+		resp, err := genkit.Generate(ctx, g, append([]ai.GenerateOption{ai.WithModel(ModelClaudeSonnet4), ai.WithPrompt("hi")}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Text()
+	}
+
+	if got := generate(ctx); got != "from default" {
+		t.Errorf("want: %q, got: %q", "from default", got)
+	}
+	// the cached response of the default workspace is not returned to acme
+	if got := generate(WithWorkspace(ctx, "acme")); got != "from acme" {
+		t.Errorf("want: %q, got: %q", "from acme", got)
+	}
+	if got := generate(ctx, ai.WithConfig(&GenerationConfig{Workspace: "acme", Citations: true})); got != "from acme" {
+		t.Errorf("want: %q, got: %q", "from acme", got)
+	}
+	if want := []string{"claude-sonnet-4-0", "claude-sonnet-4-0"}; !slices.Equal(models, want) {
+		t.Errorf("want: %q, got: %q", want, models)
+	}
+	if len(fake.requests) != 1 {
+		t.Errorf("want: 1 request, got: %d", len(fake.requests))
+	}
+
+	if _, err := genkit.Generate(WithWorkspace(ctx, "globex"), g, ai.WithModel(ModelClaudeSonnet4), ai.WithPrompt("hi")); err == nil {
+		t.Errorf("expecting an error for an unknown workspace")
+	}
+	if _, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: fake, Workspaces: map[string]Workspace{"acme": {}}})); err == nil {
+		t.Errorf("expecting an error for a workspace without an API key")
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	for _, tt := range []struct {
+		status  int
+		body    string
+		want    error
+		wantErr APIError
+	}{
+		{
+			status:  http.StatusBadRequest,
+			body:    `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: Field required"},"request_id":"req_body"}`,
+			want:    ErrInvalidRequest,
+			wantErr: APIError{StatusCode: 400, Type: "invalid_request_error", Message: "max_tokens: Field required", RequestID: "req_1"},
+		},
+		{
+			status:  http.StatusUnauthorized,
+			body:    `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`,
+			want:    ErrAuthentication,
+			wantErr: APIError{StatusCode: 401, Type: "authentication_error", Message: "invalid x-api-key", RequestID: "req_1"},
+		},
+		{
+			status:  http.StatusForbidden,
+			body:    `{"type":"error","error":{"type":"permission_error","message":"no access"}}`,
+			want:    ErrPermission,
+			wantErr: APIError{StatusCode: 403, Type: "permission_error", Message: "no access", RequestID: "req_1"},
+		},
+		{
+			status:  http.StatusNotFound,
+			body:    `{"type":"error","error":{"type":"not_found_error","message":"model: claude-typo"}}`,
+			want:    ErrNotFound,
+			wantErr: APIError{StatusCode: 404, Type: "not_found_error", Message: "model: claude-typo", RequestID: "req_1"},
+		},
+		{
+			status:  http.StatusRequestEntityTooLarge,
+			body:    `request too large`,
+			want:    ErrRequestTooLarge,
+			wantErr: APIError{StatusCode: 413, Type: "request_too_large", RequestID: "req_1"},
+		},
+		{
+			status:  http.StatusTooManyRequests,
+			body:    `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`,
+			want:    ErrAPIRateLimited,
+			wantErr: APIError{StatusCode: 429, Type: "rate_limit_error", Message: "slow down", RequestID: "req_1"},
+		},
+		{
+			status:  statusOverloaded,
+			body:    `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			want:    ErrOverloaded,
+			wantErr: APIError{StatusCode: 529, Type: "overloaded_error", Message: "Overloaded", RequestID: "req_1"},
+		},
+	} {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("request-id", "req_1")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+			req := &ai.ModelRequest{Messages: []*ai.Message{ai.NewUserTextMessage("hi")}}
+			_, err := anthropicGenerate(context.Background(), &client.Messages, "claude-sonnet-4", req, nil)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("want: %v, got: %v", tt.want, err)
+			}
+			if errors.Is(err, ErrServer) {
+				t.Errorf("expecting %v not to match %v", err, ErrServer)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("want: *APIError, got: %T", err)
+			}
+			got := *apiErr
+			got.Err = nil
+			if got != tt.wantErr {
+				t.Errorf("want: %+v, got: %+v", tt.wantErr, got)
+			}
+			var sdkErr *anthropic.Error
+			if !errors.As(err, &sdkErr) || sdkErr.StatusCode != tt.status {
+				t.Errorf("expecting the SDK error, got: %v", err)
+			}
+		})
+	}
+
+	err := apiError(errors.New(streamErrorPrefix + `{"type":"error","error":{"type":"api_error","message":"Internal server error"}}`))
+	var apiErr *APIError
+	if !errors.Is(err, ErrServer) || !errors.As(err, &apiErr) || apiErr.StatusCode != 0 {
+		t.Errorf("unexpected stream error: %#v", err)
+	}
+	if want := "anthropic: api_error: Internal server error"; err.Error() != want {
+		t.Errorf("want: %q, got: %q", want, err.Error())
+	}
+}
+
+func TestGenkitStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want core.StatusName
+	}{
+		{name: "invalid request", err: &APIError{StatusCode: 400, Type: "invalid_request_error"}, want: core.INVALID_ARGUMENT},
+		{name: "authentication", err: &APIError{StatusCode: 401, Type: "authentication_error"}, want: core.UNAUTHENTICATED},
+		{name: "permission", err: &APIError{StatusCode: 403, Type: "permission_error"}, want: core.PERMISSION_DENIED},
+		{name: "not found", err: &APIError{StatusCode: 404, Type: "not_found_error"}, want: core.NOT_FOUND},
+		{name: "api rate limit", err: &APIError{StatusCode: 429, Type: "rate_limit_error"}, want: core.RESOURCE_EXHAUSTED},
+		{name: "server", err: &APIError{StatusCode: 500, Type: "api_error"}, want: core.INTERNAL},
+		{name: "unknown server error", err: &APIError{StatusCode: 503, Type: "unknown_error"}, want: core.INTERNAL},
+		{name: "overloaded", err: &APIError{StatusCode: 529, Type: "overloaded_error"}, want: core.UNAVAILABLE},
+		{name: "wrapped", err: fmt.Errorf("continuation 1: %w", &APIError{Type: "overloaded_error"}), want: core.UNAVAILABLE},
+		{name: "context window", err: &ContextWindowExceededError{}, want: core.INVALID_ARGUMENT},
+		{name: "media", err: &MediaError{}, want: core.INVALID_ARGUMENT},
+		{name: "policy", err: &PolicyError{}, want: core.PERMISSION_DENIED},
+		{name: "budget", err: &BudgetExceededError{}, want: core.RESOURCE_EXHAUSTED},
+		{name: "rate limiter", err: ErrRateLimited, want: core.RESOURCE_EXHAUSTED},
+		{name: "circuit open", err: &CircuitOpenError{}, want: core.UNAVAILABLE},
+		{name: "network", err: io.ErrUnexpectedEOF, want: core.UNAVAILABLE},
+		{name: "deadline", err: context.DeadlineExceeded, want: core.DEADLINE_EXCEEDED},
+		{name: "canceled", err: context.Canceled, want: core.CANCELLED},
+		{name: "other", err: errors.New("boom")},
+		{name: "genkit error", err: core.NewError(core.ABORTED, "aborted")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := genkitStatus(tt.err)
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("want: %q, got: %q", tt.want, got)
+			}
+		})
+	}
+
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+	})
+	ctx := context.Background()
+	g, err := genkit.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &Anthropic{client: client, messages: &client.Messages}
+	m := defineAnthropicModel(g, plugin.messages, "claude-sonnet-4", anthropicModels["claude-sonnet-4"], plugin.modelMiddleware("claude-sonnet-4")...)
+	_, err = genkit.Generate(ctx, g, ai.WithModel(m), ai.WithPrompt("hi"))
+	var genkitErr *core.GenkitError
+	if !errors.As(err, &genkitErr) || genkitErr.Status != core.RESOURCE_EXHAUSTED || genkitErr.HTTPCode != http.StatusTooManyRequests {
+		t.Errorf("want: a %s Genkit error, got: %#v", core.RESOURCE_EXHAUSTED, genkitErr)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !errors.Is(err, ErrAPIRateLimited) {
+		t.Errorf("expecting the API error, got: %v", err)
+	}
+}
+
+func TestVoyageEmbedders(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	t.Setenv("VOYAGE_API_KEY", "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" || r.Header.Get("Authorization") != "Bearer pa-test-key" {
+			t.Errorf("unexpected request: %s %v", r.URL.Path, r.Header)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]any{"model": "voyage-3.5", "input": []any{"The grass is green.", "The sky is blue."}, "input_type": "document", "output_dimension": float64(256)}
+		if !maps.EqualFunc(body, want, func(a, b any) bool { return fmt.Sprint(a) == fmt.Sprint(b) }) {
+			t.Errorf("want: %v, got: %v", want, body)
+		}
+		// the embeddings are returned out of order
+		fmt.Fprint(w, `{"object":"list","data":[{"object":"embedding","embedding":[0.3,0.4],"index":1},{"object":"embedding","embedding":[0.1,0.2],"index":0}],"model":"voyage-3.5","usage":{"total_tokens":10}}`)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	if _, err := genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: &fakeMessages{}, Voyage: &VoyageConfig{Endpoint: srv.URL}})); err == nil {
+		t.Error("want: an error without a Voyage API key")
+	}
+
+	plugin := &Anthropic{Messages: &fakeMessages{}, Voyage: &VoyageConfig{APIKey: "pa-test-key", Endpoint: srv.URL}}
+	g, err := genkit.Init(ctx, genkit.WithPlugins(plugin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder := VoyageEmbedder(g, "voyage-3.5")
+	if embedder == nil {
+		t.Fatal("want: the voyage-3.5 embedder")
+	}
+	resp, err := ai.Embed(ctx, embedder,
+		ai.WithDocs(ai.DocumentFromText("The grass is green.", nil), ai.DocumentFromText("The sky is blue.", nil)),
+		ai.WithConfig(&VoyageEmbedOptions{InputType: "document", OutputDimension: 256}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Embeddings) != 2 || !slices.Equal(resp.Embeddings[0].Embedding, []float32{0.1, 0.2}) || !slices.Equal(resp.Embeddings[1].Embedding, []float32{0.3, 0.4}) {
+		t.Errorf("unexpected embeddings: %+v", resp.Embeddings)
+	}
+
+	g, err = genkit.Init(ctx, genkit.WithPlugins(&Anthropic{Messages: &fakeMessages{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VoyageEmbedder(g, "voyage-3.5") != nil {
+		t.Error("want: no embedders without a Voyage API key")
+	}
+}
+
+func TestModelCapabilities(t *testing.T) {
+	tests := []struct {
+		name string
+		want Capabilities
+	}{
+		{
+			name: "claude-haiku-4-5",
+			want: Capabilities{
+				Model:           "claude-haiku-4-5",
+				ContextWindow:   200000,
+				MaxOutputTokens: 64000,
+				Vision:          true,
+				Thinking:        true,
+				Tools:           true,
+				Pricing:         Pricing{Input: 1, Output: 5, CacheWrite: 1.25, CacheRead: 0.1},
+			},
+		},
+		{
+			name: "claude-sonnet-4-20990101",
+			want: Capabilities{
+				Model:             "claude-sonnet-4",
+				ContextWindow:     200000,
+				LongContextWindow: 1000000,
+				MaxOutputTokens:   64000,
+				Vision:            true,
+				Thinking:          true,
+				Tools:             true,
+				Pricing:           Pricing{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+			},
+		},
+		{
+			name: "claude-3-7-sonnet-latest",
+			want: Capabilities{
+				Model:                   "claude-3-7-sonnet",
+				ContextWindow:           200000,
+				MaxOutputTokens:         64000,
+				ExtendedMaxOutputTokens: 128000,
+				Vision:                  true,
+				Thinking:                true,
+				Tools:                   true,
+				Pricing:                 Pricing{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+			},
+		},
+		{
+			name: "claude-3-5-sonnet-latest",
+			want: Capabilities{
+				Model:           "claude-3-5-sonnet-v2",
+				ContextWindow:   200000,
+				MaxOutputTokens: 8192,
+				Vision:          true,
+				Tools:           true,
+				Pricing:         Pricing{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ModelCapabilities(tt.name)
+			if !ok {
+				t.Fatal("expecting the model to be known")
+			}
+			if got != tt.want {
+				t.Errorf("want: %+v, got: %+v", tt.want, got)
+			}
+		})
+	}
+
+	for _, name := range []string{"claude-opus-4-5-20251101", "claude-custom"} {
+		if c, ok := ModelCapabilities(name); ok {
+			t.Errorf("%s: expecting an unknown model, got: %+v", name, c)
+		}
+	}
+}
+
+func TestAnthropicPauseTurn(t *testing.T) {
+	search := `[{"type":"server_tool_use","id":"srvtoolu_1","name":"web_search","input":{"query":"genkit"}},` +
+		`{"type":"web_search_tool_result","tool_use_id":"srvtoolu_1","content":[{"type":"web_search_result","url":"https://genkit.dev","title":"Genkit","encrypted_content":"abc"}]}]`
+	newRequest := func(continuations int) *ai.ModelRequest {
+		return &ai.ModelRequest{
+			Config:   &GenerationConfig{PauseTurnContinuations: continuations},
+			Messages: []*ai.Message{ai.NewUserTextMessage("what is genkit?")},
+		}
+	}
+
+	t.Run("continued", func(t *testing.T) {
+		fake := &toolLoopMessages{rounds: []string{search, search}, stop: "pause_turn"}
+		resp, err := anthropicGenerate(context.Background(), fake, "claude-sonnet-4", newRequest(0), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.requests) != 3 {
+			t.Fatalf("want: 3 requests, got: %d", len(fake.requests))
+		}
+		if msgs := fake.requests[2].Messages; len(msgs) != 2 || msgs[1].Role != anthropic.MessageParamRoleAssistant || len(msgs[1].Content) != 4 {
+			t.Errorf("expecting the paused turns to be sent back, got: %+v", msgs)
+		}
+		if len(resp.Message.Content) != 5 || resp.Text() != "done" || resp.FinishReason != ai.FinishReasonStop {
+			t.Errorf("expecting the whole turn, got: %+v", resp.Message.Content)
+		}
+		if resp.Usage.InputTokens != 3 || resp.Usage.OutputTokens != 3 {
+			t.Errorf("expecting the usage of all the requests, got: %+v", resp.Usage)
+		}
+	})
+
+	t.Run("cap reached", func(t *testing.T) {
+		fake := &toolLoopMessages{rounds: []string{search, search}, stop: "pause_turn"}
+		resp, err := anthropicGenerate(context.Background(), fake, "claude-sonnet-4", newRequest(1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.requests) != 2 || len(resp.Message.Content) != 4 || resp.FinishReason != ai.FinishReasonOther {
+			t.Errorf("expecting the paused turn after a continuation, got %d requests and: %+v", len(fake.requests), resp.Message.Content)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		fake := &toolLoopMessages{rounds: []string{search}, stop: "pause_turn"}
+		resp, err := anthropicGenerate(context.Background(), fake, "claude-sonnet-4", newRequest(-1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.requests) != 1 || resp.FinishReason != ai.FinishReasonOther {
+			t.Errorf("expecting the paused turn as is, got %d requests and: %v", len(fake.requests), resp.FinishReason)
+		}
+	})
+}
@@ -0,0 +1,251 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package anthropictest provides utilities to test the applications using the
+// Anthropic plugin without calling the Anthropic API.
+package anthropictest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// Mode is what a [Recorder] does with the requests
+type Mode int
+
+const (
+	// ModeReplay answers the requests with the recorded responses, the
+	// requests not recorded fail
+	ModeReplay Mode = iota
+	// ModeRecord sends the requests to the API and records the responses
+	ModeRecord
+)
+
+// Interaction is a request and its response, as saved in the fixtures
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is a recorded request, without its headers so the API key
+// is never saved
+type RecordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+// RecordedResponse is a recorded response, with the headers of [SavedHeaders] only
+type RecordedResponse struct {
+	StatusCode int                 `json:"statusCode"`
+	Header     map[string][]string `json:"header,omitempty"`
+	Body       string              `json:"body,omitempty"`
+}
+
+// SavedHeaders are the response headers saved in the fixtures, the rate limit
+// headers starting with "anthropic-ratelimit-" are saved too
+var SavedHeaders = []string{"Content-Type", "Request-Id", "Retry-After"}
+
+// Recorder is an [http.RoundTripper] recording the interactions with the
+// Anthropic API to a fixture file, then replaying them, so tests are
+// deterministic and don't need an API key:
+//
+//	rec, err := anthropictest.NewRecorder("testdata/generate.json", anthropictest.ModeReplay)
+//	...
+//	defer rec.Stop()
+//	client := anthropic.NewClient(rec.Option(), option.WithAPIKey("test"))
+//	plugin := &anthropic.Anthropic{Messages: &client.Messages}
+type Recorder struct {
+	// Transport sends the requests when recording, [http.DefaultTransport] when nil
+	Transport http.RoundTripper
+	// Sanitize is called with every interaction before it is saved, e.g. to
+	// remove personal information from the response bodies. The sanitized
+	// requests must still match the requests of the tests to be replayed.
+	Sanitize func(*Interaction)
+
+	path string
+	mode Mode
+
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// NewRecorder returns a recorder saving to, or replaying from, the fixture
+// file at path
+func NewRecorder(path string, mode Mode) (*Recorder, error) {
+	r := &Recorder{path: path, mode: mode}
+	if mode == ModeRecord {
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("anthropictest.NewRecorder: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.interactions); err != nil {
+		return nil, fmt.Errorf("anthropictest.NewRecorder: invalid fixture %s: %w", path, err)
+	}
+	r.used = make([]bool, len(r.interactions))
+	return r, nil
+}
+
+// Option returns the SDK client option sending the requests through the recorder
+func (r *Recorder) Option() option.RequestOption {
+	return option.WithHTTPClient(&http.Client{Transport: r})
+}
+
+// RoundTrip records or replays a request
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded, err := recordRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.mode == ModeRecord {
+		return r.record(req, recorded)
+	}
+	return r.replay(req, recorded)
+}
+
+func (r *Recorder) record(req *http.Request, recorded RecordedRequest) (*http.Response, error) {
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := map[string][]string{}
+	for k, v := range resp.Header {
+		if isSavedHeader(k) {
+			header[k] = v
+		}
+	}
+	r.mu.Lock()
+	r.interactions = append(r.interactions, Interaction{
+		Request:  recorded,
+		Response: RecordedResponse{StatusCode: resp.StatusCode, Header: header, Body: string(body)},
+	})
+	r.mu.Unlock()
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, recorded RecordedRequest) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, in := range r.interactions {
+		if r.used[i] || in.Request != recorded {
+			continue
+		}
+		r.used[i] = true
+		header := http.Header{}
+		for k, v := range in.Response.Header {
+			header[http.CanonicalHeaderKey(k)] = v
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Response.StatusCode, http.StatusText(in.Response.StatusCode)),
+			StatusCode:    in.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(strings.NewReader(in.Response.Body)),
+			ContentLength: int64(len(in.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("anthropictest: no recorded response for %s %s", recorded.Method, recorded.URL)
+}
+
+// Stop saves the recorded interactions, when recording
+func (r *Recorder) Stop() error {
+	if r.mode != ModeRecord {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Sanitize != nil {
+		for i := range r.interactions {
+			r.Sanitize(&r.interactions[i])
+		}
+	}
+	data, err := json.MarshalIndent(r.interactions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Recorder.Stop: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("Recorder.Stop: %w", err)
+	}
+	if err := os.WriteFile(r.path, data, 0o644); err != nil {
+		return fmt.Errorf("Recorder.Stop: %w", err)
+	}
+	return nil
+}
+
+// recordRequest returns the request as recorded, with a compact JSON body so
+// the formatting of the body doesn't matter
+func recordRequest(req *http.Request) (RecordedRequest, error) {
+	recorded := RecordedRequest{Method: req.Method, URL: req.URL.Path}
+	if req.URL.RawQuery != "" {
+		recorded.URL += "?" + req.URL.RawQuery
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return recorded, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return RecordedRequest{}, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, body); err != nil {
+		// not JSON, e.g. a file upload
+		recorded.Body = string(body)
+		return recorded, nil
+	}
+	recorded.Body = compact.String()
+	return recorded, nil
+}
+
+func isSavedHeader(k string) bool {
+	k = http.CanonicalHeaderKey(k)
+	if strings.HasPrefix(k, "Anthropic-Ratelimit-") {
+		return true
+	}
+	for _, h := range SavedHeaders {
+		if http.CanonicalHeaderKey(h) == k {
+			return true
+		}
+	}
+	return false
+}
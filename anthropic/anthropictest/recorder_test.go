@@ -0,0 +1,102 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropictest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+	plugin "github.com/mingyuans/genkit-anthropic/anthropic"
+)
+
+func TestRecorder(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("request-id", "req_1")
+		w.Header().Set("anthropic-organization-id", "org_secret")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-20250514","content":[{"type":"text","text":"Hello!"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	path := filepath.Join(t.TempDir(), "testdata", "generate.json")
+
+	generate := func(rec *Recorder, opts ...option.RequestOption) string {
+		t.Helper()
+		ctx := context.Background()
+		client := anthropic.NewClient(append([]option.RequestOption{rec.Option(), option.WithAPIKey("sk-ant-test-key"), option.WithMaxRetries(0)}, opts...)...)
+		g, err := genkit.Init(ctx, genkit.WithPlugins(&plugin.Anthropic{Messages: &client.Messages}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := genkit.Generate(ctx, g, ai.WithModel(plugin.ModelClaudeSonnet4), ai.WithPrompt("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Text()
+	}
+
+	rec, err := NewRecorder(path, ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := generate(rec, option.WithBaseURL(srv.URL)); got != "Hello!" {
+		t.Errorf("want: %q, got: %q", "Hello!", got)
+	}
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	fixture, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"sk-ant-test-key", "org_secret"} {
+		if strings.Contains(string(fixture), secret) {
+			t.Errorf("want: %q not saved, got: %s", secret, fixture)
+		}
+	}
+
+	// the server is closed, the response is replayed
+	rec, err = NewRecorder(path, ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := generate(rec, option.WithBaseURL(srv.URL)); got != "Hello!" {
+		t.Errorf("want: %q, got: %q", "Hello!", got)
+	}
+
+	// every recorded response is replayed once
+	client := anthropic.NewClient(rec.Option(), option.WithBaseURL(srv.URL), option.WithAPIKey("sk-ant-test-key"), option.WithMaxRetries(0))
+	_, err = client.Messages.New(context.Background(), anthropic.MessageNewParams{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 10,
+		Messages:  []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock("hi"))},
+	})
+	if err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("want: no recorded response, got: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropictest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// Server is a fake Anthropic API speaking enough of the Messages API, with
+// and without streaming, to test the whole path of the plugin:
+//
+//	srv := anthropictest.NewServer()
+//	defer srv.Close()
+//	srv.Reply(anthropictest.Reply{Text: "Hello!"})
+//	client := anthropic.NewClient(srv.Options()...)
+//	plugin := &anthropic.Anthropic{Messages: &client.Messages}
+//
+// The requests are answered with the queued replies, in order, then with
+// the replies of the handler set with [Server.Handle].
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	replies  []Reply
+	handler  func(*Request) Reply
+	requests []*Request
+}
+
+// Request is a request received by the server
+type Request struct {
+	Model     string    `json:"model"`
+	MaxTokens int       `json:"max_tokens"`
+	Stream    bool      `json:"stream"`
+	Messages  []Message `json:"messages"`
+	Tools     []struct {
+		Name string `json:"name"`
+	} `json:"tools"`
+	// Body is the JSON body of the request
+	Body json.RawMessage `json:"-"`
+}
+
+// Message is a message of a request
+type Message struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// Reply is the answer of the server to a request
+type Reply struct {
+	// Text is the text of the answer
+	Text string
+	// ToolCalls are the tools Claude calls after the text
+	ToolCalls []ToolCall
+	// StopReason is "end_turn" by default, or "tool_use" with ToolCalls
+	StopReason string
+	// InputTokens and OutputTokens are the usage of the answer
+	InputTokens  int
+	OutputTokens int
+
+	// StatusCode and ErrorType answer with an API error instead, e.g. 529 and
+	// "overloaded_error"
+	StatusCode int
+	ErrorType  string
+}
+
+// ToolCall is a tool_use block of a reply
+type ToolCall struct {
+	ID    string
+	Name  string
+	Input any
+}
+
+// NewServer starts a fake Anthropic API answering "OK" by default, close it
+// when done
+func NewServer() *Server {
+	s := &Server{handler: func(*Request) Reply { return Reply{Text: "OK"} }}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/messages", s.messages)
+	mux.HandleFunc("POST /v1/messages/count_tokens", s.countTokens)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Options returns the SDK client options sending the requests to the server
+func (s *Server) Options() []option.RequestOption {
+	return []option.RequestOption{
+		option.WithBaseURL(s.URL),
+		option.WithAPIKey("sk-ant-test-key"),
+		option.WithMaxRetries(0),
+	}
+}
+
+// Reply queues the replies to the next requests
+func (s *Server) Reply(replies ...Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = append(s.replies, replies...)
+}
+
+// Handle sets the handler answering the requests once the queued replies are used
+func (s *Server) Handle(fn func(*Request) Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = fn
+}
+
+// Requests returns the requests received by the server
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request(nil), s.requests...)
+}
+
+func (s *Server) messages(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	req := &Request{Body: body}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	id := fmt.Sprintf("req_%d", len(s.requests))
+	var reply Reply
+	if len(s.replies) > 0 {
+		reply, s.replies = s.replies[0], s.replies[1:]
+		s.mu.Unlock()
+	} else {
+		handler := s.handler
+		s.mu.Unlock()
+		reply = handler(req)
+	}
+
+	if reply.StatusCode >= http.StatusBadRequest {
+		typ := reply.ErrorType
+		if typ == "" {
+			typ = "api_error"
+		}
+		writeError(w, reply.StatusCode, typ, reply.Text)
+		return
+	}
+	msg := newMessage(req, reply)
+	w.Header().Set("request-id", id)
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, e := range streamEvents(msg) {
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e["type"], data)
+	}
+}
+
+func (s *Server) countTokens(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	// about 4 characters a token
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"input_tokens": len(body)/4 + 1})
+}
+
+// message is the JSON of an Anthropic message
+type message = map[string]any
+
+// newMessage returns the message answering a request with a reply
+func newMessage(req *Request, reply Reply) message {
+	content := []any{}
+	if reply.Text != "" {
+		content = append(content, map[string]any{"type": "text", "text": reply.Text})
+	}
+	for i, call := range reply.ToolCalls {
+		id := call.ID
+		if id == "" {
+			id = fmt.Sprintf("toolu_%d", i+1)
+		}
+		input := call.Input
+		if input == nil {
+			input = map[string]any{}
+		}
+		content = append(content, map[string]any{"type": "tool_use", "id": id, "name": call.Name, "input": input})
+	}
+	stop := reply.StopReason
+	if stop == "" {
+		stop = "end_turn"
+		if len(reply.ToolCalls) > 0 {
+			stop = "tool_use"
+		}
+	}
+	in, out := reply.InputTokens, reply.OutputTokens
+	if in == 0 {
+		in = len(req.Body)/4 + 1
+	}
+	if out == 0 {
+		out = len(strings.Fields(reply.Text)) + 1
+	}
+	return message{
+		"id":            "msg_test",
+		"type":          "message",
+		"role":          "assistant",
+		"model":         req.Model,
+		"content":       content,
+		"stop_reason":   stop,
+		"stop_sequence": nil,
+		"usage":         map[string]int{"input_tokens": in, "output_tokens": out},
+	}
+}
+
+// streamEvents returns the events streaming a message: the text is streamed
+// word by word and the tool inputs in a single delta
+func streamEvents(msg message) []map[string]any {
+	usage := msg["usage"].(map[string]int)
+	start := message{}
+	for k, v := range msg {
+		start[k] = v
+	}
+	start["content"] = []any{}
+	start["stop_reason"] = nil
+	start["usage"] = map[string]int{"input_tokens": usage["input_tokens"], "output_tokens": 1}
+
+	events := []map[string]any{{"type": "message_start", "message": start}}
+	for i, block := range msg["content"].([]any) {
+		block := block.(map[string]any)
+		switch block["type"] {
+		case "text":
+			events = append(events, map[string]any{"type": "content_block_start", "index": i, "content_block": map[string]any{"type": "text", "text": ""}})
+			for _, word := range strings.SplitAfter(block["text"].(string), " ") {
+				events = append(events, map[string]any{"type": "content_block_delta", "index": i, "delta": map[string]any{"type": "text_delta", "text": word}})
+			}
+		case "tool_use":
+			events = append(events, map[string]any{"type": "content_block_start", "index": i, "content_block": map[string]any{"type": "tool_use", "id": block["id"], "name": block["name"], "input": map[string]any{}}})
+			input, _ := json.Marshal(block["input"])
+			events = append(events, map[string]any{"type": "content_block_delta", "index": i, "delta": map[string]any{"type": "input_json_delta", "partial_json": string(input)}})
+		}
+		events = append(events, map[string]any{"type": "content_block_stop", "index": i})
+	}
+	return append(events,
+		map[string]any{"type": "message_delta", "delta": map[string]any{"stop_reason": msg["stop_reason"], "stop_sequence": nil}, "usage": map[string]int{"output_tokens": usage["output_tokens"]}},
+		map[string]any{"type": "message_stop"},
+	)
+}
+
+func writeError(w http.ResponseWriter, status int, typ, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": typ, "message": msg},
+	})
+}
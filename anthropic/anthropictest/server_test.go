@@ -0,0 +1,113 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropictest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+	plugin "github.com/mingyuans/genkit-anthropic/anthropic"
+)
+
+func TestServer(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	ctx := context.Background()
+	srv := NewServer()
+	defer srv.Close()
+	client := anthropic.NewClient(srv.Options()...)
+	g, err := genkit.Init(ctx, genkit.WithPlugins(&plugin.Anthropic{Messages: &client.Messages}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		srv.Reply(Reply{Text: "Hello from the fake server"})
+		var chunks []string
+		var usage *ai.GenerationUsage
+		resp, err := genkit.Generate(ctx, g,
+			ai.WithModel(plugin.ModelClaudeSonnet4),
+			ai.WithPrompt("hi"),
+			ai.WithStreaming(func(_ context.Context, c *ai.ModelResponseChunk) error {
+				if u := plugin.ChunkUsage(c); u != nil {
+					usage = u
+					return nil
+				}
+				chunks = append(chunks, c.Text())
+				return nil
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Hello from the fake server"; resp.Text() != want {
+			t.Errorf("want: %q, got: %q", want, resp.Text())
+		}
+		if want := "Hello |from |the |fake |server"; strings.Join(chunks, "|") != want {
+			t.Errorf("want: %q, got: %q", want, strings.Join(chunks, "|"))
+		}
+		if usage == nil || usage.OutputTokens != resp.Usage.OutputTokens {
+			t.Errorf("want: the usage %+v in the final chunk, got: %+v", resp.Usage, usage)
+		}
+		if id := plugin.RequestID(resp); id == "" {
+			t.Error("want: a request ID, got none")
+		}
+	})
+
+	t.Run("tool use", func(t *testing.T) {
+		weather := genkit.DefineTool(g, "getWeather", "returns the weather of a city",
+			func(ctx *ai.ToolContext, input struct {
+				City string `json:"city"`
+			}) (string, error) {
+				return "sunny in " + input.City, nil
+			})
+		srv.Reply(
+			Reply{ToolCalls: []ToolCall{{Name: "getWeather", Input: map[string]string{"city": "Paris"}}}},
+			Reply{Text: "It is sunny."},
+		)
+		n := len(srv.Requests())
+		resp, err := genkit.Generate(ctx, g,
+			ai.WithModel(plugin.ModelClaudeSonnet4),
+			ai.WithPrompt("what's the weather in Paris?"),
+			ai.WithTools(weather))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Text() != "It is sunny." {
+			t.Errorf("want: %q, got: %q", "It is sunny.", resp.Text())
+		}
+		requests := srv.Requests()[n:]
+		if len(requests) != 2 {
+			t.Fatalf("want: %d requests, got: %d", 2, len(requests))
+		}
+		last := requests[1].Messages[len(requests[1].Messages)-1]
+		if last.Role != "user" || !strings.Contains(string(last.Content), "sunny in Paris") {
+			t.Errorf("want: the tool result, got: %s", last.Content)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		srv.Reply(Reply{StatusCode: 529, ErrorType: "overloaded_error", Text: "Overloaded"})
+		_, err := genkit.Generate(ctx, g, ai.WithModel(plugin.ModelClaudeSonnet4), ai.WithPrompt("hi"))
+		if !errors.Is(err, plugin.ErrOverloaded) {
+			t.Errorf("want: %v, got: %v", plugin.ErrOverloaded, err)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/firebase/genkit/go/ai"
+)
+
+// BackendMetadataKey is the response message metadata key holding the name of
+// the [Backend] that generated the response, when not the Anthropic API
+const BackendMetadataKey = "backend"
+
+// Backend is another deployment of the Claude models, such as Amazon Bedrock
+// or Google Vertex AI, the plugin fails over to when the Anthropic API is
+// unavailable. The models keep their Genkit names.
+type Backend struct {
+	// Name identifies the backend in the response metadata, e.g. "bedrock"
+	Name string
+	// Options configure the client of the backend, e.g. the
+	// bedrock.WithLoadDefaultConfig or vertex.WithGoogleAuth options of the Anthropic SDK
+	Options []option.RequestOption
+	// ModelID maps an Anthropic model ID, e.g. "claude-sonnet-4-20250514", to
+	// the ID of the model on the backend, e.g. "anthropic.claude-sonnet-4-20250514-v1:0"
+	// on Bedrock. Model IDs are unchanged when nil.
+	ModelID func(string) string
+}
+
+// backendClient is the client of a configured backend
+type backendClient struct {
+	name    string
+	client  *anthropic.Client
+	modelID func(string) string
+}
+
+func newBackendClient(b Backend) *backendClient {
+	return &backendClient{name: b.Name, client: newClient(b.Options...), modelID: b.ModelID}
+}
+
+// generate generates with the model of the backend
+func (b *backendClient) generate(
+	ctx context.Context,
+	model string,
+	input *ai.ModelRequest,
+	cb func(context.Context, *ai.ModelResponseChunk) error,
+) (*ai.ModelResponse, error) {
+	c, err := configFromRequest(input)
+	if err != nil {
+		return nil, err
+	}
+	// the model ID of the backend is sent as the version of the model
+	if b.modelID != nil {
+		c.Version = b.modelID(modelID(model, c))
+		in := *input
+		in.Config = c
+		input = &in
+	}
+	return anthropicGenerate(ctx, &b.client.Messages, model, input, cb)
+}
+
+// failover makes the calls to a model fail over to the backends, in order,
+// while the previous ones are unavailable
+func failover(backends []*backendClient, model string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			streamed := false
+			var streamCb func(context.Context, *ai.ModelResponseChunk) error
+			if cb != nil {
+				streamCb = func(ctx context.Context, chunk *ai.ModelResponseChunk) error {
+					streamed = true
+					return cb(ctx, chunk)
+				}
+			}
+
+			r, err := next(ctx, input, streamCb)
+			for _, b := range backends {
+				// the chunks streamed can't be taken back
+				if err == nil || streamed || !isUnavailable(err) {
+					break
+				}
+				if r, err = b.generate(ctx, model, input, streamCb); err == nil {
+					r.Request = input
+					if r.Message != nil {
+						if r.Message.Metadata == nil {
+							r.Message.Metadata = map[string]any{}
+						}
+						r.Message.Metadata[BackendMetadataKey] = b.name
+					}
+				}
+			}
+			return r, err
+		}
+	}
+}
+
+// isUnavailable reports whether an error means the backend can't serve the
+// request now: a server or overloaded error, or a connection error
+func isUnavailable(err error) bool {
+	if isServerError(err) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
@@ -0,0 +1,339 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+	"github.com/firebase/genkit/go/ai"
+)
+
+// Batches sends requests through the Message Batches API, processed
+// asynchronously at a lower cost than regular requests.
+type Batches struct {
+	client *anthropic.Client
+	media  *mediaConfig
+}
+
+// Batches returns the Message Batches API client of an initialized plugin
+func (a *Anthropic) Batches() *Batches {
+	return &Batches{client: a.client, media: a.media}
+}
+
+// BatchRequest is a request of a batch
+type BatchRequest struct {
+	// CustomID identifies the request among the batch results, it must be unique in the batch
+	CustomID string
+	// Model is the name of the model, e.g. "claude-sonnet-4"
+	Model   string
+	Request *ai.ModelRequest
+}
+
+// Batch is the state of a message batch
+type Batch struct {
+	ID string
+	// Status is one of "in_progress", "canceling" or "ended"
+	Status        string
+	RequestCounts BatchRequestCounts
+	CreatedAt     time.Time
+	EndedAt       time.Time
+	ExpiresAt     time.Time
+}
+
+// BatchRequestCounts counts the requests of a batch by state
+type BatchRequestCounts struct {
+	Processing int
+	Succeeded  int
+	Errored    int
+	Canceled   int
+	Expired    int
+}
+
+// Ended reports whether the batch is done processing and its results can be read
+func (b *Batch) Ended() bool {
+	return b.Status == string(anthropic.MessageBatchProcessingStatusEnded)
+}
+
+// BatchResultState is the outcome of a request of a batch
+type BatchResultState string
+
+const (
+	BatchResultSucceeded BatchResultState = "succeeded"
+	BatchResultErrored   BatchResultState = "errored"
+	// BatchResultCanceled is the state of the requests not processed before the batch was canceled
+	BatchResultCanceled BatchResultState = "canceled"
+	// BatchResultExpired is the state of the requests not processed before the batch expired
+	BatchResultExpired BatchResultState = "expired"
+)
+
+var (
+	// ErrBatchRequestCanceled is the [BatchResult.Err] of canceled requests
+	ErrBatchRequestCanceled = errors.New("batch request canceled")
+	// ErrBatchRequestExpired is the [BatchResult.Err] of expired requests
+	ErrBatchRequestExpired = errors.New("batch request expired")
+)
+
+// BatchError is the [BatchResult.Err] of errored requests
+type BatchError struct {
+	// Type is the Anthropic error type, e.g. "invalid_request_error"
+	Type    string
+	Message string
+}
+
+func (e *BatchError) Error() string {
+	return e.Type + ": " + e.Message
+}
+
+// BatchResult is the result of a request of a batch
+type BatchResult struct {
+	CustomID string
+	State    BatchResultState
+	// Response is the response of a succeeded request
+	Response *ai.ModelResponse
+	// Err is the reason a request did not succeed: a [*BatchError],
+	// [ErrBatchRequestCanceled] or [ErrBatchRequestExpired]
+	Err error
+}
+
+// FailedRequests returns the requests that did not succeed in the batch
+// results, to be retried with a new batch or regular generate calls.
+// Requests without a result are considered failed.
+func FailedRequests(requests []BatchRequest, results []*BatchResult) []BatchRequest {
+	succeeded := map[string]bool{}
+	for _, r := range results {
+		if r.State == BatchResultSucceeded && r.Err == nil {
+			succeeded[r.CustomID] = true
+		}
+	}
+	failed := []BatchRequest{}
+	for _, r := range requests {
+		if !succeeded[r.CustomID] {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Submit creates a batch with the given requests, converted as for generation
+func (b *Batches) Submit(ctx context.Context, requests []BatchRequest) (*Batch, error) {
+	if b.client == nil {
+		return nil, errors.New("Batches.Submit: plugin not initialized")
+	}
+	encoded := make([]*EncodedBatchRequest, 0, len(requests))
+	for _, r := range requests {
+		e, err := EncodeBatchRequest(withMediaConfig(ctx, b.media), r)
+		if err != nil {
+			return nil, fmt.Errorf("Batches.Submit: %w", err)
+		}
+		encoded = append(encoded, e)
+	}
+	batch, err := b.submit(ctx, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Batches.Submit: %w", err)
+	}
+	return batch, nil
+}
+
+// SubmitEncoded creates a batch with requests already converted, e.g. read with [ReadBatchRequests]
+func (b *Batches) SubmitEncoded(ctx context.Context, requests []*EncodedBatchRequest) (*Batch, error) {
+	if b.client == nil {
+		return nil, errors.New("Batches.SubmitEncoded: plugin not initialized")
+	}
+	batch, err := b.submit(ctx, requests)
+	if err != nil {
+		return nil, fmt.Errorf("Batches.SubmitEncoded: %w", err)
+	}
+	return batch, nil
+}
+
+func (b *Batches) submit(ctx context.Context, requests []*EncodedBatchRequest) (*Batch, error) {
+	params := anthropic.MessageBatchNewParams{}
+	betas := []string{}
+	for _, r := range requests {
+		for _, f := range r.Betas {
+			if !slices.Contains(betas, f) {
+				betas = append(betas, f)
+			}
+		}
+		params.Requests = append(params.Requests, anthropic.MessageBatchNewParamsRequest{
+			CustomID: r.CustomID,
+			// the batch params are the Messages API params, sent as is
+			Params: param.Override[anthropic.MessageBatchNewParamsRequestParams](r.Params),
+		})
+	}
+
+	opts := []option.RequestOption{}
+	if len(betas) > 0 {
+		opts = append(opts, option.WithHeader("anthropic-beta", strings.Join(betas, ",")))
+	}
+	batch, err := b.client.Messages.Batches.New(ctx, params, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return fromMessageBatch(batch), nil
+}
+
+// Get returns the batch with the given ID
+func (b *Batches) Get(ctx context.Context, id string) (*Batch, error) {
+	if b.client == nil {
+		return nil, errors.New("Batches.Get: plugin not initialized")
+	}
+	batch, err := b.client.Messages.Batches.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("Batches.Get: %w", err)
+	}
+	return fromMessageBatch(batch), nil
+}
+
+// Cancel cancels the processing of a batch, the requests not processed yet end
+// as [BatchResultCanceled]. The batch is "canceling" until it ended.
+func (b *Batches) Cancel(ctx context.Context, id string) (*Batch, error) {
+	if b.client == nil {
+		return nil, errors.New("Batches.Cancel: plugin not initialized")
+	}
+	batch, err := b.client.Messages.Batches.Cancel(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("Batches.Cancel: %w", err)
+	}
+	return fromMessageBatch(batch), nil
+}
+
+// PollOptions configures how [Batches.WaitForBatch] polls a batch
+type PollOptions struct {
+	// Interval is the delay before the first poll, 10 seconds by default
+	Interval time.Duration
+	// MaxInterval caps the delay between polls, 5 minutes by default
+	MaxInterval time.Duration
+	// Multiplier grows the delay after each poll, 1.5 by default
+	Multiplier float64
+	// OnResult is called with every result once the batch ended, returning an error stops the results
+	OnResult func(*BatchResult) error
+	// Requests are the requests of the batch. The responses to these requests
+	// are completed as for generation, e.g. with their structured output.
+	Requests []BatchRequest
+}
+
+// WaitForBatch polls the batch with backoff until it ended, then streams its
+// results to [PollOptions.OnResult] as they are decoded
+func (b *Batches) WaitForBatch(ctx context.Context, id string, opts PollOptions) (*Batch, error) {
+	if b.client == nil {
+		return nil, errors.New("Batches.WaitForBatch: plugin not initialized")
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	maxInterval := opts.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = 5 * time.Minute
+	}
+	multiplier := opts.Multiplier
+	if multiplier < 1 {
+		multiplier = 1.5
+	}
+
+	var batch *Batch
+	for {
+		var err error
+		if batch, err = b.Get(ctx, id); err != nil {
+			return nil, fmt.Errorf("Batches.WaitForBatch: %w", err)
+		}
+		if batch.Ended() {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return batch, fmt.Errorf("Batches.WaitForBatch: %w", ctx.Err())
+		case <-time.After(interval):
+		}
+		interval = min(time.Duration(float64(interval)*multiplier), maxInterval)
+	}
+
+	if opts.OnResult == nil {
+		return batch, nil
+	}
+	requests := batchRequestsByID(opts.Requests)
+	stream := b.client.Messages.Batches.ResultsStreaming(ctx, id)
+	defer stream.Close()
+	for stream.Next() {
+		if err := opts.OnResult(fromMessageBatchResponse(stream.Current(), requests)); err != nil {
+			return batch, err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return batch, fmt.Errorf("Batches.WaitForBatch: %w", err)
+	}
+	return batch, nil
+}
+
+func fromMessageBatch(batch *anthropic.MessageBatch) *Batch {
+	return &Batch{
+		ID:     batch.ID,
+		Status: string(batch.ProcessingStatus),
+		RequestCounts: BatchRequestCounts{
+			Processing: int(batch.RequestCounts.Processing),
+			Succeeded:  int(batch.RequestCounts.Succeeded),
+			Errored:    int(batch.RequestCounts.Errored),
+			Canceled:   int(batch.RequestCounts.Canceled),
+			Expired:    int(batch.RequestCounts.Expired),
+		},
+		CreatedAt: batch.CreatedAt,
+		EndedAt:   batch.EndedAt,
+		ExpiresAt: batch.ExpiresAt,
+	}
+}
+
+// batchRequestsByID indexes the batch requests by custom ID
+func batchRequestsByID(requests []BatchRequest) map[string]*ai.ModelRequest {
+	byID := make(map[string]*ai.ModelRequest, len(requests))
+	for _, r := range requests {
+		byID[r.CustomID] = r.Request
+	}
+	return byID
+}
+
+// fromMessageBatchResponse translates a line of the batch results to a
+// [BatchResult], completing the response of a known request as for generation
+func fromMessageBatchResponse(r anthropic.MessageBatchIndividualResponse, requests map[string]*ai.ModelRequest) *BatchResult {
+	result := &BatchResult{CustomID: r.CustomID, State: BatchResultState(r.Result.Type)}
+	switch result.State {
+	case BatchResultSucceeded:
+		result.Response, result.Err = anthropicToGenkitResponse(&r.Result.Message)
+		if input := requests[r.CustomID]; result.Err == nil && input != nil {
+			if err := completeResponse(result.Response, input); err != nil {
+				result.Response, result.Err = nil, err
+			}
+		}
+	case BatchResultErrored:
+		result.Err = &BatchError{Type: r.Result.Error.Error.Type, Message: r.Result.Error.Error.Message}
+	case BatchResultCanceled:
+		result.Err = ErrBatchRequestCanceled
+	case BatchResultExpired:
+		result.Err = ErrBatchRequestExpired
+	default:
+		result.Err = fmt.Errorf("unknown batch result type %q", r.Result.Type)
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// EncodedBatchRequest is a batch request converted to the Anthropic format,
+// as written on each line of a batch requests JSONL file
+type EncodedBatchRequest struct {
+	CustomID string `json:"custom_id"`
+	// Params are the Messages API params of the request
+	Params json.RawMessage `json:"params"`
+	// Betas are the beta features the request needs, sent as anthropic-beta header
+	Betas []string `json:"betas,omitempty"`
+}
+
+// EncodeBatchRequest converts a batch request to the Anthropic format
+func EncodeBatchRequest(ctx context.Context, r BatchRequest) (*EncodedBatchRequest, error) {
+	req, err := toAnthropicRequest(ctx, r.Model, r.Request)
+	if err != nil {
+		return nil, fmt.Errorf("request %q: %w", r.CustomID, err)
+	}
+	c, err := configFromRequest(r.Request)
+	if err != nil {
+		return nil, fmt.Errorf("request %q: %w", r.CustomID, err)
+	}
+	if err := checkVersion(r.Model, c); err != nil {
+		return nil, fmt.Errorf("request %q: %w", r.CustomID, err)
+	}
+	betas, err := betaFeatures(c, r.Request, modelID(r.Model, c))
+	if err != nil {
+		return nil, fmt.Errorf("request %q: %w", r.CustomID, err)
+	}
+	params, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("request %q: %w", r.CustomID, err)
+	}
+	return &EncodedBatchRequest{CustomID: r.CustomID, Params: params, Betas: betas}, nil
+}
+
+// WriteBatchRequests converts the batch requests and writes them to w as JSONL,
+// to be reviewed and submitted later with [ReadBatchRequests] and [Batches.SubmitEncoded]
+func WriteBatchRequests(ctx context.Context, w io.Writer, requests []BatchRequest) error {
+	enc := json.NewEncoder(w)
+	for _, r := range requests {
+		e, err := EncodeBatchRequest(ctx, r)
+		if err != nil {
+			return fmt.Errorf("WriteBatchRequests: %w", err)
+		}
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("WriteBatchRequests: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReadBatchRequests reads batch requests written by [WriteBatchRequests]
+func ReadBatchRequests(r io.Reader) ([]*EncodedBatchRequest, error) {
+	requests := []*EncodedBatchRequest{}
+	seen := map[string]bool{}
+	err := readJSONL(r, func(line []byte) error {
+		var e EncodedBatchRequest
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		if e.CustomID == "" || len(e.Params) == 0 {
+			return errors.New("custom_id and params are required")
+		}
+		if seen[e.CustomID] {
+			return fmt.Errorf("duplicate custom_id %q", e.CustomID)
+		}
+		seen[e.CustomID] = true
+		requests = append(requests, &e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ReadBatchRequests: %w", err)
+	}
+	return requests, nil
+}
+
+// ExportResults writes the results of an ended batch to w, as the JSONL returned by Anthropic
+func (b *Batches) ExportResults(ctx context.Context, id string, w io.Writer) error {
+	if b.client == nil {
+		return errors.New("Batches.ExportResults: plugin not initialized")
+	}
+	var resp *http.Response
+	// the results are copied as is instead of decoded and encoded again
+	if err := b.client.Get(ctx, fmt.Sprintf("v1/messages/batches/%s/results", id), nil, &resp,
+		option.WithHeader("Accept", "application/x-jsonl")); err != nil {
+		return fmt.Errorf("Batches.ExportResults: %w", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("Batches.ExportResults: %w", err)
+	}
+	return nil
+}
+
+// ReadBatchResults decodes batch results written by [Batches.ExportResults]
+// and calls fn with each of them, returning an error from fn stops the results.
+// The responses to the given requests are completed as for generation, the
+// requests can be nil.
+func ReadBatchResults(r io.Reader, requests []BatchRequest, fn func(*BatchResult) error) error {
+	byID := batchRequestsByID(requests)
+	err := readJSONL(r, func(line []byte) error {
+		var resp anthropic.MessageBatchIndividualResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return err
+		}
+		return fn(fromMessageBatchResponse(resp, byID))
+	})
+	if err != nil {
+		return fmt.Errorf("ReadBatchResults: %w", err)
+	}
+	return nil
+}
+
+// readJSONL calls fn with every non empty line of r
+func readJSONL(r io.Reader, fn func([]byte) error) error {
+	scanner := bufio.NewScanner(r)
+	// requests with media can be much larger than the default buffer
+	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,137 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCoolDown = 30 * time.Second
+)
+
+// CircuitBreakerConfig makes the Generate calls of the plugin fail fast during
+// Anthropic outages: after consecutive server errors (5xx, including 529
+// overloaded) the breaker opens and the calls fail with a [*CircuitOpenError]
+// for a cool-down period. A single call is then let through to probe the API,
+// closing the breaker when it succeeds.
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive server errors opening the breaker, 5 by default
+	Failures int
+	// CoolDown is how long the breaker stays open, 30s by default
+	CoolDown time.Duration
+}
+
+// CircuitOpenError is returned by the calls rejected by an open circuit breaker
+type CircuitOpenError struct {
+	// RetryAt is when the breaker lets a call through again
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open until %s", e.RetryAt.Format(time.RFC3339))
+}
+
+// circuitBreaker counts the consecutive server errors of the calls
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// probing is true while the call probing the API after the cool-down is running
+	probing bool
+
+	c   CircuitBreakerConfig
+	now func() time.Time
+}
+
+// newCircuitBreaker returns a closed breaker, now is the clock of the breaker
+func newCircuitBreaker(c CircuitBreakerConfig, now func() time.Time) *circuitBreaker {
+	if c.Failures <= 0 {
+		c.Failures = defaultBreakerFailures
+	}
+	if c.CoolDown <= 0 {
+		c.CoolDown = defaultBreakerCoolDown
+	}
+	return &circuitBreaker{c: c, now: now}
+}
+
+// allow returns a [*CircuitOpenError] if a call can't be made now
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.now().Before(b.openUntil) || b.probing {
+		return &CircuitOpenError{RetryAt: b.openUntil}
+	}
+	b.probing = true
+	return nil
+}
+
+// record records the outcome of a call
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case isServerError(err):
+		b.failures++
+		if b.probing || b.failures >= b.c.Failures {
+			b.openUntil = b.now().Add(b.c.CoolDown)
+		}
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		// says nothing about the API, another call will probe it
+	default:
+		// the API answered
+		b.failures = 0
+		b.openUntil = time.Time{}
+	}
+	b.probing = false
+}
+
+// isServerError reports whether an error is a server error of the API
+func isServerError(err error) bool {
+	var eventErr *StreamEventError
+	if errors.As(err, &eventErr) {
+		return eventErr.Type == "api_error" || eventErr.Type == "overloaded_error"
+	}
+	var apiErr *anthropic.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode >= http.StatusInternalServerError
+}
+
+// middleware makes the calls of a model fail fast while the breaker is open
+func (b *circuitBreaker) middleware() ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			if err := b.allow(); err != nil {
+				return nil, err
+			}
+			resp, err := next(ctx, input, cb)
+			b.record(err)
+			return resp, err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+const defaultBudgetWindow = 24 * time.Hour
+
+// BudgetConfig caps the spending of the Generate calls of the plugin over a
+// window of time, the calls made once a limit is reached fail with a
+// [*BudgetExceededError] until the window ends. The calls already running
+// when the limit is reached may spend past it.
+type BudgetConfig struct {
+	// MaxCost is the maximum estimated cost in USD, see [Cost], no limit when 0
+	MaxCost float64
+	// MaxTokens is the maximum number of input and output tokens, no limit when 0
+	MaxTokens int
+	// Window is the period the limits apply to, e.g. time.Hour, a day by
+	// default. The windows are aligned on the multiples of Window since the
+	// zero time, so a daily budget is reset at midnight UTC
+	Window time.Duration
+}
+
+// BudgetExceededError is returned by the calls rejected once the budget of the
+// plugin is spent
+type BudgetExceededError struct {
+	// Cost and Tokens are the amounts spent in the window
+	Cost   float64
+	Tokens int
+	// ResetAt is when the window ends and the calls are allowed again
+	ResetAt time.Time
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("budget exceeded: spent $%.4f and %d tokens, reset at %s",
+		e.Cost, e.Tokens, e.ResetAt.Format(time.RFC3339))
+}
+
+// budget accounts for the spending of the calls in the current window
+type budget struct {
+	mu     sync.Mutex
+	start  time.Time
+	cost   float64
+	tokens int
+
+	c   BudgetConfig
+	now func() time.Time
+}
+
+// newBudget returns an unspent budget, now is the clock of the budget
+func newBudget(c BudgetConfig, now func() time.Time) *budget {
+	if c.Window <= 0 {
+		c.Window = defaultBudgetWindow
+	}
+	return &budget{c: c, now: now}
+}
+
+// roll starts a new window once the current one ended, b.mu must be held
+func (b *budget) roll() {
+	if start := b.now().Truncate(b.c.Window); !start.Equal(b.start) {
+		b.start = start
+		b.cost = 0
+		b.tokens = 0
+	}
+}
+
+// allow returns a [*BudgetExceededError] if a limit is reached
+func (b *budget) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	if (b.c.MaxCost > 0 && b.cost >= b.c.MaxCost) || (b.c.MaxTokens > 0 && b.tokens >= b.c.MaxTokens) {
+		return &BudgetExceededError{Cost: b.cost, Tokens: b.tokens, ResetAt: b.start.Add(b.c.Window)}
+	}
+	return nil
+}
+
+// spend records the usage of a response
+func (b *budget) spend(r *ai.ModelResponse) {
+	cost, _ := Cost(r)
+	tokens := 0
+	if r.Usage != nil {
+		tokens = r.Usage.InputTokens + r.Usage.OutputTokens
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.cost += cost
+	b.tokens += tokens
+}
+
+// middleware rejects the calls of a model once the budget is spent
+func (b *budget) middleware() ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			if err := b.allow(); err != nil {
+				return nil, err
+			}
+			r, err := next(ctx, input, cb)
+			if err == nil {
+				b.spend(r)
+			}
+			return r, err
+		}
+	}
+}
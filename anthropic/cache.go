@@ -0,0 +1,217 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"maps"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+	"github.com/firebase/genkit/go/ai"
+)
+
+// CacheControlMetadataKey is the part metadata key that sets a prompt caching
+// breakpoint after the part: the whole prompt prefix up to and including this
+// part is cached by Anthropic. Set it to true to use the default 5 minutes
+// cache, or to a TTL such as [CacheTTLOneHour] to choose how long it is kept.
+//
+//	p := ai.NewTextPart(longDocument)
+//	p.Metadata = map[string]any{anthropic.CacheControlMetadataKey: true}
+const CacheControlMetadataKey = "cacheControl"
+
+// Keys of the prompt caching token counts in [ai.GenerationUsage.Custom].
+// Cache reads are also reported as [ai.GenerationUsage.CachedContentTokens].
+const (
+	UsageCacheCreationInputTokens = "cacheCreationInputTokens"
+	UsageCacheReadInputTokens     = "cacheReadInputTokens"
+)
+
+const (
+	// CacheTTLFiveMinutes is the default prompt cache TTL
+	CacheTTLFiveMinutes = "5m"
+	// CacheTTLOneHour keeps the prompt cache for an hour, at a higher write cost
+	CacheTTLOneHour = "1h"
+
+	extendedCacheTTLBeta = "extended-cache-ttl-2025-04-11"
+)
+
+// cacheControl returns the cache breakpoint requested in the part metadata, if any
+func cacheControl(p *ai.Part) (anthropic.CacheControlEphemeralParam, bool) {
+	ttl, ok := cacheTTL(p)
+	if !ok {
+		return anthropic.CacheControlEphemeralParam{}, false
+	}
+	return newCacheControl(ttl), true
+}
+
+// cacheTTL returns the TTL of the cache breakpoint requested in the part
+// metadata, empty for the default TTL
+func cacheTTL(p *ai.Part) (string, bool) {
+	switch v := p.Metadata[CacheControlMetadataKey].(type) {
+	case bool:
+		return "", v
+	case string:
+		switch v {
+		case "ephemeral":
+			return "", true
+		case CacheTTLFiveMinutes, CacheTTLOneHour:
+			return v, true
+		}
+	case map[string]any:
+		ttl, _ := v["ttl"].(string)
+		return ttl, true
+	}
+	return "", false
+}
+
+// newCacheControl returns an ephemeral cache breakpoint with the given TTL,
+// empty for the default TTL
+func newCacheControl(ttl string) anthropic.CacheControlEphemeralParam {
+	cc := anthropic.NewCacheControlEphemeralParam()
+	if ttl != "" {
+		cc.SetExtraFields(map[string]any{"ttl": ttl})
+	}
+	return cc
+}
+
+// usesExtendedCacheTTL reports whether any cache breakpoint of the request uses the one hour TTL
+func usesExtendedCacheTTL(c *GenerationConfig, messages []*ai.Message) bool {
+	if c.CacheTTL == CacheTTLOneHour && (c.CacheSystemPrompt || c.CacheTools || c.AutoCache != nil) {
+		return true
+	}
+	for _, m := range messages {
+		for _, p := range m.Content {
+			if ttl, ok := cacheTTL(p); ok && ttl == CacheTTLOneHour {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setCacheControl sets a cache breakpoint on a content block
+func setCacheControl(block *anthropic.ContentBlockParamUnion, cc anthropic.CacheControlEphemeralParam) {
+	if field := block.GetCacheControl(); field != nil {
+		*field = cc
+		return
+	}
+	// raw blocks, copied to leave the request untouched
+	if raw, ok := block.Overrides(); ok {
+		if m, ok := raw.(map[string]any); ok {
+			m = maps.Clone(m)
+			m["cache_control"] = cc
+			*block = param.Override[anthropic.ContentBlockParamUnion](m)
+		}
+	}
+}
+
+// setToolCacheControl sets a cache breakpoint on a tool definition
+func setToolCacheControl(tool *anthropic.ToolUnionParam, cc anthropic.CacheControlEphemeralParam) {
+	if field := tool.GetCacheControl(); field != nil {
+		*field = cc
+		return
+	}
+	// built-in and server tools
+	if raw, ok := tool.Overrides(); ok {
+		if m, ok := raw.(map[string]any); ok {
+			m = maps.Clone(m)
+			m["cache_control"] = cc
+			*tool = param.Override[anthropic.ToolUnionParam](m)
+		}
+	}
+}
+
+// maxCacheBreakpoints is the number of cache breakpoints allowed by Anthropic per request
+const maxCacheBreakpoints = 4
+
+// AutoCacheConfig enables automatic prompt caching: breakpoints are set at the
+// end of the system prompt and on a recent message, so every turn of a
+// conversation reads the prefix cached by the previous turn.
+type AutoCacheConfig struct {
+	// SkipMessages is the number of most recent messages kept out of the cached prefix,
+	// 0 caches the conversation up to and including the last message
+	SkipMessages int `json:"skipMessages,omitempty"`
+	// MinMessages is the number of messages a conversation needs before messages
+	// are cached, shorter conversations only cache the system prompt
+	MinMessages int `json:"minMessages,omitempty"`
+}
+
+// applyAutoCache sets the automatic cache breakpoints on a request, keeping the
+// breakpoints set explicitly and the Anthropic limit of breakpoints
+func applyAutoCache(req *anthropic.MessageNewParams, ac *AutoCacheConfig, ttl string) {
+	used := 0
+	for _, b := range req.System {
+		if b.CacheControl.Type != "" {
+			used++
+		}
+	}
+	for i := range req.Tools {
+		if hasToolCacheControl(&req.Tools[i]) {
+			used++
+		}
+	}
+	for _, m := range req.Messages {
+		for i := range m.Content {
+			if hasCacheControl(&m.Content[i]) {
+				used++
+			}
+		}
+	}
+
+	if n := len(req.System); n > 0 && req.System[n-1].CacheControl.Type == "" && used < maxCacheBreakpoints {
+		req.System[n-1].CacheControl = newCacheControl(ttl)
+		used++
+	}
+
+	idx := len(req.Messages) - 1 - ac.SkipMessages
+	if idx < 0 || len(req.Messages) < ac.MinMessages || used >= maxCacheBreakpoints {
+		return
+	}
+	content := req.Messages[idx].Content
+	if len(content) == 0 || hasCacheControl(&content[len(content)-1]) {
+		return
+	}
+	setCacheControl(&content[len(content)-1], newCacheControl(ttl))
+}
+
+// hasCacheControl reports whether a cache breakpoint is set on a content block
+func hasCacheControl(block *anthropic.ContentBlockParamUnion) bool {
+	if field := block.GetCacheControl(); field != nil {
+		return field.Type != ""
+	}
+	if raw, ok := block.Overrides(); ok {
+		if m, ok := raw.(map[string]any); ok {
+			_, set := m["cache_control"]
+			return set
+		}
+	}
+	return false
+}
+
+// hasToolCacheControl reports whether a cache breakpoint is set on a tool definition
+func hasToolCacheControl(tool *anthropic.ToolUnionParam) bool {
+	if field := tool.GetCacheControl(); field != nil {
+		return field.Type != ""
+	}
+	if raw, ok := tool.Overrides(); ok {
+		if m, ok := raw.(map[string]any); ok {
+			_, set := m["cache_control"]
+			return set
+		}
+	}
+	return false
+}
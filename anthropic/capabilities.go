@@ -0,0 +1,109 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Capabilities are the limits, features and prices of a model, e.g. to route
+// the simple requests of an application to a cheaper model
+type Capabilities struct {
+	// Model is the name of the model, e.g. "claude-sonnet-4"
+	Model string
+	// ContextWindow is the number of input and output tokens of a request
+	ContextWindow int
+	// LongContextWindow is the context window with [GenerationConfig.LongContext],
+	// 0 when the model doesn't support it
+	LongContextWindow int
+	// MaxOutputTokens is the number of output tokens the model generates at
+	// most, see [GenerationConfig.ClampMaxOutputTokens]
+	MaxOutputTokens int
+	// ExtendedMaxOutputTokens is the output limit with [GenerationConfig.ExtendedOutput],
+	// 0 when the model doesn't support it
+	ExtendedMaxOutputTokens int
+	// Vision is true when the model accepts images and PDF documents
+	Vision bool
+	// Thinking is true when the model supports extended thinking
+	Thinking bool
+	// Tools is true when the model calls tools
+	Tools bool
+	// Pricing is the list price of the model, see [DefaultPricing]
+	Pricing Pricing
+}
+
+// thinkingModels are the models supporting extended thinking, by model name
+var thinkingModels = []string{
+	"claude-3-7-sonnet",
+	"claude-opus-4",
+	"claude-sonnet-4",
+	"claude-opus-4-1",
+	"claude-sonnet-4-5",
+	"claude-haiku-4-5",
+}
+
+// snapshotSuffix is the suffix of the model IDs of the snapshots of a model name
+var snapshotSuffix = regexp.MustCompile(`^-(\d{8}|latest)$`)
+
+// ModelCapabilities returns the capabilities of a model known to the plugin,
+// given by name or ID, false when the model is unknown
+func ModelCapabilities(name string) (Capabilities, bool) {
+	model, ok := knownModel(name)
+	if !ok {
+		return Capabilities{}, false
+	}
+	info := anthropicModels[model]
+	c := Capabilities{
+		Model:         model,
+		ContextWindow: defaultContextWindow,
+		Thinking:      slices.Contains(thinkingModels, model),
+		Pricing:       DefaultPricing[model],
+	}
+	if info.Supports != nil {
+		c.Vision = info.Supports.Media
+		c.Tools = info.Supports.Tools
+	}
+	if SupportsLongContext(model) {
+		c.LongContextWindow = longContextWindow
+	}
+	c.MaxOutputTokens, _ = outputLimit(model, &GenerationConfig{})
+	if n, _ := outputLimit(model, &GenerationConfig{ExtendedOutput: true}); n != c.MaxOutputTokens {
+		c.ExtendedMaxOutputTokens = n
+	}
+	return c, true
+}
+
+// knownModel returns the name of a model known to the plugin, given by name
+// or ID, e.g. the ID of a snapshot released after the plugin
+func knownModel(name string) (string, bool) {
+	if _, ok := anthropicModels[name]; ok {
+		return name, true
+	}
+	for m, info := range anthropicModels {
+		if slices.Contains(info.Versions, name) {
+			return m, true
+		}
+	}
+	for m := range anthropicModels {
+		if rest, ok := strings.CutPrefix(name, m); ok && snapshotSuffix.MatchString(rest) {
+			return m, true
+		}
+	}
+	return "", false
+}
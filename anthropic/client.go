@@ -0,0 +1,57 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"slices"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/anthropics/anthropic-sdk-go/packages/ssestream"
+)
+
+// MessagesAPI is the part of the Anthropic Messages API the models generate
+// with, implemented by the Messages service of the SDK client. Set
+// [Anthropic.Messages] to a fake implementation to test flows without
+// calling the API.
+type MessagesAPI interface {
+	New(ctx context.Context, body anthropic.MessageNewParams, opts ...option.RequestOption) (*anthropic.Message, error)
+	NewStreaming(ctx context.Context, body anthropic.MessageNewParams, opts ...option.RequestOption) *ssestream.Stream[anthropic.MessageStreamEventUnion]
+	CountTokens(ctx context.Context, body anthropic.MessageCountTokensParams, opts ...option.RequestOption) (*anthropic.MessageTokensCount, error)
+}
+
+var _ MessagesAPI = (*anthropic.MessageService)(nil)
+
+// newClient returns an SDK client safe for concurrent requests. Its services
+// append the options of each request to their shared options, whose spare
+// capacity would let the concurrent requests overwrite each other's options,
+// e.g. their response destination or their beta header.
+func newClient(opts ...option.RequestOption) *anthropic.Client {
+	c := anthropic.NewClient(opts...)
+	c.Options = slices.Clip(c.Options)
+	c.Completions.Options = slices.Clip(c.Completions.Options)
+	c.Messages.Options = slices.Clip(c.Messages.Options)
+	c.Messages.Batches.Options = slices.Clip(c.Messages.Batches.Options)
+	c.Models.Options = slices.Clip(c.Models.Options)
+	c.Beta.Options = slices.Clip(c.Beta.Options)
+	c.Beta.Models.Options = slices.Clip(c.Beta.Models.Options)
+	c.Beta.Messages.Options = slices.Clip(c.Beta.Messages.Options)
+	c.Beta.Messages.Batches.Options = slices.Clip(c.Beta.Messages.Batches.Options)
+	c.Beta.Files.Options = slices.Clip(c.Beta.Files.Options)
+	return &c
+}
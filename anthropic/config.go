@@ -0,0 +1,235 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+)
+
+// GenerationConfig is the Anthropic specific generation config.
+// It accepts every [ai.GenerationCommonConfig] field plus options that only
+// exist on the Anthropic Messages API.
+type GenerationConfig struct {
+	ai.GenerationCommonConfig
+
+	// ToolChoice controls how Claude uses the tools given in the request.
+	// It takes precedence over [ai.ModelRequest.ToolChoice].
+	ToolChoice *ToolChoice `json:"toolChoice,omitempty"`
+
+	// WebFetch enables the web_fetch server tool
+	WebFetch *WebFetchConfig `json:"webFetch,omitempty"`
+
+	// Computer configures the display of the computer use tool, it is required
+	// when the tool of [DefineComputerTool] is given
+	Computer *ComputerUseConfig `json:"computer,omitempty"`
+
+	// CodeExecution enables the code_execution server tool
+	CodeExecution bool `json:"codeExecution,omitempty"`
+	// Container is the ID of a code execution container to reuse, see [ContainerID]
+	Container string `json:"container,omitempty"`
+
+	// MCPServers are remote MCP servers Claude can call tools from directly
+	MCPServers []MCPServer `json:"mcpServers,omitempty"`
+
+	// Citations enables citations on every document sent in the request,
+	// see [Citations] to read them from the response parts and
+	// [DocumentCitationsMetadataKey] to set them per document
+	Citations bool `json:"citations,omitempty"`
+
+	// CacheSystemPrompt sets a prompt caching breakpoint at the end of the system prompt
+	CacheSystemPrompt bool `json:"cacheSystemPrompt,omitempty"`
+	// CacheTools sets a prompt caching breakpoint at the end of the tool definitions.
+	// Parts can also be cached individually, see [CacheControlMetadataKey].
+	CacheTools bool `json:"cacheTools,omitempty"`
+	// CacheTTL is the TTL of the CacheSystemPrompt and CacheTools breakpoints,
+	// e.g. [CacheTTLOneHour]. It defaults to 5 minutes.
+	CacheTTL string `json:"cacheTTL,omitempty"`
+	// AutoCache sets cache breakpoints automatically on the system prompt and
+	// the conversation, so callers don't need to tag parts on each turn
+	AutoCache *AutoCacheConfig `json:"autoCache,omitempty"`
+
+	// LongContext enables the 1M tokens context window on the models that support it,
+	// see [SupportsLongContext]. Input above 200k tokens is billed at a higher rate.
+	LongContext bool `json:"longContext,omitempty"`
+
+	// ExtendedOutput raises the output limit of Claude 3.7 Sonnet to 128k tokens,
+	// MaxOutputTokens still defaults to [MaxNumberOfTokens]
+	ExtendedOutput bool `json:"extendedOutput,omitempty"`
+
+	// ClampMaxOutputTokens lowers a MaxOutputTokens above the output limit of
+	// the model to that limit, a [*MaxOutputTokensExceededError] is returned
+	// otherwise. The default MaxOutputTokens is always within the limit.
+	ClampMaxOutputTokens bool `json:"clampMaxOutputTokens,omitempty"`
+
+	// MaxContinuations is the number of follow-up requests sent when the answer
+	// is cut at MaxOutputTokens, each one continues the answer so far. The
+	// response holds the whole answer and the usage of all the requests.
+	MaxContinuations int `json:"maxContinuations,omitempty"`
+
+	// DisableStreaming sends the request without streaming even when the call
+	// has a stream callback, e.g. behind proxies buffering server-sent
+	// events. The callback then receives the whole response, with its usage,
+	// as a single chunk and [WithStreamEvents] receives no events.
+	DisableStreaming bool `json:"disableStreaming,omitempty"`
+
+	// PauseTurnContinuations is the number of follow-up requests sent when
+	// Anthropic pauses a turn with the pause_turn stop reason, e.g. during a
+	// long running server tool such as web search, 5 by default. The response
+	// holds the whole turn and the usage of all the requests. Set it to -1 to
+	// get the paused turns as is.
+	PauseTurnContinuations int `json:"pauseTurnContinuations,omitempty"`
+
+	// StreamReconnects is the number of times a streamed response dropped by
+	// the network is requested again, with the answer received so far as
+	// prefill, streaming goes on where it stopped. Disabled by default.
+	StreamReconnects int `json:"streamReconnects,omitempty"`
+
+	// OutputRepairs is the number of requests sent to fix a structured output
+	// that doesn't match the requested schema, 1 by default. Set it to -1 to
+	// disable the repairs and the validation of the output.
+	OutputRepairs int `json:"outputRepairs,omitempty"`
+
+	// ToolInputRepairs enables the validation of the tool calls against the
+	// input schema of their tool: it is the number of requests sent to fix the
+	// calls with an invalid input before a [ToolInputValidationError] is
+	// returned, -1 returns the error without repairs. The tool calls are not
+	// validated by default. The invalid calls may already have been streamed.
+	ToolInputRepairs int `json:"toolInputRepairs,omitempty"`
+
+	// UserID is sent as metadata.user_id to tell apart the end users of an
+	// application, it takes precedence over [WithUserID]. It must not contain
+	// personal information such as names or emails.
+	UserID string `json:"userId,omitempty"`
+
+	// Workspace is the name of the workspace of [Anthropic.Workspaces] the
+	// request is sent to, it takes precedence over [WithWorkspace]
+	Workspace string `json:"workspace,omitempty"`
+
+	// ContextWindowCheck counts, or estimates, the input tokens before sending the request and
+	// fails with a [*ContextWindowExceededError] when the input and MaxOutputTokens
+	// don't fit the context window of the model
+	ContextWindowCheck ContextWindowCheck `json:"contextWindowCheck,omitempty"`
+
+	// ContextManagement lets Anthropic clear the oldest tool results of long
+	// conversations, the edits applied are reported by [ContextEdits]
+	ContextManagement *ContextManagementConfig `json:"contextManagement,omitempty"`
+
+	// Truncation trims the oldest turns of the conversation to a number of
+	// turns or of input tokens before the request is sent
+	Truncation *TruncationConfig `json:"truncation,omitempty"`
+
+	// DryRun returns the request that would be sent to Anthropic without
+	// sending it, as the [*anthropic.MessageNewParams] custom field of an empty
+	// response, to inspect the prompt, cache breakpoints and tool schemas
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// ToolChoiceType is the kind of tool_choice sent to Anthropic.
+type ToolChoiceType string
+
+const (
+	// ToolChoiceAuto lets Claude decide whether to call a tool.
+	ToolChoiceAuto ToolChoiceType = "auto"
+	// ToolChoiceAny forces Claude to call one of the given tools.
+	ToolChoiceAny ToolChoiceType = "any"
+	// ToolChoiceNone forbids Claude from calling any tool.
+	ToolChoiceNone ToolChoiceType = "none"
+	// ToolChoiceTool forces Claude to call the tool named in [ToolChoice.Name].
+	ToolChoiceTool ToolChoiceType = "tool"
+)
+
+// ToolChoice describes the tool_choice of an Anthropic request.
+type ToolChoice struct {
+	Type ToolChoiceType `json:"type,omitempty"`
+	// Name is the tool to call, only used when Type is [ToolChoiceTool]
+	Name string `json:"name,omitempty"`
+	// DisableParallelToolUse limits Claude to at most one tool call per turn.
+	// It has no effect when Type is [ToolChoiceNone].
+	DisableParallelToolUse bool `json:"disableParallelToolUse,omitempty"`
+}
+
+// ToolErrorMetadataKey is the tool response part metadata key that marks a tool
+// call as failed. When set to true the tool_result is sent with is_error.
+const ToolErrorMetadataKey = "isError"
+
+const (
+	// PartialMetadataKey marks the tool request parts streamed while Claude is
+	// still writing the tool arguments
+	PartialMetadataKey = "partial"
+	// PartialJSONMetadataKey is the metadata key of the streamed tool request
+	// parts holding the latest fragment of the tool arguments JSON
+	PartialJSONMetadataKey = "partialJson"
+)
+
+const (
+	// SignatureMetadataKey is the reasoning part metadata key of the signature
+	// of Claude's thinking, sent back with the thinking in the next turns
+	SignatureMetadataKey = "signature"
+	// RedactedThinkingMetadataKey is the reasoning part metadata key of the
+	// encrypted data of a thinking redacted by the safety systems
+	RedactedThinkingMetadataKey = "redactedThinking"
+)
+
+// ToolError can be returned as a tool output to tell Claude the tool call failed.
+// It is sent as a tool_result with is_error set and the message as content.
+type ToolError struct {
+	Message string `json:"error"`
+}
+
+func (e *ToolError) Error() string {
+	return e.Message
+}
+
+type userIDKey struct{}
+
+// WithUserID returns a context whose requests are sent with the given end user
+// ID as metadata.user_id, see [GenerationConfig.UserID]
+func WithUserID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, id)
+}
+
+// userIDFromContext returns the end user ID set with [WithUserID]
+func userIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(userIDKey{}).(string)
+	return id
+}
+
+type streamEventsKey struct{}
+
+// StreamEventFunc receives the raw events of a streamed response, e.g.
+// message_start or content_block_delta, as decoded by the Anthropic SDK. The
+// SDK drops the ping events and the event types it doesn't know. Returning an
+// error stops the stream.
+type StreamEventFunc func(ctx context.Context, event anthropic.MessageStreamEventUnion) error
+
+// WithStreamEvents returns a context whose responses are streamed to fn event
+// by event, besides the chunks of the Genkit callback, e.g. for UIs rendering
+// the content blocks as Anthropic sends them. The responses are streamed
+// even without a Genkit callback. The responses served from the
+// [Anthropic.ResponseCache] or shared by [Anthropic.Deduplicate] have no events.
+func WithStreamEvents(ctx context.Context, fn StreamEventFunc) context.Context {
+	return context.WithValue(ctx, streamEventsKey{}, fn)
+}
+
+// streamEventsFromContext returns the callback set with [WithStreamEvents]
+func streamEventsFromContext(ctx context.Context) StreamEventFunc {
+	fn, _ := ctx.Value(streamEventsKey{}).(StreamEventFunc)
+	return fn
+}
@@ -0,0 +1,145 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+)
+
+const (
+	contextManagementBeta = "context-management-2025-06-27"
+
+	clearToolUsesEditType = "clear_tool_uses_20250919"
+
+	// ContextEditsMetadataKey is the response message metadata key of the
+	// [ContextEdit] list applied by Anthropic, see [ContextEdits]
+	ContextEditsMetadataKey = "contextEdits"
+)
+
+// ContextManagementConfig configures the edits Anthropic applies to the
+// context of a request before generating, so long-running agents don't
+// overflow the context window
+type ContextManagementConfig struct {
+	// ClearToolUses clears the oldest tool results once the input is large
+	ClearToolUses *ClearToolUsesConfig `json:"clearToolUses,omitempty"`
+}
+
+// ClearToolUsesConfig configures the clearing of the oldest tool results of
+// a conversation, replaced with placeholders. The defaults are Anthropic's.
+type ClearToolUsesConfig struct {
+	// TriggerInputTokens is the number of input tokens above which the tool
+	// results are cleared, 100k by default
+	TriggerInputTokens int `json:"triggerInputTokens,omitempty"`
+	// KeepToolUses is the number of most recent tool uses kept, 3 by default
+	KeepToolUses int `json:"keepToolUses,omitempty"`
+	// ClearAtLeastTokens is the minimum number of tokens cleared at once, so
+	// the prompt cache isn't invalidated for a few tokens
+	ClearAtLeastTokens int `json:"clearAtLeastTokens,omitempty"`
+	// ExcludeTools are the tools whose results are never cleared
+	ExcludeTools []string `json:"excludeTools,omitempty"`
+	// ClearToolInputs clears the inputs of the tool calls too
+	ClearToolInputs bool `json:"clearToolInputs,omitempty"`
+}
+
+// ContextEdit is an edit applied by Anthropic to the context of a request
+type ContextEdit struct {
+	// Type is the type of the edit, e.g. "clear_tool_uses_20250919"
+	Type               string `json:"type"`
+	ClearedToolUses    int    `json:"clearedToolUses,omitempty"`
+	ClearedInputTokens int    `json:"clearedInputTokens,omitempty"`
+}
+
+// ContextEdits returns the edits Anthropic applied to the context of the
+// request of the response, e.g. the tool results cleared, so agents know what
+// Claude no longer sees
+func ContextEdits(resp *ai.ModelResponse) []*ContextEdit {
+	if resp == nil || resp.Message == nil {
+		return nil
+	}
+	switch edits := resp.Message.Metadata[ContextEditsMetadataKey].(type) {
+	case []*ContextEdit:
+		return edits
+	case []any:
+		// metadata decoded from JSON, e.g. a stored conversation history
+		b, err := json.Marshal(edits)
+		if err != nil {
+			return nil
+		}
+		var decoded []*ContextEdit
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			return nil
+		}
+		return decoded
+	}
+	return nil
+}
+
+// toAnthropicContextManagement translates the config to the context_management
+// request field
+func toAnthropicContextManagement(c *ContextManagementConfig) map[string]any {
+	edits := []map[string]any{}
+	if t := c.ClearToolUses; t != nil {
+		edit := map[string]any{"type": clearToolUsesEditType}
+		if t.TriggerInputTokens > 0 {
+			edit["trigger"] = map[string]any{"type": "input_tokens", "value": t.TriggerInputTokens}
+		}
+		if t.KeepToolUses > 0 {
+			edit["keep"] = map[string]any{"type": "tool_uses", "value": t.KeepToolUses}
+		}
+		if t.ClearAtLeastTokens > 0 {
+			edit["clear_at_least"] = map[string]any{"type": "input_tokens", "value": t.ClearAtLeastTokens}
+		}
+		if len(t.ExcludeTools) > 0 {
+			edit["exclude_tools"] = t.ExcludeTools
+		}
+		if t.ClearToolInputs {
+			edit["clear_tool_inputs"] = true
+		}
+		edits = append(edits, edit)
+	}
+	return map[string]any{"edits": edits}
+}
+
+// contextEdits returns the context edits reported in an Anthropic message, if any
+func contextEdits(m *anthropic.Message) ([]*ContextEdit, error) {
+	field, ok := m.JSON.ExtraFields["context_management"]
+	if !ok || field.Raw() == "" || field.Raw() == "null" {
+		return nil, nil
+	}
+	var cm struct {
+		AppliedEdits []struct {
+			Type               string `json:"type"`
+			ClearedToolUses    int    `json:"cleared_tool_uses"`
+			ClearedInputTokens int    `json:"cleared_input_tokens"`
+		} `json:"applied_edits"`
+	}
+	if err := json.Unmarshal([]byte(field.Raw()), &cm); err != nil {
+		return nil, fmt.Errorf("unable to decode context management: %w", err)
+	}
+	if len(cm.AppliedEdits) == 0 {
+		return nil, nil
+	}
+	edits := make([]*ContextEdit, 0, len(cm.AppliedEdits))
+	for _, e := range cm.AppliedEdits {
+		edits = append(edits, &ContextEdit{Type: e.Type, ClearedToolUses: e.ClearedToolUses, ClearedInputTokens: e.ClearedInputTokens})
+	}
+	return edits, nil
+}
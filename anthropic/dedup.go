@@ -0,0 +1,204 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"sync"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a context whose Generate calls are deduplicated
+// with the given key instead of the hash of their request, see [Anthropic.Deduplicate]
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// idempotencyKeyFromContext returns the key set with [WithIdempotencyKey]
+func idempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// dedupCall is a call in flight, shared by the duplicate calls
+type dedupCall struct {
+	done chan struct{}
+	resp *ai.ModelResponse
+	err  error
+}
+
+// deduplicator shares a single upstream call between the duplicate calls in flight
+type deduplicator struct {
+	mu    sync.Mutex
+	calls map[string]*dedupCall
+}
+
+func newDeduplicator() *deduplicator {
+	return &deduplicator{calls: map[string]*dedupCall{}}
+}
+
+// middleware makes the duplicate calls to a model wait for the response of the
+// first one. The duplicates don't stream: their callback receives the whole
+// response as a single chunk.
+func (d *deduplicator) middleware(model string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			key, ok := requestKey(ctx, model, input)
+			if !ok {
+				return next(ctx, input, cb)
+			}
+
+			d.mu.Lock()
+			if call, ok := d.calls[key]; ok {
+				d.mu.Unlock()
+				return call.wait(ctx, cb)
+			}
+			call := &dedupCall{done: make(chan struct{})}
+			d.calls[key] = call
+			d.mu.Unlock()
+
+			call.resp, call.err = next(ctx, input, cb)
+			d.mu.Lock()
+			delete(d.calls, key)
+			d.mu.Unlock()
+			close(call.done)
+			return call.resp, call.err
+		}
+	}
+}
+
+// wait waits for the response of the call
+func (c *dedupCall) wait(ctx context.Context, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	// every caller gets a response of its own
+	return replay(ctx, copyResponse(c.resp), cb)
+}
+
+// requestKey returns the key identifying the identical requests to a model:
+// the key set with [WithIdempotencyKey], or else the hash of the request
+func requestKey(ctx context.Context, model string, input *ai.ModelRequest) (string, bool) {
+	key := idempotencyKeyFromContext(ctx)
+	if key == "" {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return "", false
+		}
+		sum := sha256.Sum256(append([]byte(model+"\n"), b...))
+		key = hex.EncodeToString(sum[:])
+	}
+	// the requests of the workspaces are answered separately
+	if ws := workspaceFromContext(ctx); ws != "" {
+		model = ws + "/" + model
+	}
+	return model + "/" + key, true
+}
+
+// copyResponse returns a deep copy of a response, its message, parts, usage
+// and their metadata can be changed without changing the response
+func copyResponse(resp *ai.ModelResponse) *ai.ModelResponse {
+	r := *resp
+	if resp.Message != nil {
+		m := *resp.Message
+		m.Metadata = cloneMetadata(m.Metadata)
+		m.Content = make([]*ai.Part, len(resp.Message.Content))
+		for i, p := range resp.Message.Content {
+			m.Content[i] = copyPart(p)
+		}
+		r.Message = &m
+	}
+	if resp.Usage != nil {
+		u := *resp.Usage
+		u.Custom = maps.Clone(u.Custom)
+		r.Usage = &u
+	}
+	return &r
+}
+
+// copyPart returns a copy of a part whose metadata and tool calls can be
+// changed without changing the part
+func copyPart(p *ai.Part) *ai.Part {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.Metadata = cloneMetadata(p.Metadata)
+	c.Custom = cloneMetadata(p.Custom)
+	if p.ToolRequest != nil {
+		tr := *p.ToolRequest
+		tr.Input = cloneValue(tr.Input)
+		c.ToolRequest = &tr
+	}
+	if p.ToolResponse != nil {
+		tr := *p.ToolResponse
+		tr.Output = cloneValue(tr.Output)
+		c.ToolResponse = &tr
+	}
+	return &c
+}
+
+// cloneMetadata returns a deep copy of the JSON maps and slices of metadata,
+// the other values are shared
+func cloneMetadata(m map[string]any) map[string]any {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]any, len(m))
+	for k, v := range m {
+		c[k] = cloneValue(v)
+	}
+	return c
+}
+
+// cloneValue returns a deep copy of a JSON map or slice, the value itself otherwise
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		return cloneMetadata(v)
+	case []any:
+		c := make([]any, len(v))
+		for i, e := range v {
+			c[i] = cloneValue(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// replay streams a response received by another call as a single chunk
+func replay(ctx context.Context, r *ai.ModelResponse, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+	if cb != nil && r.Message != nil {
+		if err := cb(ctx, &ai.ModelResponseChunk{Role: r.Message.Role, Content: r.Message.Content}); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
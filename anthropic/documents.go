@@ -0,0 +1,357 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+	"github.com/firebase/genkit/go/ai"
+)
+
+// CitationsMetadataKey is the text part metadata key holding the []*Citation
+// returned by Claude for that text.
+const CitationsMetadataKey = "citations"
+
+// Citation is a source Claude used for a piece of its answer
+type Citation struct {
+	// Type is the kind of location, one of char_location, page_location,
+	// content_block_location or web_search_result_location
+	Type      string `json:"type"`
+	CitedText string `json:"citedText,omitempty"`
+	// DocumentIndex is the index of the cited document among the request documents
+	DocumentIndex int    `json:"documentIndex"`
+	DocumentTitle string `json:"documentTitle,omitempty"`
+	// StartCharIndex and EndCharIndex locate char_location citations
+	StartCharIndex int `json:"startCharIndex,omitempty"`
+	EndCharIndex   int `json:"endCharIndex,omitempty"`
+	// StartPageNumber and EndPageNumber locate page_location citations
+	StartPageNumber int `json:"startPageNumber,omitempty"`
+	EndPageNumber   int `json:"endPageNumber,omitempty"`
+	// StartBlockIndex and EndBlockIndex locate content_block_location citations
+	StartBlockIndex int `json:"startBlockIndex,omitempty"`
+	EndBlockIndex   int `json:"endBlockIndex,omitempty"`
+	// URL and Title locate web_search_result_location citations
+	URL   string `json:"url,omitempty"`
+	Title string `json:"title,omitempty"`
+	// Source and SearchResultIndex locate search_result_location citations,
+	// Source is the [DocumentSourceMetadataKey] of the cited [ai.Document]
+	Source            string `json:"source,omitempty"`
+	SearchResultIndex int    `json:"searchResultIndex,omitempty"`
+}
+
+// Citations returns the citations attached to a response part, if any, also
+// when its metadata was decoded from JSON, e.g. from a stored history
+func Citations(p *ai.Part) []*Citation {
+	if p == nil {
+		return nil
+	}
+	switch citations := p.Metadata[CitationsMetadataKey].(type) {
+	case []*Citation:
+		return citations
+	case []any, []map[string]any:
+		// metadata decoded from JSON, e.g. a stored conversation history
+		b, err := json.Marshal(citations)
+		if err != nil {
+			return nil
+		}
+		var decoded []*Citation
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			return nil
+		}
+		return decoded
+	}
+	return nil
+}
+
+// fromAnthropicCitation translates a citation of a text block to a [Citation]
+func fromAnthropicCitation(c anthropic.TextCitationUnion) *Citation {
+	return withSearchResultLocation(c.RawJSON(), &Citation{
+		Type:            c.Type,
+		CitedText:       c.CitedText,
+		DocumentIndex:   int(c.DocumentIndex),
+		DocumentTitle:   c.DocumentTitle,
+		StartCharIndex:  int(c.StartCharIndex),
+		EndCharIndex:    int(c.EndCharIndex),
+		StartPageNumber: int(c.StartPageNumber),
+		EndPageNumber:   int(c.EndPageNumber),
+		StartBlockIndex: int(c.StartBlockIndex),
+		EndBlockIndex:   int(c.EndBlockIndex),
+		URL:             c.URL,
+		Title:           c.Title,
+	})
+}
+
+// fromAnthropicCitationDelta translates a streamed citation to a [Citation]
+func fromAnthropicCitationDelta(c anthropic.CitationsDeltaCitationUnion) *Citation {
+	return withSearchResultLocation(c.RawJSON(), &Citation{
+		Type:            c.Type,
+		CitedText:       c.CitedText,
+		DocumentIndex:   int(c.DocumentIndex),
+		DocumentTitle:   c.DocumentTitle,
+		StartCharIndex:  int(c.StartCharIndex),
+		EndCharIndex:    int(c.EndCharIndex),
+		StartPageNumber: int(c.StartPageNumber),
+		EndPageNumber:   int(c.EndPageNumber),
+		StartBlockIndex: int(c.StartBlockIndex),
+		EndBlockIndex:   int(c.EndBlockIndex),
+		URL:             c.URL,
+		Title:           c.Title,
+	})
+}
+
+// withSearchResultLocation fills the search_result_location fields, not modeled by the SDK yet
+func withSearchResultLocation(raw string, c *Citation) *Citation {
+	if c.Type != "search_result_location" {
+		return c
+	}
+	var loc struct {
+		Source            string `json:"source"`
+		Title             string `json:"title"`
+		SearchResultIndex int    `json:"search_result_index"`
+		StartBlockIndex   int    `json:"start_block_index"`
+		EndBlockIndex     int    `json:"end_block_index"`
+	}
+	if err := json.Unmarshal([]byte(raw), &loc); err != nil {
+		return c
+	}
+	c.Source = loc.Source
+	c.Title = loc.Title
+	c.SearchResultIndex = loc.SearchResultIndex
+	c.StartBlockIndex = loc.StartBlockIndex
+	c.EndBlockIndex = loc.EndBlockIndex
+	return c
+}
+
+const (
+	// DocumentSourceMetadataKey is the [ai.Document] metadata key holding the
+	// source (e.g. URL or ID) of the document, sent as the search result source
+	DocumentSourceMetadataKey = "source"
+	// DocumentTitleMetadataKey is the metadata key of the [ai.Document]s and
+	// of the document parts, e.g. PDFs, holding the title of the document
+	DocumentTitleMetadataKey = "title"
+	// DocumentContextMetadataKey is the metadata key of the [ai.Document]s with
+	// media and of the document parts holding the context of the document,
+	// e.g. its author or date, which Claude reads but doesn't cite
+	DocumentContextMetadataKey = "context"
+	// DocumentCitationsMetadataKey is the bool metadata key of the [ai.Document]s
+	// and of the document parts, e.g. PDFs, enabling or disabling the citations
+	// of the document whatever [GenerationConfig.Citations]. The citations of
+	// the text documents, sent as search results, are enabled for all or none.
+	DocumentCitationsMetadataKey = "citationsEnabled"
+
+	searchResultsBeta = "search-results-2025-06-09"
+)
+
+// toAnthropicDocs translates the retrieved documents of a request to content
+// blocks: the text documents to search_result blocks, so Claude cites them back
+// with their source, and the documents with media, e.g. the PDFs or images of
+// a retriever, to document and image blocks
+func toAnthropicDocs(ctx context.Context, docs []*ai.Document, citations bool) ([]anthropic.ContentBlockParamUnion, error) {
+	blocks := make([]anthropic.ContentBlockParamUnion, 0, len(docs))
+	// searchCitations is the citations setting of the search results, once known
+	var searchCitations *bool
+	for i, doc := range docs {
+		source, _ := doc.Metadata[DocumentSourceMetadataKey].(string)
+		if source == "" {
+			source = fmt.Sprintf("document-%d", i)
+		}
+		title, _ := doc.Metadata[DocumentTitleMetadataKey].(string)
+		if title == "" {
+			title = source
+		}
+		enabled, set := documentCitations(doc.Metadata)
+		if !isTextDocument(doc) {
+			docContext, _ := doc.Metadata[DocumentContextMetadataKey].(string)
+			media, err := toAnthropicMediaDocument(ctx, doc, title, docContext)
+			if err != nil {
+				return nil, fmt.Errorf("document %d: %w", i, err)
+			}
+			if set {
+				for i := range media {
+					setCitations(&media[i], enabled, true)
+				}
+			}
+			blocks = append(blocks, media...)
+			continue
+		}
+		if !set {
+			enabled = citations
+		}
+		if searchCitations == nil {
+			searchCitations = &enabled
+		} else if *searchCitations != enabled {
+			return nil, fmt.Errorf("document %d: the citations of the text documents must be enabled for all or none", i)
+		}
+
+		content := []map[string]any{}
+		for _, p := range doc.Content {
+			content = append(content, map[string]any{"type": "text", "text": p.Text})
+		}
+		block := map[string]any{
+			"type":    "search_result",
+			"source":  source,
+			"title":   title,
+			"content": content,
+		}
+		if enabled {
+			block["citations"] = map[string]any{"enabled": true}
+		}
+		blocks = append(blocks, param.Override[anthropic.ContentBlockParamUnion](block))
+	}
+	return blocks, nil
+}
+
+// isTextDocument reports whether a document is made of text parts only
+func isTextDocument(doc *ai.Document) bool {
+	for _, p := range doc.Content {
+		if !p.IsText() {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTextDocuments reports whether some documents are sent as search results
+func hasTextDocuments(docs []*ai.Document) bool {
+	for _, doc := range docs {
+		if isTextDocument(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+// toAnthropicMediaDocument translates a document with media to a block per
+// part, with the document title and context: the media as documents or images
+// and the text as plain text documents
+func toAnthropicMediaDocument(ctx context.Context, doc *ai.Document, title, docContext string) ([]anthropic.ContentBlockParamUnion, error) {
+	blocks := make([]anthropic.ContentBlockParamUnion, 0, len(doc.Content))
+	for _, p := range doc.Content {
+		var block anthropic.ContentBlockParamUnion
+		switch {
+		case p.IsText():
+			block = anthropic.NewDocumentBlock(anthropic.PlainTextSourceParam{Data: p.Text})
+		case p.IsMedia():
+			var err error
+			if block, err = toAnthropicMediaBlock(ctx, p); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported part in document: %v", p.Kind)
+		}
+		setDocumentInfo(&block, title, docContext)
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// setDocumentInfo sets the title and the context of a document block when not
+// empty, the other blocks are unchanged
+func setDocumentInfo(block *anthropic.ContentBlockParamUnion, title, context string) {
+	if doc := block.OfDocument; doc != nil {
+		if title != "" {
+			doc.Title = anthropic.String(title)
+		}
+		if context != "" {
+			doc.Context = anthropic.String(context)
+		}
+		return
+	}
+	// the raw document blocks of the uploaded files
+	if raw, ok := block.Overrides(); ok {
+		if doc, ok := raw.(map[string]any); ok && doc["type"] == "document" {
+			doc = maps.Clone(doc)
+			if title != "" {
+				doc["title"] = title
+			}
+			if context != "" {
+				doc["context"] = context
+			}
+			*block = param.Override[anthropic.ContentBlockParamUnion](doc)
+		}
+	}
+}
+
+// documentInfo returns the title and the context of a document part
+func documentInfo(p *ai.Part) (title, context string) {
+	title, _ = p.Metadata[DocumentTitleMetadataKey].(string)
+	context, _ = p.Metadata[DocumentContextMetadataKey].(string)
+	return title, context
+}
+
+// withSearchResults puts the document blocks ahead of the last user message
+// content, after its tool results: Anthropic requires the tool results first,
+// e.g. in the tool loop turns of Genkit, which sends the documents again
+func withSearchResults(messages []anthropic.MessageParam, results []anthropic.ContentBlockParamUnion) []anthropic.MessageParam {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == anthropic.MessageParamRoleUser {
+			content := messages[i].Content
+			n := 0
+			for n < len(content) && content[n].OfToolResult != nil {
+				n++
+			}
+			messages[i].Content = slices.Concat(content[:n], results, content[n:])
+			return messages
+		}
+	}
+	return append(messages, anthropic.NewUserMessage(results...))
+}
+
+// enableCitations turns on citations for every document block of the
+// messages, but the documents whose citations are set with [DocumentCitationsMetadataKey]
+func enableCitations(messages []anthropic.MessageParam) {
+	for _, m := range messages {
+		for i := range m.Content {
+			setCitations(&m.Content[i], true, false)
+		}
+	}
+}
+
+// documentCitations returns the citations setting of the metadata of a
+// document, see [DocumentCitationsMetadataKey]
+func documentCitations(metadata map[string]any) (enabled, ok bool) {
+	enabled, ok = metadata[DocumentCitationsMetadataKey].(bool)
+	return enabled, ok
+}
+
+// setCitations enables or disables the citations of a document block, the
+// other blocks are unchanged. The documents whose citations are already set are
+// only changed with override.
+func setCitations(block *anthropic.ContentBlockParamUnion, enabled, override bool) {
+	if doc := block.OfDocument; doc != nil {
+		if override || !doc.Citations.Enabled.Valid() {
+			doc.Citations = anthropic.CitationsConfigParam{Enabled: anthropic.Bool(enabled)}
+		}
+		return
+	}
+	// raw document blocks given as custom parts, copied to leave the request untouched
+	if raw, ok := block.Overrides(); ok {
+		if doc, ok := raw.(map[string]any); ok && doc["type"] == "document" {
+			if _, set := doc["citations"]; override || !set {
+				doc = maps.Clone(doc)
+				doc["citations"] = map[string]any{"enabled": enabled}
+				*block = param.Override[anthropic.ContentBlockParamUnion](doc)
+			}
+		}
+	}
+}
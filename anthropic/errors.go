@@ -0,0 +1,331 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
+)
+
+// ErrOverloaded matches, with [errors.Is], the errors of the calls failing
+// because Anthropic is temporarily overloaded (overloaded_error, HTTP 529),
+// unlike other server errors, so callers can shed load
+var ErrOverloaded = errors.New("anthropic is overloaded")
+
+// The errors matching, with [errors.Is], the [*APIError] of each error type
+var (
+	// ErrInvalidRequest matches the invalid_request_error errors, HTTP 400
+	ErrInvalidRequest = errors.New("anthropic rejected the request")
+	// ErrAuthentication matches the authentication_error errors, HTTP 401
+	ErrAuthentication = errors.New("anthropic authentication failed")
+	// ErrPermission matches the permission_error errors, HTTP 403
+	ErrPermission = errors.New("anthropic permission denied")
+	// ErrNotFound matches the not_found_error errors, HTTP 404
+	ErrNotFound = errors.New("anthropic resource not found")
+	// ErrRequestTooLarge matches the request_too_large errors, HTTP 413
+	ErrRequestTooLarge = errors.New("anthropic request too large")
+	// ErrAPIRateLimited matches the rate_limit_error errors, HTTP 429, unlike
+	// [ErrRateLimited] returned by the rate limiter of the plugin
+	ErrAPIRateLimited = errors.New("anthropic rate limit exceeded")
+	// ErrServer matches the api_error errors, HTTP 500
+	ErrServer = errors.New("anthropic server error")
+)
+
+// statusOverloaded is the HTTP status of the overloaded_error responses
+const statusOverloaded = 529
+
+// errorTypes are the errors matching the error types, by type
+var errorTypes = map[string]error{
+	"invalid_request_error": ErrInvalidRequest,
+	"authentication_error":  ErrAuthentication,
+	"permission_error":      ErrPermission,
+	"not_found_error":       ErrNotFound,
+	"request_too_large":     ErrRequestTooLarge,
+	"rate_limit_error":      ErrAPIRateLimited,
+	"api_error":             ErrServer,
+	"overloaded_error":      ErrOverloaded,
+}
+
+// statusErrorTypes are the error types of the HTTP statuses, for the
+// responses without an error body
+var statusErrorTypes = map[int]string{
+	http.StatusBadRequest:            "invalid_request_error",
+	http.StatusUnauthorized:          "authentication_error",
+	http.StatusForbidden:             "permission_error",
+	http.StatusNotFound:              "not_found_error",
+	http.StatusRequestEntityTooLarge: "request_too_large",
+	http.StatusTooManyRequests:       "rate_limit_error",
+	http.StatusInternalServerError:   "api_error",
+	statusOverloaded:                 "overloaded_error",
+}
+
+// APIError is an error returned by the Anthropic API, for a request or in the
+// middle of a streamed response. It matches the error of its type with
+// [errors.Is], e.g. [ErrAPIRateLimited], and unwraps to the [*anthropic.Error] of
+// the SDK or to the [*StreamEventError].
+type APIError struct {
+	// StatusCode is the HTTP status of the response, 0 for the errors of a stream
+	StatusCode int
+	// Type is the type of the error, e.g. "invalid_request_error"
+	Type    string
+	Message string
+	// RequestID identifies the request for the Anthropic support
+	RequestID string
+	Err       error
+}
+
+func (e *APIError) Error() string {
+	msg := e.Type
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("%s (HTTP %d)", msg, e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += ", request " + e.RequestID
+	}
+	return "anthropic: " + msg
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func (e *APIError) Is(target error) bool {
+	return target != nil && errorTypes[e.Type] == target
+}
+
+// apiError wraps an error of an API call in an [*APIError], the other errors
+// are returned as is
+func apiError(err error) error {
+	if eventErr := streamEventError(err); eventErr != nil {
+		err = eventErr
+	}
+	var eventErr *StreamEventError
+	if errors.As(err, &eventErr) {
+		return &APIError{Type: eventErr.Type, Message: eventErr.Message, Err: err}
+	}
+	var sdkErr *anthropic.Error
+	if !errors.As(err, &sdkErr) {
+		return err
+	}
+	var body struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+	_ = json.Unmarshal([]byte(sdkErr.RawJSON()), &body)
+	e := &APIError{
+		StatusCode: sdkErr.StatusCode,
+		Type:       body.Error.Type,
+		Message:    body.Error.Message,
+		RequestID:  body.RequestID,
+		Err:        err,
+	}
+	if e.Type == "" {
+		e.Type = statusErrorTypes[sdkErr.StatusCode]
+	}
+	if sdkErr.Response != nil && sdkErr.Response.Header.Get("request-id") != "" {
+		e.RequestID = sdkErr.Response.Header.Get("request-id")
+	}
+	return e
+}
+
+// isOverloaded reports whether an error of an API call is an overloaded_error
+func isOverloaded(err error) bool {
+	var eventErr *StreamEventError
+	if errors.As(err, &eventErr) {
+		return eventErr.Type == "overloaded_error"
+	}
+	var apiErr *anthropic.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == statusOverloaded || apiErrorType(apiErr) == "overloaded_error"
+}
+
+// apiErrorType returns the type of an API error, e.g. "invalid_request_error"
+func apiErrorType(apiErr *anthropic.Error) string {
+	var body struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(apiErr.RawJSON()), &body); err != nil {
+		return ""
+	}
+	return body.Error.Type
+}
+
+// StreamEventError is an error event sent by Anthropic in the middle of a
+// streamed response, e.g. an overloaded_error or an api_error
+type StreamEventError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (e *StreamEventError) Error() string {
+	return fmt.Sprintf("anthropic stream error: %s: %s", e.Type, e.Message)
+}
+
+// streamErrorPrefix starts the errors of the SDK for the error events of a stream
+const streamErrorPrefix = "received error while streaming: "
+
+// streamEventError returns the error event held by an error of the SDK stream,
+// nil if there is none
+func streamEventError(err error) *StreamEventError {
+	data, ok := strings.CutPrefix(err.Error(), streamErrorPrefix)
+	if !ok {
+		return nil
+	}
+	var event struct {
+		Error StreamEventError `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil || event.Error.Type == "" {
+		return nil
+	}
+	return &event.Error
+}
+
+// StreamError is returned when a streamed response fails after it started,
+// Partial holds the part of the answer received before the failure
+type StreamError struct {
+	Partial *ai.ModelResponse
+	Err     error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream interrupted: %v", e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// isTransient reports whether an error is a network failure that may not
+// happen again, e.g. a connection reset or a stream closed too early
+func isTransient(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// errorStatuses are the Genkit statuses of the error types of the API
+var errorStatuses = map[string]core.StatusName{
+	"invalid_request_error": core.INVALID_ARGUMENT,
+	"authentication_error":  core.UNAUTHENTICATED,
+	"permission_error":      core.PERMISSION_DENIED,
+	"not_found_error":       core.NOT_FOUND,
+	"request_too_large":     core.INVALID_ARGUMENT,
+	"rate_limit_error":      core.RESOURCE_EXHAUSTED,
+	"api_error":             core.INTERNAL,
+	"overloaded_error":      core.UNAVAILABLE,
+}
+
+// genkitStatus returns the Genkit status of an error of a model, false when
+// the error has none
+func genkitStatus(err error) (core.StatusName, bool) {
+	var (
+		apiErr     *APIError
+		windowErr  *ContextWindowExceededError
+		mediaErr   *MediaError
+		policyErr  *PolicyError
+		budgetErr  *BudgetExceededError
+		circuitErr *CircuitOpenError
+		genkitErr  *core.GenkitError
+	)
+	switch {
+	case errors.As(err, &genkitErr):
+		// the status is already set, e.g. by a middleware of the application
+		return "", false
+	case errors.As(err, &apiErr):
+		if status, ok := errorStatuses[apiErr.Type]; ok {
+			return status, true
+		}
+		if apiErr.StatusCode >= http.StatusInternalServerError {
+			return core.INTERNAL, true
+		}
+		return "", false
+	case errors.Is(err, context.Canceled):
+		return core.CANCELLED, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return core.DEADLINE_EXCEEDED, true
+	case errors.As(err, &windowErr), errors.As(err, &mediaErr):
+		return core.INVALID_ARGUMENT, true
+	case errors.As(err, &policyErr):
+		return core.PERMISSION_DENIED, true
+	case errors.As(err, &budgetErr), errors.Is(err, ErrRateLimited):
+		return core.RESOURCE_EXHAUSTED, true
+	case errors.As(err, &circuitErr), isTransient(err):
+		return core.UNAVAILABLE, true
+	}
+	return "", false
+}
+
+// StatusError is an error of a model with its Genkit status. It matches a
+// [*core.GenkitError] with [errors.As], so Genkit reports the status of the
+// failed flows, and unwraps to the error of the model, e.g. an [*APIError].
+type StatusError struct {
+	Status core.StatusName
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StatusError) As(target any) bool {
+	t, ok := target.(**core.GenkitError)
+	if ok {
+		*t = &core.GenkitError{Message: e.Err.Error(), Status: e.Status, HTTPCode: core.HTTPStatusCode(e.Status)}
+	}
+	return ok
+}
+
+// genkitErrors returns the errors of the models with their Genkit status
+func genkitErrors() ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			r, err := next(ctx, input, cb)
+			if err != nil {
+				if status, ok := genkitStatus(err); ok {
+					return nil, &StatusError{Status: status, Err: err}
+				}
+			}
+			return r, err
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// ModelMetadataKey is the response message metadata key holding the name of
+// the model that generated the response of a fallback model, see [Anthropic.DefineFallbackModel]
+const ModelMetadataKey = "model"
+
+// DefineFallbackModel defines a model generating with the first of the given
+// models, e.g. "claude-sonnet-4", "claude-3-7-sonnet", "claude-3-5-haiku".
+// When a model is overloaded or not found the request is sent to the next
+// model, unless the response already started streaming. The responses hold the
+// name of the model used under [ModelMetadataKey]. A Version in the config of
+// a request is rejected: a version pins a snapshot of a single model, none of
+// the other models of the chain generate with it.
+func (a *Anthropic) DefineFallbackModel(g *genkit.Genkit, name string, models []string, mw ...ai.ModelMiddleware) (ai.Model, error) {
+	if len(models) == 0 {
+		return nil, fmt.Errorf("%s.DefineFallbackModel: no models for %q", provider, name)
+	}
+	if existing := definedModel(g, name); existing != nil {
+		return existing, nil
+	}
+	supports := &Multimodal
+	if info, ok := anthropicModels[models[0]]; ok {
+		supports = info.Supports
+	}
+	meta := &ai.ModelInfo{
+		Label:    provider + "-" + name,
+		Supports: supports,
+	}
+	// every model of the chain fails over to the backends
+	fns := make([]ai.ModelFunc, len(models))
+	for i, model := range models {
+		client := a.messages
+		fns[i] = func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			return anthropicGenerate(ctx, client, model, input, cb)
+		}
+		if len(a.backends) > 0 {
+			fns[i] = failover(a.backends, model)(fns[i])
+		}
+	}
+	fn := func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+		c, err := configFromRequest(input)
+		if err != nil {
+			return nil, err
+		}
+		if c.Version != "" {
+			return nil, fmt.Errorf("fallback model %q does not support versions, got: %q", name, c.Version)
+		}
+		return generateWithFallback(ctx, models, fns, input, cb)
+	}
+	return defineModelFunc(g, name, meta, fn, a.middleware(name, mw...)...), nil
+}
+
+// generateWithFallback generates with the first model that is available, fns
+// generating with each of the models
+func generateWithFallback(
+	ctx context.Context,
+	models []string,
+	fns []ai.ModelFunc,
+	input *ai.ModelRequest,
+	cb func(context.Context, *ai.ModelResponseChunk) error,
+) (*ai.ModelResponse, error) {
+	streamed := false
+	var streamCb func(context.Context, *ai.ModelResponseChunk) error
+	if cb != nil {
+		streamCb = func(ctx context.Context, chunk *ai.ModelResponseChunk) error {
+			streamed = true
+			return cb(ctx, chunk)
+		}
+	}
+
+	var err error
+	for i, model := range models {
+		var r *ai.ModelResponse
+		r, err = fns[i](ctx, input, streamCb)
+		if err == nil {
+			if r.Message != nil {
+				if r.Message.Metadata == nil {
+					r.Message.Metadata = map[string]any{}
+				}
+				r.Message.Metadata[ModelMetadataKey] = model
+			}
+			return r, nil
+		}
+		// the chunks streamed can't be taken back
+		if streamed || !canFallback(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// canFallback reports whether a request failing with err can be sent to another model
+func canFallback(err error) bool {
+	if isOverloaded(err) {
+		return true
+	}
+	var apiErr *anthropic.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,221 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// MediaFetcher fetches the content of the media parts referenced by URI, see
+// [Anthropic.MediaFetchers]. The body is read up to [Anthropic.MediaDownloadLimit]
+// and closed by the caller, the content type is the one reported by the
+// storage, if any.
+type MediaFetcher interface {
+	Fetch(ctx context.Context, uri *url.URL) (body io.ReadCloser, contentType string, err error)
+}
+
+// DefaultMediaFetchers returns the fetchers of the URI schemes of the media
+// parts resolved by default, see [Anthropic.MediaFetchers]
+func DefaultMediaFetchers() map[string]MediaFetcher {
+	return map[string]MediaFetcher{
+		"http":  HTTPFetcher{},
+		"https": HTTPFetcher{},
+		"gs":    GCSFetcher{},
+		"s3":    S3Fetcher{},
+	}
+}
+
+// HTTPFetcher fetches http(s) URLs with [Anthropic.MediaHTTPClient]
+type HTTPFetcher struct{}
+
+// Fetch implements [MediaFetcher]
+func (HTTPFetcher) Fetch(ctx context.Context, uri *url.URL) (io.ReadCloser, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return fetch(req)
+}
+
+// GCSFetcher fetches gs://bucket/object URIs from Google Cloud Storage with
+// [Anthropic.MediaHTTPClient]. Objects are fetched anonymously unless an OAuth2
+// access token is set, e.g. the output of `gcloud auth print-access-token`.
+type GCSFetcher struct {
+	// Token is the OAuth2 access token, GOOGLE_OAUTH_ACCESS_TOKEN by default
+	Token string
+	// Endpoint is the storage endpoint, STORAGE_EMULATOR_HOST or
+	// https://storage.googleapis.com by default
+	Endpoint string
+}
+
+// Fetch implements [MediaFetcher]
+func (f GCSFetcher) Fetch(ctx context.Context, uri *url.URL) (io.ReadCloser, string, error) {
+	bucket, object := uri.Host, strings.TrimPrefix(uri.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, "", fmt.Errorf("invalid gs URI %q, expecting gs://bucket/object", uri)
+	}
+	endpoint := f.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("STORAGE_EMULATOR_HOST")
+	}
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", strings.TrimSuffix(endpoint, "/"),
+		url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	token := f.Token
+	if token == "" {
+		token = os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return fetch(req)
+}
+
+// S3Fetcher fetches s3://bucket/key URIs from Amazon S3 with
+// [Anthropic.MediaHTTPClient]. Requests are signed with the AWS credentials of
+// the environment, i.e. AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, objects are fetched anonymously without credentials.
+type S3Fetcher struct {
+	// Region is the region of the buckets, AWS_REGION, AWS_DEFAULT_REGION or
+	// us-east-1 by default
+	Region string
+	// Endpoint is the S3 compatible endpoint, AWS_ENDPOINT_URL_S3 or
+	// AWS_ENDPOINT_URL by default. Buckets are addressed by path on custom
+	// endpoints, e.g. MinIO, by virtual host on Amazon S3.
+	Endpoint string
+}
+
+// Fetch implements [MediaFetcher]
+func (f S3Fetcher) Fetch(ctx context.Context, uri *url.URL) (io.ReadCloser, string, error) {
+	bucket, key := uri.Host, strings.TrimPrefix(uri.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, "", fmt.Errorf("invalid s3 URI %q, expecting s3://bucket/key", uri)
+	}
+	region := firstNonEmpty(f.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint := firstNonEmpty(f.Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+
+	u := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, escapePath(key))
+	if endpoint != "" {
+		u = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), bucket, escapePath(key))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		signV4(req, id, secret, os.Getenv("AWS_SESSION_TOKEN"), region, time.Now())
+	}
+	return fetch(req)
+}
+
+// fetch sends the request of a fetcher with the HTTP client of the media
+// settings of its context and checks its status
+func fetch(req *http.Request) (io.ReadCloser, string, error) {
+	c := mediaConfigFromContext(req.Context())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("%s", resp.Status)
+	}
+	if resp.ContentLength > c.limit {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("larger than %d bytes", c.limit)
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+// emptySHA256 is the hex encoded SHA-256 of an empty payload
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 signs a GET request to S3 with AWS Signature Version 4
+func signV4(req *http.Request, id, secret, token, region string, now time.Time) {
+	now = now.UTC()
+	date, datetime := now.Format("20060102"), now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", datetime)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	headers := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, emptySHA256, datetime)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+		signed += ";x-amz-security-token"
+		headers += "x-amz-security-token:" + token + "\n"
+	}
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers, signed, emptySHA256}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + datetime + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, s := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		id, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath escapes an object key as AWS does, everything except the
+// unreserved characters and the slashes
+func escapePath(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
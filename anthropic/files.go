@@ -0,0 +1,146 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+)
+
+const (
+	// FileURIScheme prefixes the media URL of parts referencing an uploaded file,
+	// e.g. "anthropic-file:file_011CNha8iCJcU1wXNR6q4V8w"
+	FileURIScheme = "anthropic-file:"
+
+	filesBeta = "files-api-2025-04-14"
+)
+
+// File is a file uploaded with the Files API
+type File struct {
+	ID        string
+	Filename  string
+	MimeType  string
+	SizeBytes int64
+	CreatedAt time.Time
+}
+
+// Files manages the files uploaded to Anthropic, so large documents and
+// images can be referenced by ID instead of being sent on every request.
+type Files struct {
+	client *anthropic.Client
+}
+
+// Files returns the Files API client of an initialized plugin
+func (a *Anthropic) Files() *Files {
+	return &Files{client: a.client}
+}
+
+// Upload uploads the content of r as a file with the given name and content type
+func (f *Files) Upload(ctx context.Context, name, contentType string, r io.Reader) (*File, error) {
+	if f.client == nil {
+		return nil, errors.New("Files.Upload: plugin not initialized")
+	}
+	meta, err := f.client.Beta.Files.Upload(ctx, anthropic.BetaFileUploadParams{
+		File: anthropic.File(r, name, contentType),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Files.Upload: %w", err)
+	}
+	return fromFileMetadata(meta), nil
+}
+
+// List returns all the uploaded files
+func (f *Files) List(ctx context.Context) ([]*File, error) {
+	if f.client == nil {
+		return nil, errors.New("Files.List: plugin not initialized")
+	}
+	files := []*File{}
+	iter := f.client.Beta.Files.ListAutoPaging(ctx, anthropic.BetaFileListParams{})
+	for iter.Next() {
+		meta := iter.Current()
+		files = append(files, fromFileMetadata(&meta))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("Files.List: %w", err)
+	}
+	return files, nil
+}
+
+// Get returns the uploaded file with the given ID
+func (f *Files) Get(ctx context.Context, id string) (*File, error) {
+	if f.client == nil {
+		return nil, errors.New("Files.Get: plugin not initialized")
+	}
+	meta, err := f.client.Beta.Files.GetMetadata(ctx, id, anthropic.BetaFileGetMetadataParams{})
+	if err != nil {
+		return nil, fmt.Errorf("Files.Get: %w", err)
+	}
+	return fromFileMetadata(meta), nil
+}
+
+// Delete deletes the uploaded file with the given ID
+func (f *Files) Delete(ctx context.Context, id string) error {
+	if f.client == nil {
+		return errors.New("Files.Delete: plugin not initialized")
+	}
+	if _, err := f.client.Beta.Files.Delete(ctx, id, anthropic.BetaFileDeleteParams{}); err != nil {
+		return fmt.Errorf("Files.Delete: %w", err)
+	}
+	return nil
+}
+
+func fromFileMetadata(meta *anthropic.FileMetadata) *File {
+	return &File{
+		ID:        meta.ID,
+		Filename:  meta.Filename,
+		MimeType:  meta.MimeType,
+		SizeBytes: meta.SizeBytes,
+		CreatedAt: meta.CreatedAt,
+	}
+}
+
+// NewFilePart returns a media part referencing an uploaded file
+func NewFilePart(f *File) *ai.Part {
+	return ai.NewMediaPart(f.MimeType, FileURIScheme+f.ID)
+}
+
+// fileID returns the ID of the uploaded file referenced by a media part, if any
+func fileID(p *ai.Part) (string, bool) {
+	if !p.IsMedia() {
+		return "", false
+	}
+	return strings.CutPrefix(p.Text, FileURIScheme)
+}
+
+// usesFiles reports whether any message of the request references an uploaded file
+func usesFiles(messages []*ai.Message) bool {
+	for _, m := range messages {
+		for _, p := range m.Content {
+			if _, ok := fileID(p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// GuardrailStage is the stage of a call a guardrail checks
+type GuardrailStage string
+
+const (
+	// GuardrailRequest is the check of a request before it is sent
+	GuardrailRequest GuardrailStage = "request"
+	// GuardrailResponse is the check of a response once received
+	GuardrailResponse GuardrailStage = "response"
+)
+
+// PolicyError is returned by the Generate calls vetoed by a guardrail. The
+// guardrails return it, with a Reason, to veto a request or a response.
+type PolicyError struct {
+	// Model and Stage are set by the plugin
+	Model  string
+	Stage  GuardrailStage
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s of %s blocked by policy: %s", e.Stage, e.Model, e.Reason)
+}
+
+// GuardrailsConfig configures the checks of the requests and responses of
+// every model of the plugin, e.g. to redact personal data or to block the
+// prompts breaking the policies of a service. A check returns the request or
+// response to use, rewritten or not, or a [*PolicyError] to veto it. The other
+// errors fail the call as is.
+type GuardrailsConfig struct {
+	// CheckRequest checks a request before it is sent to the model
+	CheckRequest func(ctx context.Context, model string, req *ai.ModelRequest) (*ai.ModelRequest, error)
+	// CheckResponse checks a response before it is returned. The streaming
+	// calls then receive the checked response as a single chunk, as the
+	// chunks can't be taken back once streamed.
+	CheckResponse func(ctx context.Context, model string, resp *ai.ModelResponse) (*ai.ModelResponse, error)
+}
+
+// middleware checks the requests and the responses of a model
+func (c GuardrailsConfig) middleware(model string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			if c.CheckRequest != nil {
+				checked, err := c.CheckRequest(ctx, model, input)
+				if err != nil {
+					return nil, policyError(err, model, GuardrailRequest)
+				}
+				input = checked
+			}
+			if c.CheckResponse == nil {
+				return next(ctx, input, cb)
+			}
+
+			var streaming func(context.Context, *ai.ModelResponseChunk) error
+			if cb != nil {
+				// the chunks are dropped, the checked response is streamed instead
+				streaming = func(context.Context, *ai.ModelResponseChunk) error { return nil }
+			}
+			r, err := next(ctx, input, streaming)
+			if err != nil {
+				return nil, err
+			}
+			if r, err = c.CheckResponse(ctx, model, r); err != nil {
+				return nil, policyError(err, model, GuardrailResponse)
+			}
+			return replay(ctx, r, cb)
+		}
+	}
+}
+
+// policyError sets the model and the stage of a [*PolicyError], other errors
+// are returned as is
+func policyError(err error, model string, stage GuardrailStage) error {
+	var perr *PolicyError
+	if errors.As(err, &perr) {
+		perr.Model, perr.Stage = model, stage
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// TruncationConfig trims the oldest turns of a conversation before it is sent,
+// so long-running chats don't overflow the context window. A turn is a user
+// message and the messages answering it, the tool calls and their results are
+// kept together. The system messages and the last turn are always kept.
+type TruncationConfig struct {
+	// MaxTurns keeps the last turns of the conversation, all of them when 0
+	MaxTurns int `json:"maxTurns,omitempty"`
+	// MaxInputTokens trims the oldest turns until the input tokens of the
+	// request are at most MaxInputTokens, no limit when 0
+	MaxInputTokens int `json:"maxInputTokens,omitempty"`
+	// Count is how the input tokens are counted against MaxInputTokens,
+	// estimated by default, see [ContextWindowCheck]. Counting costs a few
+	// count_tokens calls per request.
+	Count ContextWindowCheck `json:"count,omitempty"`
+}
+
+// truncateHistory returns the request without the oldest turns of its
+// conversation, as configured by [GenerationConfig.Truncation]
+func truncateHistory(ctx context.Context, client MessagesAPI, model string, input *ai.ModelRequest) (*ai.ModelRequest, error) {
+	c, err := configFromRequest(input)
+	if err != nil {
+		return nil, err
+	}
+	t := c.Truncation
+	if t == nil {
+		return input, nil
+	}
+	starts := turnStarts(input.Messages)
+	if len(starts) <= 1 {
+		return input, nil
+	}
+
+	drop := 0
+	if t.MaxTurns > 0 && len(starts) > t.MaxTurns {
+		drop = len(starts) - t.MaxTurns
+	}
+	if t.MaxInputTokens > 0 {
+		// the fewest turns to drop for the request to fit, counted with a
+		// binary search to keep the count_tokens calls few
+		lo, hi := drop, len(starts)-1
+		for lo < hi {
+			mid := (lo + hi) / 2
+			n, err := inputTokens(ctx, client, model, withoutTurns(input, starts, mid), t.Count)
+			if err != nil {
+				return nil, fmt.Errorf("unable to truncate the conversation: %w", err)
+			}
+			if n <= t.MaxInputTokens {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+		drop = lo
+	}
+	if drop == 0 {
+		return input, nil
+	}
+	return withoutTurns(input, starts, drop), nil
+}
+
+// turnStarts returns the indexes of the messages starting the turns of a
+// conversation: the user messages other than tool results, and the first
+// message that is not a system message
+func turnStarts(messages []*ai.Message) []int {
+	var starts []int
+	for i, m := range messages {
+		if m.Role == ai.RoleSystem {
+			continue
+		}
+		if len(starts) == 0 || m.Role == ai.RoleUser && !hasToolResponse(m) {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+func hasToolResponse(m *ai.Message) bool {
+	for _, p := range m.Content {
+		if p.IsToolResponse() {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutTurns returns the request without its first turns, keeping the
+// system messages
+func withoutTurns(input *ai.ModelRequest, starts []int, turns int) *ai.ModelRequest {
+	if turns == 0 {
+		return input
+	}
+	from := starts[turns]
+	messages := make([]*ai.Message, 0, len(input.Messages)-from)
+	for _, m := range input.Messages[:from] {
+		if m.Role == ai.RoleSystem {
+			messages = append(messages, m)
+		}
+	}
+	truncated := *input
+	truncated.Messages = append(messages, input.Messages[from:]...)
+	return &truncated
+}
+
+// inputTokens counts, or estimates, the input tokens of a request
+func inputTokens(ctx context.Context, client MessagesAPI, model string, input *ai.ModelRequest, count ContextWindowCheck) (int, error) {
+	switch count {
+	case ContextWindowCheckCount:
+		return countTokens(ctx, client, model, input)
+	case "", ContextWindowCheckEstimate:
+		req, err := toAnthropicRequest(ctx, model, input)
+		if err != nil {
+			return 0, err
+		}
+		return estimateTokens(req), nil
+	default:
+		return 0, fmt.Errorf("unknown token count %q", count)
+	}
+}
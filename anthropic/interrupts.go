@@ -0,0 +1,108 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// Interrupted is the state of a generation interrupted by its tools, e.g. a
+// tool waiting for a human approval with [ai.ToolContext.Interrupt]. It is
+// marshaled to JSON to resume the generation later, possibly in another
+// process, once the interrupted tools have a result.
+type Interrupted struct {
+	// Messages are the conversation up to the model turn with the tool
+	// requests, its tool_use blocks and thinking blocks are sent back as is
+	Messages []*ai.Message `json:"messages"`
+}
+
+// NewInterrupted returns the state of an interrupted response, it fails when
+// the response was not interrupted
+func NewInterrupted(resp *ai.ModelResponse) (*Interrupted, error) {
+	if resp == nil || resp.FinishReason != ai.FinishReasonInterrupted || resp.Message == nil {
+		return nil, errors.New("NewInterrupted: the response was not interrupted")
+	}
+	return &Interrupted{Messages: resp.History()}, nil
+}
+
+// Interrupts returns the tool requests waiting for a result, to pass to the
+// Respond or Restart method of their tool
+func (s *Interrupted) Interrupts() []*ai.Part {
+	var interrupts []*ai.Part
+	for _, p := range s.turn() {
+		if p.IsToolRequest() && p.Metadata["interrupt"] != nil {
+			interrupts = append(interrupts, p)
+		}
+	}
+	return interrupts
+}
+
+// Resume returns the options resuming the generation with the results of the
+// interrupted tools: the tool responses of their Respond method and the tool
+// requests of their Restart method. The other options of the generation, e.g.
+// the model and the tools, are given again.
+func (s *Interrupted) Resume(results ...*ai.Part) ([]ai.GenerateOption, error) {
+	pending := map[string]bool{}
+	for _, p := range s.Interrupts() {
+		pending[p.ToolRequest.Ref] = true
+	}
+	var responses, restarts []*ai.Part
+	for _, p := range results {
+		switch {
+		case p.IsToolResponse() && pending[p.ToolResponse.Ref]:
+			responses = append(responses, p)
+			delete(pending, p.ToolResponse.Ref)
+		case p.IsToolRequest() && pending[p.ToolRequest.Ref]:
+			restarts = append(restarts, p)
+			delete(pending, p.ToolRequest.Ref)
+		default:
+			return nil, fmt.Errorf("Interrupted.Resume: %s is not the result of an interrupted tool", describePart(p))
+		}
+	}
+
+	opts := []ai.GenerateOption{ai.WithMessages(s.Messages...)}
+	if len(responses) > 0 {
+		opts = append(opts, ai.WithToolResponses(responses...))
+	}
+	if len(restarts) > 0 {
+		opts = append(opts, ai.WithToolRestarts(restarts...))
+	}
+	return opts, nil
+}
+
+// turn returns the parts of the interrupted model turn
+func (s *Interrupted) turn() []*ai.Part {
+	if n := len(s.Messages); n > 0 && s.Messages[n-1].Role == ai.RoleModel {
+		return s.Messages[n-1].Content
+	}
+	return nil
+}
+
+// describePart names a tool part in the errors
+func describePart(p *ai.Part) string {
+	switch {
+	case p.IsToolResponse():
+		return fmt.Sprintf("tool response %q (%s)", p.ToolResponse.Name, p.ToolResponse.Ref)
+	case p.IsToolRequest():
+		return fmt.Sprintf("tool request %q (%s)", p.ToolRequest.Name, p.ToolRequest.Ref)
+	default:
+		return "a part other than a tool part"
+	}
+}
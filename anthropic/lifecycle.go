@@ -0,0 +1,113 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// ModelLifecycle is the deprecation schedule of a model announced by Anthropic
+type ModelLifecycle struct {
+	// Deprecated is the date the model was deprecated, it is still served
+	// until it is retired
+	Deprecated time.Time
+	// Retired is the date the requests to the model start failing
+	Retired time.Time
+	// Replacement is the model recommended instead, e.g. "claude-sonnet-4-5"
+	Replacement string
+}
+
+// IsDeprecated reports whether the model is deprecated at the given time
+func (l ModelLifecycle) IsDeprecated(t time.Time) bool {
+	return !l.Deprecated.IsZero() && !t.Before(l.Deprecated)
+}
+
+// IsRetired reports whether the model is retired at the given time
+func (l ModelLifecycle) IsRetired(t time.Time) bool {
+	return !l.Retired.IsZero() && !t.Before(l.Retired)
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// modelLifecycles are the deprecation schedules of the models, by model name
+// and ID
+var modelLifecycles = map[string]ModelLifecycle{
+	"claude-3-5-sonnet":          {Deprecated: date(2025, time.August, 13), Retired: date(2025, time.October, 22), Replacement: "claude-sonnet-4-5"},
+	"claude-3-5-sonnet-20240620": {Deprecated: date(2025, time.August, 13), Retired: date(2025, time.October, 22), Replacement: "claude-sonnet-4-5"},
+	"claude-3-5-sonnet-v2":       {Deprecated: date(2025, time.August, 13), Retired: date(2025, time.October, 22), Replacement: "claude-sonnet-4-5"},
+	"claude-3-5-sonnet-20241022": {Deprecated: date(2025, time.August, 13), Retired: date(2025, time.October, 22), Replacement: "claude-sonnet-4-5"},
+	"claude-3-5-sonnet-latest":   {Deprecated: date(2025, time.August, 13), Retired: date(2025, time.October, 22), Replacement: "claude-sonnet-4-5"},
+	"claude-3-7-sonnet":          {Deprecated: date(2025, time.October, 28), Retired: date(2026, time.February, 19), Replacement: "claude-sonnet-4-5"},
+	"claude-3-7-sonnet-20250219": {Deprecated: date(2025, time.October, 28), Retired: date(2026, time.February, 19), Replacement: "claude-sonnet-4-5"},
+	"claude-3-7-sonnet-latest":   {Deprecated: date(2025, time.October, 28), Retired: date(2026, time.February, 19), Replacement: "claude-sonnet-4-5"},
+	"claude-3-5-haiku":           {Deprecated: date(2025, time.October, 28), Retired: date(2026, time.February, 19), Replacement: "claude-haiku-4-5"},
+	"claude-3-5-haiku-20241022":  {Deprecated: date(2025, time.October, 28), Retired: date(2026, time.February, 19), Replacement: "claude-haiku-4-5"},
+	"claude-3-5-haiku-latest":    {Deprecated: date(2025, time.October, 28), Retired: date(2026, time.February, 19), Replacement: "claude-haiku-4-5"},
+}
+
+// Lifecycle returns the deprecation schedule of a model, given by name or ID,
+// false when the model has none
+func Lifecycle(model string) (ModelLifecycle, bool) {
+	l, ok := modelLifecycles[model]
+	return l, ok
+}
+
+// isScheduled reports whether a model, given by name or ID, has a deprecation schedule
+func isScheduled(model string) bool {
+	_, ok := modelLifecycles[model]
+	return ok
+}
+
+// withLifecycle returns the info of a model with the deprecated stage once
+// the model is deprecated
+func withLifecycle(name string, info ai.ModelInfo, now time.Time) ai.ModelInfo {
+	if l, ok := Lifecycle(name); ok && l.IsDeprecated(now) {
+		info.Stage = ai.ModelStageDeprecated
+	}
+	return info
+}
+
+// deprecationWarnings are the models warned about, they are warned about once
+var deprecationWarnings sync.Map
+
+// warnDeprecated logs a warning the first time a deprecated model, given by
+// name or ID, is defined or used
+func warnDeprecated(ctx context.Context, model string, now time.Time) {
+	l, ok := Lifecycle(model)
+	if !ok || !l.IsDeprecated(now) {
+		return
+	}
+	if _, warned := deprecationWarnings.LoadOrStore(model, true); warned {
+		return
+	}
+	msg := "anthropic: model is deprecated"
+	if l.IsRetired(now) {
+		msg = "anthropic: model is retired"
+	}
+	slog.WarnContext(ctx, msg,
+		"model", model,
+		"deprecated", l.Deprecated.Format(time.DateOnly),
+		"retired", l.Retired.Format(time.DateOnly),
+		"replacement", l.Replacement)
+}
@@ -0,0 +1,154 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+const (
+	defaultGenerateManyConcurrency = 4
+	defaultGenerateManyRetries     = 2
+	defaultGenerateManyRetryDelay  = time.Second
+)
+
+// GenerateManyOptions configures [GenerateMany]
+type GenerateManyOptions struct {
+	// Concurrency is the number of requests generated at the same time, 4 by default
+	Concurrency int
+	// Retries is the number of times a request failing with a rate limit, a
+	// server or a connection error is generated again, on top of the retries
+	// of the API calls, see [RetryConfig]. 2 by default, negative disables them.
+	Retries int
+	// RetryDelay is the delay before the first retry of a request, doubled on
+	// every retry, 1s by default
+	RetryDelay time.Duration
+}
+
+// withDefaults returns the options with the defaults of the unset fields
+func (o GenerateManyOptions) withDefaults() GenerateManyOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultGenerateManyConcurrency
+	}
+	if o.Retries == 0 {
+		o.Retries = defaultGenerateManyRetries
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = defaultGenerateManyRetryDelay
+	}
+	return o
+}
+
+// GenerateResult is the result of a request of [GenerateMany]
+type GenerateResult struct {
+	Response *ai.ModelResponse
+	// Err is the error of the last attempt of a failed request
+	Err error
+	// Attempts is the number of times the request was generated
+	Attempts int
+}
+
+// GenerateMany generates the responses of the requests with the Anthropic model,
+// a few at a time, for the bulk jobs that can't wait for the Batches API. The
+// results are in the order of the requests, the failure of a request doesn't
+// stop the others. The config of a model reference applies to the requests
+// without config. It fails when the model is not defined.
+func GenerateMany(ctx context.Context, g *genkit.Genkit, model ai.ModelArg, requests []*ai.ModelRequest, opts GenerateManyOptions) ([]*GenerateResult, error) {
+	m, ok := model.(ai.Model)
+	if !ok {
+		m = AnthropicModel(g, strings.TrimPrefix(model.Name(), provider+"/"))
+	}
+	if m == nil {
+		return nil, fmt.Errorf("GenerateMany: model %q not defined", model.Name())
+	}
+	var config any
+	if ref, ok := model.(ai.ModelRef); ok {
+		config = ref.Config()
+	}
+	opts = opts.withDefaults()
+
+	results := make([]*GenerateResult, len(requests))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(opts.Concurrency, len(requests)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				req := requests[i]
+				if req.Config == nil && config != nil {
+					withConfig := *req
+					withConfig.Config = config
+					req = &withConfig
+				}
+				results[i] = generateWithRetries(ctx, m, req, opts)
+			}
+		}()
+	}
+	for i := range requests {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results, nil
+}
+
+// generateWithRetries generates a response, again while the request fails
+// with a retryable error
+func generateWithRetries(ctx context.Context, m ai.Model, req *ai.ModelRequest, opts GenerateManyOptions) *GenerateResult {
+	result := &GenerateResult{}
+	delay := opts.RetryDelay
+	for {
+		result.Attempts++
+		result.Response, result.Err = m.Generate(ctx, req, nil)
+		if result.Err == nil || result.Attempts > opts.Retries || !isRetryable(result.Err) {
+			return result
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return result
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
+// isRetryable reports whether a request failed with a rate limit, a server
+// or a connection error, likely to succeed later
+func isRetryable(err error) bool {
+	if isServerError(err) || isTransient(err) {
+		return true
+	}
+	var eventErr *StreamEventError
+	if errors.As(err, &eventErr) {
+		return eventErr.Type == "rate_limit_error"
+	}
+	var apiErr *anthropic.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,163 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Limits of the images accepted by the Messages API
+const (
+	maxImageSize      = 5 << 20
+	maxImageDimension = 8000
+	maxImagesPerCall  = 100
+)
+
+// supportedImageTypes are the image formats accepted by Anthropic
+var supportedImageTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// MediaError is returned for the media parts of a request Anthropic would
+// reject, e.g. an image larger than 5MB, before the request is sent
+type MediaError struct {
+	// Message and Part are the indexes of the offending part in the request
+	Message int
+	Part    int
+	Reason  string
+}
+
+func (e *MediaError) Error() string {
+	return fmt.Sprintf("invalid media in message %d, part %d: %s", e.Message, e.Part, e.Reason)
+}
+
+// atPart sets the index of the part of a [*MediaError], other errors are
+// returned as is
+func atPart(err error, part int) error {
+	var merr *MediaError
+	if errors.As(err, &merr) {
+		merr.Part = part
+	}
+	return err
+}
+
+// atMessage sets the index of the message of a [*MediaError], other errors
+// are returned as is
+func atMessage(err error, message int) error {
+	var merr *MediaError
+	if errors.As(err, &merr) {
+		merr.Message = message
+	}
+	return err
+}
+
+// validateImage checks an image against the limits of Anthropic, only the
+// header of the image is decoded
+func validateImage(m *mediaData) error {
+	supported := false
+	for _, t := range supportedImageTypes {
+		supported = supported || t == m.contentType
+	}
+	if !supported {
+		return &MediaError{Reason: fmt.Sprintf("unsupported image type %q, want one of %v", m.contentType, supportedImageTypes)}
+	}
+	if size := m.size(); size > maxImageSize {
+		return &MediaError{Reason: fmt.Sprintf("image of %d bytes, larger than %d bytes", size, maxImageSize)}
+	}
+	width, height, err := imageSize(m.contentType, m.reader())
+	if err != nil {
+		return &MediaError{Reason: fmt.Sprintf("invalid %s image: %v", m.contentType, err)}
+	}
+	if width > maxImageDimension || height > maxImageDimension {
+		return &MediaError{Reason: fmt.Sprintf("image of %dx%d pixels, larger than %dx%d pixels", width, height, maxImageDimension, maxImageDimension)}
+	}
+	return nil
+}
+
+// imageSize returns the dimensions of an image from its header
+func imageSize(contentType string, r io.Reader) (width, height int, err error) {
+	if contentType == "image/webp" {
+		header := make([]byte, 30)
+		n, _ := io.ReadFull(r, header)
+		return webpSize(header[:n])
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// webpSize returns the dimensions of a WebP image from the header of its
+// VP8, VP8L or VP8X chunk, the standard library doesn't decode WebP
+func webpSize(data []byte) (width, height int, err error) {
+	if len(data) < 30 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0, errors.New("not a WebP image")
+	}
+	chunk := data[20:]
+	switch string(data[12:16]) {
+	case "VP8 ":
+		// lossy: the frame header follows the 3 bytes start code
+		return int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3fff), int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3fff), nil
+	case "VP8L":
+		// lossless: 14 bits of width - 1 and height - 1 after the signature
+		bits := binary.LittleEndian.Uint32(chunk[1:5])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	case "VP8X":
+		// extended: 24 bits of canvas width - 1 and height - 1 after the flags
+		w := uint32(chunk[4]) | uint32(chunk[5])<<8 | uint32(chunk[6])<<16
+		h := uint32(chunk[7]) | uint32(chunk[8])<<8 | uint32(chunk[9])<<16
+		return int(w) + 1, int(h) + 1, nil
+	}
+	return 0, 0, errors.New("unknown WebP chunk")
+}
+
+// imagesIn returns the number of images of a content block, including the
+// images of a tool result
+func imagesIn(block anthropic.ContentBlockParamUnion) int {
+	if block.OfImage != nil {
+		return 1
+	}
+	n := 0
+	if block.OfToolResult != nil {
+		for _, c := range block.OfToolResult.Content {
+			if c.OfImage != nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// countImages adds the images of the blocks of a message to count, and
+// fails once there are more than Anthropic accepts in a request
+func countImages(blocks []anthropic.ContentBlockParamUnion, count *int) error {
+	for i, block := range blocks {
+		*count += imagesIn(block)
+		if *count > maxImagesPerCall {
+			return &MediaError{Part: i, Reason: fmt.Sprintf("more than %d images in the request", maxImagesPerCall)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// MemoryToolName is the name of the Anthropic memory tool. The Genkit tool
+// defined with [DefineMemoryTool] is sent to Claude as the memory tool.
+const MemoryToolName = "memory"
+
+// memoryDir is the directory of the memory files, as seen by Claude
+const memoryDir = "/memories"
+
+// ErrMemoryNotFound is returned by a [MemoryStore] for a missing file
+var ErrMemoryNotFound = errors.New("memory file not found")
+
+// MemoryStore persists the memory files of Claude between the turns, and the
+// conversations, of an agent. The paths are cleaned, relative to the /memories
+// directory, e.g. "notes/todo.md".
+type MemoryStore interface {
+	// Read returns the content of a file, or [ErrMemoryNotFound]
+	Read(ctx context.Context, path string) (string, error)
+	// Write creates or replaces a file
+	Write(ctx context.Context, path, content string) error
+	// Delete deletes a file, or a directory and its files, or returns [ErrMemoryNotFound]
+	Delete(ctx context.Context, path string) error
+	// List returns the paths of the files in a directory and its subdirectories,
+	// "" being the /memories directory
+	List(ctx context.Context, dir string) ([]string, error)
+}
+
+// MemoryCommand is the input of the memory tool, see
+// https://docs.anthropic.com/en/docs/agents-and-tools/tool-use/memory-tool
+type MemoryCommand struct {
+	// Command is one of view, create, str_replace, insert, delete and rename
+	Command string `json:"command"`
+	// Path is the file or directory the command applies to, under /memories
+	Path string `json:"path,omitempty"`
+	// ViewRange is the optional [start, end] line range to view, end -1 means the end of the file
+	ViewRange []int `json:"view_range,omitempty"`
+	// FileText is the content of the file to create
+	FileText string `json:"file_text,omitempty"`
+	// OldStr is the text to replace, it must match exactly once
+	OldStr string `json:"old_str,omitempty"`
+	// NewStr is the replacement text of str_replace
+	NewStr string `json:"new_str,omitempty"`
+	// InsertLine is the line after which InsertText is inserted, 0 for the top of the file
+	InsertLine int `json:"insert_line,omitempty"`
+	// InsertText is the text to insert
+	InsertText string `json:"insert_text,omitempty"`
+	// OldPath and NewPath are the paths of the file renamed
+	OldPath string `json:"old_path,omitempty"`
+	NewPath string `json:"new_path,omitempty"`
+}
+
+// DefineMemoryTool registers the Genkit tool executing Claude's memory commands
+// under [MemoryToolName], persisting the memory files in the store. The failed
+// commands are reported to Claude as a [*ToolError], only the errors of the
+// store fail the generation.
+func DefineMemoryTool(g *genkit.Genkit, store MemoryStore) ai.Tool {
+	return defineBuiltinTool(g, MemoryToolName, "Store and retrieve information across conversations in memory files",
+		func(ctx *ai.ToolContext, input MemoryCommand) (any, error) {
+			out, err := runMemoryCommand(ctx, store, input)
+			var cerr *ToolError
+			if errors.As(err, &cerr) {
+				return cerr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return out, nil
+		})
+}
+
+// runMemoryCommand runs a memory command against the store, the invalid
+// commands fail with a [*ToolError]
+func runMemoryCommand(ctx context.Context, store MemoryStore, c MemoryCommand) (string, error) {
+	switch c.Command {
+	case "view":
+		p, err := memoryPath(c.Path)
+		if err != nil {
+			return "", err
+		}
+		if p == "" {
+			return viewMemoryDir(ctx, store, c.Path, p)
+		}
+		content, err := store.Read(ctx, p)
+		if errors.Is(err, ErrMemoryNotFound) {
+			return viewMemoryDir(ctx, store, c.Path, p)
+		}
+		if err != nil {
+			return "", err
+		}
+		return viewMemoryFile(c.Path, content, c.ViewRange)
+	case "create":
+		p, err := memoryPath(c.Path)
+		if err != nil {
+			return "", err
+		}
+		if p == "" {
+			return "", &ToolError{Message: fmt.Sprintf("%s is a directory", c.Path)}
+		}
+		if err := store.Write(ctx, p, c.FileText); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("File created successfully at %s", c.Path), nil
+	case "str_replace":
+		return editMemory(ctx, store, c.Path, func(content string) (string, error) {
+			switch n := strings.Count(content, c.OldStr); {
+			case c.OldStr == "" || n == 0:
+				return "", &ToolError{Message: fmt.Sprintf("no match found for replacement text in %s", c.Path)}
+			case n > 1:
+				return "", &ToolError{Message: fmt.Sprintf("found %d matches for replacement text in %s, it must be unique", n, c.Path)}
+			}
+			return strings.Replace(content, c.OldStr, c.NewStr, 1), nil
+		})
+	case "insert":
+		return editMemory(ctx, store, c.Path, func(content string) (string, error) {
+			lines := strings.Split(content, "\n")
+			if c.InsertLine < 0 || c.InsertLine > len(lines) {
+				return "", &ToolError{Message: fmt.Sprintf("invalid insert_line %d, %s has %d lines", c.InsertLine, c.Path, len(lines))}
+			}
+			return strings.Join(slices.Insert(lines, c.InsertLine, strings.TrimSuffix(c.InsertText, "\n")), "\n"), nil
+		})
+	case "delete":
+		p, err := memoryPath(c.Path)
+		if err != nil {
+			return "", err
+		}
+		if p == "" {
+			return "", &ToolError{Message: fmt.Sprintf("cannot delete %s", memoryDir)}
+		}
+		if err := store.Delete(ctx, p); errors.Is(err, ErrMemoryNotFound) {
+			return "", &ToolError{Message: fmt.Sprintf("%s does not exist", c.Path)}
+		} else if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Successfully deleted %s", c.Path), nil
+	case "rename":
+		from, err := memoryPath(c.OldPath)
+		if err != nil {
+			return "", err
+		}
+		to, err := memoryPath(c.NewPath)
+		if err != nil {
+			return "", err
+		}
+		content, err := store.Read(ctx, from)
+		if errors.Is(err, ErrMemoryNotFound) {
+			return "", &ToolError{Message: fmt.Sprintf("%s does not exist", c.OldPath)}
+		} else if err != nil {
+			return "", err
+		}
+		if err := store.Write(ctx, to, content); err != nil {
+			return "", err
+		}
+		if err := store.Delete(ctx, from); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Successfully renamed %s to %s", c.OldPath, c.NewPath), nil
+	}
+	return "", &ToolError{Message: fmt.Sprintf("unknown memory command %q", c.Command)}
+}
+
+// memoryPath returns the path of a memory file relative to /memories, it
+// fails for the paths outside of it, e.g. /memories/../etc/passwd
+func memoryPath(p string) (string, error) {
+	cleaned := path.Clean("/" + p)
+	if cleaned == memoryDir {
+		return "", nil
+	}
+	rel, ok := strings.CutPrefix(cleaned, memoryDir+"/")
+	if !ok {
+		return "", &ToolError{Message: fmt.Sprintf("invalid path %q, it must be in the %s directory", p, memoryDir)}
+	}
+	return rel, nil
+}
+
+// editMemory replaces the content of a memory file with its edit
+func editMemory(ctx context.Context, store MemoryStore, p string, edit func(string) (string, error)) (string, error) {
+	rel, err := memoryPath(p)
+	if err != nil {
+		return "", err
+	}
+	content, err := store.Read(ctx, rel)
+	if errors.Is(err, ErrMemoryNotFound) {
+		return "", &ToolError{Message: fmt.Sprintf("%s does not exist", p)}
+	} else if err != nil {
+		return "", err
+	}
+	edited, err := edit(content)
+	if err != nil {
+		return "", err
+	}
+	if err := store.Write(ctx, rel, edited); err != nil {
+		return "", err
+	}
+	return "The memory file has been edited.", nil
+}
+
+// viewMemoryFile returns the numbered lines of a memory file
+func viewMemoryFile(p, content string, viewRange []int) (string, error) {
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	start, end := 1, len(lines)
+	if len(viewRange) == 2 {
+		start = viewRange[0]
+		if viewRange[1] != -1 {
+			end = viewRange[1]
+		}
+		if start < 1 || end > len(lines) || start > end {
+			return "", &ToolError{Message: fmt.Sprintf("invalid view_range %v, %s has %d lines", viewRange, p, len(lines))}
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Here's the content of %s with line numbers:\n", p)
+	for i := start; i <= end; i++ {
+		fmt.Fprintf(&b, "%6d\t%s\n", i, lines[i-1])
+	}
+	return b.String(), nil
+}
+
+// viewMemoryDir returns the files of a memory directory
+func viewMemoryDir(ctx context.Context, store MemoryStore, p, rel string) (string, error) {
+	files, err := store.List(ctx, rel)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 && rel != "" {
+		return "", &ToolError{Message: fmt.Sprintf("%s does not exist", p)}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Directory: %s\n", path.Join(memoryDir, rel))
+	for _, f := range files {
+		fmt.Fprintf(&b, "- %s\n", path.Join(memoryDir, f))
+	}
+	return b.String(), nil
+}
+
+// FileMemoryStore is a [MemoryStore] keeping the memory files in a directory of
+// the local file system, the files can't escape it, e.g. through symlinks
+type FileMemoryStore struct {
+	root *os.Root
+}
+
+// NewFileMemoryStore returns the store of the memory files in the directory,
+// created if missing
+func NewFileMemoryStore(dir string) (*FileMemoryStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &FileMemoryStore{root: root}, nil
+}
+
+// Close closes the directory of the store
+func (s *FileMemoryStore) Close() error {
+	return s.root.Close()
+}
+
+func (s *FileMemoryStore) Read(_ context.Context, p string) (string, error) {
+	f, err := s.root.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrMemoryNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return "", err
+	} else if info.IsDir() {
+		return "", ErrMemoryNotFound
+	}
+	b, err := io.ReadAll(f)
+	return string(b), err
+}
+
+func (s *FileMemoryStore) Write(_ context.Context, p, content string) error {
+	if dir := path.Dir(p); dir != "." {
+		if err := s.mkdirAll(dir); err != nil {
+			return err
+		}
+	}
+	f, err := s.root.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mkdirAll creates a directory of the store and its parents
+func (s *FileMemoryStore) mkdirAll(dir string) error {
+	var parent string
+	for _, name := range strings.Split(dir, "/") {
+		parent = path.Join(parent, name)
+		if err := s.root.Mkdir(parent, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileMemoryStore) Delete(ctx context.Context, p string) error {
+	files, err := s.List(ctx, p)
+	if err != nil {
+		return err
+	}
+	if err := s.root.Remove(p); errors.Is(err, fs.ErrNotExist) {
+		return ErrMemoryNotFound
+	} else if err == nil {
+		return nil
+	}
+	// a directory: its files first, then its subdirectories, the deepest first
+	for _, f := range files {
+		if err := s.root.Remove(f); err != nil {
+			return err
+		}
+	}
+	var dirs []string
+	fs.WalkDir(s.root.FS(), p, func(d string, e fs.DirEntry, err error) error {
+		if err == nil && e.IsDir() {
+			dirs = append(dirs, d)
+		}
+		return nil
+	})
+	for _, d := range slices.Backward(dirs) {
+		if err := s.root.Remove(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileMemoryStore) List(_ context.Context, dir string) ([]string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	var files []string
+	err := fs.WalkDir(s.root.FS(), dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !e.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return files, err
+}
@@ -0,0 +1,128 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Attributes of the metrics, in addition to the model
+const (
+	attrTokenType = "gen_ai.token.type"
+	attrErrorType = "error.type"
+)
+
+// metrics are the instruments recording the calls of the models
+type metrics struct {
+	requests metric.Int64Counter
+	tokens   metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+// newMetrics creates the instruments of the plugin from mp, or from the
+// global provider when mp is nil
+func newMetrics(mp metric.MeterProvider) (*metrics, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter(tracerName)
+	requests, err := meter.Int64Counter("anthropic.requests",
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Generate calls sent to Anthropic, by model and error type"))
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := meter.Int64Counter("anthropic.tokens",
+		metric.WithUnit("{token}"),
+		metric.WithDescription("Tokens used by the Generate calls, by model and token type"))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64Histogram("anthropic.request.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of the Generate calls sent to Anthropic"))
+	if err != nil {
+		return nil, err
+	}
+	return &metrics{requests: requests, tokens: tokens, duration: duration}, nil
+}
+
+// middleware records the calls of a model, their duration and token usage
+func (m *metrics) middleware(model string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			start := time.Now()
+			resp, err := next(ctx, input, cb)
+
+			attrs := []attribute.KeyValue{attribute.String(attrRequestModel, model)}
+			if err != nil {
+				attrs = append(attrs, attribute.String(attrErrorType, errorType(err)))
+			}
+			set := metric.WithAttributes(attrs...)
+			m.requests.Add(ctx, 1, set)
+			m.duration.Record(ctx, time.Since(start).Seconds(), set)
+			if err == nil && resp.Usage != nil {
+				for typ, n := range map[string]int{
+					"input":          resp.Usage.InputTokens,
+					"output":         resp.Usage.OutputTokens,
+					"cache_read":     int(resp.Usage.Custom[UsageCacheReadInputTokens]),
+					"cache_creation": int(resp.Usage.Custom[UsageCacheCreationInputTokens]),
+				} {
+					if n > 0 {
+						m.tokens.Add(ctx, int64(n), metric.WithAttributes(
+							attribute.String(attrRequestModel, model),
+							attribute.String(attrTokenType, typ),
+						))
+					}
+				}
+			}
+			return resp, err
+		}
+	}
+}
+
+// errorType returns the low-cardinality type of an error of a call, e.g.
+// the type of an API error such as "overloaded_error"
+func errorType(err error) string {
+	var eventErr *StreamEventError
+	if errors.As(err, &eventErr) {
+		return eventErr.Type
+	}
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		if typ := apiErrorType(apiErr); typ != "" {
+			return typ
+		}
+		return strconv.Itoa(apiErr.StatusCode)
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "_OTHER"
+}
@@ -26,16 +26,21 @@ const provider = "anthropic"
 var Multimodal = ai.ModelSupports{
 	Multiturn:  true,
 	Tools:      true,
+	ToolChoice: true,
 	SystemRole: true,
 	Media:      true,
+	Context:    true,
+	// JSON output is forced with a tool, it can't be combined with other tools
+	Constrained: ai.ConstrainedSupportNoTools,
 }
 
-// supported anthropic models
+// supported anthropic models. Their first version is the model ID sent by
+// default, a request pins another one with the Version of its config.
 var anthropicModels = map[string]ai.ModelInfo{
 	"claude-3-5-sonnet-v2": {
 		Label:    "Anthropic Claude 3.5 Sonnet v2",
 		Supports: &Multimodal,
-		Versions: []string{"claude-3-5-sonnet-latest"},
+		Versions: []string{"claude-3-5-sonnet-latest", "claude-3-5-sonnet-20241022"},
 	},
 	"claude-3-5-sonnet": {
 		Label:    "Anthropic Claude 3.5 Sonnet",
@@ -50,21 +55,62 @@ var anthropicModels = map[string]ai.ModelInfo{
 	"claude-3-5-haiku": {
 		Label:    "Anthropic Claude 3.5 Haiku",
 		Supports: &Multimodal,
-		Versions: []string{"claude-3-5-haiku-latest"},
+		Versions: []string{"claude-3-5-haiku-latest", "claude-3-5-haiku-20241022"},
 	},
 	"claude-3-7-sonnet": {
 		Label:    "Anthropic Claude 3.7 Sonnet",
 		Supports: &Multimodal,
-		Versions: []string{"claude-3-7-sonnet-latest"},
+		Versions: []string{"claude-3-7-sonnet-latest", "claude-3-7-sonnet-20250219"},
 	},
 	"claude-opus-4": {
 		Label:    "Anthropic Claude Opus 4",
 		Supports: &Multimodal,
-		Versions: []string{"claude-opus-4-20250514"},
+		Versions: []string{"claude-opus-4-20250514", "claude-opus-4-0"},
 	},
 	"claude-sonnet-4": {
 		Label:    "Anthropic Claude Sonnet 4",
 		Supports: &Multimodal,
-		Versions: []string{"claude-sonnet-4-20250514"},
+		Versions: []string{"claude-sonnet-4-20250514", "claude-sonnet-4-0"},
 	},
+	"claude-opus-4-1": {
+		Label:    "Anthropic Claude Opus 4.1",
+		Supports: &Multimodal,
+		Versions: []string{"claude-opus-4-1-20250805", "claude-opus-4-1"},
+	},
+	"claude-sonnet-4-5": {
+		Label:    "Anthropic Claude Sonnet 4.5",
+		Supports: &Multimodal,
+		Versions: []string{"claude-sonnet-4-5-20250929", "claude-sonnet-4-5"},
+	},
+	"claude-haiku-4-5": {
+		Label:    "Anthropic Claude Haiku 4.5",
+		Supports: &Multimodal,
+		Versions: []string{"claude-haiku-4-5-20251001", "claude-haiku-4-5"},
+	},
+}
+
+// References to the supported models, to be used with [ai.WithModel].
+// Use [NewModelRef] to set their config.
+var (
+	ModelClaudeSonnet45   = NewModelRef("claude-sonnet-4-5", nil)
+	ModelClaudeHaiku45    = NewModelRef("claude-haiku-4-5", nil)
+	ModelClaudeOpus41     = NewModelRef("claude-opus-4-1", nil)
+	ModelClaudeSonnet4    = NewModelRef("claude-sonnet-4", nil)
+	ModelClaudeOpus4      = NewModelRef("claude-opus-4", nil)
+	ModelClaude37Sonnet   = NewModelRef("claude-3-7-sonnet", nil)
+	ModelClaude35SonnetV2 = NewModelRef("claude-3-5-sonnet-v2", nil)
+	ModelClaude35Sonnet   = NewModelRef("claude-3-5-sonnet", nil)
+	ModelClaude35Haiku    = NewModelRef("claude-3-5-haiku", nil)
+	ModelClaude3Haiku     = NewModelRef("claude-3-haiku", nil)
+)
+
+// NewModelRef returns a reference to the Anthropic model with the given name,
+// e.g. "claude-sonnet-4", generating with the given config. The Version of the
+// config pins one of the versions of the model, e.g. "claude-sonnet-4-20250514".
+func NewModelRef(name string, config *GenerationConfig) ai.ModelRef {
+	// keep a nil config untyped, Genkit checks the config against nil
+	if config == nil {
+		return ai.NewModelRef(provider+"/"+name, nil)
+	}
+	return ai.NewModelRef(provider+"/"+name, config)
 }
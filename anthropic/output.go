@@ -0,0 +1,291 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// structuredOutputToolName is the tool Claude is forced to call with the requested output,
+// Claude reliably follows a tool input schema
+const structuredOutputToolName = "structured_output"
+
+// structuredOutput is a JSON output schema requested with [ai.ModelRequest.Output]
+type structuredOutput struct {
+	// requested is the schema of the output, schema the schema of the tool input
+	requested map[string]any
+	schema    map[string]any
+	// wrapped is true when the schema is not an object, the output is then
+	// the "output" property of the tool input as tool inputs must be objects
+	wrapped bool
+}
+
+// structuredOutputFor returns the JSON output requested, if any. Only the
+// constrained outputs are requested with the output tool: Genkit asks for the
+// others in the prompt, e.g. when the request has tools Claude must be free to call.
+func structuredOutputFor(i *ai.ModelRequest) *structuredOutput {
+	if i.Output == nil || !i.Output.Constrained || len(i.Output.Schema) == 0 {
+		return nil
+	}
+	if i.Output.Format != "" && i.Output.Format != "json" && i.Output.Format != "array" {
+		return nil
+	}
+	if i.Output.Schema["type"] == "object" {
+		return &structuredOutput{requested: i.Output.Schema, schema: i.Output.Schema}
+	}
+	return &structuredOutput{
+		requested: i.Output.Schema,
+		schema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"output": i.Output.Schema},
+			"required":   []string{"output"},
+		},
+		wrapped: true,
+	}
+}
+
+// tool returns the tool whose input is the output
+func (o *structuredOutput) tool() anthropic.ToolUnionParam {
+	return param.Override[anthropic.ToolUnionParam](map[string]any{
+		"name":         structuredOutputToolName,
+		"description":  "Responds to the user with the requested structured output.",
+		"input_schema": o.schema,
+	})
+}
+
+// toolChoice forces Claude to call the output tool
+func (o *structuredOutput) toolChoice() anthropic.ToolChoiceUnionParam {
+	return anthropic.ToolChoiceUnionParam{OfTool: &anthropic.ToolChoiceToolParam{Name: structuredOutputToolName}}
+}
+
+// apply replaces the output tool call of a response with the JSON output
+func (o *structuredOutput) apply(r *ai.ModelResponse) error {
+	if r.Message == nil {
+		return nil
+	}
+	for i, p := range r.Message.Content {
+		if !p.IsToolRequest() || p.ToolRequest.Name != structuredOutputToolName {
+			continue
+		}
+		b, err := json.Marshal(p.ToolRequest.Input)
+		if err != nil {
+			return fmt.Errorf("unable to encode structured output: %w", err)
+		}
+		if o.wrapped {
+			var input struct {
+				Output json.RawMessage `json:"output"`
+			}
+			if err := json.Unmarshal(b, &input); err != nil || len(input.Output) == 0 {
+				return fmt.Errorf("unexpected structured output: %s", b)
+			}
+			b = input.Output
+		}
+		r.Message.Content[i] = ai.NewJSONPart(string(b))
+	}
+	return nil
+}
+
+// defaultOutputRepairs is the number of repair requests sent when the output doesn't match the schema
+const defaultOutputRepairs = 1
+
+// OutputValidationError is returned when the structured output still doesn't
+// match the requested schema after the repair requests
+type OutputValidationError struct {
+	// Output is the last output of Claude
+	Output string
+	// Errors describe how the output doesn't match the schema
+	Errors []string
+}
+
+func (e *OutputValidationError) Error() string {
+	return "output doesn't match the schema: " + strings.Join(e.Errors, "; ")
+}
+
+// validate returns how the output of a response doesn't match the schema, if it doesn't
+func (o *structuredOutput) validate(r *ai.ModelResponse) *OutputValidationError {
+	text := r.Text()
+	result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(o.requested), gojsonschema.NewStringLoader(text))
+	if err != nil {
+		return &OutputValidationError{Output: text, Errors: []string{"output is not valid JSON: " + err.Error()}}
+	}
+	if result.Valid() {
+		return nil
+	}
+	verr := &OutputValidationError{Output: text}
+	for _, e := range result.Errors() {
+		verr.Errors = append(verr.Errors, e.String())
+	}
+	return verr
+}
+
+// repairMessage asks Claude to fix its previous output
+func repairMessage(verr *OutputValidationError) *ai.Message {
+	return ai.NewUserTextMessage("The output doesn't match the requested schema:\n- " +
+		strings.Join(verr.Errors, "\n- ") + "\nRespond again with an output that matches the schema.")
+}
+
+// PartialOutputMetadataKey is the metadata key of the streamed structured
+// output parts holding the output so far as well-formed JSON, e.g. {"name":"Ad"}
+// while the text of the parts are the raw output deltas
+const PartialOutputMetadataKey = "partialOutput"
+
+// wrappedOutputPrefix matches the start of a wrapped output tool input
+var wrappedOutputPrefix = regexp.MustCompile(`^\s*\{\s*"output"\s*:\s*`)
+
+// partialOutput accumulates the streamed input of the output tool
+type partialOutput struct {
+	wrapped bool
+	raw     strings.Builder
+	// emitted is the length of the output already streamed
+	emitted int
+}
+
+func (o *structuredOutput) newPartialOutput() *partialOutput {
+	return &partialOutput{wrapped: o.wrapped}
+}
+
+// add appends a delta of the tool input, it returns the output text to stream
+// and the output so far as well-formed JSON
+func (p *partialOutput) add(delta string) (string, string) {
+	p.raw.WriteString(delta)
+	raw := p.raw.String()
+
+	text := p.text(raw, false)
+	newText := text[p.emitted:]
+	p.emitted = len(text)
+
+	snapshot, ok := completeJSON(raw)
+	if !ok {
+		return newText, ""
+	}
+	if p.wrapped {
+		var input struct {
+			Output json.RawMessage `json:"output"`
+		}
+		if err := json.Unmarshal([]byte(snapshot), &input); err != nil {
+			return newText, ""
+		}
+		snapshot = string(input.Output)
+	}
+	return newText, snapshot
+}
+
+// finish returns the output text not streamed yet once the tool input is complete
+func (p *partialOutput) finish() string {
+	text := p.text(p.raw.String(), true)
+	if len(text) <= p.emitted {
+		return ""
+	}
+	rest := text[p.emitted:]
+	p.emitted = len(text)
+	return rest
+}
+
+// text returns the output text of the raw tool input. The closing braces at
+// the end of a wrapped output are held back until it is known whether they
+// close the output or the tool input.
+func (p *partialOutput) text(raw string, final bool) string {
+	if !p.wrapped {
+		return raw
+	}
+	prefix := wrappedOutputPrefix.FindString(raw)
+	if prefix == "" {
+		return ""
+	}
+	text := raw[len(prefix):]
+	if final {
+		text = strings.TrimRightFunc(text, unicode.IsSpace)
+		text = strings.TrimSuffix(text, "}")
+		return strings.TrimRightFunc(text, unicode.IsSpace)
+	}
+	return strings.TrimRight(text, "} \t\r\n")
+}
+
+// completeJSON turns the start of a JSON value into well-formed JSON, by
+// dropping its incomplete last token and closing its strings, arrays and objects
+func completeJSON(s string) (string, bool) {
+	for cut := len(s); cut > 0; cut-- {
+		prefix := s[:cut]
+		closers, inString, escaped := jsonClosers(prefix)
+		if escaped {
+			continue
+		}
+		if inString {
+			prefix += `"`
+		} else {
+			prefix = strings.TrimRightFunc(prefix, unicode.IsSpace)
+			prefix = strings.TrimSuffix(prefix, ",")
+			if strings.HasSuffix(prefix, ":") {
+				prefix += "null"
+			}
+		}
+		candidate := prefix + closers
+		if json.Valid([]byte(candidate)) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// jsonClosers returns the closing brackets of the arrays and objects left
+// open at the end of s, and whether s ends in a string or an escape sequence
+func jsonClosers(s string) (closers string, inString, escaped bool) {
+	stack := []byte{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+				// unicode escapes must be complete
+				if c == 'u' && i+4 >= len(s) {
+					return "", true, true
+				}
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		closers += string(stack[i])
+	}
+	return closers, inString, escaped
+}
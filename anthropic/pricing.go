@@ -0,0 +1,117 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"maps"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+)
+
+// CostMetadataKey is the response message metadata key holding the
+// estimated cost of the response in USD, see [Cost]
+const CostMetadataKey = "costUsd"
+
+// Pricing is the price of the tokens of a model, in USD per million tokens
+type Pricing struct {
+	Input  float64
+	Output float64
+	// CacheWrite is the price of the input tokens written to the prompt cache
+	CacheWrite float64
+	// CacheRead is the price of the input tokens read from the prompt cache
+	CacheRead float64
+}
+
+// DefaultPricing is the list price of the models known to the plugin, by model
+// name. The prompt cache writes are priced at the rate of the 5 minutes TTL.
+var DefaultPricing = map[string]Pricing{
+	"claude-opus-4-1":      {Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.5},
+	"claude-sonnet-4-5":    {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-haiku-4-5":     {Input: 1, Output: 5, CacheWrite: 1.25, CacheRead: 0.1},
+	"claude-opus-4":        {Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.5},
+	"claude-sonnet-4":      {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-7-sonnet":    {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-5-sonnet-v2": {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-5-sonnet":    {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-5-haiku":     {Input: 0.8, Output: 4, CacheWrite: 1, CacheRead: 0.08},
+	"claude-3-haiku":       {Input: 0.25, Output: 1.25, CacheWrite: 0.3, CacheRead: 0.03},
+}
+
+// Cost returns the estimated cost of a response in USD, false when the
+// pricing of its model is unknown
+func Cost(r *ai.ModelResponse) (float64, bool) {
+	if r == nil || r.Message == nil {
+		return 0, false
+	}
+	cost, ok := r.Message.Metadata[CostMetadataKey].(float64)
+	return cost, ok
+}
+
+// cost returns the cost of the given usage in USD
+func (p Pricing) cost(u *ai.GenerationUsage) float64 {
+	tokens := float64(u.InputTokens)*p.Input +
+		float64(u.OutputTokens)*p.Output +
+		u.Custom[UsageCacheCreationInputTokens]*p.CacheWrite +
+		u.Custom[UsageCacheReadInputTokens]*p.CacheRead
+	return tokens / 1e6
+}
+
+// newPricing returns the default pricing with the given prices, e.g.
+// negotiated rates, in place of the defaults
+func newPricing(overrides map[string]Pricing) map[string]Pricing {
+	prices := maps.Clone(DefaultPricing)
+	maps.Copy(prices, overrides)
+	return prices
+}
+
+// pricingFor returns the pricing of the model of a response: the model a
+// fallback model generated with, the model name, or the Anthropic model ID
+func pricingFor(prices map[string]Pricing, model string, r *ai.ModelResponse) (Pricing, bool) {
+	if used, ok := r.Message.Metadata[ModelMetadataKey].(string); ok {
+		model = used
+	}
+	if p, ok := prices[model]; ok {
+		return p, true
+	}
+	if m, ok := r.Custom.(*anthropic.Message); ok {
+		p, ok := prices[string(m.Model)]
+		return p, ok
+	}
+	return Pricing{}, false
+}
+
+// costs is the middleware adding the estimated cost of the responses of a
+// model to their metadata
+func costs(prices map[string]Pricing, model string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			r, err := next(ctx, input, cb)
+			if err != nil || r.Message == nil || r.Usage == nil {
+				return r, err
+			}
+			if p, ok := pricingFor(prices, model, r); ok {
+				if r.Message.Metadata == nil {
+					r.Message.Metadata = map[string]any{}
+				}
+				r.Message.Metadata[CostMetadataKey] = p.cost(r.Usage)
+			}
+			return r, nil
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// ErrRateLimited is returned by the calls over the limits of a rejecting [RateLimiterConfig]
+var ErrRateLimited = errors.New("client-side rate limit exceeded")
+
+// RateLimiterConfig limits the Generate calls of the plugin before they reach
+// the API, so a burst of flows doesn't trip the limits of the organization.
+// Calls over the limits wait for their turn, unless Reject is set.
+type RateLimiterConfig struct {
+	// RequestsPerMinute is the number of calls allowed per minute, 0 for no limit
+	RequestsPerMinute int
+	// TokensPerMinute is the number of input tokens allowed per minute, 0 for no
+	// limit. The input tokens of a call are estimated from the parts of its
+	// request, the media referenced by URI are not downloaded.
+	TokensPerMinute int
+	// Reject fails the calls over the limits with [ErrRateLimited] instead of
+	// making them wait
+	Reject bool
+}
+
+// rateLimiter is a token bucket limiter of the requests and input tokens
+type rateLimiter struct {
+	mu       sync.Mutex
+	requests *bucket
+	tokens   *bucket
+	reject   bool
+	now      func() time.Time
+}
+
+// newRateLimiter returns a limiter with full buckets, now is the clock of the limiter
+func newRateLimiter(c RateLimiterConfig, now func() time.Time) *rateLimiter {
+	l := &rateLimiter{reject: c.Reject, now: now}
+	if c.RequestsPerMinute > 0 {
+		l.requests = newBucket(c.RequestsPerMinute, l.now())
+	}
+	if c.TokensPerMinute > 0 {
+		l.tokens = newBucket(c.TokensPerMinute, l.now())
+	}
+	return l
+}
+
+// wait waits until a call with the given input tokens is allowed
+func (l *rateLimiter) wait(ctx context.Context, tokens int) error {
+	l.mu.Lock()
+	now := l.now()
+	var delay time.Duration
+	if l.requests != nil {
+		delay = max(delay, l.requests.delay(1, now))
+	}
+	if l.tokens != nil {
+		delay = max(delay, l.tokens.delay(tokens, now))
+	}
+	if delay > 0 && l.reject {
+		l.mu.Unlock()
+		return ErrRateLimited
+	}
+	l.take(1, tokens)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.take(-1, -tokens)
+		l.mu.Unlock()
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// take takes the requests and tokens of a call from the buckets, l.mu must be held
+func (l *rateLimiter) take(requests, tokens int) {
+	if l.requests != nil {
+		l.requests.take(requests)
+	}
+	if l.tokens != nil {
+		l.tokens.take(tokens)
+	}
+}
+
+// middleware makes the calls of a model wait for the limiter
+func (l *rateLimiter) middleware() ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			tokens := 0
+			if l.tokens != nil {
+				tokens = estimateRequestTokens(input)
+			}
+			if err := l.wait(ctx, tokens); err != nil {
+				return nil, err
+			}
+			return next(ctx, input, cb)
+		}
+	}
+}
+
+// bucket is a token bucket refilled continuously at its per minute capacity
+type bucket struct {
+	capacity float64
+	level    float64
+	last     time.Time
+}
+
+func newBucket(perMinute int, now time.Time) *bucket {
+	return &bucket{capacity: float64(perMinute), level: float64(perMinute), last: now}
+}
+
+// delay refills the bucket and returns how long to wait for n tokens. A call
+// larger than the bucket waits for a full bucket.
+func (b *bucket) delay(n int, now time.Time) time.Duration {
+	// a clock going backwards doesn't drain the bucket
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.level = math.Min(b.capacity, b.level+elapsed.Minutes()*b.capacity)
+		b.last = now
+	}
+	missing := math.Min(float64(n), b.capacity) - b.level
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.capacity * float64(time.Minute))
+}
+
+// take takes n tokens from the bucket, its level goes negative for the calls
+// waiting for their turn
+func (b *bucket) take(n int) {
+	b.level -= math.Min(float64(n), b.capacity)
+}
@@ -0,0 +1,104 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/firebase/genkit/go/ai"
+)
+
+// RateLimitsMetadataKey is the response message metadata key holding the
+// [RateLimits] reported by Anthropic with the response
+const RateLimitsMetadataKey = "rateLimits"
+
+// RateLimit is the state of one limit of the organization, as reported by the
+// anthropic-ratelimit-* response headers
+type RateLimit struct {
+	// Limit is the maximum allowed in the rate limit period
+	Limit int64 `json:"limit"`
+	// Remaining is what is left before being rate limited
+	Remaining int64 `json:"remaining"`
+	// Reset is when the limit is fully replenished
+	Reset time.Time `json:"reset,omitzero"`
+}
+
+// RateLimits are the rate limits of the organization after a call. A limit not
+// reported by Anthropic is nil.
+type RateLimits struct {
+	Requests     *RateLimit `json:"requests,omitempty"`
+	Tokens       *RateLimit `json:"tokens,omitempty"`
+	InputTokens  *RateLimit `json:"inputTokens,omitempty"`
+	OutputTokens *RateLimit `json:"outputTokens,omitempty"`
+	// RetryAfter is how long to wait before retrying a rate limited call
+	RetryAfter time.Duration `json:"retryAfter,omitempty"`
+}
+
+// ResponseRateLimits returns the rate limits reported with a response, nil if none
+func ResponseRateLimits(r *ai.ModelResponse) *RateLimits {
+	if r == nil || r.Message == nil {
+		return nil
+	}
+	rl, _ := r.Message.Metadata[RateLimitsMetadataKey].(*RateLimits)
+	return rl
+}
+
+// parseRateLimits returns the rate limits of the response headers, nil if none
+func parseRateLimits(h http.Header) *RateLimits {
+	rl := &RateLimits{
+		Requests:     parseRateLimit(h, "requests"),
+		Tokens:       parseRateLimit(h, "tokens"),
+		InputTokens:  parseRateLimit(h, "input-tokens"),
+		OutputTokens: parseRateLimit(h, "output-tokens"),
+	}
+	if d, ok := retryAfter(&http.Response{Header: h}); ok {
+		rl.RetryAfter = d
+	}
+	if rl.Requests == nil && rl.Tokens == nil && rl.InputTokens == nil && rl.OutputTokens == nil {
+		return nil
+	}
+	return rl
+}
+
+// parseRateLimit returns the limit of the anthropic-ratelimit-<name>-* headers, nil if not set
+func parseRateLimit(h http.Header, name string) *RateLimit {
+	prefix := "anthropic-ratelimit-" + name + "-"
+	limit, err := strconv.ParseInt(h.Get(prefix+"limit"), 10, 64)
+	if err != nil {
+		return nil
+	}
+	remaining, _ := strconv.ParseInt(h.Get(prefix+"remaining"), 10, 64)
+	reset, _ := time.Parse(time.RFC3339, h.Get(prefix+"reset"))
+	return &RateLimit{Limit: limit, Remaining: remaining, Reset: reset}
+}
+
+// rateLimitsMiddleware calls fn with the rate limits of every API response,
+// including the rate limited ones
+func rateLimitsMiddleware(fn func(*RateLimits)) option.Middleware {
+	return func(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+		resp, err := next(req)
+		if resp != nil {
+			if rl := parseRateLimits(resp.Header); rl != nil {
+				fn(rl)
+			}
+		}
+		return resp, err
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+const (
+	defaultResizeMaxMegapixels = 1.15
+	defaultResizeMaxDimension  = 1568
+	defaultResizeJPEGQuality   = 85
+)
+
+// ImageResizeConfig downscales and re-encodes the inline images of the requests
+// larger than its limits before they are sent, the images are sent as JPEG
+// when PNG doesn't fit MaxBytes. The defaults are the sizes Anthropic
+// recommends, the larger images are downscaled by the API anyway. WebP
+// images and images referenced by URL are sent as is.
+type ImageResizeConfig struct {
+	// MaxMegapixels is the maximum number of pixels of an image, 1.15 by default
+	MaxMegapixels float64
+	// MaxDimension is the maximum width and height in pixels, 1568 by default
+	MaxDimension int
+	// MaxBytes is the maximum encoded size of an image, 5MB by default
+	MaxBytes int
+	// JPEGQuality is the quality of the JPEG images re-encoded, 85 by default
+	JPEGQuality int
+}
+
+func (c ImageResizeConfig) withDefaults() ImageResizeConfig {
+	if c.MaxMegapixels <= 0 {
+		c.MaxMegapixels = defaultResizeMaxMegapixels
+	}
+	if c.MaxDimension <= 0 {
+		c.MaxDimension = defaultResizeMaxDimension
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = maxImageSize
+	}
+	if c.JPEGQuality <= 0 {
+		c.JPEGQuality = defaultResizeJPEGQuality
+	}
+	return c
+}
+
+// middleware resizes the images of the requests of a model
+func (c ImageResizeConfig) middleware() ai.ModelMiddleware {
+	c = c.withDefaults()
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			resized, err := c.resizeRequest(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			return next(ctx, resized, cb)
+		}
+	}
+}
+
+// resizeRequest returns the request with its images resized, the request is
+// copied when an image changes
+func (c ImageResizeConfig) resizeRequest(ctx context.Context, input *ai.ModelRequest) (*ai.ModelRequest, error) {
+	var messages []*ai.Message
+	for i, m := range input.Messages {
+		var content []*ai.Part
+		for j, p := range m.Content {
+			if !p.IsMedia() || isMediaURL(ctx, p) {
+				continue
+			}
+			if _, ok := fileID(p); ok {
+				continue
+			}
+			resized, err := c.resize(ctx, p)
+			if err != nil {
+				return nil, fmt.Errorf("message %d, part %d: %w", i, j, err)
+			}
+			if resized == p {
+				continue
+			}
+			if content == nil {
+				content = slices.Clone(m.Content)
+			}
+			content[j] = resized
+		}
+		if content == nil {
+			continue
+		}
+		if messages == nil {
+			messages = slices.Clone(input.Messages)
+		}
+		copied := *m
+		copied.Content = content
+		messages[i] = &copied
+	}
+	if messages == nil {
+		return input, nil
+	}
+	resized := *input
+	resized.Messages = messages
+	return &resized, nil
+}
+
+// resize returns the media part with its image resized, the part itself when
+// the image fits the limits or can't be resized
+func (c ImageResizeConfig) resize(ctx context.Context, p *ai.Part) (*ai.Part, error) {
+	m, err := readMedia(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	contentType := m.contentType
+	if contentType != "image/jpeg" && contentType != "image/png" && contentType != "image/gif" {
+		return p, nil
+	}
+	// the images within the limits are not decoded
+	cfg, _, err := image.DecodeConfig(m.reader())
+	if err != nil {
+		// sent as is, the validation of the images reports it
+		return p, nil
+	}
+	scale := c.scale(cfg.Width, cfg.Height)
+	if scale >= 1 && m.size() <= c.MaxBytes {
+		return p, nil
+	}
+
+	img, _, err := image.Decode(m.reader())
+	if err != nil {
+		return p, nil
+	}
+	for range 5 {
+		if scale < 1 {
+			img = downscale(img, scale)
+		}
+		var out []byte
+		contentType, out, err = c.encode(img, contentType)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode the resized image: %w", err)
+		}
+		if len(out) <= c.MaxBytes {
+			resized := ai.NewMediaPart(contentType, dataURI(contentType, out))
+			resized.Metadata = p.Metadata
+			return resized, nil
+		}
+		// still too large, shrink further
+		scale = 0.75
+	}
+	return nil, fmt.Errorf("unable to fit the image in %d bytes", c.MaxBytes)
+}
+
+// scale returns the factor fitting an image of the given size in the limits
+func (c ImageResizeConfig) scale(width, height int) float64 {
+	scale := math.Sqrt(c.MaxMegapixels * 1e6 / float64(width*height))
+	return min(scale, float64(c.MaxDimension)/float64(max(width, height)))
+}
+
+// encode encodes an image as PNG, or as JPEG for the JPEG images and the PNG
+// images too large
+func (c ImageResizeConfig) encode(img image.Image, contentType string) (string, []byte, error) {
+	var buf bytes.Buffer
+	if contentType != "image/jpeg" {
+		if err := png.Encode(&buf, img); err != nil {
+			return "", nil, err
+		}
+		if buf.Len() <= c.MaxBytes {
+			return "image/png", buf.Bytes(), nil
+		}
+		buf.Reset()
+	}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: c.JPEGQuality}); err != nil {
+		return "", nil, err
+	}
+	return "image/jpeg", buf.Bytes(), nil
+}
+
+// downscale returns the image scaled by a factor lower than 1, each pixel
+// being the average of the pixels of the source it covers
+func downscale(src image.Image, scale float64) image.Image {
+	b := src.Bounds()
+	w := max(1, int(float64(b.Dx())*scale))
+	h := max(1, int(float64(b.Dy())*scale))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := range w {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// dataURI returns the base64 data URI of the data, encoded straight into the
+// URI so the large images are not copied once more
+func dataURI(contentType string, data []byte) string {
+	var b strings.Builder
+	prefix := "data:" + contentType + ";base64,"
+	b.Grow(len(prefix) + base64.StdEncoding.EncodedLen(len(data)))
+	b.WriteString(prefix)
+	enc := base64.NewEncoder(base64.StdEncoding, &b)
+	enc.Write(data)
+	enc.Close()
+	return b.String()
+}
@@ -0,0 +1,177 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+const (
+	defaultResponseCacheTTL        = time.Hour
+	defaultResponseCacheMaxEntries = 1000
+)
+
+// ResponseCachedMetadataKey is the response message metadata key set to true
+// on the responses returned from the [ResponseCacheConfig] cache
+const ResponseCachedMetadataKey = "responseCached"
+
+// ResponseStore stores the responses of the response cache, e.g. in Redis to
+// share them between the instances of a service. The responses are stored
+// for the TTL of the cache, a missing or expired response is not found.
+type ResponseStore interface {
+	Get(ctx context.Context, key string) (r *ai.ModelResponse, found bool, err error)
+	Set(ctx context.Context, key string, r *ai.ModelResponse, ttl time.Duration) error
+}
+
+// ResponseCacheConfig configures the cache returning the previous response of
+// a model to the identical requests, e.g. for evaluation runs and demos. The
+// requests are identified by the hash of their request, or the key set with
+// [WithIdempotencyKey].
+type ResponseCacheConfig struct {
+	// TTL is how long a response is returned again, 1h by default
+	TTL time.Duration
+	// Store stores the responses, in memory when nil
+	Store ResponseStore
+	// MaxEntries caps the number of responses of the in-memory store, the
+	// least recently used are evicted first, 1000 by default
+	MaxEntries int
+}
+
+// withDefaults returns the config with the defaults of the unset fields
+func (c ResponseCacheConfig) withDefaults() ResponseCacheConfig {
+	if c.TTL <= 0 {
+		c.TTL = defaultResponseCacheTTL
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = defaultResponseCacheMaxEntries
+	}
+	return c
+}
+
+// responseCache returns the cached responses of the identical requests
+type responseCache struct {
+	ttl   time.Duration
+	store ResponseStore
+}
+
+func newResponseCache(c ResponseCacheConfig, now func() time.Time) *responseCache {
+	c = c.withDefaults()
+	store := c.Store
+	if store == nil {
+		store = newMemoryStore(c.MaxEntries, now)
+	}
+	return &responseCache{ttl: c.TTL, store: store}
+}
+
+// middleware returns the cached response of a request, or caches the response
+// of the model. The cached responses are not streamed: the callback receives
+// the whole response as a single chunk. The failed calls are not cached, and
+// the calls go to the model when the store fails.
+func (rc *responseCache) middleware(model string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			key, ok := requestKey(ctx, model, input)
+			if !ok {
+				return next(ctx, input, cb)
+			}
+			cached, found, err := rc.store.Get(ctx, key)
+			if err != nil {
+				slog.WarnContext(ctx, "anthropic: unable to read the response cache", "err", err)
+			}
+			if found {
+				r := copyResponse(cached)
+				if r.Message != nil {
+					r.Message.Metadata = maps.Clone(r.Message.Metadata)
+					if r.Message.Metadata == nil {
+						r.Message.Metadata = map[string]any{}
+					}
+					r.Message.Metadata[ResponseCachedMetadataKey] = true
+				}
+				return replay(ctx, r, cb)
+			}
+
+			r, err := next(ctx, input, cb)
+			if err != nil {
+				return nil, err
+			}
+			if err := rc.store.Set(ctx, key, r, rc.ttl); err != nil {
+				slog.WarnContext(ctx, "anthropic: unable to write the response cache", "err", err)
+			}
+			return r, nil
+		}
+	}
+}
+
+// memoryStore is the in-memory [ResponseStore], evicting the least recently
+// used responses
+type memoryStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	now        func() time.Time
+	// entries are the elements of lru by key, the most recently used first
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	key       string
+	r         *ai.ModelResponse
+	expiresAt time.Time
+}
+
+func newMemoryStore(maxEntries int, now func() time.Time) *memoryStore {
+	return &memoryStore{maxEntries: maxEntries, now: now, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (s *memoryStore) Get(_ context.Context, key string) (*ai.ModelResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := e.Value.(*memoryEntry)
+	if !s.now().Before(entry.expiresAt) {
+		s.lru.Remove(e)
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	s.lru.MoveToFront(e)
+	return entry.r, true, nil
+}
+
+func (s *memoryStore) Set(_ context.Context, key string, r *ai.ModelResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		s.lru.Remove(e)
+	}
+	s.entries[key] = s.lru.PushFront(&memoryEntry{key: key, r: copyResponse(r), expiresAt: s.now().Add(ttl)})
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
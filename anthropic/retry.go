@@ -0,0 +1,193 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = 500 * time.Millisecond
+	defaultRetryMaxDelay    = 8 * time.Second
+	defaultRetryJitter      = 0.25
+
+	defaultOverloadedBaseDelay = 2 * time.Second
+	defaultOverloadedMaxDelay  = 30 * time.Second
+)
+
+// RetryConfig configures how the plugin retries the calls failing with a rate
+// limit (429), a server error (5xx) or a connection error. It applies to every
+// call of the plugin: blocking and streaming generation, token counting, files
+// and batches.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts of a call, including the first one,
+	// 3 by default, 1 disables retries
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled on every retry,
+	// 500ms by default
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts, 8s by default. A call asked
+	// by Anthropic to wait longer with retry-after is not retried.
+	MaxDelay time.Duration
+	// Jitter is the fraction of the delay randomly removed from it so clients
+	// don't retry in lockstep, 0.25 by default, negative disables it
+	Jitter float64
+	// OverloadedBaseDelay and OverloadedMaxDelay replace BaseDelay and MaxDelay
+	// for the overloaded errors (529), which take longer to clear: 2s and 30s by default
+	OverloadedBaseDelay time.Duration
+	OverloadedMaxDelay  time.Duration
+}
+
+// withDefaults returns the config with the defaults of the unset fields
+func (rc RetryConfig) withDefaults() RetryConfig {
+	if rc.MaxAttempts <= 0 {
+		rc.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if rc.BaseDelay <= 0 {
+		rc.BaseDelay = defaultRetryBaseDelay
+	}
+	if rc.MaxDelay <= 0 {
+		rc.MaxDelay = defaultRetryMaxDelay
+	}
+	if rc.Jitter == 0 {
+		rc.Jitter = defaultRetryJitter
+	}
+	if rc.OverloadedBaseDelay <= 0 {
+		rc.OverloadedBaseDelay = defaultOverloadedBaseDelay
+	}
+	if rc.OverloadedMaxDelay <= 0 {
+		rc.OverloadedMaxDelay = defaultOverloadedMaxDelay
+	}
+	return rc
+}
+
+// options returns the client options retrying the calls, in place of the
+// retries of the Anthropic SDK
+func (rc RetryConfig) options() []option.RequestOption {
+	return []option.RequestOption{
+		option.WithMaxRetries(0),
+		option.WithMiddleware(retryMiddleware(rc.withDefaults())),
+	}
+}
+
+// retryMiddleware retries the failed HTTP requests. The request body is
+// replayed from GetBody, so requests without it are only attempted once.
+func retryMiddleware(rc RetryConfig) option.Middleware {
+	return func(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+		for attempt := 1; ; attempt++ {
+			resp, err := next(req)
+			if attempt >= rc.MaxAttempts || !shouldRetry(req, resp, err) {
+				return resp, err
+			}
+			delay, ok := rc.delay(attempt, resp)
+			if !ok {
+				return resp, err
+			}
+			if req.GetBody != nil {
+				body, berr := req.GetBody()
+				if berr != nil {
+					return resp, err
+				}
+				req.Body = body
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+
+			t := time.NewTimer(delay)
+			select {
+			case <-req.Context().Done():
+				t.Stop()
+				return nil, req.Context().Err()
+			case <-t.C:
+			}
+		}
+	}
+}
+
+// shouldRetry reports whether a failed request can be retried
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		// connection errors, not the cancellation of the call
+		return req.Context().Err() == nil && !errors.Is(err, req.Context().Err())
+	}
+	switch resp.Header.Get("x-should-retry") {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusConflict ||
+		resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= http.StatusInternalServerError
+}
+
+// delay returns how long to wait before the next attempt: the delay asked by
+// the retry-after headers of the response, or else the exponential backoff.
+// It returns false when the delay asked is longer than the max delay, the call
+// then fails rather than blocking for that long.
+func (rc RetryConfig) delay(attempt int, resp *http.Response) (time.Duration, bool) {
+	base, maxDelay := rc.BaseDelay, rc.MaxDelay
+	if resp != nil && resp.StatusCode == statusOverloaded {
+		base, maxDelay = rc.OverloadedBaseDelay, rc.OverloadedMaxDelay
+	}
+	if d, ok := retryAfter(resp); ok {
+		return d, d <= maxDelay
+	}
+	d := time.Duration(float64(base) * math.Pow(2, float64(attempt-1)))
+	if d > maxDelay || d <= 0 {
+		d = maxDelay
+	}
+	if rc.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * min(rc.Jitter, 1) * float64(d))
+	}
+	return d, true
+}
+
+// retryAfter returns the delay asked by the retry-after-ms or retry-after
+// headers of a response, if any
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if ms, err := strconv.ParseFloat(resp.Header.Get("retry-after-ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	v := resp.Header.Get("retry-after")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.ParseFloat(v, 64); err == nil && s >= 0 {
+		return time.Duration(s * float64(time.Second)), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
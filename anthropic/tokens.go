@@ -0,0 +1,344 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+	"github.com/firebase/genkit/go/ai"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// CountTokens returns the number of input tokens the request would use with
+// the given model, without generating a response
+func (a *Anthropic) CountTokens(ctx context.Context, model string, input *ai.ModelRequest) (int, error) {
+	if a.messages == nil {
+		return 0, errors.New("Anthropic.CountTokens: plugin not initialized")
+	}
+	ctx, span := startSpan(ctx, newTracer(a.TracerProvider), "anthropic/countTokens", model)
+	n, err := countTokens(withMediaConfig(ctx, a.media), a.messages, model, input)
+	if err == nil {
+		span.SetAttributes(attribute.Int(attrInputTokens, n))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return 0, fmt.Errorf("Anthropic.CountTokens: %w", err)
+	}
+	return n, nil
+}
+
+// countTokens counts the input tokens of a request, converted the same way as for generation
+func countTokens(ctx context.Context, client MessagesAPI, model string, input *ai.ModelRequest) (int, error) {
+	req, err := toAnthropicRequest(ctx, model, input)
+	if err != nil {
+		return 0, fmt.Errorf("unable to generate anthropic request: %w", err)
+	}
+	opts, err := toAnthropicRequestOptions(model, input)
+	if err != nil {
+		return 0, fmt.Errorf("unable to generate anthropic request: %w", err)
+	}
+
+	return countRequestTokens(ctx, client, req, opts)
+}
+
+// countRequestTokens counts the input tokens of a converted request
+func countRequestTokens(ctx context.Context, client MessagesAPI, req *anthropic.MessageNewParams, opts []option.RequestOption) (int, error) {
+	count, err := client.CountTokens(ctx, toAnthropicCountTokensParams(req), opts...)
+	if err != nil {
+		return 0, apiError(err)
+	}
+	return int(count.InputTokens), nil
+}
+
+// toAnthropicCountTokensParams keeps the fields of a request that count as input tokens
+func toAnthropicCountTokensParams(req *anthropic.MessageNewParams) anthropic.MessageCountTokensParams {
+	params := anthropic.MessageCountTokensParams{
+		Model:      req.Model,
+		Messages:   req.Messages,
+		ToolChoice: req.ToolChoice,
+	}
+	if len(req.System) > 0 {
+		params.System = anthropic.MessageCountTokensParamsSystemUnion{OfTextBlockArray: req.System}
+	}
+	for _, tool := range req.Tools {
+		// the tool definitions are sent as is, count_tokens accepts the same tools
+		params.Tools = append(params.Tools, param.Override[anthropic.MessageCountTokensToolUnionParam](tool))
+	}
+	extras := map[string]any{}
+	for _, field := range []string{"mcp_servers", "context_management"} {
+		if v, ok := req.ExtraFields()[field]; ok {
+			extras[field] = v
+		}
+	}
+	if len(extras) > 0 {
+		params.SetExtraFields(extras)
+	}
+	return params
+}
+
+// ContextWindowCheck is how input tokens are counted before a request is sent
+type ContextWindowCheck string
+
+const (
+	// ContextWindowCheckCount counts the input tokens with the count_tokens API,
+	// at the cost of an extra API call per request
+	ContextWindowCheckCount ContextWindowCheck = "count"
+	// ContextWindowCheckEstimate estimates the input tokens locally from the
+	// request size, it is free but approximate
+	ContextWindowCheckEstimate ContextWindowCheck = "estimate"
+)
+
+const (
+	// defaultContextWindow is the context window, in tokens, of the Claude models
+	defaultContextWindow = 200000
+	// longContextWindow is the context window of the models with the long context beta enabled
+	longContextWindow = 1000000
+
+	longContextBeta = "context-1m-2025-08-07"
+
+	extendedOutputBeta = "output-128k-2025-02-19"
+)
+
+// SupportsLongContext reports whether the 1M tokens context window can be
+// enabled on a model, given by name or ID: Claude Sonnet 4 and 4.5
+func SupportsLongContext(model string) bool {
+	return strings.HasPrefix(model, "claude-sonnet-4")
+}
+
+// ContextWindowExceededError is returned when a request doesn't fit the context
+// window of the model, see [GenerationConfig.ContextWindowCheck]
+type ContextWindowExceededError struct {
+	Model string
+	// InputTokens is the counted, or estimated, number of input tokens
+	InputTokens int
+	// MaxOutputTokens is the max_tokens of the request
+	MaxOutputTokens int
+	// ContextWindow is the number of tokens the model accepts
+	ContextWindow int
+	// Estimated is true when InputTokens was estimated locally
+	Estimated bool
+}
+
+func (e *ContextWindowExceededError) Error() string {
+	kind := "counted"
+	if e.Estimated {
+		kind = "estimated"
+	}
+	return fmt.Sprintf("context window exceeded for %s: %d %s input tokens + %d max output tokens > %d",
+		e.Model, e.InputTokens, kind, e.MaxOutputTokens, e.ContextWindow)
+}
+
+// contextWindow returns the context window of a model
+func contextWindow(model string, c *GenerationConfig) int {
+	if c.LongContext && SupportsLongContext(model) {
+		return longContextWindow
+	}
+	return defaultContextWindow
+}
+
+// maxOutputTokens are the output limits of the models, by model name. The
+// model IDs, e.g. snapshots, have the limit of their model name prefix.
+var maxOutputTokens = map[string]int{
+	"claude-opus-4-5":   64000,
+	"claude-opus-4-1":   32000,
+	"claude-opus-4":     32000,
+	"claude-sonnet-4-5": 64000,
+	"claude-sonnet-4":   64000,
+	"claude-haiku-4-5":  64000,
+	"claude-3-7-sonnet": 64000,
+	"claude-3-5-sonnet": 8192,
+	"claude-3-5-haiku":  8192,
+	"claude-3-opus":     4096,
+	"claude-3-haiku":    4096,
+}
+
+// extendedOutputTokens is the output limit of Claude 3.7 Sonnet with [GenerationConfig.ExtendedOutput]
+const extendedOutputTokens = 128000
+
+// MaxOutputTokensExceededError is returned when the MaxOutputTokens of a
+// request is above the output limit of the model, see [GenerationConfig.ClampMaxOutputTokens]
+type MaxOutputTokensExceededError struct {
+	Model string
+	// MaxOutputTokens is the requested number of output tokens
+	MaxOutputTokens int
+	// Limit is the number of output tokens the model generates at most
+	Limit int
+}
+
+func (e *MaxOutputTokensExceededError) Error() string {
+	return fmt.Sprintf("max output tokens exceeded for %s: %d > %d, the output limit of the model",
+		e.Model, e.MaxOutputTokens, e.Limit)
+}
+
+// outputLimit returns the output limit of a model, given by name or ID, false
+// when it is unknown, e.g. for a model discovered with the Models API
+func outputLimit(model string, c *GenerationConfig) (int, bool) {
+	if c.ExtendedOutput && strings.HasPrefix(model, "claude-3-7-sonnet") {
+		return extendedOutputTokens, true
+	}
+	limit, prefix := 0, ""
+	for name, n := range maxOutputTokens {
+		if strings.HasPrefix(model, name) && len(name) > len(prefix) {
+			limit, prefix = n, name
+		}
+	}
+	return limit, prefix != ""
+}
+
+// toAnthropicMaxTokens returns the max_tokens of a request: its MaxOutputTokens,
+// or [MaxNumberOfTokens] by default, within the output limit of the model
+func toAnthropicMaxTokens(model string, c *GenerationConfig) (int64, error) {
+	limit, known := outputLimit(model, c)
+	if c.MaxOutputTokens == 0 {
+		if known && limit < MaxNumberOfTokens {
+			return int64(limit), nil
+		}
+		return MaxNumberOfTokens, nil
+	}
+	if known && c.MaxOutputTokens > limit {
+		if !c.ClampMaxOutputTokens {
+			return 0, &MaxOutputTokensExceededError{Model: model, MaxOutputTokens: c.MaxOutputTokens, Limit: limit}
+		}
+		return int64(limit), nil
+	}
+	return int64(c.MaxOutputTokens), nil
+}
+
+// checkContextWindow returns a [*ContextWindowExceededError] when the request
+// doesn't fit the context window, if the check is enabled. The tokens are
+// counted from the converted request sent with the given options.
+func checkContextWindow(ctx context.Context, client MessagesAPI, input *ai.ModelRequest, req *anthropic.MessageNewParams, opts []option.RequestOption) error {
+	c, err := configFromRequest(input)
+	if err != nil {
+		return err
+	}
+
+	var n int
+	switch c.ContextWindowCheck {
+	case "":
+		return nil
+	case ContextWindowCheckCount:
+		if n, err = countRequestTokens(ctx, client, req, opts); err != nil {
+			return fmt.Errorf("unable to count input tokens: %w", err)
+		}
+	case ContextWindowCheckEstimate:
+		n = estimateTokens(req)
+	default:
+		return fmt.Errorf("unknown context window check %q", c.ContextWindowCheck)
+	}
+
+	window := contextWindow(string(req.Model), c)
+	if n+int(req.MaxTokens) > window {
+		return &ContextWindowExceededError{
+			Model:           string(req.Model),
+			InputTokens:     n,
+			MaxOutputTokens: int(req.MaxTokens),
+			ContextWindow:   window,
+			Estimated:       c.ContextWindowCheck == ContextWindowCheckEstimate,
+		}
+	}
+	return nil
+}
+
+const (
+	// charsPerToken is the average number of characters of a token of English text
+	charsPerToken = 4
+	// imageTokens is the cost of an image of the largest size Claude accepts without resizing
+	imageTokens = 1600
+)
+
+// estimateTokens estimates the input tokens of a request from the size of its
+// text, images count for their maximum cost once resized by Anthropic and PDF
+// documents are not counted
+func estimateTokens(req *anthropic.MessageNewParams) int {
+	chars := 0
+	for _, b := range req.System {
+		chars += len(b.Text)
+	}
+	images := 0
+	for _, m := range req.Messages {
+		for _, block := range m.Content {
+			if block.OfImage != nil {
+				images++
+				continue
+			}
+			// the size of a PDF says little about its tokens, they are left out
+			if doc := block.OfDocument; doc != nil && (doc.Source.OfBase64 != nil || doc.Source.OfURL != nil) {
+				continue
+			}
+			if text := block.GetText(); text != nil {
+				chars += len(*text)
+				continue
+			}
+			b, err := json.Marshal(block)
+			if err != nil {
+				continue
+			}
+			chars += len(b)
+		}
+	}
+	for _, tool := range req.Tools {
+		b, err := json.Marshal(tool)
+		if err != nil {
+			continue
+		}
+		chars += len(b)
+	}
+	return chars/charsPerToken + images*imageTokens
+}
+
+// estimateRequestTokens estimates the input tokens of a Genkit request the way
+// [estimateTokens] does, without converting it: the media referenced by URI
+// are not downloaded, the images count for their maximum cost and the other
+// media, e.g. PDF documents, are not counted
+func estimateRequestTokens(input *ai.ModelRequest) int {
+	chars := 0
+	images := 0
+	for _, m := range input.Messages {
+		for _, p := range m.Content {
+			switch {
+			case p.IsMedia():
+				if strings.HasPrefix(p.ContentType, "image/") || strings.HasPrefix(p.Text, "data:image/") {
+					images++
+				}
+			case p.IsText() || p.IsReasoning():
+				chars += len(p.Text)
+			default:
+				b, err := json.Marshal(p)
+				if err != nil {
+					continue
+				}
+				chars += len(b)
+			}
+		}
+	}
+	for _, tool := range input.Tools {
+		b, err := json.Marshal(tool)
+		if err != nil {
+			continue
+		}
+		chars += len(b)
+	}
+	return chars/charsPerToken + images*imageTokens
+}
@@ -0,0 +1,120 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ToolInputValidationError is returned when tool calls of Claude still have an
+// input that doesn't match the input schema of their tool after the repair
+// requests, see [GenerationConfig.ToolInputRepairs]
+type ToolInputValidationError struct {
+	// Calls are the tool calls with an invalid input
+	Calls []*InvalidToolCall
+}
+
+// InvalidToolCall is a tool call whose input doesn't match the input schema of its tool
+type InvalidToolCall struct {
+	// Request is the tool request of Claude
+	Request *ai.ToolRequest
+	// Errors describe how the input doesn't match the schema
+	Errors []string
+}
+
+func (e *ToolInputValidationError) Error() string {
+	calls := make([]string, 0, len(e.Calls))
+	for _, c := range e.Calls {
+		calls = append(calls, fmt.Sprintf("%s (%s): %s", c.Request.Name, c.Request.Ref, strings.Join(c.Errors, "; ")))
+	}
+	return "tool input doesn't match the schema: " + strings.Join(calls, ", ")
+}
+
+// validateToolInputs returns the tool calls of a response whose input doesn't
+// match the input schema of their tool, if any. The builtin tools, defined by
+// Anthropic, and the tools without a schema are not validated.
+func validateToolInputs(r *ai.ModelResponse, tools []*ai.ToolDefinition, c *GenerationConfig, model string) *ToolInputValidationError {
+	if r.Message == nil || len(tools) == 0 {
+		return nil
+	}
+	schemas := map[string]map[string]any{}
+	for _, t := range tools {
+		if builtin, err := builtinToolFor(t, c, model); builtin != nil || err != nil || len(t.InputSchema) == 0 {
+			continue
+		}
+		schemas[t.Name] = t.InputSchema
+	}
+
+	var verr *ToolInputValidationError
+	for _, p := range r.Message.Content {
+		if !p.IsToolRequest() {
+			continue
+		}
+		schema, ok := schemas[p.ToolRequest.Name]
+		if !ok {
+			continue
+		}
+		var errs []string
+		result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(schema), gojsonschema.NewGoLoader(p.ToolRequest.Input))
+		if err != nil {
+			errs = []string{"input can't be validated: " + err.Error()}
+		} else {
+			for _, e := range result.Errors() {
+				errs = append(errs, e.String())
+			}
+		}
+		if len(errs) == 0 {
+			continue
+		}
+		if verr == nil {
+			verr = &ToolInputValidationError{}
+		}
+		verr.Calls = append(verr.Calls, &InvalidToolCall{Request: p.ToolRequest, Errors: errs})
+	}
+	return verr
+}
+
+// toolInputRepairMessage answers the tool calls of a response with the
+// validation errors of their input, the valid calls are not run either
+func toolInputRepairMessage(m *ai.Message, verr *ToolInputValidationError) *ai.Message {
+	invalid := map[string][]string{}
+	for _, c := range verr.Calls {
+		invalid[c.Request.Ref] = c.Errors
+	}
+	var parts []*ai.Part
+	for _, p := range m.Content {
+		if !p.IsToolRequest() {
+			continue
+		}
+		msg := "The tool was not called as other tool calls had an invalid input, call it again if needed."
+		if errs, ok := invalid[p.ToolRequest.Ref]; ok {
+			msg = "The input doesn't match the input schema of the tool:\n- " + strings.Join(errs, "\n- ") +
+				"\nCall the tool again with an input that matches the schema."
+		}
+		parts = append(parts, ai.NewToolResponsePart(&ai.ToolResponse{
+			Name:   p.ToolRequest.Name,
+			Ref:    p.ToolRequest.Ref,
+			Output: errors.New(msg),
+		}))
+	}
+	return ai.NewMessage(ai.RoleTool, nil, parts...)
+}
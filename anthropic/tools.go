@@ -0,0 +1,484 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+	"github.com/invopop/jsonschema"
+)
+
+const (
+	webFetchToolType = "web_fetch_20250910"
+	webFetchToolName = "web_fetch"
+	webFetchBeta     = "web-fetch-2025-09-10"
+)
+
+const (
+	codeExecutionToolType = "code_execution_20250522"
+	codeExecutionToolName = "code_execution"
+	codeExecutionBeta     = "code-execution-2025-05-22"
+
+	containerMetadataKey = "container"
+)
+
+// Container is the sandbox in which the code execution tool runs
+type Container struct {
+	ID        string `json:"id"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+// ContainerID returns the ID of the code execution container used to generate
+// the response, pass it as [GenerationConfig.Container] to reuse the sandbox in
+// follow-up requests. It returns an empty string if no container was used.
+func ContainerID(resp *ai.ModelResponse) string {
+	if resp == nil || resp.Message == nil {
+		return ""
+	}
+	switch c := resp.Message.Metadata[containerMetadataKey].(type) {
+	case *Container:
+		return c.ID
+	case map[string]any:
+		// metadata decoded from JSON, e.g. a stored conversation history
+		id, _ := c["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// containerMetadata returns the container reported in an Anthropic message, if any
+func containerMetadata(m *anthropic.Message) (*Container, error) {
+	field, ok := m.JSON.ExtraFields["container"]
+	if !ok || field.Raw() == "" || field.Raw() == "null" {
+		return nil, nil
+	}
+	var container struct {
+		ID        string `json:"id"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.Unmarshal([]byte(field.Raw()), &container); err != nil {
+		return nil, fmt.Errorf("unable to decode container: %w", err)
+	}
+	return &Container{ID: container.ID, ExpiresAt: container.ExpiresAt}, nil
+}
+
+// WebFetchConfig enables the web_fetch server tool, letting Claude retrieve
+// the content of URLs on Anthropic's side.
+type WebFetchConfig struct {
+	// MaxUses limits the number of fetches in a single request
+	MaxUses int `json:"maxUses,omitempty"`
+	// AllowedDomains restricts fetches to these domains, cannot be used with BlockedDomains
+	AllowedDomains []string `json:"allowedDomains,omitempty"`
+	// BlockedDomains forbids fetches to these domains, cannot be used with AllowedDomains
+	BlockedDomains []string `json:"blockedDomains,omitempty"`
+	// Citations enables citations on the fetched documents
+	Citations bool `json:"citations,omitempty"`
+	// MaxContentTokens limits the size of the fetched content included in the context
+	MaxContentTokens int `json:"maxContentTokens,omitempty"`
+}
+
+// toAnthropicServerTools returns the server tools enabled in the config
+func toAnthropicServerTools(c *GenerationConfig) ([]anthropic.ToolUnionParam, error) {
+	tools := []anthropic.ToolUnionParam{}
+
+	if wf := c.WebFetch; wf != nil {
+		if len(wf.AllowedDomains) > 0 && len(wf.BlockedDomains) > 0 {
+			return nil, fmt.Errorf("web fetch: allowed and blocked domains cannot be used together")
+		}
+		tool := map[string]any{
+			"type": webFetchToolType,
+			"name": webFetchToolName,
+		}
+		if wf.MaxUses > 0 {
+			tool["max_uses"] = wf.MaxUses
+		}
+		if len(wf.AllowedDomains) > 0 {
+			tool["allowed_domains"] = wf.AllowedDomains
+		}
+		if len(wf.BlockedDomains) > 0 {
+			tool["blocked_domains"] = wf.BlockedDomains
+		}
+		if wf.Citations {
+			tool["citations"] = map[string]any{"enabled": true}
+		}
+		if wf.MaxContentTokens > 0 {
+			tool["max_content_tokens"] = wf.MaxContentTokens
+		}
+		tools = append(tools, param.Override[anthropic.ToolUnionParam](tool))
+	}
+
+	if c.CodeExecution {
+		tools = append(tools, param.Override[anthropic.ToolUnionParam](map[string]any{
+			"type": codeExecutionToolType,
+			"name": codeExecutionToolName,
+		}))
+	}
+
+	return tools, nil
+}
+
+// betaFeatures returns the anthropic-beta flags required by the config and content of a request
+func betaFeatures(c *GenerationConfig, i *ai.ModelRequest, model string) ([]string, error) {
+	betas := []string{}
+	seen := map[string]bool{}
+	add := func(beta string) {
+		if beta != "" && !seen[beta] {
+			seen[beta] = true
+			betas = append(betas, beta)
+		}
+	}
+
+	if c.WebFetch != nil {
+		add(webFetchBeta)
+	}
+	if c.CodeExecution || c.Container != "" {
+		add(codeExecutionBeta)
+	}
+	if len(c.MCPServers) > 0 {
+		add(mcpClientBeta)
+	}
+	if c.ContextManagement != nil {
+		add(contextManagementBeta)
+	}
+	if hasTextDocuments(i.Docs) {
+		add(searchResultsBeta)
+	}
+	if usesFiles(i.Messages) {
+		add(filesBeta)
+	}
+	if usesExtendedCacheTTL(c, i.Messages) {
+		add(extendedCacheTTLBeta)
+	}
+	if c.LongContext {
+		if !SupportsLongContext(model) {
+			return nil, fmt.Errorf("model %q does not support the 1M tokens context window", model)
+		}
+		add(longContextBeta)
+	}
+	if c.ExtendedOutput {
+		if !strings.HasPrefix(model, "claude-3-7-sonnet") {
+			return nil, fmt.Errorf("model %q does not support extended output", model)
+		}
+		add(extendedOutputBeta)
+	}
+	for _, t := range i.Tools {
+		builtin, err := builtinToolFor(t, c, model)
+		if err != nil {
+			return nil, err
+		}
+		if builtin != nil {
+			add(builtin.beta)
+		}
+	}
+	return betas, nil
+}
+
+// builtinTool is a client tool whose definition is provided by Anthropic,
+// the Genkit tool with the same name executes it
+type builtinTool struct {
+	params map[string]any
+	beta   string
+}
+
+// builtinToolKey is the input schema keyword marking the Genkit tools defined
+// to execute an Anthropic defined tool, e.g. with [DefineBashTool]. The other
+// tools are sent as regular tools, whatever their name.
+const builtinToolKey = "x-anthropic-builtin"
+
+// defineBuiltinTool registers the Genkit tool executing an Anthropic defined
+// tool, its input schema is the schema of In marked with [builtinToolKey]
+func defineBuiltinTool[In, Out any](g *genkit.Genkit, name, description string, fn func(ctx *ai.ToolContext, input In) (Out, error)) ai.Tool {
+	reflector := jsonschema.Reflector{DoNotReference: true}
+	var in In
+	schema := reflector.Reflect(in)
+	schema.Version = ""
+	schema.Extras = map[string]any{builtinToolKey: name}
+	return genkit.DefineToolWithInputSchema(g, name, description, schema, func(ctx *ai.ToolContext, input any) (Out, error) {
+		var typed In
+		b, err := json.Marshal(input)
+		if err == nil {
+			err = json.Unmarshal(b, &typed)
+		}
+		if err != nil {
+			var zero Out
+			return zero, fmt.Errorf("invalid input of tool %q: %w", name, err)
+		}
+		return fn(ctx, typed)
+	})
+}
+
+// builtinToolFor returns the Anthropic defined tool of a Genkit tool defined
+// with [DefineComputerTool], [DefineTextEditorTool], [DefineLegacyTextEditorTool],
+// [DefineBashTool] or [DefineMemoryTool], or nil if the tool is a regular tool
+func builtinToolFor(t *ai.ToolDefinition, c *GenerationConfig, model string) (*builtinTool, error) {
+	name := t.Name
+	if marker, _ := t.InputSchema[builtinToolKey].(string); marker != name {
+		return nil, nil
+	}
+	switch name {
+	case ComputerToolName:
+		if c.Computer == nil {
+			return nil, fmt.Errorf("tool %q requires the Computer config to be set", ComputerToolName)
+		}
+		if c.Computer.DisplayWidthPx <= 0 || c.Computer.DisplayHeightPx <= 0 {
+			return nil, fmt.Errorf("tool %q requires the display width and height", ComputerToolName)
+		}
+		toolType, beta := "computer_20250124", "computer-use-2025-01-24"
+		if isClaude35Model(model) {
+			toolType, beta = "computer_20241022", "computer-use-2024-10-22"
+		}
+		params := map[string]any{
+			"type":              toolType,
+			"name":              ComputerToolName,
+			"display_width_px":  c.Computer.DisplayWidthPx,
+			"display_height_px": c.Computer.DisplayHeightPx,
+		}
+		if c.Computer.DisplayNumber != nil {
+			params["display_number"] = *c.Computer.DisplayNumber
+		}
+		return &builtinTool{params: params, beta: beta}, nil
+	case TextEditorToolName:
+		if isClaude3Model(model) {
+			return nil, fmt.Errorf("model %q only supports the text editor tool named %q", model, LegacyTextEditorToolName)
+		}
+		return &builtinTool{params: map[string]any{
+			"type": "text_editor_20250429",
+			"name": TextEditorToolName,
+		}}, nil
+	case LegacyTextEditorToolName:
+		if !isClaude3Model(model) {
+			return nil, fmt.Errorf("model %q only supports the text editor tool named %q", model, TextEditorToolName)
+		}
+		if isClaude35Model(model) {
+			return &builtinTool{params: map[string]any{
+				"type": "text_editor_20241022",
+				"name": LegacyTextEditorToolName,
+			}, beta: "computer-use-2024-10-22"}, nil
+		}
+		return &builtinTool{params: map[string]any{
+			"type": "text_editor_20250124",
+			"name": LegacyTextEditorToolName,
+		}}, nil
+	case MemoryToolName:
+		return &builtinTool{params: map[string]any{
+			"type": "memory_20250818",
+			"name": MemoryToolName,
+		}, beta: contextManagementBeta}, nil
+	case BashToolName:
+		if isClaude35Model(model) {
+			return &builtinTool{params: map[string]any{
+				"type": "bash_20241022",
+				"name": BashToolName,
+			}, beta: "computer-use-2024-10-22"}, nil
+		}
+		return &builtinTool{params: map[string]any{
+			"type": "bash_20250124",
+			"name": BashToolName,
+		}}, nil
+	}
+	return nil, nil
+}
+
+// isClaude3Model reports whether the model ID belongs to the Claude 3 family (3, 3.5 and 3.7)
+func isClaude3Model(model string) bool {
+	return strings.HasPrefix(model, "claude-3-")
+}
+
+// isClaude35Model reports whether the model ID belongs to the Claude 3.5 generation
+func isClaude35Model(model string) bool {
+	return strings.HasPrefix(model, "claude-3-5-")
+}
+
+// ComputerToolName is the name of the Anthropic computer use tool. The Genkit
+// tool defined with [DefineComputerTool] is sent to Claude as the computer use tool.
+const ComputerToolName = "computer"
+
+// ComputerUseConfig describes the display controlled by the computer use tool
+type ComputerUseConfig struct {
+	DisplayWidthPx  int  `json:"displayWidthPx"`
+	DisplayHeightPx int  `json:"displayHeightPx"`
+	DisplayNumber   *int `json:"displayNumber,omitempty"`
+}
+
+// ComputerAction is the input of the computer use tool, see
+// https://docs.anthropic.com/en/docs/agents-and-tools/tool-use/computer-use-tool
+type ComputerAction struct {
+	// Action is the action to perform, e.g. screenshot, left_click, type or key
+	Action string `json:"action"`
+	// Coordinate is the [x, y] position targeted by mouse actions
+	Coordinate []int `json:"coordinate,omitempty"`
+	// StartCoordinate is the [x, y] position a left_click_drag starts from
+	StartCoordinate []int `json:"start_coordinate,omitempty"`
+	// Text is the text to type, the key combination to press, or the modifier keys held during clicks
+	Text string `json:"text,omitempty"`
+	// ScrollDirection is one of up, down, left or right
+	ScrollDirection string `json:"scroll_direction,omitempty"`
+	// ScrollAmount is the number of scroll wheel clicks
+	ScrollAmount int `json:"scroll_amount,omitempty"`
+	// Duration is the number of seconds for hold_key and wait
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// DefineComputerTool registers the Genkit tool executing Claude's computer use
+// actions. The function usually returns a screenshot as an [ai.Part] media after
+// performing the action.
+func DefineComputerTool(g *genkit.Genkit, fn func(ctx *ai.ToolContext, input ComputerAction) (any, error)) ai.Tool {
+	return defineBuiltinTool(g, ComputerToolName, "Control the mouse and keyboard of a computer and take screenshots", fn)
+}
+
+const mcpClientBeta = "mcp-client-2025-04-04"
+
+// MCPServer is a remote MCP server reached by Anthropic through the MCP connector
+type MCPServer struct {
+	// Name identifies the server in the mcp_tool_use blocks
+	Name string `json:"name"`
+	// URL of the server, it must use https
+	URL string `json:"url"`
+	// AuthorizationToken is the OAuth token sent to the server, if it requires one
+	AuthorizationToken string `json:"authorizationToken,omitempty"`
+	// AllowedTools restricts the server tools Claude can call, all tools are allowed if empty
+	AllowedTools []string `json:"allowedTools,omitempty"`
+}
+
+// toAnthropicMCPServers translates the MCP servers to the mcp_servers request field
+func toAnthropicMCPServers(servers []MCPServer) ([]map[string]any, error) {
+	resp := make([]map[string]any, 0, len(servers))
+	for _, s := range servers {
+		if s.Name == "" || s.URL == "" {
+			return nil, fmt.Errorf("mcp server name and url are required")
+		}
+		server := map[string]any{
+			"type": "url",
+			"name": s.Name,
+			"url":  s.URL,
+		}
+		if s.AuthorizationToken != "" {
+			server["authorization_token"] = s.AuthorizationToken
+		}
+		if len(s.AllowedTools) > 0 {
+			server["tool_configuration"] = map[string]any{
+				"enabled":       true,
+				"allowed_tools": s.AllowedTools,
+			}
+		}
+		resp = append(resp, server)
+	}
+	return resp, nil
+}
+
+// isServerBlock reports whether a response block type is executed on Anthropic's side
+func isServerBlock(blockType string) bool {
+	return blockType == "mcp_tool_use" || strings.HasSuffix(blockType, "_tool_result")
+}
+
+// serverBlockPart keeps a content block executed on Anthropic's side (server
+// tool calls and their results) as an [ai.PartCustom], so Genkit does not try
+// to run it and it can be sent back untouched on the next turn.
+func serverBlockPart(raw string) (*ai.Part, error) {
+	block := map[string]any{}
+	if err := json.Unmarshal([]byte(raw), &block); err != nil {
+		return nil, fmt.Errorf("unable to decode server block: %w", err)
+	}
+	return ai.NewCustomPart(block), nil
+}
+
+// fromServerBlockPart translates a part created by [serverBlockPart] back to an Anthropic block
+func fromServerBlockPart(p *ai.Part) (anthropic.ContentBlockParamUnion, error) {
+	if _, ok := p.Custom["type"].(string); !ok {
+		return anthropic.ContentBlockParamUnion{}, fmt.Errorf("custom part is not an anthropic content block: %v", p.Custom)
+	}
+	return param.Override[anthropic.ContentBlockParamUnion](p.Custom), nil
+}
+
+const (
+	// TextEditorToolName is the name of the Anthropic text editor tool for Claude 4 models.
+	// The Genkit tool defined with [DefineTextEditorTool] is sent to Claude as the text editor tool.
+	TextEditorToolName = "str_replace_based_edit_tool"
+	// LegacyTextEditorToolName is the name of the Anthropic text editor tool for Claude 3.5 and 3.7 models.
+	LegacyTextEditorToolName = "str_replace_editor"
+)
+
+// TextEditorCommand is the input of the text editor tool, see
+// https://docs.anthropic.com/en/docs/agents-and-tools/tool-use/text-editor-tool
+type TextEditorCommand struct {
+	// Command is one of view, str_replace, create, insert and, for Claude 3 models, undo_edit
+	Command string `json:"command"`
+	// Path is the file or directory the command applies to
+	Path string `json:"path"`
+	// ViewRange is the optional [start, end] line range to view, end -1 means the end of the file
+	ViewRange []int `json:"view_range,omitempty"`
+	// OldStr is the text to replace, it must match exactly once
+	OldStr string `json:"old_str,omitempty"`
+	// NewStr is the replacement text for str_replace, or the text to insert
+	NewStr string `json:"new_str,omitempty"`
+	// FileText is the content of the file to create
+	FileText string `json:"file_text,omitempty"`
+	// InsertLine is the line after which NewStr is inserted
+	InsertLine int `json:"insert_line,omitempty"`
+}
+
+// DefineTextEditorTool registers the Genkit tool executing Claude's text editor
+// commands under [TextEditorToolName]. The function returns the command output,
+// e.g. the viewed file content or a confirmation of the edit.
+func DefineTextEditorTool(g *genkit.Genkit, fn func(ctx *ai.ToolContext, input TextEditorCommand) (string, error)) ai.Tool {
+	return defineBuiltinTool(g, TextEditorToolName, "View, create and edit text files", fn)
+}
+
+// DefineLegacyTextEditorTool registers the Genkit tool executing the text
+// editor commands of Claude 3.5 and 3.7 under [LegacyTextEditorToolName]
+func DefineLegacyTextEditorTool(g *genkit.Genkit, fn func(ctx *ai.ToolContext, input TextEditorCommand) (string, error)) ai.Tool {
+	return defineBuiltinTool(g, LegacyTextEditorToolName, "View, create and edit text files", fn)
+}
+
+// BashToolName is the name of the Anthropic bash tool. The Genkit tool defined
+// with [DefineBashTool] is sent to Claude as the bash tool.
+const BashToolName = "bash"
+
+// BashCommand is the input of the bash tool, see
+// https://docs.anthropic.com/en/docs/agents-and-tools/tool-use/bash-tool
+type BashCommand struct {
+	// Command is the shell command to run
+	Command string `json:"command,omitempty"`
+	// Restart asks for the shell session to be restarted
+	Restart bool `json:"restart,omitempty"`
+}
+
+// DefineBashTool registers the Genkit tool executing Claude's bash commands under
+// [BashToolName]. The host application runs the command in a persistent shell
+// session and returns its output.
+func DefineBashTool(g *genkit.Genkit, fn func(ctx *ai.ToolContext, input BashCommand) (string, error)) ai.Tool {
+	return defineBuiltinTool(g, BashToolName, "Run commands in a bash shell", fn)
+}
+
+// DefineToolWithJSONSchema registers a tool whose input schema is a raw JSON
+// schema document rather than the schema Genkit generates for the input type,
+// e.g. to describe the input with oneOf, pattern or const. The schema is sent
+// to Claude as is and the input of the tool is the decoded JSON. The keywords
+// of the JSON Schema specification are kept, the custom keywords are not.
+func DefineToolWithJSONSchema[Out any](g *genkit.Genkit, name, description string, schema []byte, fn func(ctx *ai.ToolContext, input any) (Out, error)) (ai.Tool, error) {
+	var s jsonschema.Schema
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return nil, fmt.Errorf("invalid input schema of tool %q: %w", name, err)
+	}
+	return genkit.DefineToolWithInputSchema(g, name, description, &s, fn), nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/firebase/genkit/go/ai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of the plugin
+const tracerName = "github.com/mingyuans/genkit-anthropic/anthropic"
+
+// Attributes of the spans, following the OpenTelemetry semantic conventions
+// for generative AI where they exist
+const (
+	attrSystem              = "gen_ai.system"
+	attrRequestModel        = "gen_ai.request.model"
+	attrResponseModel       = "gen_ai.response.model"
+	attrResponseID          = "gen_ai.response.id"
+	attrFinishReasons       = "gen_ai.response.finish_reasons"
+	attrInputTokens         = "gen_ai.usage.input_tokens"
+	attrOutputTokens        = "gen_ai.usage.output_tokens"
+	attrCacheReadTokens     = "anthropic.usage.cache_read_input_tokens"
+	attrCacheCreationTokens = "anthropic.usage.cache_creation_input_tokens"
+	attrStopReason          = "anthropic.stop_reason"
+	attrRequestID           = "anthropic.request_id"
+	attrStream              = "anthropic.stream"
+	attrBackend             = "anthropic.backend"
+)
+
+// newTracer returns the tracer of the plugin from tp, or from the global
+// provider when tp is nil
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startSpan starts the span of a call to Anthropic, a child of the span of ctx,
+// e.g. the span of the Genkit action
+func startSpan(ctx context.Context, tracer trace.Tracer, name, model string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append([]attribute.KeyValue{
+		attribute.String(attrSystem, provider),
+		attribute.String(attrRequestModel, model),
+	}, attrs...)
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span with the error of the call, if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracing is the middleware recording a span for each call of a model, with
+// the token counts and the stop reason of the response
+func tracing(tracer trace.Tracer, model string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			name := "anthropic/generate"
+			if cb != nil {
+				name = "anthropic/stream"
+			}
+			ctx, span := startSpan(ctx, tracer, name, model, attribute.Bool(attrStream, cb != nil))
+			resp, err := next(ctx, input, cb)
+			if err == nil {
+				span.SetAttributes(responseAttributes(resp)...)
+			}
+			endSpan(span, err)
+			return resp, err
+		}
+	}
+}
+
+// responseAttributes returns the span attributes of a response
+func responseAttributes(r *ai.ModelResponse) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.StringSlice(attrFinishReasons, []string{string(r.FinishReason)}),
+	}
+	if u := r.Usage; u != nil {
+		attrs = append(attrs,
+			attribute.Int(attrInputTokens, u.InputTokens),
+			attribute.Int(attrOutputTokens, u.OutputTokens),
+			attribute.Int(attrCacheReadTokens, int(u.Custom[UsageCacheReadInputTokens])),
+			attribute.Int(attrCacheCreationTokens, int(u.Custom[UsageCacheCreationInputTokens])),
+		)
+	}
+	if m, ok := r.Custom.(*anthropic.Message); ok {
+		attrs = append(attrs,
+			attribute.String(attrResponseModel, string(m.Model)),
+			attribute.String(attrResponseID, m.ID),
+			attribute.String(attrStopReason, string(m.StopReason)),
+		)
+	}
+	if id := RequestID(r); id != "" {
+		attrs = append(attrs, attribute.String(attrRequestID, id))
+	}
+	if r.Message != nil {
+		if backend, ok := r.Message.Metadata[BackendMetadataKey].(string); ok {
+			attrs = append(attrs, attribute.String(attrBackend, backend))
+		}
+	}
+	return attrs
+}
@@ -17,111 +17,329 @@
 package anthropic
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/firebase/genkit/go/ai"
 )
 
-// Data extracts content type and data from a Part.
-func Data(p *ai.Part) (contentType string, data []byte, err error) {
-	if p.IsMedia() {
-		// For media parts, the content is in the Text field as a data URI
-		// or the ContentType and Text fields contain the type and base64 data
-		contentType = p.ContentType
-		if contentType == "" {
-			contentType = "application/octet-stream"
-		}
+const (
+	// defaultMediaDownloadLimit is the default of [Anthropic.MediaDownloadLimit]
+	defaultMediaDownloadLimit = 32 << 20
+	// defaultMediaTimeout is the timeout of the default [Anthropic.MediaHTTPClient]
+	defaultMediaTimeout = 30 * time.Second
+)
+
+// mediaConfig is the configuration of the media downloads of a plugin,
+// attached to the context of its calls
+type mediaConfig struct {
+	limit    int64
+	client   *http.Client
+	fetchers map[string]MediaFetcher
+}
+
+// defaultMedia is the configuration of the media downloads outside the calls
+// of a plugin
+var defaultMedia = newMediaConfig(0, nil, nil)
+
+// newMediaConfig returns the configuration of the media downloads, the zero
+// values are replaced by their defaults
+func newMediaConfig(limit int64, client *http.Client, fetchers map[string]MediaFetcher) *mediaConfig {
+	if limit <= 0 {
+		limit = defaultMediaDownloadLimit
+	}
+	if client == nil {
+		client = &http.Client{Timeout: defaultMediaTimeout}
+	}
+	all := DefaultMediaFetchers()
+	maps.Copy(all, fetchers)
+	return &mediaConfig{limit: limit, client: client, fetchers: all}
+}
+
+type mediaConfigKey struct{}
 
-		text := p.Text
-		if strings.HasPrefix(text, "data:") {
-			// Handle data URI format: "data:image/jpeg;base64,/9j/4AAQSkZJRgABAQAAAQABAAD..."
-			parts := strings.SplitN(text[5:], ",", 2)
-			if len(parts) != 2 {
-				return "", nil, fmt.Errorf("invalid data URI format")
-			}
-
-			// Parse media type and encoding
-			mediaTypeParts := strings.Split(parts[0], ";")
-			contentType = mediaTypeParts[0]
-
-			// Check if base64 encoded
-			isBase64 := false
-			for _, part := range mediaTypeParts[1:] {
-				if part == "base64" {
-					isBase64 = true
-					break
-				}
-			}
-
-			if isBase64 {
-				data, err = base64.StdEncoding.DecodeString(parts[1])
-				if err != nil {
-					return "", nil, fmt.Errorf("failed to decode base64 data: %w", err)
-				}
-			} else {
-				data = []byte(parts[1])
-			}
-
-			return contentType, data, nil
-		} else {
-			// Assume the Text field contains base64 encoded data
-			data, err = base64.StdEncoding.DecodeString(text)
-			if err != nil {
-				return "", nil, fmt.Errorf("failed to decode base64 data: %w", err)
-			}
-			return contentType, data, nil
+// withMediaConfig returns a context downloading the media with the given configuration
+func withMediaConfig(ctx context.Context, c *mediaConfig) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, mediaConfigKey{}, c)
+}
+
+// mediaConfigFromContext returns the configuration of the media downloads of
+// the context, the default one outside the calls of a plugin
+func mediaConfigFromContext(ctx context.Context) *mediaConfig {
+	if c, ok := ctx.Value(mediaConfigKey{}).(*mediaConfig); ok {
+		return c
+	}
+	return defaultMedia
+}
+
+// mediaMiddleware downloads the media of the calls of a model with the given
+// configuration
+func mediaMiddleware(c *mediaConfig) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			return next(withMediaConfig(ctx, c), input, cb)
 		}
 	}
+}
 
-	if p.IsData() {
-		// For data parts, the content is in the Text field
+// isMediaURL reports whether a media part references its content by a URI
+// with a fetcher, e.g. http(s), gs or s3, see [Anthropic.MediaFetchers]
+func isMediaURL(ctx context.Context, p *ai.Part) bool {
+	scheme, _, ok := strings.Cut(p.Text, "://")
+	if !ok {
+		return false
+	}
+	_, ok = mediaConfigFromContext(ctx).fetchers[strings.ToLower(scheme)]
+	return ok
+}
+
+// downloadMedia downloads the content of a media part referenced by URI with
+// the fetcher of its scheme. The content type of the part prevails over the
+// one of the storage.
+func downloadMedia(ctx context.Context, p *ai.Part) (contentType string, data []byte, err error) {
+	uri, err := url.Parse(p.Text)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to download %s: %w", p.Text, err)
+	}
+	c := mediaConfigFromContext(ctx)
+	body, contentType, err := c.fetchers[uri.Scheme].Fetch(ctx, uri)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to download %s: %w", p.Text, err)
+	}
+	defer body.Close()
+	data, err = io.ReadAll(io.LimitReader(body, c.limit+1))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to download %s: %w", p.Text, err)
+	}
+	if int64(len(data)) > c.limit {
+		return "", nil, fmt.Errorf("failed to download %s: larger than %d bytes", p.Text, c.limit)
+	}
+
+	if p.ContentType != "" {
 		contentType = p.ContentType
-		if contentType == "" {
-			contentType = "application/octet-stream"
+	}
+	if mt, err := mediaType(contentType); err == nil {
+		contentType = sniff(mt, data)
+	}
+	return contentType, data, nil
+}
+
+// Data extracts content type and data from a Part. The media referenced by
+// URIs are downloaded with the media settings of the plugin calling it, e.g.
+// [Anthropic.MediaFetchers], the defaults otherwise.
+// The Text of a part is a data URI, or the data itself: raw for the textual
+// content types, such as text/plain or application/json, base64 otherwise.
+// The parameters of the content type, e.g. charset, are not returned. The type
+// of the untyped data is detected from its content, see [http.DetectContentType].
+func Data(ctx context.Context, p *ai.Part) (contentType string, data []byte, err error) {
+	if !p.IsMedia() && !p.IsData() {
+		return "", nil, fmt.Errorf("unsupported part type for data extraction")
+	}
+	if isMediaURL(ctx, p) {
+		return downloadMedia(ctx, p)
+	}
+	if strings.HasPrefix(p.Text, "data:") {
+		return parseDataURI(p.Text)
+	}
+
+	contentType, err = mediaType(p.ContentType)
+	if err != nil {
+		return "", nil, err
+	}
+	if isTextual(contentType) {
+		return contentType, []byte(p.Text), nil
+	}
+	data, err = decodeBase64(p.Text)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decode base64 data: %w", err)
+	}
+	return sniff(contentType, data), data, nil
+}
+
+// mediaData is the data of a media part, kept base64 encoded when the part
+// holds it so: the images are sent base64 encoded too, decoding them would
+// only copy them
+type mediaData struct {
+	contentType string
+	// encoded is the standard base64 data, empty when raw holds the data
+	encoded string
+	raw     []byte
+}
+
+// readMedia returns the data of a media part, the inline base64 data is not
+// decoded, the other data is read with [Data]
+func readMedia(ctx context.Context, p *ai.Part) (*mediaData, error) {
+	if contentType, encoded, ok := inlineBase64(ctx, p); ok {
+		return &mediaData{contentType: contentType, encoded: encoded}, nil
+	}
+	contentType, data, err := Data(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &mediaData{contentType: contentType, raw: data}, nil
+}
+
+// base64 returns the standard base64 encoding of the data
+func (m *mediaData) base64() string {
+	if m.encoded != "" {
+		return m.encoded
+	}
+	return base64.StdEncoding.EncodeToString(m.raw)
+}
+
+// bytes returns the decoded data
+func (m *mediaData) bytes() ([]byte, error) {
+	if m.encoded != "" {
+		return base64.StdEncoding.DecodeString(m.encoded)
+	}
+	return m.raw, nil
+}
+
+// size returns the size in bytes of the decoded data
+func (m *mediaData) size() int {
+	if m.encoded != "" {
+		return len(m.encoded)/4*3 - (len(m.encoded) - len(strings.TrimRight(m.encoded, "=")))
+	}
+	return len(m.raw)
+}
+
+// reader returns a reader of the decoded data, decoding it as it is read
+func (m *mediaData) reader() io.Reader {
+	if m.encoded != "" {
+		return base64.NewDecoder(base64.StdEncoding, strings.NewReader(m.encoded))
+	}
+	return bytes.NewReader(m.raw)
+}
+
+// inlineBase64 returns the content type and the data of a media part holding
+// standard base64 data inline, in a data URI or not. The type of the untyped
+// data is sniffed from its first bytes only.
+func inlineBase64(ctx context.Context, p *ai.Part) (contentType, encoded string, ok bool) {
+	if !p.IsMedia() || isMediaURL(ctx, p) {
+		return "", "", false
+	}
+	meta, encoded := p.ContentType, p.Text
+	if rest, isURI := strings.CutPrefix(p.Text, "data:"); isURI {
+		if meta, encoded, ok = strings.Cut(rest, ","); !ok {
+			return "", "", false
+		}
+		// the default text/plain type of RFC 2397 is read by Data
+		if meta, ok = strings.CutSuffix(meta, ";base64"); !ok || meta == "" || strings.HasPrefix(meta, ";") {
+			return "", "", false
 		}
+	}
+	contentType, err := mediaType(meta)
+	if err != nil || isTextual(contentType) || !isStdBase64(encoded) {
+		return "", "", false
+	}
+	if contentType == "application/octet-stream" {
+		// the 512 bytes looked at by http.DetectContentType
+		head, err := base64.StdEncoding.DecodeString(encoded[:min(len(encoded), 684)])
+		if err != nil {
+			return "", "", false
+		}
+		contentType = sniff(contentType, head)
+	}
+	return contentType, encoded, true
+}
 
-		text := p.Text
-		if strings.HasPrefix(text, "data:") {
-			// Handle data URI format
-			parts := strings.SplitN(text[5:], ",", 2)
-			if len(parts) != 2 {
-				return "", nil, fmt.Errorf("invalid data URI format")
-			}
-
-			// Parse media type and encoding
-			mediaTypeParts := strings.Split(parts[0], ";")
-			contentType = mediaTypeParts[0]
-
-			// Check if base64 encoded
-			isBase64 := false
-			for _, part := range mediaTypeParts[1:] {
-				if part == "base64" {
-					isBase64 = true
-					break
-				}
-			}
-
-			if isBase64 {
-				data, err = base64.StdEncoding.DecodeString(parts[1])
-				if err != nil {
-					return "", nil, fmt.Errorf("failed to decode base64 data: %w", err)
-				}
-			} else {
-				data = []byte(parts[1])
-			}
-
-			return contentType, data, nil
-		} else {
-			// Assume the Text field contains base64 encoded data
-			data, err = base64.StdEncoding.DecodeString(text)
-			if err != nil {
-				return "", nil, fmt.Errorf("failed to decode base64 data: %w", err)
-			}
-			return contentType, data, nil
+// isStdBase64 reports whether a string is padded standard base64, without
+// decoding it
+func isStdBase64(s string) bool {
+	if s == "" || len(s)%4 != 0 {
+		return false
+	}
+	unpadded := strings.TrimSuffix(strings.TrimSuffix(s, "="), "=")
+	for i := 0; i < len(unpadded); i++ {
+		c := unpadded[i]
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '+' || c == '/') {
+			return false
 		}
 	}
+	return true
+}
+
+// parseDataURI returns the content type and the data of a data URI, such as
+// "data:image/jpeg;base64,/9j/4AAQ..." or "data:text/plain;charset=utf-8,hello%20world"
+func parseDataURI(uri string) (contentType string, data []byte, err error) {
+	meta, payload, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid data URI format")
+	}
+	meta, isBase64 := strings.CutSuffix(meta, ";base64")
+	if meta == "" || strings.HasPrefix(meta, ";") {
+		// the default of RFC 2397
+		meta = "text/plain" + meta
+	}
+	contentType, err = mediaType(meta)
+	if err != nil {
+		return "", nil, err
+	}
 
-	return "", nil, fmt.Errorf("unsupported part type for data extraction")
+	// the data of the URIs is URL-encoded, e.g. spaces are %20
+	payload, err = url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid data URI: %w", err)
+	}
+	if !isBase64 {
+		return contentType, []byte(payload), nil
+	}
+	data, err = decodeBase64(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decode base64 data: %w", err)
+	}
+	return sniff(contentType, data), data, nil
+}
+
+// sniff returns the media type detected from the magic numbers of the data
+// when the declared type is unknown, e.g. image/png or application/pdf
+func sniff(contentType string, data []byte) string {
+	if contentType != "application/octet-stream" {
+		return contentType
+	}
+	if mt, err := mediaType(http.DetectContentType(data)); err == nil {
+		return mt
+	}
+	return contentType
+}
+
+// mediaType returns the media type of a content type, without its
+// parameters, application/octet-stream when it is empty
+func mediaType(contentType string) (string, error) {
+	if contentType == "" {
+		return "application/octet-stream", nil
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	return mt, nil
+}
+
+// isTextual reports whether the data of a media type is text
+func isTextual(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" || mediaType == "application/xml" ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// decodeBase64 decodes padded or unpadded base64 data
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "=") || len(s)%4 == 0 {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
 }
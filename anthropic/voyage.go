@@ -0,0 +1,214 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// voyageEmbedders are the Voyage AI text embedding models, the embedding
+// models recommended by Anthropic
+var voyageEmbedders = []string{
+	"voyage-3.5",
+	"voyage-3.5-lite",
+	"voyage-3-large",
+	"voyage-3",
+	"voyage-3-lite",
+	"voyage-code-3",
+	"voyage-finance-2",
+	"voyage-law-2",
+	"voyage-multilingual-2",
+}
+
+// VoyageConfig configures the Voyage AI embedders of the plugin, named after
+// their model, e.g. "anthropic/voyage-3.5"
+type VoyageConfig struct {
+	// APIKey is the Voyage API key, VOYAGE_API_KEY by default
+	APIKey string
+	// Endpoint is the Voyage API, https://api.voyageai.com by default
+	Endpoint string
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// VoyageEmbedOptions are the options of the embed requests of the Voyage embedders
+type VoyageEmbedOptions struct {
+	// InputType is "query" or "document", the inputs are embedded as is when empty
+	InputType string `json:"inputType,omitempty"`
+	// OutputDimension is the dimension of the embeddings, e.g. 256, 512, 1024
+	// or 2048 for the models supporting it, the default of the model when 0
+	OutputDimension int `json:"outputDimension,omitempty"`
+	// Truncation truncates the inputs over the context length of the model,
+	// they fail when false. Inputs are truncated when nil.
+	Truncation *bool `json:"truncation,omitempty"`
+}
+
+// VoyageEmbedder returns the Voyage embedder with the given name, e.g.
+// "voyage-3.5". It returns nil if the embedder was not defined.
+func VoyageEmbedder(g *genkit.Genkit, name string) ai.Embedder {
+	return genkit.LookupEmbedder(g, provider, name)
+}
+
+// voyageClient calls the embeddings API of Voyage AI
+type voyageClient struct {
+	apiKey   string
+	endpoint string
+	client   *http.Client
+}
+
+// newVoyageClient returns the Voyage client of the config, nil with neither a
+// config nor VOYAGE_API_KEY
+func newVoyageClient(c *VoyageConfig) (*voyageClient, error) {
+	apiKey := os.Getenv("VOYAGE_API_KEY")
+	if c != nil && c.APIKey != "" {
+		apiKey = c.APIKey
+	}
+	if apiKey == "" {
+		if c == nil {
+			return nil, nil
+		}
+		return nil, errors.New("Voyage API key is required. Set Voyage.APIKey field or VOYAGE_API_KEY environment variable")
+	}
+	if c == nil {
+		c = &VoyageConfig{}
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	endpoint := firstNonEmpty(c.Endpoint, "https://api.voyageai.com")
+	return &voyageClient{apiKey: apiKey, endpoint: strings.TrimSuffix(endpoint, "/"), client: client}, nil
+}
+
+// defineEmbedders defines an embedder per Voyage model
+func (v *voyageClient) defineEmbedders(g *genkit.Genkit) {
+	for _, name := range voyageEmbedders {
+		genkit.DefineEmbedder(g, provider, name, func(ctx context.Context, req *ai.EmbedRequest) (*ai.EmbedResponse, error) {
+			return v.embed(ctx, name, req)
+		})
+	}
+}
+
+// embed embeds the text of the documents of a request
+func (v *voyageClient) embed(ctx context.Context, model string, req *ai.EmbedRequest) (*ai.EmbedResponse, error) {
+	opts, err := voyageOptions(req.Options)
+	if err != nil {
+		return nil, err
+	}
+	input := make([]string, 0, len(req.Input))
+	for i, doc := range req.Input {
+		var sb strings.Builder
+		for _, p := range doc.Content {
+			if !p.IsText() {
+				return nil, fmt.Errorf("document %d: only text content is supported by the Voyage embedders", i)
+			}
+			sb.WriteString(p.Text)
+		}
+		input = append(input, sb.String())
+	}
+
+	body := map[string]any{"model": model, "input": input}
+	if opts.InputType != "" {
+		body["input_type"] = opts.InputType
+	}
+	if opts.OutputDimension != 0 {
+		body["output_dimension"] = opts.OutputDimension
+	}
+	if opts.Truncation != nil {
+		body["truncation"] = *opts.Truncation
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, v.endpoint+"/v1/embeddings", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+v.apiKey)
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("voyage: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Detail string `json:"detail"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		if json.Unmarshal(b, &e) == nil && e.Detail != "" {
+			return nil, fmt.Errorf("voyage: %s: %s", resp.Status, e.Detail)
+		}
+		return nil, fmt.Errorf("voyage: %s", resp.Status)
+	}
+
+	var out struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+			Index     int       `json:"index"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("voyage: invalid response: %w", err)
+	}
+	embeddings := make([]*ai.Embedding, len(input))
+	for _, d := range out.Data {
+		if d.Index < 0 || d.Index >= len(embeddings) {
+			return nil, fmt.Errorf("voyage: invalid embedding index %d", d.Index)
+		}
+		embeddings[d.Index] = &ai.Embedding{Embedding: d.Embedding}
+	}
+	for i, e := range embeddings {
+		if e == nil {
+			return nil, fmt.Errorf("voyage: no embedding for document %d", i)
+		}
+	}
+	return &ai.EmbedResponse{Embeddings: embeddings}, nil
+}
+
+// voyageOptions returns the options of an embed request
+func voyageOptions(options any) (*VoyageEmbedOptions, error) {
+	var result VoyageEmbedOptions
+
+	switch o := options.(type) {
+	case VoyageEmbedOptions:
+		result = o
+	case *VoyageEmbedOptions:
+		result = *o
+	case map[string]any:
+		if err := mapToStruct(o, &result); err != nil {
+			return nil, err
+		}
+	case nil:
+		// Empty options are considered valid
+	default:
+		return nil, fmt.Errorf("unexpected options type: %T", options)
+	}
+	return &result, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2025 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package anthropic
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/anthropics/anthropic-sdk-go/packages/ssestream"
+	"github.com/firebase/genkit/go/ai"
+)
+
+// Workspace is an Anthropic workspace the requests of a tenant are sent to,
+// e.g. to isolate the usage and the limits of the customers of a service. A
+// request selects its workspace with [GenerationConfig.Workspace] or
+// [WithWorkspace], the other requests are sent with the plugin API key.
+type Workspace struct {
+	// APIKey is the API key of the workspace
+	APIKey string
+	// BaseURL is the URL of the API, the URL of Anthropic when empty
+	BaseURL string
+	// Models maps the names of the models, e.g. "claude-sonnet-4", to the
+	// model IDs sent for the workspace, e.g. the snapshots a tenant was
+	// validated with. The Version of a request takes precedence.
+	Models map[string]string
+	// Options are the other options of the client of the workspace
+	Options []option.RequestOption
+}
+
+type workspaceKey struct{}
+
+// WithWorkspace returns a context whose requests are sent to the workspace
+// with the given name of [Anthropic.Workspaces]
+func WithWorkspace(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, workspaceKey{}, name)
+}
+
+// workspaceFromContext returns the workspace set with [WithWorkspace]
+func workspaceFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(workspaceKey{}).(string)
+	return name
+}
+
+// workspaceClient is the client of a configured workspace
+type workspaceClient struct {
+	messages MessagesAPI
+	models   map[string]string
+}
+
+// workspaces sends the requests to the Messages API of their workspace
+type workspaces struct {
+	// MessagesAPI is the API of the requests without a workspace
+	MessagesAPI
+	clients map[string]*workspaceClient
+}
+
+func newWorkspaces(messages MessagesAPI, configs map[string]Workspace, opts []option.RequestOption) (*workspaces, error) {
+	w := &workspaces{MessagesAPI: messages, clients: map[string]*workspaceClient{}}
+	for name, ws := range configs {
+		if ws.APIKey == "" {
+			return nil, fmt.Errorf("workspace %q has no API key", name)
+		}
+		o := append([]option.RequestOption{option.WithAPIKey(ws.APIKey)}, opts...)
+		if ws.BaseURL != "" {
+			o = append(o, option.WithBaseURL(ws.BaseURL))
+		}
+		c := newClient(append(o, ws.Options...)...)
+		w.clients[name] = &workspaceClient{messages: &c.Messages, models: ws.Models}
+	}
+	return w, nil
+}
+
+// middleware selects the workspace of the requests, it fails for the unknown
+// workspaces. The requests are sent to the model ID of their workspace.
+func (w *workspaces) middleware(model string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, input *ai.ModelRequest, cb func(context.Context, *ai.ModelResponseChunk) error) (*ai.ModelResponse, error) {
+			c, err := configFromRequest(input)
+			if err != nil {
+				return nil, err
+			}
+			name := c.Workspace
+			if name == "" {
+				name = workspaceFromContext(ctx)
+			}
+			if name == "" {
+				return next(ctx, input, cb)
+			}
+			ws, ok := w.clients[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown workspace %q", name)
+			}
+			if id, ok := ws.models[model]; ok {
+				if input, err = defaultVersion(input, id); err != nil {
+					return nil, err
+				}
+			}
+			return next(WithWorkspace(ctx, name), input, cb)
+		}
+	}
+}
+
+// messages returns the Messages API of the workspace of a request
+func (w *workspaces) messages(ctx context.Context) MessagesAPI {
+	if ws, ok := w.clients[workspaceFromContext(ctx)]; ok {
+		return ws.messages
+	}
+	return w.MessagesAPI
+}
+
+func (w *workspaces) New(ctx context.Context, body anthropic.MessageNewParams, opts ...option.RequestOption) (*anthropic.Message, error) {
+	return w.messages(ctx).New(ctx, body, opts...)
+}
+
+func (w *workspaces) NewStreaming(ctx context.Context, body anthropic.MessageNewParams, opts ...option.RequestOption) *ssestream.Stream[anthropic.MessageStreamEventUnion] {
+	return w.messages(ctx).NewStreaming(ctx, body, opts...)
+}
+
+func (w *workspaces) CountTokens(ctx context.Context, body anthropic.MessageCountTokensParams, opts ...option.RequestOption) (*anthropic.MessageTokensCount, error) {
+	return w.messages(ctx).CountTokens(ctx, body, opts...)
+}